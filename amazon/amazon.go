@@ -9,7 +9,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
@@ -37,6 +37,8 @@ type IEcrClient interface {
 
 	DeleteRepository(ctx context.Context, input *ecr.DeleteRepositoryInput, optFns ...func(*ecr.Options)) (response *ecr.DeleteRepositoryOutput, err error)
 
+	BatchDeleteImage(ctx context.Context, input *ecr.BatchDeleteImageInput, optFns ...func(*ecr.Options)) (response *ecr.BatchDeleteImageOutput, err error)
+
 	DeleteLifecyclePolicy(ctx context.Context, input *ecr.DeleteLifecyclePolicyInput, optFns ...func(*ecr.Options)) (response *ecr.DeleteLifecyclePolicyOutput, err error)
 
 	GetAuthorizationToken(ctx context.Context, input *ecr.GetAuthorizationTokenInput, optFns ...func(*ecr.Options)) (response *ecr.GetAuthorizationTokenOutput, err error)
@@ -55,49 +57,108 @@ var newRepositoriesCounter = prometheus.NewCounter(prometheus.CounterOpts{
 	Help:      "Total number of new repositories created",
 })
 
-func (c *ecrHandler) ListRepositories(w http.ResponseWriter, r *http.Request) {
-	log.Println("Listing repos")
+// repository converts an ECR repository to the common response
+func repository(repo types.Repository) common.Repository {
+	return common.Repository{
+		Name:     aws.ToString(repo.RepositoryName),
+		URI:      aws.ToString(repo.RepositoryUri),
+		Created:  repo.CreatedAt,
+		Provider: repo,
+	}
+}
+
+// Maximum number of results per DescribeRepositories request
+const maxResults = 1000
+
+// listRepositories returns all repositories, or a single page if params is
+// paged, and the token for the next page
+func (c *ecrHandler) listRepositories(ctx context.Context, params common.ListParams) ([]common.Repository, string, error) {
+	slog.InfoContext(ctx, "Listing repos")
 	input := ecr.DescribeRepositoriesInput{}
 	if c.registryId != "" {
 		input.RegistryId = &c.registryId
 	}
-	repos, err := c.client.DescribeRepositories(context.TODO(), &input)
+	if params.Limit > 0 {
+		input.MaxResults = aws.Int32(int32(min(params.Limit, maxResults)))
+	}
+	if params.PageToken != "" {
+		input.NextToken = &params.PageToken
+	}
+
+	repositories := []common.Repository{}
+	for {
+		repos, err := c.client.DescribeRepositories(ctx, &input)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, repo := range repos.Repositories {
+			repositories = append(repositories, repository(repo))
+		}
+		input.NextToken = repos.NextToken
+		if input.NextToken == nil || params.Paged() {
+			break
+		}
+	}
+	return repositories, aws.ToString(input.NextToken), nil
+}
+
+// AllRepositories returns all repositories, following pagination
+func (c *ecrHandler) AllRepositories(ctx context.Context) ([]common.Repository, error) {
+	repositories, _, err := c.listRepositories(ctx, common.ListParams{})
+	return repositories, err
+}
+
+// ListRepositories returns all repositories, or a single page if limit or
+// page_token are given
+func (c *ecrHandler) ListRepositories(w http.ResponseWriter, r *http.Request) {
+	params, err := common.ListGetParams(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
+		common.BadRequest(w, r, err)
+		return
+	}
+
+	repositories, nextToken, err := c.listRepositories(r.Context(), params)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
-	jsonBytes, err := json.Marshal(repos.Repositories)
+
+	jsonBytes, err := json.Marshal(repositories)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
+	if nextToken != "" {
+		w.Header().Set(common.NextPageTokenHeader, nextToken)
+	}
 	w.WriteHeader(http.StatusOK)
 	_, errw := w.Write(jsonBytes)
 	if errw != nil {
-		log.Println("ERROR:", errw)
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
 	}
 }
 
-func (c *ecrHandler) getRepoByName(name string) (*types.Repository, error) {
+func (c *ecrHandler) getRepoByName(ctx context.Context, name string) (*types.Repository, error) {
 	input := ecr.DescribeRepositoriesInput{
 		RepositoryNames: []string{name},
 	}
 	if c.registryId != "" {
 		input.RegistryId = &c.registryId
 	}
-	repos, err := c.client.DescribeRepositories(context.TODO(), &input)
+	repos, err := c.client.DescribeRepositories(ctx, &input)
 	if err != nil {
 		var awsErr *types.RepositoryNotFoundException
 		if errors.As(err, &awsErr) {
-			log.Printf("Repo '%s' not found\n", name)
+			slog.InfoContext(ctx, "Repo not found", "repo", name)
 			return nil, nil
 		}
-		log.Println("ERROR:", err)
+		slog.ErrorContext(ctx, "getRepoByName failed", "error", err)
 		return nil, err
 	}
-	log.Printf("Repo '%s' found: %s\n", name, *repos.Repositories[0].RepositoryUri)
+	slog.InfoContext(ctx, "Repo found", "repo", name, "uri", *repos.Repositories[0].RepositoryUri)
 	return &repos.Repositories[0], nil
 }
 
@@ -109,7 +170,7 @@ func (c *ecrHandler) getRepositoryAsJson(r *http.Request) (bool, string, []byte,
 		return false, name, null, err
 	}
 
-	repo, err := c.getRepoByName(name)
+	repo, err := c.getRepoByName(r.Context(), name)
 	if err != nil {
 		return false, name, null, err
 	}
@@ -118,7 +179,7 @@ func (c *ecrHandler) getRepositoryAsJson(r *http.Request) (bool, string, []byte,
 		return false, name, null, nil
 	}
 
-	jsonBytes, err := json.Marshal(repo)
+	jsonBytes, err := json.Marshal(repository(*repo))
 	if err != nil {
 		return false, name, null, err
 	}
@@ -128,12 +189,12 @@ func (c *ecrHandler) getRepositoryAsJson(r *http.Request) (bool, string, []byte,
 func (c *ecrHandler) GetRepository(w http.ResponseWriter, r *http.Request) {
 	found, name, jsonBytes, err := c.getRepositoryAsJson(r)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "GetRepository failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
 
-	log.Printf("Getting repo %s", name)
+	slog.InfoContext(r.Context(), "Getting repo", "repo", name)
 
 	if found {
 		w.WriteHeader(http.StatusOK)
@@ -142,14 +203,14 @@ func (c *ecrHandler) GetRepository(w http.ResponseWriter, r *http.Request) {
 	}
 	_, errw := w.Write(jsonBytes)
 	if errw != nil {
-		log.Println("ERROR:", errw)
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
 	}
 }
 
 func (c *ecrHandler) GetImage(w http.ResponseWriter, r *http.Request) {
 	repoName, tag, err := common.ImageGetNameAndTag(r)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
@@ -162,32 +223,105 @@ func (c *ecrHandler) GetImage(w http.ResponseWriter, r *http.Request) {
 	if c.registryId != "" {
 		input.RegistryId = &c.registryId
 	}
-	images, err := c.client.DescribeImages(context.TODO(), &input)
+	images, err := c.client.DescribeImages(r.Context(), &input)
 	if err != nil {
 		var awsErrImage *types.ImageNotFoundException
 		var awsErrRepo *types.RepositoryNotFoundException
 		if errors.As(err, &awsErrImage) || errors.As(err, &awsErrRepo) {
-			log.Printf("Image '%s' not found\n", fullname)
+			slog.InfoContext(r.Context(), "Image not found", "image", fullname)
 			common.NotFound(w, r)
 			return
 		}
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	image := images.ImageDetails[0]
+	slog.InfoContext(r.Context(), "Image found", "image", fullname, "tags", image.ImageTags)
+	jsonBytes, err := json.Marshal(common.Image{
+		Repository: repoName,
+		Tag:        tag,
+		Digest:     aws.ToString(image.ImageDigest),
+		PushedAt:   image.ImagePushedAt,
+		SizeBytes:  aws.ToInt64(image.ImageSizeInBytes),
+		Provider:   image,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// AllImages returns all images in a repository, following pagination
+func (c *ecrHandler) AllImages(ctx context.Context, repoName string) ([]common.Image, error) {
+	slog.InfoContext(ctx, "Listing images", "repo", repoName)
+
+	input := ecr.DescribeImagesInput{
+		RepositoryName: &repoName,
+		MaxResults:     aws.Int32(maxResults),
+	}
+	if c.registryId != "" {
+		input.RegistryId = &c.registryId
+	}
+	images := []common.Image{}
+	for {
+		response, err := c.client.DescribeImages(ctx, &input)
+		if err != nil {
+			var awsErrRepo *types.RepositoryNotFoundException
+			if errors.As(err, &awsErrRepo) {
+				slog.InfoContext(ctx, "Repo not found", "repo", repoName)
+				return nil, common.ErrRepositoryNotFound
+			}
+			return nil, err
+		}
+		for _, image := range response.ImageDetails {
+			images = append(images, common.NewImages(repoName, image.ImageTags, aws.ToString(image.ImageDigest), aws.ToInt64(image.ImageSizeInBytes), image.ImagePushedAt, image)...)
+		}
+		if response.NextToken == nil {
+			break
+		}
+		input.NextToken = response.NextToken
+	}
+	return images, nil
+}
+
+// ListImages returns all images in a repository, following pagination
+func (c *ecrHandler) ListImages(w http.ResponseWriter, r *http.Request) {
+	repoName, err := common.ImagesGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	images, err := c.AllImages(r.Context(), repoName)
+	if errors.Is(err, common.ErrRepositoryNotFound) {
+		common.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
 
-	image := &images.ImageDetails[0]
-	log.Printf("Image '%s' found: %s\n", fullname, image.ImageTags)
-	jsonBytes, err := json.Marshal(image)
+	jsonBytes, err := json.Marshal(images)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	_, errw := w.Write(jsonBytes)
 	if errw != nil {
-		log.Println("ERROR:", errw)
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
 	}
 }
 
@@ -215,7 +349,7 @@ func lifecyclePolicy(priority int, countType string, countNumber int) string {
 
 // Need https://github.com/aws/containers-roadmap/issues/921
 // to add support for `sinceImagePulled` in the lifecycle policy
-func (c *ecrHandler) setRepositoryPolicy(repoName string) error {
+func (c *ecrHandler) setRepositoryPolicy(ctx context.Context, repoName string) error {
 	if c.expiresAfterPushDays == 0 && c.expiresAfterPullDays == 0 {
 		return nil
 	}
@@ -242,7 +376,7 @@ func (c *ecrHandler) setRepositoryPolicy(repoName string) error {
 		input.RegistryId = &c.registryId
 	}
 
-	policyResponse, err := c.client.PutLifecyclePolicy(context.TODO(), &input)
+	policyResponse, err := c.client.PutLifecyclePolicy(ctx, &input)
 	if err != nil {
 		return err
 	}
@@ -250,19 +384,19 @@ func (c *ecrHandler) setRepositoryPolicy(repoName string) error {
 	if err != nil {
 		return err
 	}
-	log.Printf("Policy for repo '%s' set: %s", repoName, jsonBytes)
+	slog.InfoContext(ctx, "Repo policy set", "repo", repoName, "policy", string(jsonBytes))
 	return nil
 }
 
 func (c *ecrHandler) CreateRepository(w http.ResponseWriter, r *http.Request) {
 	name, err := common.RepoGetName(r)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
 
-	log.Println("Creating repo", name)
+	slog.InfoContext(r.Context(), "Creating repo", "repo", name)
 
 	input := ecr.CreateRepositoryInput{
 		RepositoryName: &name,
@@ -270,7 +404,7 @@ func (c *ecrHandler) CreateRepository(w http.ResponseWriter, r *http.Request) {
 	if c.registryId != "" {
 		input.RegistryId = &c.registryId
 	}
-	createResponse, err := c.client.CreateRepository(context.TODO(), &input)
+	createResponse, err := c.client.CreateRepository(r.Context(), &input)
 	var jsonResponse []byte
 
 	if err != nil {
@@ -279,19 +413,19 @@ func (c *ecrHandler) CreateRepository(w http.ResponseWriter, r *http.Request) {
 		if errors.As(err, &awsErr) {
 			found, _, jsonBytes, err := c.getRepositoryAsJson(r)
 			if err != nil {
-				log.Println("ERROR:", err)
+				slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
 				common.InternalServerError(w, r, err)
 				return
 			}
 			if !found {
-				log.Printf("RepositoryAlreadyExistsException but repository not found %s: %v", name, awsErr)
+				slog.ErrorContext(r.Context(), "RepositoryAlreadyExistsException but repository not found", "repo", name, "error", awsErr)
 				common.InternalServerError(w, r, err)
 				return
 			}
-			log.Println("Repo already exists", name)
+			slog.InfoContext(r.Context(), "Repo already exists", "repo", name)
 			jsonResponse = jsonBytes
 		} else {
-			log.Println("ERROR:", err)
+			slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
 			common.InternalServerError(w, r, err)
 			return
 		}
@@ -299,17 +433,17 @@ func (c *ecrHandler) CreateRepository(w http.ResponseWriter, r *http.Request) {
 		newRepositoriesCounter.Inc()
 	}
 
-	err = c.setRepositoryPolicy(name)
+	err = c.setRepositoryPolicy(r.Context(), name)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
 
 	if jsonResponse == nil {
-		jsonBytes, err := json.Marshal(createResponse.Repository)
+		jsonBytes, err := json.Marshal(repository(*createResponse.Repository))
 		if err != nil {
-			log.Println("ERROR:", err)
+			slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
 			common.InternalServerError(w, r, err)
 			return
 		}
@@ -318,66 +452,122 @@ func (c *ecrHandler) CreateRepository(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	_, errw := w.Write(jsonResponse)
 	if errw != nil {
-		log.Println("ERROR:", errw)
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
 	}
 }
 
-func (c *ecrHandler) deleteRepositoryPolicy(repoName string) error {
+func (c *ecrHandler) deleteRepositoryPolicy(ctx context.Context, repoName string) error {
 	input := ecr.DeleteLifecyclePolicyInput{
 		RepositoryName: &repoName,
 	}
 	if c.registryId != "" {
 		input.RegistryId = &c.registryId
 	}
-	_, err := c.client.DeleteLifecyclePolicy(context.TODO(), &input)
+	_, err := c.client.DeleteLifecyclePolicy(ctx, &input)
 	if err != nil {
 		// Ignore if it didn't exist
 		var awsErrRepo *types.RepositoryNotFoundException
 		var awsErrPolicy *types.LifecyclePolicyNotFoundException
 		if errors.As(err, &awsErrRepo) || errors.As(err, &awsErrPolicy) {
-			log.Println("Lifecycle policy not found", repoName)
+			slog.InfoContext(ctx, "Lifecycle policy not found", "repo", repoName)
+			return nil
+		}
+		return err
+	}
+	slog.InfoContext(ctx, "Repo policy deleted", "repo", repoName)
+	return nil
+}
+
+// RemoveRepository deletes a repository and its lifecycle policy, it succeeds
+// if the repository doesn't exist
+func (c *ecrHandler) RemoveRepository(ctx context.Context, name string) error {
+	slog.InfoContext(ctx, "Deleting repo", "repo", name)
+
+	err := c.deleteRepositoryPolicy(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	input := ecr.DeleteRepositoryInput{
+		RepositoryName: &name,
+	}
+	if c.registryId != "" {
+		input.RegistryId = &c.registryId
+	}
+	_, err = c.client.DeleteRepository(ctx, &input)
+
+	if err != nil {
+		// Ignore if it didn't exist
+		var awsErr *types.RepositoryNotFoundException
+		if errors.As(err, &awsErr) {
+			slog.InfoContext(ctx, "Repo not found", "repo", name)
 			return nil
 		}
 		return err
 	}
-	log.Printf("Policy for repo '%s' deleted", repoName)
 	return nil
 }
 
 func (c *ecrHandler) DeleteRepository(w http.ResponseWriter, r *http.Request) {
 	name, err := common.RepoGetName(r)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "DeleteRepository failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
 
-	log.Println("Deleting repo", name)
+	err = c.RemoveRepository(r.Context(), name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
 
-	err = c.deleteRepositoryPolicy(name)
+// DeleteImage deletes a single image tag, the image is deleted by ECR when it
+// has no remaining tags
+func (c *ecrHandler) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	repoName, tag, err := common.ImageGetNameAndTag(r)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
+	fullname := fmt.Sprintf("%s:%s", repoName, tag)
 
-	input := ecr.DeleteRepositoryInput{
-		RepositoryName: &name,
+	slog.InfoContext(r.Context(), "Deleting image", "image", fullname)
+
+	input := ecr.BatchDeleteImageInput{
+		RepositoryName: &repoName,
+		ImageIds:       []types.ImageIdentifier{{ImageTag: &tag}},
 	}
 	if c.registryId != "" {
 		input.RegistryId = &c.registryId
 	}
-	_, err = c.client.DeleteRepository(context.TODO(), &input)
-
+	response, err := c.client.BatchDeleteImage(r.Context(), &input)
 	if err != nil {
 		// Ignore if it didn't exist
 		var awsErr *types.RepositoryNotFoundException
 		if errors.As(err, &awsErr) {
-			log.Println("Repo not found", name)
+			slog.InfoContext(r.Context(), "Repo not found", "repo", repoName)
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	for _, failure := range response.Failures {
+		// Ignore if it didn't exist
+		if failure.FailureCode == types.ImageFailureCodeImageNotFound || failure.FailureCode == types.ImageFailureCodeImageTagDoesNotMatchDigest {
+			slog.InfoContext(r.Context(), "Image not found", "image", fullname)
+			continue
+		}
+		err := fmt.Errorf("failed to delete image %s: %s %s", fullname, failure.FailureCode, aws.ToString(failure.FailureReason))
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
@@ -386,15 +576,15 @@ func (c *ecrHandler) DeleteRepository(w http.ResponseWriter, r *http.Request) {
 }
 
 func (c *ecrHandler) GetToken(w http.ResponseWriter, r *http.Request) {
-	token, err := c.client.GetAuthorizationToken(context.TODO(), &ecr.GetAuthorizationTokenInput{})
+	token, err := c.client.GetAuthorizationToken(r.Context(), &ecr.GetAuthorizationTokenInput{})
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
 	if len(token.AuthorizationData) != 1 {
 		msg := fmt.Errorf("expected 1 token, got %d", len(token.AuthorizationData))
-		log.Println("ERROR:", msg)
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", msg)
 		common.InternalServerError(w, r, msg)
 		return
 	}
@@ -407,14 +597,14 @@ func (c *ecrHandler) GetToken(w http.ResponseWriter, r *http.Request) {
 	// token is base64(username:password)
 	decodedBytes, err := base64.StdEncoding.DecodeString(*token.AuthorizationData[0].AuthorizationToken)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
 	username, password, found := strings.Cut(string(decodedBytes), ":")
 	if !found {
 		err := fmt.Errorf("invalid token")
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
 		common.InternalServerError(w, r, err)
 	}
 
@@ -423,14 +613,14 @@ func (c *ecrHandler) GetToken(w http.ResponseWriter, r *http.Request) {
 
 	jsonBytes, err := json.Marshal(ret)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	_, errw := w.Write(jsonBytes)
 	if errw != nil {
-		log.Println("ERROR:", errw)
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
 	}
 }
 
@@ -449,6 +639,22 @@ func envvarIntGreaterThanZero(envvar string) (int, error) {
 	return i, nil
 }
 
+// HealthCheck lists a single repository to check the credentials are valid
+func (c *ecrHandler) HealthCheck(ctx context.Context) error {
+	input := ecr.DescribeRepositoriesInput{
+		MaxResults: aws.Int32(1),
+	}
+	if c.registryId != "" {
+		input.RegistryId = &c.registryId
+	}
+	_, err := c.client.DescribeRepositories(ctx, &input)
+	return err
+}
+
+func init() {
+	common.RegisterProvider("amazon", Setup)
+}
+
 func Setup(promRegistry *prometheus.Registry, args []string) (common.IRegistryClient, error) {
 	if len(args) != 0 {
 		return nil, errors.New("no arguments expected")
@@ -460,7 +666,7 @@ func Setup(promRegistry *prometheus.Registry, args []string) (common.IRegistryCl
 	cfg, err := config.LoadDefaultConfig(context.TODO())
 
 	if err != nil {
-		log.Printf("failed to load configuration, %v", err)
+		slog.Error("Failed to load configuration", "error", err)
 		return nil, err
 	}
 
@@ -472,23 +678,43 @@ func Setup(promRegistry *prometheus.Registry, args []string) (common.IRegistryCl
 
 	identity, err := stsClient.GetCallerIdentity(context.TODO(), &sts.GetCallerIdentityInput{})
 	if err != nil {
-		log.Printf("failed to get identity, %v", err)
+		slog.Error("Failed to get identity", "error", err)
 		return nil, err
 	}
-	log.Printf("Identity: %v", *identity.Arn)
+	slog.Info("Identity", "arn", *identity.Arn)
 
 	ecrClient := ecr.NewFromConfig(cfg, func(o *ecr.Options) {
 		if endpoint != "" {
 			o.BaseEndpoint = aws.String(endpoint)
 		}
+		// Retries are handled by retryingEcrClient
+		o.Retryer = aws.NopRetryer{}
 	})
 
 	registryId := os.Getenv("AWS_REGISTRY_ID")
-	log.Println("Registry ID:", registryId)
+	slog.Info("Registry ID", "registry_id", registryId)
+
+	timeout, err := common.UpstreamTimeout()
+	if err != nil {
+		return nil, err
+	}
+	retryConfig, err := common.RetryConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	retrier := common.NewRetrier("amazon", retryConfig, retryable)
+
+	// Every call is traced and logged once, each attempt has a timeout and is
+	// recorded in the metrics
+	var client IEcrClient = &timeoutEcrClient{client: ecrClient, timeout: timeout}
+	client = &metricsEcrClient{client: client}
+	client = &retryingEcrClient{client: client, retrier: retrier}
+	client = &loggingEcrClient{client: client}
+	client = &tracingEcrClient{client: client}
 
 	ecrH := &ecrHandler{
 		registryId: registryId,
-		client:     ecrClient,
+		client:     client,
 	}
 
 	expiresAfterPushDays, err := envvarIntGreaterThanZero("AWS_ECR_EXPIRES_AFTER_PUSH_DAYS")
@@ -505,6 +731,7 @@ func Setup(promRegistry *prometheus.Registry, args []string) (common.IRegistryCl
 	// ecrH.expiresAfterPullDays = expiresAfterPullDays
 
 	promRegistry.MustRegister(newRepositoriesCounter)
+	promRegistry.MustRegister(repositoriesDeletedCounter)
 
 	return ecrH, nil
 }
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strconv"
 	"testing"
 	"time"
 
@@ -25,10 +26,12 @@ type MockEcrClient struct {
 	putLifecycleRequests    []ecr.PutLifecyclePolicyInput
 	deleteRepoRequests      []ecr.DeleteRepositoryInput
 	deleteLifecycleRequests []ecr.DeleteLifecyclePolicyInput
+	deleteImageRequests     []ecr.BatchDeleteImageInput
 	getTokenRequests        []ecr.GetAuthorizationTokenInput
 
-	createRepoNoops int
-	deleteRepoNoops int
+	createRepoNoops  int
+	deleteRepoNoops  int
+	deleteImageNoops int
 }
 
 const registryId = "123456789012"
@@ -42,14 +45,18 @@ func (c *MockEcrClient) repository(name string) types.Repository {
 		RegistryId:     aws.String(registryId),
 		RepositoryName: &name,
 		RepositoryUri:  aws.String(fmt.Sprintf("%s.dkr.ecr.eu-west-2.amazonaws.com/%s", registryId, name)),
+		CreatedAt:      aws.Time(timestamp()),
 	}
 }
 
 func (c *MockEcrClient) image(name string, tag string) types.ImageDetail {
 	return types.ImageDetail{
-		ImageTags:      []string{tag},
-		RegistryId:     aws.String(registryId),
-		RepositoryName: &name,
+		ImageDigest:      aws.String("sha256:1234"),
+		ImagePushedAt:    aws.Time(timestamp()),
+		ImageSizeInBytes: aws.Int64(123456),
+		ImageTags:        []string{tag},
+		RegistryId:       aws.String(registryId),
+		RepositoryName:   &name,
 	}
 }
 
@@ -57,12 +64,27 @@ func (c *MockEcrClient) DescribeRepositories(ctx context.Context, input *ecr.Des
 	c.describeRepoRequests = append(c.describeRepoRequests, *input)
 
 	if input.RepositoryNames == nil {
-		return &ecr.DescribeRepositoriesOutput{
-			Repositories: []types.Repository{
-				c.repository("existing-image"),
-				c.repository("another-image"),
-			},
-		}, nil
+		// Paginated, the next token is the index of the next repository
+		names := []string{"existing-image", "another-image", "third-image"}
+		start := 0
+		if input.NextToken != nil {
+			start, err = strconv.Atoi(*input.NextToken)
+			if err != nil {
+				return nil, &types.InvalidParameterException{Message: aws.String("Invalid NextToken")}
+			}
+		}
+		end := start + 2
+		if input.MaxResults != nil {
+			end = start + int(*input.MaxResults)
+		}
+		output := &ecr.DescribeRepositoriesOutput{}
+		for i := start; i < end && i < len(names); i++ {
+			output.Repositories = append(output.Repositories, c.repository(names[i]))
+		}
+		if end < len(names) {
+			output.NextToken = aws.String(strconv.Itoa(end))
+		}
+		return output, nil
 	}
 
 	if reflect.DeepEqual(input.RepositoryNames, []string{"existing-image"}) {
@@ -79,6 +101,28 @@ func (c *MockEcrClient) DescribeRepositories(ctx context.Context, input *ecr.Des
 func (c *MockEcrClient) DescribeImages(ctx context.Context, input *ecr.DescribeImagesInput, optFns ...func(*ecr.Options)) (response *ecr.DescribeImagesOutput, err error) {
 	c.describeImageRequests = append(c.describeImageRequests, *input)
 
+	if input.ImageIds == nil {
+		// List all images, one image per page
+		switch {
+		case *input.RepositoryName != "existing-image":
+			return nil, &types.RepositoryNotFoundException{Message: aws.String("Repository not found")}
+		case input.NextToken == nil:
+			image := c.image("existing-image", "tag")
+			image.ImageTags = append(image.ImageTags, "latest")
+			return &ecr.DescribeImagesOutput{
+				ImageDetails: []types.ImageDetail{image},
+				NextToken:    aws.String("2"),
+			}, nil
+		default:
+			image := c.image("existing-image", "")
+			image.ImageTags = nil
+			image.ImageDigest = aws.String("sha256:5678")
+			return &ecr.DescribeImagesOutput{
+				ImageDetails: []types.ImageDetail{image},
+			}, nil
+		}
+	}
+
 	if *input.RepositoryName == "existing-image" && *input.ImageIds[0].ImageTag == "tag" {
 		return &ecr.DescribeImagesOutput{
 			ImageDetails: []types.ImageDetail{
@@ -137,6 +181,32 @@ func (c *MockEcrClient) DeleteRepository(ctx context.Context, input *ecr.DeleteR
 	return nil, &types.RepositoryNotFoundException{Message: aws.String("Repository not found")}
 }
 
+func (c *MockEcrClient) BatchDeleteImage(ctx context.Context, input *ecr.BatchDeleteImageInput, optFns ...func(*ecr.Options)) (response *ecr.BatchDeleteImageOutput, err error) {
+	c.deleteImageRequests = append(c.deleteImageRequests, *input)
+
+	if *input.RepositoryName != "existing-image" {
+		c.deleteImageNoops++
+		return nil, &types.RepositoryNotFoundException{Message: aws.String("Repository not found")}
+	}
+
+	if *input.ImageIds[0].ImageTag == "tag" {
+		return &ecr.BatchDeleteImageOutput{
+			ImageIds: input.ImageIds,
+		}, nil
+	}
+
+	c.deleteImageNoops++
+	return &ecr.BatchDeleteImageOutput{
+		Failures: []types.ImageFailure{
+			{
+				FailureCode:   types.ImageFailureCodeImageNotFound,
+				FailureReason: aws.String("Requested image not found"),
+				ImageId:       &input.ImageIds[0],
+			},
+		},
+	}, nil
+}
+
 func (c *MockEcrClient) DeleteLifecyclePolicy(ctx context.Context, input *ecr.DeleteLifecyclePolicyInput, optFns ...func(*ecr.Options)) (response *ecr.DeleteLifecyclePolicyOutput, err error) {
 	c.deleteLifecycleRequests = append(c.deleteLifecycleRequests, *input)
 
@@ -169,6 +239,7 @@ func (e *MockEcrClient) assertCounts(t *testing.T, expected map[string]int) {
 		"deleteRepos":      len(e.deleteRepoRequests),
 		"deleteLifecycles": len(e.deleteLifecycleRequests),
 		"describeImages":   len(e.describeImageRequests),
+		"deleteImages":     len(e.deleteImageRequests),
 		"getTokens":        len(e.getTokenRequests),
 	}
 	for k, v := range countRequests {
@@ -183,8 +254,9 @@ func (e *MockEcrClient) assertCounts(t *testing.T, expected map[string]int) {
 	}
 
 	countNoops := map[string]int{
-		"createNoops": e.createRepoNoops,
-		"deleteNoops": e.deleteRepoNoops,
+		"createNoops":      e.createRepoNoops,
+		"deleteNoops":      e.deleteRepoNoops,
+		"deleteImageNoops": e.deleteImageNoops,
 	}
 	for k, v := range countNoops {
 		e := 0
@@ -234,28 +306,90 @@ func TestList(t *testing.T) {
 	}
 
 	ecrClient.assertCounts(t, map[string]int{
-		"describeRepos": 1,
+		"describeRepos": 2,
 	})
 
+	if res.Header.Get(common.NextPageTokenHeader) != "" {
+		t.Errorf("Unexpected next page token: %v", res.Header.Get(common.NextPageTokenHeader))
+	}
+
 	fmt.Println(string(data))
 
-	var result []map[string]interface{}
+	var result []common.Repository
 	err2 := json.Unmarshal([]byte(data), &result)
 	if err2 != nil {
 		t.Errorf("Unexpected error: %v", err2)
 	}
 
-	if len(result) != 2 {
-		t.Errorf("Expected 2 items: %v", result)
+	if len(result) != 3 {
+		t.Fatalf("Expected 3 items: %v", result)
 	}
-	if result[0]["RepositoryName"] != "existing-image" || result[0]["RepositoryUri"] != "123456789012.dkr.ecr.eu-west-2.amazonaws.com/existing-image" {
+	if result[0].Name != "existing-image" || result[0].URI != "123456789012.dkr.ecr.eu-west-2.amazonaws.com/existing-image" || !result[0].Created.Equal(timestamp()) {
 		t.Errorf("Expected 'existing-image': %v", result[0])
 	}
-	if result[1]["RepositoryName"] != "another-image" || result[1]["RepositoryUri"] != "123456789012.dkr.ecr.eu-west-2.amazonaws.com/another-image" {
+	if result[1].Name != "another-image" || result[1].URI != "123456789012.dkr.ecr.eu-west-2.amazonaws.com/another-image" {
 		t.Errorf("Expected 'another-image': %v", result[1])
 	}
 }
 
+func TestListPaged(t *testing.T) {
+	testCases := []struct {
+		query             string
+		expectedStatus    int
+		expectedNames     []string
+		expectedNextToken string
+	}{
+		{"?limit=1", 200, []string{"existing-image"}, "1"},
+		{"?limit=1&page_token=1", 200, []string{"another-image"}, "2"},
+		{"?page_token=1", 200, []string{"another-image", "third-image"}, ""},
+		{"?limit=5", 200, []string{"existing-image", "another-image", "third-image"}, ""},
+		{"?limit=0", 400, nil, ""},
+		{"?page_token=invalid", 500, nil, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			ecrClient, res, data, err := request(t, "GET", "/repos/"+tc.query)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != tc.expectedStatus {
+				t.Errorf("Expected StatusCode %v: %v", tc.expectedStatus, res.StatusCode)
+			}
+			if tc.expectedStatus == 400 {
+				ecrClient.assertCounts(t, map[string]int{})
+				return
+			}
+
+			ecrClient.assertCounts(t, map[string]int{
+				"describeRepos": 1,
+			})
+			if tc.expectedStatus != 200 {
+				return
+			}
+
+			if res.Header.Get(common.NextPageTokenHeader) != tc.expectedNextToken {
+				t.Errorf("Expected next page token '%v': %v", tc.expectedNextToken, res.Header.Get(common.NextPageTokenHeader))
+			}
+
+			var result []common.Repository
+			err2 := json.Unmarshal([]byte(data), &result)
+			if err2 != nil {
+				t.Errorf("Unexpected error: %v", err2)
+			}
+
+			names := []string{}
+			for _, repo := range result {
+				names = append(names, repo.Name)
+			}
+			if !reflect.DeepEqual(names, tc.expectedNames) {
+				t.Errorf("Expected %v: %v", tc.expectedNames, names)
+			}
+		})
+	}
+}
+
 func TestGetByName(t *testing.T) {
 	e := &ecrHandler{
 		registryId: registryId,
@@ -263,7 +397,7 @@ func TestGetByName(t *testing.T) {
 	}
 
 	{
-		r, err := e.getRepoByName("existing-image")
+		r, err := e.getRepoByName(context.Background(), "existing-image")
 		if err != nil {
 			t.Errorf("Unexpected error: %v", err)
 		}
@@ -276,7 +410,7 @@ func TestGetByName(t *testing.T) {
 	}
 
 	{
-		r, err := e.getRepoByName("new-image")
+		r, err := e.getRepoByName(context.Background(), "new-image")
 		if err != nil {
 			t.Errorf("Unexpected error: %v", err)
 		}
@@ -304,13 +438,14 @@ func TestGetRepositoryAsJson(t *testing.T) {
 		if name != "existing-image" {
 			t.Errorf("Unexpected repository name: %v", name)
 		}
-		var jsonObj map[string]string
+		var jsonObj common.Repository
 		err = json.Unmarshal(jsonBytes, &jsonObj)
 		if err != nil {
 			t.Errorf("Unexpected error: %v", err)
 		}
 
-		if jsonObj["RepositoryName"] != "existing-image" || jsonObj["RegistryId"] != registryId || jsonObj["RepositoryUri"] != "123456789012.dkr.ecr.eu-west-2.amazonaws.com/existing-image" {
+		provider := jsonObj.Provider.(map[string]interface{})
+		if jsonObj.Name != "existing-image" || provider["RegistryId"] != registryId || jsonObj.URI != "123456789012.dkr.ecr.eu-west-2.amazonaws.com/existing-image" {
 			t.Errorf("Unexpected json: %s", jsonBytes)
 		}
 	}
@@ -358,13 +493,13 @@ func TestGetRepo(t *testing.T) {
 			})
 
 			if tc.expectedStatusCode == 200 {
-				var result map[string]interface{}
+				var result common.Repository
 				err2 := json.Unmarshal([]byte(data), &result)
 				if err2 != nil {
 					t.Errorf("Unexpected error: %v", err2)
 				}
 
-				if result["RepositoryName"] != "existing-image" {
+				if result.Name != "existing-image" {
 					t.Errorf("Expected 'existing-image': %v", result)
 				}
 			} else if string(data) != "null" {
@@ -402,15 +537,18 @@ func TestGetImage(t *testing.T) {
 			})
 
 			if tc.expectedStatusCode == 200 {
-				var result map[string]interface{}
+				var result common.Image
 				err2 := json.Unmarshal([]byte(data), &result)
 				if err2 != nil {
 					t.Errorf("Unexpected error: %v", err2)
 				}
 
-				if result["RepositoryName"] != "existing-image" {
+				if result.Repository != "existing-image" || result.Tag != tc.tag || result.Digest != "sha256:1234" || result.SizeBytes != 123456 || !result.PushedAt.Equal(timestamp()) {
 					t.Errorf("Expected 'existing-image': %v", result)
 				}
+				if result.Provider.(map[string]interface{})["RepositoryName"] != "existing-image" {
+					t.Errorf("Expected provider response: %v", result.Provider)
+				}
 			} else if string(data) != "null\n" {
 				t.Errorf("Expected 'null': %v", string(data))
 			}
@@ -418,6 +556,60 @@ func TestGetImage(t *testing.T) {
 	}
 }
 
+func TestListImages(t *testing.T) {
+	{
+		ecrClient, res, data, err := request(t, "GET", "/images/existing-image")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 200 {
+			t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+		}
+
+		ecrClient.assertCounts(t, map[string]int{
+			"describeImages": 2,
+		})
+
+		var result []common.Image
+		err2 := json.Unmarshal([]byte(data), &result)
+		if err2 != nil {
+			t.Errorf("Unexpected error: %v", err2)
+		}
+
+		if len(result) != 3 {
+			t.Fatalf("Expected 3 items: %v", result)
+		}
+		for i, tag := range []string{"tag", "latest"} {
+			if result[i].Repository != "existing-image" || result[i].Tag != tag || result[i].Digest != "sha256:1234" || result[i].SizeBytes != 123456 || !result[i].PushedAt.Equal(timestamp()) {
+				t.Errorf("Unexpected image: %v", result[i])
+			}
+		}
+		if result[2].Tag != "" || result[2].Digest != "sha256:5678" {
+			t.Errorf("Expected untagged image: %v", result[2])
+		}
+	}
+
+	{
+		ecrClient, res, data, err := request(t, "GET", "/images/new-image")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 404 {
+			t.Errorf("Expected StatusCode 404: %v", res.StatusCode)
+		}
+
+		ecrClient.assertCounts(t, map[string]int{
+			"describeImages": 1,
+		})
+
+		if string(data) != "null\n" {
+			t.Errorf("Expected 'null': %v", string(data))
+		}
+	}
+}
+
 func TestCreate(t *testing.T) {
 	testCases := []struct {
 		imageName string
@@ -450,13 +642,13 @@ func TestCreate(t *testing.T) {
 				})
 			}
 
-			var result map[string]interface{}
+			var result common.Repository
 			err2 := json.Unmarshal([]byte(data), &result)
 			if err2 != nil {
 				t.Errorf("Unexpected error: %v", err2)
 			}
 
-			if result["RepositoryName"] != tc.imageName {
+			if result.Name != tc.imageName {
 				t.Errorf("Expected '%v': %v", tc.imageName, result)
 			}
 		})
@@ -500,6 +692,46 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestDeleteImage(t *testing.T) {
+	testCases := []struct {
+		imageName string
+		tag       string
+		delete    bool
+	}{
+		{"existing-image", "tag", true},
+		{"existing-image", "new-tag", false},
+		{"new-image", "tag", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v,%v", tc.imageName, tc.tag, tc.delete), func(t *testing.T) {
+			ecrClient, res, _, err := request(t, "DELETE", fmt.Sprintf("/image/%s:%s", tc.imageName, tc.tag))
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != 200 {
+				t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+			}
+
+			if tc.delete {
+				ecrClient.assertCounts(t, map[string]int{
+					"deleteImages": 1,
+				})
+			} else {
+				ecrClient.assertCounts(t, map[string]int{
+					"deleteImages":     1,
+					"deleteImageNoops": 1,
+				})
+			}
+
+			if *ecrClient.deleteImageRequests[0].RegistryId != registryId || *ecrClient.deleteImageRequests[0].ImageIds[0].ImageTag != tc.tag {
+				t.Errorf("Unexpected request: %v", ecrClient.deleteImageRequests[0])
+			}
+		})
+	}
+}
+
 func TestToken(t *testing.T) {
 	testCases := []struct {
 		suffix string
@@ -543,3 +775,18 @@ func TestToken(t *testing.T) {
 		})
 	}
 }
+
+func TestHealthCheck(t *testing.T) {
+	ecrClient := MockEcrClient{}
+	e := &ecrHandler{
+		registryId: registryId,
+		client:     &ecrClient,
+	}
+	err := e.HealthCheck(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ecrClient.describeRepoRequests) != 1 || *ecrClient.describeRepoRequests[0].MaxResults != 1 || *ecrClient.describeRepoRequests[0].RegistryId != registryId {
+		t.Errorf("Unexpected requests: %v", ecrClient.describeRepoRequests)
+	}
+}
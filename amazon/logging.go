@@ -0,0 +1,117 @@
+package amazon
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/smithy-go/middleware"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// logEcrCall logs a call to the ECR API with the AWS request ID
+func logEcrCall(ctx context.Context, operation string, start time.Time, metadata middleware.Metadata, err error) {
+	requestID, _ := awsmiddleware.GetRequestIDMetadata(metadata)
+	var responseErr *awshttp.ResponseError
+	if requestID == "" && errors.As(err, &responseErr) {
+		requestID = responseErr.ServiceRequestID()
+	}
+	common.LogUpstreamCall(ctx, "ecr."+operation, start, requestID, err)
+}
+
+// loggingEcrClient wraps an IEcrClient to log every call
+type loggingEcrClient struct {
+	client IEcrClient
+}
+
+func (c *loggingEcrClient) DescribeRepositories(ctx context.Context, input *ecr.DescribeRepositoriesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeRepositoriesOutput, error) {
+	start := time.Now()
+	response, err := c.client.DescribeRepositories(ctx, input, optFns...)
+	var metadata middleware.Metadata
+	if response != nil {
+		metadata = response.ResultMetadata
+	}
+	logEcrCall(ctx, "DescribeRepositories", start, metadata, err)
+	return response, err
+}
+
+func (c *loggingEcrClient) DescribeImages(ctx context.Context, input *ecr.DescribeImagesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeImagesOutput, error) {
+	start := time.Now()
+	response, err := c.client.DescribeImages(ctx, input, optFns...)
+	var metadata middleware.Metadata
+	if response != nil {
+		metadata = response.ResultMetadata
+	}
+	logEcrCall(ctx, "DescribeImages", start, metadata, err)
+	return response, err
+}
+
+func (c *loggingEcrClient) CreateRepository(ctx context.Context, input *ecr.CreateRepositoryInput, optFns ...func(*ecr.Options)) (*ecr.CreateRepositoryOutput, error) {
+	start := time.Now()
+	response, err := c.client.CreateRepository(ctx, input, optFns...)
+	var metadata middleware.Metadata
+	if response != nil {
+		metadata = response.ResultMetadata
+	}
+	logEcrCall(ctx, "CreateRepository", start, metadata, err)
+	return response, err
+}
+
+func (c *loggingEcrClient) PutLifecyclePolicy(ctx context.Context, input *ecr.PutLifecyclePolicyInput, optFns ...func(*ecr.Options)) (*ecr.PutLifecyclePolicyOutput, error) {
+	start := time.Now()
+	response, err := c.client.PutLifecyclePolicy(ctx, input, optFns...)
+	var metadata middleware.Metadata
+	if response != nil {
+		metadata = response.ResultMetadata
+	}
+	logEcrCall(ctx, "PutLifecyclePolicy", start, metadata, err)
+	return response, err
+}
+
+func (c *loggingEcrClient) DeleteRepository(ctx context.Context, input *ecr.DeleteRepositoryInput, optFns ...func(*ecr.Options)) (*ecr.DeleteRepositoryOutput, error) {
+	start := time.Now()
+	response, err := c.client.DeleteRepository(ctx, input, optFns...)
+	var metadata middleware.Metadata
+	if response != nil {
+		metadata = response.ResultMetadata
+	}
+	logEcrCall(ctx, "DeleteRepository", start, metadata, err)
+	return response, err
+}
+
+func (c *loggingEcrClient) BatchDeleteImage(ctx context.Context, input *ecr.BatchDeleteImageInput, optFns ...func(*ecr.Options)) (*ecr.BatchDeleteImageOutput, error) {
+	start := time.Now()
+	response, err := c.client.BatchDeleteImage(ctx, input, optFns...)
+	var metadata middleware.Metadata
+	if response != nil {
+		metadata = response.ResultMetadata
+	}
+	logEcrCall(ctx, "BatchDeleteImage", start, metadata, err)
+	return response, err
+}
+
+func (c *loggingEcrClient) DeleteLifecyclePolicy(ctx context.Context, input *ecr.DeleteLifecyclePolicyInput, optFns ...func(*ecr.Options)) (*ecr.DeleteLifecyclePolicyOutput, error) {
+	start := time.Now()
+	response, err := c.client.DeleteLifecyclePolicy(ctx, input, optFns...)
+	var metadata middleware.Metadata
+	if response != nil {
+		metadata = response.ResultMetadata
+	}
+	logEcrCall(ctx, "DeleteLifecyclePolicy", start, metadata, err)
+	return response, err
+}
+
+func (c *loggingEcrClient) GetAuthorizationToken(ctx context.Context, input *ecr.GetAuthorizationTokenInput, optFns ...func(*ecr.Options)) (*ecr.GetAuthorizationTokenOutput, error) {
+	start := time.Now()
+	response, err := c.client.GetAuthorizationToken(ctx, input, optFns...)
+	var metadata middleware.Metadata
+	if response != nil {
+		metadata = response.ResultMetadata
+	}
+	logEcrCall(ctx, "GetAuthorizationToken", start, metadata, err)
+	return response, err
+}
@@ -0,0 +1,76 @@
+package amazon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// requestIDEcrClient returns an AWS request ID from DescribeRepositories
+type requestIDEcrClient struct {
+	MockEcrClient
+}
+
+func (c *requestIDEcrClient) DescribeRepositories(ctx context.Context, input *ecr.DescribeRepositoriesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeRepositoriesOutput, error) {
+	response, err := c.MockEcrClient.DescribeRepositories(ctx, input, optFns...)
+	if response != nil {
+		awsmiddleware.SetRequestIDMetadata(&response.ResultMetadata, "aws-request-1")
+	}
+	return response, err
+}
+
+func TestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := common.NewLogHandler(&buf, "json", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	e := &ecrHandler{
+		registryId: registryId,
+		client:     &loggingEcrClient{client: &requestIDEcrClient{}},
+	}
+	s := &common.RegistryServer{
+		Client: e,
+	}
+	req := httptest.NewRequest("GET", "/repo/existing-image", http.NoBody)
+	req = req.WithContext(common.WithRequestID(req.Context(), "request-1"))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]interface{}
+		err := json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record["request_id"] != "request-1" {
+			t.Errorf("Expected request_id: %v", record)
+		}
+		if record["operation"] == "ecr.DescribeRepositories" {
+			found = true
+			if record["upstream_request_id"] != "aws-request-1" {
+				t.Errorf("Expected upstream_request_id: %v", record)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected upstream call to be logged: %s", buf.String())
+	}
+}
@@ -0,0 +1,97 @@
+package amazon
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+var repositoriesDeletedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "repositories_deleted_total",
+	Help:      "Total number of repositories deleted",
+})
+
+// errorCode returns the AWS error code if err is an API error
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+func observe(operation string, start time.Time, err error) {
+	common.ObserveUpstreamCall("amazon", operation, start, errorCode(err), err)
+}
+
+// metricsEcrClient wraps an IEcrClient to record the duration and errors of
+// every call
+type metricsEcrClient struct {
+	client IEcrClient
+}
+
+func (c *metricsEcrClient) DescribeRepositories(ctx context.Context, input *ecr.DescribeRepositoriesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeRepositoriesOutput, error) {
+	start := time.Now()
+	response, err := c.client.DescribeRepositories(ctx, input, optFns...)
+	observe("ecr.DescribeRepositories", start, err)
+	return response, err
+}
+
+func (c *metricsEcrClient) DescribeImages(ctx context.Context, input *ecr.DescribeImagesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeImagesOutput, error) {
+	start := time.Now()
+	response, err := c.client.DescribeImages(ctx, input, optFns...)
+	observe("ecr.DescribeImages", start, err)
+	return response, err
+}
+
+func (c *metricsEcrClient) CreateRepository(ctx context.Context, input *ecr.CreateRepositoryInput, optFns ...func(*ecr.Options)) (*ecr.CreateRepositoryOutput, error) {
+	start := time.Now()
+	response, err := c.client.CreateRepository(ctx, input, optFns...)
+	observe("ecr.CreateRepository", start, err)
+	return response, err
+}
+
+func (c *metricsEcrClient) PutLifecyclePolicy(ctx context.Context, input *ecr.PutLifecyclePolicyInput, optFns ...func(*ecr.Options)) (*ecr.PutLifecyclePolicyOutput, error) {
+	start := time.Now()
+	response, err := c.client.PutLifecyclePolicy(ctx, input, optFns...)
+	observe("ecr.PutLifecyclePolicy", start, err)
+	return response, err
+}
+
+func (c *metricsEcrClient) DeleteRepository(ctx context.Context, input *ecr.DeleteRepositoryInput, optFns ...func(*ecr.Options)) (*ecr.DeleteRepositoryOutput, error) {
+	start := time.Now()
+	response, err := c.client.DeleteRepository(ctx, input, optFns...)
+	observe("ecr.DeleteRepository", start, err)
+	if err == nil {
+		repositoriesDeletedCounter.Inc()
+	}
+	return response, err
+}
+
+func (c *metricsEcrClient) BatchDeleteImage(ctx context.Context, input *ecr.BatchDeleteImageInput, optFns ...func(*ecr.Options)) (*ecr.BatchDeleteImageOutput, error) {
+	start := time.Now()
+	response, err := c.client.BatchDeleteImage(ctx, input, optFns...)
+	observe("ecr.BatchDeleteImage", start, err)
+	return response, err
+}
+
+func (c *metricsEcrClient) DeleteLifecyclePolicy(ctx context.Context, input *ecr.DeleteLifecyclePolicyInput, optFns ...func(*ecr.Options)) (*ecr.DeleteLifecyclePolicyOutput, error) {
+	start := time.Now()
+	response, err := c.client.DeleteLifecyclePolicy(ctx, input, optFns...)
+	observe("ecr.DeleteLifecyclePolicy", start, err)
+	return response, err
+}
+
+func (c *metricsEcrClient) GetAuthorizationToken(ctx context.Context, input *ecr.GetAuthorizationTokenInput, optFns ...func(*ecr.Options)) (*ecr.GetAuthorizationTokenOutput, error) {
+	start := time.Now()
+	response, err := c.client.GetAuthorizationToken(ctx, input, optFns...)
+	observe("ecr.GetAuthorizationToken", start, err)
+	return response, err
+}
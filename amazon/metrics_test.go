@@ -0,0 +1,33 @@
+package amazon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	client := &metricsEcrClient{client: &MockEcrClient{}}
+
+	_, err := client.DescribeRepositories(context.Background(), &ecr.DescribeRepositoriesInput{RepositoryNames: []string{"missing"}})
+	if code := errorCode(err); code != "RepositoryNotFoundException" {
+		t.Errorf("Expected RepositoryNotFoundException: %s", code)
+	}
+
+	before := testutil.ToFloat64(repositoriesDeletedCounter)
+	// Only successful deletions are counted
+	_, err = client.DeleteRepository(context.Background(), &ecr.DeleteRepositoryInput{RepositoryName: aws.String("existing-image")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.DeleteRepository(context.Background(), &ecr.DeleteRepositoryInput{RepositoryName: aws.String("missing")})
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if deleted := testutil.ToFloat64(repositoriesDeletedCounter) - before; deleted != 1 {
+		t.Errorf("Expected 1 deleted repository: %f", deleted)
+	}
+}
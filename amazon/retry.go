@@ -0,0 +1,89 @@
+package amazon
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// AWS error codes for throttling, which don't always have a 429 status
+var throttlingCodes = map[string]bool{
+	"ThrottlingException":       true,
+	"ThrottledException":        true,
+	"TooManyRequestsException":  true,
+	"RequestLimitExceeded":      true,
+	"RequestThrottled":          true,
+	"RequestThrottledException": true,
+}
+
+// retryable returns true if err is caused by throttling or a server error
+func retryable(err error) bool {
+	if throttlingCodes[errorCode(err)] {
+		return true
+	}
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		status := respErr.HTTPStatusCode()
+		return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	}
+	return false
+}
+
+// retryingEcrClient wraps an IEcrClient to retry calls that fail with a
+// retryable error
+type retryingEcrClient struct {
+	client  IEcrClient
+	retrier *common.Retrier
+}
+
+func (c *retryingEcrClient) DescribeRepositories(ctx context.Context, input *ecr.DescribeRepositoriesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeRepositoriesOutput, error) {
+	return common.Retry(ctx, c.retrier, "ecr.DescribeRepositories", func(ctx context.Context) (*ecr.DescribeRepositoriesOutput, error) {
+		return c.client.DescribeRepositories(ctx, input, optFns...)
+	})
+}
+
+func (c *retryingEcrClient) DescribeImages(ctx context.Context, input *ecr.DescribeImagesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeImagesOutput, error) {
+	return common.Retry(ctx, c.retrier, "ecr.DescribeImages", func(ctx context.Context) (*ecr.DescribeImagesOutput, error) {
+		return c.client.DescribeImages(ctx, input, optFns...)
+	})
+}
+
+func (c *retryingEcrClient) CreateRepository(ctx context.Context, input *ecr.CreateRepositoryInput, optFns ...func(*ecr.Options)) (*ecr.CreateRepositoryOutput, error) {
+	return common.Retry(ctx, c.retrier, "ecr.CreateRepository", func(ctx context.Context) (*ecr.CreateRepositoryOutput, error) {
+		return c.client.CreateRepository(ctx, input, optFns...)
+	})
+}
+
+func (c *retryingEcrClient) PutLifecyclePolicy(ctx context.Context, input *ecr.PutLifecyclePolicyInput, optFns ...func(*ecr.Options)) (*ecr.PutLifecyclePolicyOutput, error) {
+	return common.Retry(ctx, c.retrier, "ecr.PutLifecyclePolicy", func(ctx context.Context) (*ecr.PutLifecyclePolicyOutput, error) {
+		return c.client.PutLifecyclePolicy(ctx, input, optFns...)
+	})
+}
+
+func (c *retryingEcrClient) DeleteRepository(ctx context.Context, input *ecr.DeleteRepositoryInput, optFns ...func(*ecr.Options)) (*ecr.DeleteRepositoryOutput, error) {
+	return common.Retry(ctx, c.retrier, "ecr.DeleteRepository", func(ctx context.Context) (*ecr.DeleteRepositoryOutput, error) {
+		return c.client.DeleteRepository(ctx, input, optFns...)
+	})
+}
+
+func (c *retryingEcrClient) BatchDeleteImage(ctx context.Context, input *ecr.BatchDeleteImageInput, optFns ...func(*ecr.Options)) (*ecr.BatchDeleteImageOutput, error) {
+	return common.Retry(ctx, c.retrier, "ecr.BatchDeleteImage", func(ctx context.Context) (*ecr.BatchDeleteImageOutput, error) {
+		return c.client.BatchDeleteImage(ctx, input, optFns...)
+	})
+}
+
+func (c *retryingEcrClient) DeleteLifecyclePolicy(ctx context.Context, input *ecr.DeleteLifecyclePolicyInput, optFns ...func(*ecr.Options)) (*ecr.DeleteLifecyclePolicyOutput, error) {
+	return common.Retry(ctx, c.retrier, "ecr.DeleteLifecyclePolicy", func(ctx context.Context) (*ecr.DeleteLifecyclePolicyOutput, error) {
+		return c.client.DeleteLifecyclePolicy(ctx, input, optFns...)
+	})
+}
+
+func (c *retryingEcrClient) GetAuthorizationToken(ctx context.Context, input *ecr.GetAuthorizationTokenInput, optFns ...func(*ecr.Options)) (*ecr.GetAuthorizationTokenOutput, error) {
+	return common.Retry(ctx, c.retrier, "ecr.GetAuthorizationToken", func(ctx context.Context) (*ecr.GetAuthorizationTokenOutput, error) {
+		return c.client.GetAuthorizationToken(ctx, input, optFns...)
+	})
+}
@@ -0,0 +1,51 @@
+package amazon
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+func TestRetryable(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"throttling", &smithy.GenericAPIError{Code: "ThrottlingException"}, true},
+		{"server-error", &smithyhttp.ResponseError{Response: &smithyhttp.Response{Response: &http.Response{StatusCode: 503}}, Err: errors.New("unavailable")}, true},
+		{"not-found", &types.RepositoryNotFoundException{}, false},
+		{"other", errors.New("failed"), false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if r := retryable(tc.err); r != tc.expected {
+				t.Errorf("Expected %v: %v", tc.expected, r)
+			}
+		})
+	}
+}
+
+func TestRetryingClient(t *testing.T) {
+	ecrClient := &MockEcrClient{}
+	client := &retryingEcrClient{
+		client:  ecrClient,
+		retrier: common.NewRetrier("amazon", common.RetryConfig{MaxAttempts: 3}, retryable),
+	}
+	_, err := client.DescribeRepositories(context.Background(), &ecr.DescribeRepositoriesInput{RepositoryNames: []string{"missing"}})
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	// Not found isn't retried
+	if len(ecrClient.describeRepoRequests) != 1 {
+		t.Errorf("Expected 1 request: %v", ecrClient.describeRepoRequests)
+	}
+}
@@ -0,0 +1,64 @@
+package amazon
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// timeoutEcrClient wraps an IEcrClient to apply a timeout to every call
+type timeoutEcrClient struct {
+	client  IEcrClient
+	timeout time.Duration
+}
+
+func (c *timeoutEcrClient) DescribeRepositories(ctx context.Context, input *ecr.DescribeRepositoriesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeRepositoriesOutput, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.DescribeRepositories(ctx, input, optFns...)
+}
+
+func (c *timeoutEcrClient) DescribeImages(ctx context.Context, input *ecr.DescribeImagesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeImagesOutput, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.DescribeImages(ctx, input, optFns...)
+}
+
+func (c *timeoutEcrClient) CreateRepository(ctx context.Context, input *ecr.CreateRepositoryInput, optFns ...func(*ecr.Options)) (*ecr.CreateRepositoryOutput, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.CreateRepository(ctx, input, optFns...)
+}
+
+func (c *timeoutEcrClient) PutLifecyclePolicy(ctx context.Context, input *ecr.PutLifecyclePolicyInput, optFns ...func(*ecr.Options)) (*ecr.PutLifecyclePolicyOutput, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.PutLifecyclePolicy(ctx, input, optFns...)
+}
+
+func (c *timeoutEcrClient) DeleteRepository(ctx context.Context, input *ecr.DeleteRepositoryInput, optFns ...func(*ecr.Options)) (*ecr.DeleteRepositoryOutput, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.DeleteRepository(ctx, input, optFns...)
+}
+
+func (c *timeoutEcrClient) BatchDeleteImage(ctx context.Context, input *ecr.BatchDeleteImageInput, optFns ...func(*ecr.Options)) (*ecr.BatchDeleteImageOutput, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.BatchDeleteImage(ctx, input, optFns...)
+}
+
+func (c *timeoutEcrClient) DeleteLifecyclePolicy(ctx context.Context, input *ecr.DeleteLifecyclePolicyInput, optFns ...func(*ecr.Options)) (*ecr.DeleteLifecyclePolicyOutput, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.DeleteLifecyclePolicy(ctx, input, optFns...)
+}
+
+func (c *timeoutEcrClient) GetAuthorizationToken(ctx context.Context, input *ecr.GetAuthorizationTokenInput, optFns ...func(*ecr.Options)) (*ecr.GetAuthorizationTokenOutput, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.GetAuthorizationToken(ctx, input, optFns...)
+}
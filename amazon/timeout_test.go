@@ -0,0 +1,62 @@
+package amazon
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// slowEcrClient blocks DescribeRepositories until the context is done
+type slowEcrClient struct {
+	MockEcrClient
+}
+
+func (c *slowEcrClient) DescribeRepositories(ctx context.Context, input *ecr.DescribeRepositoriesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeRepositoriesOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestTimeout(t *testing.T) {
+	testCases := []struct {
+		client             IEcrClient
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{&slowEcrClient{}, 504, `{"error": "upstream timeout"}` + "\n"},
+		{&MockEcrClient{}, 200, ""},
+	}
+
+	for _, tc := range testCases {
+		e := &ecrHandler{
+			registryId: registryId,
+			client:     &timeoutEcrClient{client: tc.client, timeout: 10 * time.Millisecond},
+		}
+		s := &common.RegistryServer{
+			Client: e,
+		}
+
+		req := httptest.NewRequest("GET", "/repo/existing-image", http.NoBody)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != tc.expectedStatusCode {
+			t.Errorf("Expected StatusCode %d: %d", tc.expectedStatusCode, res.StatusCode)
+		}
+		if tc.expectedBody != "" && string(data) != tc.expectedBody {
+			t.Errorf("Unexpected body: %s", data)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package amazon
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+func startSpan(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return common.StartUpstreamSpan(ctx, "amazon", operation)
+}
+
+// endSpan ends a span with the AWS error code if the call failed
+func endSpan(span trace.Span, err error) {
+	common.EndUpstreamSpan(span, errorCode(err), err)
+}
+
+// tracingEcrClient wraps an IEcrClient to create a span for every call
+type tracingEcrClient struct {
+	client IEcrClient
+}
+
+func (c *tracingEcrClient) DescribeRepositories(ctx context.Context, input *ecr.DescribeRepositoriesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeRepositoriesOutput, error) {
+	ctx, span := startSpan(ctx, "ecr.DescribeRepositories")
+	response, err := c.client.DescribeRepositories(ctx, input, optFns...)
+	endSpan(span, err)
+	return response, err
+}
+
+func (c *tracingEcrClient) DescribeImages(ctx context.Context, input *ecr.DescribeImagesInput, optFns ...func(*ecr.Options)) (*ecr.DescribeImagesOutput, error) {
+	ctx, span := startSpan(ctx, "ecr.DescribeImages")
+	response, err := c.client.DescribeImages(ctx, input, optFns...)
+	endSpan(span, err)
+	return response, err
+}
+
+func (c *tracingEcrClient) CreateRepository(ctx context.Context, input *ecr.CreateRepositoryInput, optFns ...func(*ecr.Options)) (*ecr.CreateRepositoryOutput, error) {
+	ctx, span := startSpan(ctx, "ecr.CreateRepository")
+	response, err := c.client.CreateRepository(ctx, input, optFns...)
+	endSpan(span, err)
+	return response, err
+}
+
+func (c *tracingEcrClient) PutLifecyclePolicy(ctx context.Context, input *ecr.PutLifecyclePolicyInput, optFns ...func(*ecr.Options)) (*ecr.PutLifecyclePolicyOutput, error) {
+	ctx, span := startSpan(ctx, "ecr.PutLifecyclePolicy")
+	response, err := c.client.PutLifecyclePolicy(ctx, input, optFns...)
+	endSpan(span, err)
+	return response, err
+}
+
+func (c *tracingEcrClient) DeleteRepository(ctx context.Context, input *ecr.DeleteRepositoryInput, optFns ...func(*ecr.Options)) (*ecr.DeleteRepositoryOutput, error) {
+	ctx, span := startSpan(ctx, "ecr.DeleteRepository")
+	response, err := c.client.DeleteRepository(ctx, input, optFns...)
+	endSpan(span, err)
+	return response, err
+}
+
+func (c *tracingEcrClient) BatchDeleteImage(ctx context.Context, input *ecr.BatchDeleteImageInput, optFns ...func(*ecr.Options)) (*ecr.BatchDeleteImageOutput, error) {
+	ctx, span := startSpan(ctx, "ecr.BatchDeleteImage")
+	response, err := c.client.BatchDeleteImage(ctx, input, optFns...)
+	endSpan(span, err)
+	return response, err
+}
+
+func (c *tracingEcrClient) DeleteLifecyclePolicy(ctx context.Context, input *ecr.DeleteLifecyclePolicyInput, optFns ...func(*ecr.Options)) (*ecr.DeleteLifecyclePolicyOutput, error) {
+	ctx, span := startSpan(ctx, "ecr.DeleteLifecyclePolicy")
+	response, err := c.client.DeleteLifecyclePolicy(ctx, input, optFns...)
+	endSpan(span, err)
+	return response, err
+}
+
+func (c *tracingEcrClient) GetAuthorizationToken(ctx context.Context, input *ecr.GetAuthorizationTokenInput, optFns ...func(*ecr.Options)) (*ecr.GetAuthorizationTokenOutput, error) {
+	ctx, span := startSpan(ctx, "ecr.GetAuthorizationToken")
+	response, err := c.client.GetAuthorizationToken(ctx, input, optFns...)
+	endSpan(span, err)
+	return response, err
+}
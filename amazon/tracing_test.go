@@ -0,0 +1,44 @@
+package amazon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	client := &tracingEcrClient{client: &MockEcrClient{}}
+	_, err := client.DescribeRepositories(context.Background(), &ecr.DescribeRepositoriesInput{RepositoryNames: []string{"existing-image"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.DescribeRepositories(context.Background(), &ecr.DescribeRepositoriesInput{RepositoryNames: []string{"missing"}})
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans: %v", spans)
+	}
+	for i, expectedCode := range []string{"", "RepositoryNotFoundException"} {
+		attrs := map[string]string{}
+		for _, kv := range spans[i].Attributes() {
+			attrs[string(kv.Key)] = kv.Value.Emit()
+		}
+		if spans[i].Name() != "ecr.DescribeRepositories" || attrs[string(common.ProviderAttribute)] != "amazon" || attrs[string(common.ErrorCodeAttribute)] != expectedCode {
+			t.Errorf("Unexpected span %s: %v", spans[i].Name(), attrs)
+		}
+	}
+}
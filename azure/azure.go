@@ -0,0 +1,620 @@
+// Azure Container Registry
+// SDK: https://pkg.go.dev/github.com/Azure/azure-sdk-for-go/sdk/containers/azcontainerregistry
+
+package azure
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/containers/azcontainerregistry"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// Scope required to exchange an Azure AD token for an ACR refresh token
+const acrScope = "https://containerregistry.azure.net/.default"
+
+// ACR refresh tokens must be used with this username
+// https://learn.microsoft.com/en-us/azure/container-registry/container-registry-authentication#az-acr-login-with---expose-token
+const acrTokenUsername = "00000000-0000-0000-0000-000000000000"
+
+// Number of repositories to request per page
+const listPageSize = 1000
+
+// IAcrClient is a subset of the ACR data-plane API.
+// The SDK returns pagers for listing repositories and manifests which can't
+// easily be mocked, so ListRepositories and ListManifests return a single
+// page instead.
+type IAcrClient interface {
+	ListRepositories(ctx context.Context, options *azcontainerregistry.ClientListRepositoriesOptions) (response azcontainerregistry.ClientListRepositoriesResponse, err error)
+
+	GetRepositoryProperties(ctx context.Context, name string, options *azcontainerregistry.ClientGetRepositoryPropertiesOptions) (response azcontainerregistry.ClientGetRepositoryPropertiesResponse, err error)
+
+	GetTagProperties(ctx context.Context, name string, tag string, options *azcontainerregistry.ClientGetTagPropertiesOptions) (response azcontainerregistry.ClientGetTagPropertiesResponse, err error)
+
+	ListManifests(ctx context.Context, name string, options *azcontainerregistry.ClientListManifestsOptions) (response azcontainerregistry.ClientListManifestsResponse, err error)
+
+	DeleteRepository(ctx context.Context, name string, options *azcontainerregistry.ClientDeleteRepositoryOptions) (response azcontainerregistry.ClientDeleteRepositoryResponse, err error)
+
+	DeleteTag(ctx context.Context, name string, tag string, options *azcontainerregistry.ClientDeleteTagOptions) (response azcontainerregistry.ClientDeleteTagResponse, err error)
+
+	GetManifestProperties(ctx context.Context, name string, digest string, options *azcontainerregistry.ClientGetManifestPropertiesOptions) (response azcontainerregistry.ClientGetManifestPropertiesResponse, err error)
+}
+
+// IAcrAuthenticationClient is a subset of the ACR authentication API
+type IAcrAuthenticationClient interface {
+	ExchangeAADAccessTokenForACRRefreshToken(ctx context.Context, grantType azcontainerregistry.PostContentSchemaGrantType, service string, options *azcontainerregistry.AuthenticationClientExchangeAADAccessTokenForACRRefreshTokenOptions) (response azcontainerregistry.AuthenticationClientExchangeAADAccessTokenForACRRefreshTokenResponse, err error)
+}
+
+// acrClient implements IAcrClient using the ACR SDK
+type acrClient struct {
+	*azcontainerregistry.Client
+}
+
+func (c *acrClient) ListRepositories(ctx context.Context, options *azcontainerregistry.ClientListRepositoriesOptions) (azcontainerregistry.ClientListRepositoriesResponse, error) {
+	return c.NewListRepositoriesPager(options).NextPage(ctx)
+}
+
+func (c *acrClient) ListManifests(ctx context.Context, name string, options *azcontainerregistry.ClientListManifestsOptions) (azcontainerregistry.ClientListManifestsResponse, error) {
+	return c.NewListManifestsPager(name, options).NextPage(ctx)
+}
+
+type acrHandler struct {
+	// The registry login server, e.g. example.azurecr.io
+	loginServer string
+	tenantId    string
+	client      IAcrClient
+	authClient  IAcrAuthenticationClient
+	credential  azcore.TokenCredential
+}
+
+func isNotFound(err error) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
+
+// repository converts ACR repository properties to the common response
+func (c *acrHandler) repository(props azcontainerregistry.ContainerRepositoryProperties) common.Repository {
+	var name string
+	if props.Name != nil {
+		name = *props.Name
+	}
+	repo := common.Repository{
+		Name:     name,
+		URI:      fmt.Sprintf("%s/%s", c.loginServer, name),
+		Created:  props.CreatedOn,
+		Provider: props,
+	}
+	if props.ManifestCount != nil {
+		repo.ImageCount = to.Ptr(int64(*props.ManifestCount))
+	}
+	return repo
+}
+
+// listRepositories returns all repositories, or a single page if params is
+// paged, and the token for the next page. The page token is the last
+// repository name of the previous page.
+func (c *acrHandler) listRepositories(ctx context.Context, params common.ListParams) ([]common.Repository, string, error) {
+	slog.InfoContext(ctx, "Listing repos")
+	names := []string{}
+	options := azcontainerregistry.ClientListRepositoriesOptions{
+		MaxNum: to.Ptr(int32(listPageSize)),
+	}
+	if params.Limit > 0 {
+		options.MaxNum = to.Ptr(int32(min(params.Limit, listPageSize)))
+	}
+	if params.PageToken != "" {
+		options.Last = &params.PageToken
+	}
+	next := ""
+	for {
+		repos, err := c.client.ListRepositories(ctx, &options)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, name := range repos.Names {
+			names = append(names, *name)
+		}
+		if repos.Link == nil || *repos.Link == "" || len(repos.Names) == 0 {
+			next = ""
+			break
+		}
+		options.Last = repos.Names[len(repos.Names)-1]
+		next = *options.Last
+		if params.Paged() {
+			break
+		}
+	}
+
+	repositories := make([]common.Repository, len(names))
+	for i := range names {
+		repositories[i] = c.repository(azcontainerregistry.ContainerRepositoryProperties{
+			Name:                &names[i],
+			RegistryLoginServer: &c.loginServer,
+		})
+	}
+	return repositories, next, nil
+}
+
+// AllRepositories returns all repositories, following pagination
+func (c *acrHandler) AllRepositories(ctx context.Context) ([]common.Repository, error) {
+	repositories, _, err := c.listRepositories(ctx, common.ListParams{})
+	return repositories, err
+}
+
+// ListRepositories returns all repositories, or a single page if limit or
+// page_token are given
+func (c *acrHandler) ListRepositories(w http.ResponseWriter, r *http.Request) {
+	params, err := common.ListGetParams(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
+		common.BadRequest(w, r, err)
+		return
+	}
+
+	repositories, next, err := c.listRepositories(r.Context(), params)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	jsonBytes, err := json.Marshal(repositories)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	if next != "" {
+		w.Header().Set(common.NextPageTokenHeader, next)
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+func (c *acrHandler) getRepoByName(ctx context.Context, name string) (*azcontainerregistry.ContainerRepositoryProperties, error) {
+	repo, err := c.client.GetRepositoryProperties(ctx, name, nil)
+	if err != nil {
+		if isNotFound(err) {
+			slog.InfoContext(ctx, "Repo not found", "repo", name)
+			return nil, nil
+		}
+		slog.ErrorContext(ctx, "getRepoByName failed", "error", err)
+		return nil, err
+	}
+	slog.InfoContext(ctx, "Repo found", "repo", name)
+	return &repo.ContainerRepositoryProperties, nil
+}
+
+func (c *acrHandler) GetRepository(w http.ResponseWriter, r *http.Request) {
+	name, err := common.RepoGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Getting repo", "repo", name)
+
+	repo, err := c.getRepoByName(r.Context(), name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	if repo == nil {
+		common.NotFound(w, r)
+		return
+	}
+	jsonBytes, err := json.Marshal(c.repository(*repo))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+func (c *acrHandler) GetImage(w http.ResponseWriter, r *http.Request) {
+	repoName, tag, err := common.ImageGetNameAndTag(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	fullname := fmt.Sprintf("%s:%s", repoName, tag)
+
+	slog.InfoContext(r.Context(), "Getting image", "image", fullname)
+
+	image, err := c.client.GetTagProperties(r.Context(), repoName, tag, nil)
+	if err != nil {
+		if isNotFound(err) {
+			slog.InfoContext(r.Context(), "Image not found", "image", fullname)
+			common.NotFound(w, r)
+			return
+		}
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Image found", "image", fullname)
+	if image.Tag == nil || image.Tag.Digest == nil {
+		err := fmt.Errorf("no digest returned for image %s", fullname)
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	digest := *image.Tag.Digest
+	manifest, err := c.client.GetManifestProperties(r.Context(), repoName, digest, nil)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	var size int64
+	if manifest.Manifest != nil && manifest.Manifest.Size != nil {
+		size = *manifest.Manifest.Size
+	}
+	jsonBytes, err := json.Marshal(common.Image{
+		Repository: repoName,
+		Tag:        tag,
+		Digest:     digest,
+		PushedAt:   image.Tag.CreatedOn,
+		SizeBytes:  size,
+		Provider:   image.ArtifactTagProperties,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// AllImages returns all manifests in a repository
+func (c *acrHandler) AllImages(ctx context.Context, name string) ([]common.Image, error) {
+	slog.InfoContext(ctx, "Listing images", "repo", name)
+
+	images := []common.Image{}
+	options := azcontainerregistry.ClientListManifestsOptions{
+		MaxNum: to.Ptr(int32(listPageSize)),
+	}
+	for {
+		manifests, err := c.client.ListManifests(ctx, name, &options)
+		if err != nil {
+			if isNotFound(err) {
+				slog.InfoContext(ctx, "Repo not found", "repo", name)
+				return nil, common.ErrRepositoryNotFound
+			}
+			return nil, err
+		}
+		for _, manifest := range manifests.Attributes {
+			if manifest == nil || manifest.Digest == nil {
+				slog.WarnContext(ctx, "Skipping manifest without digest", "repo", name)
+				continue
+			}
+			tags := []string{}
+			for _, tag := range manifest.Tags {
+				if tag != nil {
+					tags = append(tags, *tag)
+				}
+			}
+			var size int64
+			if manifest.Size != nil {
+				size = *manifest.Size
+			}
+			images = append(images, common.NewImages(name, tags, *manifest.Digest, size, manifest.CreatedOn, manifest)...)
+		}
+		if manifests.Link == nil || *manifests.Link == "" || len(manifests.Attributes) == 0 {
+			break
+		}
+		last := manifests.Attributes[len(manifests.Attributes)-1]
+		if last == nil || last.Digest == nil {
+			return nil, fmt.Errorf("can't get next page of manifests for %s, last manifest has no digest", name)
+		}
+		options.Last = last.Digest
+	}
+	return images, nil
+}
+
+// ListImages returns all manifests in a repository
+func (c *acrHandler) ListImages(w http.ResponseWriter, r *http.Request) {
+	name, err := common.ImagesGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	images, err := c.AllImages(r.Context(), name)
+	if errors.Is(err, common.ErrRepositoryNotFound) {
+		common.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(images)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// CreateRepository is a no-op since ACR creates repositories on push.
+// If the repository already exists it is returned, otherwise a placeholder is
+// returned containing the repository name.
+func (c *acrHandler) CreateRepository(w http.ResponseWriter, r *http.Request) {
+	name, err := common.RepoGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	repo, err := c.getRepoByName(r.Context(), name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	if repo == nil {
+		slog.InfoContext(r.Context(), "Repo will be created on push", "repo", name)
+		repo = &azcontainerregistry.ContainerRepositoryProperties{
+			Name:                &name,
+			RegistryLoginServer: &c.loginServer,
+		}
+	} else {
+		slog.InfoContext(r.Context(), "Repo already exists", "repo", name)
+	}
+
+	jsonBytes, err := json.Marshal(c.repository(*repo))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// RemoveRepository deletes a repository, it succeeds if the repository
+// doesn't exist
+func (c *acrHandler) RemoveRepository(ctx context.Context, name string) error {
+	slog.InfoContext(ctx, "Deleting repo", "repo", name)
+
+	_, err := c.client.DeleteRepository(ctx, name, nil)
+	if err != nil {
+		// Ignore if it didn't exist
+		if isNotFound(err) {
+			slog.InfoContext(ctx, "Repo not found", "repo", name)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *acrHandler) DeleteRepository(w http.ResponseWriter, r *http.Request) {
+	name, err := common.RepoGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	err = c.RemoveRepository(r.Context(), name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteImage deletes a single tag, the untagged manifest is left for the
+// registry retention policy
+func (c *acrHandler) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	name, tag, err := common.ImageGetNameAndTag(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	fullname := fmt.Sprintf("%s:%s", name, tag)
+
+	slog.InfoContext(r.Context(), "Deleting image", "image", fullname)
+
+	_, err = c.client.DeleteTag(r.Context(), name, tag, nil)
+	if err != nil {
+		// Ignore if it didn't exist
+		if isNotFound(err) {
+			slog.InfoContext(r.Context(), "Image not found", "image", fullname)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// jwtExpiry returns the unverified expiry time of a JWT
+func jwtExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("invalid JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, err
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, errors.New("JWT has no exp claim")
+	}
+	return time.Unix(claims.Exp, 0).UTC(), nil
+}
+
+func (c *acrHandler) GetToken(w http.ResponseWriter, r *http.Request) {
+	aadToken, err := c.credential.GetToken(r.Context(), policy.TokenRequestOptions{
+		Scopes: []string{acrScope},
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	options := azcontainerregistry.AuthenticationClientExchangeAADAccessTokenForACRRefreshTokenOptions{
+		AccessToken: &aadToken.Token,
+	}
+	if c.tenantId != "" {
+		options.Tenant = &c.tenantId
+	}
+	refreshToken, err := c.authClient.ExchangeAADAccessTokenForACRRefreshToken(
+		r.Context(), azcontainerregistry.PostContentSchemaGrantTypeAccessToken, c.loginServer, &options)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	if refreshToken.RefreshToken == nil {
+		err := errors.New("no refresh token returned")
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	expires, err := jwtExpiry(*refreshToken.RefreshToken)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Failed to get refresh token expiry, using AAD token expiry", "error", err)
+		expires = aadToken.ExpiresOn
+	}
+
+	ret := &common.RegistryToken{
+		Username: acrTokenUsername,
+		Password: *refreshToken.RefreshToken,
+		Registry: fmt.Sprintf("https://%s", c.loginServer),
+		Expires:  expires,
+	}
+
+	jsonBytes, err := json.Marshal(ret)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// HealthCheck lists a single repository to check the credentials are valid
+func (c *acrHandler) HealthCheck(ctx context.Context) error {
+	_, err := c.client.ListRepositories(ctx, &azcontainerregistry.ClientListRepositoriesOptions{
+		MaxNum: to.Ptr(int32(1)),
+	})
+	return err
+}
+
+func init() {
+	common.RegisterProvider("azure", Setup)
+}
+
+func Setup(promRegistry *prometheus.Registry, args []string) (common.IRegistryClient, error) {
+	if len(args) != 0 {
+		return nil, errors.New("no arguments expected")
+	}
+
+	loginServer := os.Getenv("AZURE_REGISTRY")
+	if loginServer == "" {
+		return nil, errors.New("AZURE_REGISTRY is required")
+	}
+	endpoint := fmt.Sprintf("https://%s", loginServer)
+
+	// Automatically looks for a usable configuration including managed
+	// identities, workload identities and service principals
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return nil, err
+	}
+
+	client, err := azcontainerregistry.NewClient(endpoint, cred, nil)
+	if err != nil {
+		return nil, err
+	}
+	authClient, err := azcontainerregistry.NewAuthenticationClient(endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Registry", "registry", loginServer)
+
+	timeout, err := common.UpstreamTimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	acrH := &acrHandler{
+		loginServer: loginServer,
+		tenantId:    os.Getenv("AZURE_TENANT_ID"),
+		client:      &timeoutAcrClient{client: &acrClient{client}, timeout: timeout},
+		authClient:  &timeoutAcrAuthenticationClient{client: authClient, timeout: timeout},
+		credential:  cred,
+	}
+
+	return acrH, nil
+}
@@ -0,0 +1,690 @@
+package azure
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/containers/azcontainerregistry"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+const loginServer = "example.azurecr.io"
+
+type MockAcrClient struct {
+	listRepoRequests    []azcontainerregistry.ClientListRepositoriesOptions
+	getRepoRequests     []string
+	getTagRequests      []string
+	getManifestRequests []string
+	listImageRequests   []azcontainerregistry.ClientListManifestsOptions
+	deleteRepoRequests  []string
+	deleteTagRequests   []string
+	exchangeRequests    []azcontainerregistry.AuthenticationClientExchangeAADAccessTokenForACRRefreshTokenOptions
+
+	deleteRepoNoops int
+	deleteTagNoops  int
+}
+
+type MockCredential struct{}
+
+func timestamp() time.Time {
+	return time.Date(2023, time.January, 1, 12, 34, 56, 0, time.UTC)
+}
+
+func notFound(code string) error {
+	return &azcore.ResponseError{
+		ErrorCode:  code,
+		StatusCode: http.StatusNotFound,
+	}
+}
+
+func (c *MockAcrClient) repository(name string) azcontainerregistry.ContainerRepositoryProperties {
+	return azcontainerregistry.ContainerRepositoryProperties{
+		Name:                to.Ptr(name),
+		RegistryLoginServer: to.Ptr(loginServer),
+		CreatedOn:           to.Ptr(timestamp()),
+		ManifestCount:       to.Ptr(int32(2)),
+	}
+}
+
+func (c *MockAcrClient) ListRepositories(ctx context.Context, options *azcontainerregistry.ClientListRepositoriesOptions) (azcontainerregistry.ClientListRepositoriesResponse, error) {
+	c.listRepoRequests = append(c.listRepoRequests, *options)
+
+	if options.Last == nil {
+		return azcontainerregistry.ClientListRepositoriesResponse{
+			Repositories: azcontainerregistry.Repositories{
+				Names: []*string{to.Ptr("existing-image")},
+			},
+			Link: to.Ptr("/acr/v1/_catalog?last=existing-image&n=1000"),
+		}, nil
+	}
+	if *options.Last == "existing-image" {
+		return azcontainerregistry.ClientListRepositoriesResponse{
+			Repositories: azcontainerregistry.Repositories{
+				Names: []*string{to.Ptr("nested/image")},
+			},
+		}, nil
+	}
+
+	panic("ERROR")
+}
+
+func (c *MockAcrClient) GetRepositoryProperties(ctx context.Context, name string, options *azcontainerregistry.ClientGetRepositoryPropertiesOptions) (azcontainerregistry.ClientGetRepositoryPropertiesResponse, error) {
+	c.getRepoRequests = append(c.getRepoRequests, name)
+
+	if name == "existing-image" {
+		return azcontainerregistry.ClientGetRepositoryPropertiesResponse{
+			ContainerRepositoryProperties: c.repository(name),
+		}, nil
+	}
+	return azcontainerregistry.ClientGetRepositoryPropertiesResponse{}, notFound("NAME_UNKNOWN")
+}
+
+func (c *MockAcrClient) GetTagProperties(ctx context.Context, name string, tag string, options *azcontainerregistry.ClientGetTagPropertiesOptions) (azcontainerregistry.ClientGetTagPropertiesResponse, error) {
+	c.getTagRequests = append(c.getTagRequests, fmt.Sprintf("%s:%s", name, tag))
+
+	if name == "existing-image" && tag == "tag" {
+		return azcontainerregistry.ClientGetTagPropertiesResponse{
+			ArtifactTagProperties: azcontainerregistry.ArtifactTagProperties{
+				RegistryLoginServer: to.Ptr(loginServer),
+				RepositoryName:      to.Ptr(name),
+				Tag: &azcontainerregistry.TagAttributes{
+					Name:      to.Ptr(tag),
+					Digest:    to.Ptr("sha256:abcdef"),
+					CreatedOn: to.Ptr(timestamp()),
+				},
+			},
+		}, nil
+	}
+	if name == "existing-image" {
+		return azcontainerregistry.ClientGetTagPropertiesResponse{}, notFound("TAG_UNKNOWN")
+	}
+	return azcontainerregistry.ClientGetTagPropertiesResponse{}, notFound("NAME_UNKNOWN")
+}
+
+func (c *MockAcrClient) GetManifestProperties(ctx context.Context, name string, digest string, options *azcontainerregistry.ClientGetManifestPropertiesOptions) (azcontainerregistry.ClientGetManifestPropertiesResponse, error) {
+	c.getManifestRequests = append(c.getManifestRequests, fmt.Sprintf("%s@%s", name, digest))
+
+	if name == "existing-image" && digest == "sha256:abcdef" {
+		return azcontainerregistry.ClientGetManifestPropertiesResponse{
+			ArtifactManifestProperties: azcontainerregistry.ArtifactManifestProperties{
+				RegistryLoginServer: to.Ptr(loginServer),
+				RepositoryName:      to.Ptr(name),
+				Manifest: &azcontainerregistry.ManifestAttributes{
+					Digest:    to.Ptr(digest),
+					Size:      to.Ptr(int64(123456)),
+					CreatedOn: to.Ptr(timestamp()),
+					Tags:      []*string{to.Ptr("tag")},
+				},
+			},
+		}, nil
+	}
+	return azcontainerregistry.ClientGetManifestPropertiesResponse{}, notFound("MANIFEST_UNKNOWN")
+}
+
+func (c *MockAcrClient) ListManifests(ctx context.Context, name string, options *azcontainerregistry.ClientListManifestsOptions) (azcontainerregistry.ClientListManifestsResponse, error) {
+	c.listImageRequests = append(c.listImageRequests, *options)
+
+	if name != "existing-image" {
+		return azcontainerregistry.ClientListManifestsResponse{}, notFound("NAME_UNKNOWN")
+	}
+	if options.Last == nil {
+		return azcontainerregistry.ClientListManifestsResponse{
+			Manifests: azcontainerregistry.Manifests{
+				Attributes: []*azcontainerregistry.ManifestAttributes{
+					{
+						Digest:    to.Ptr("sha256:1234"),
+						Size:      to.Ptr(int64(123456)),
+						CreatedOn: to.Ptr(timestamp()),
+						Tags:      []*string{to.Ptr("tag"), to.Ptr("latest")},
+					},
+				},
+			},
+			Link: to.Ptr("/acr/v1/existing-image/_manifests?last=sha256:1234&n=1000"),
+		}, nil
+	}
+	if *options.Last == "sha256:1234" {
+		return azcontainerregistry.ClientListManifestsResponse{
+			Manifests: azcontainerregistry.Manifests{
+				Attributes: []*azcontainerregistry.ManifestAttributes{
+					// Ignored
+					{
+						Size: to.Ptr(int64(1)),
+						Tags: []*string{nil},
+					},
+					{
+						Digest:    to.Ptr("sha256:5678"),
+						Size:      to.Ptr(int64(789)),
+						CreatedOn: to.Ptr(timestamp()),
+					},
+				},
+			},
+		}, nil
+	}
+
+	panic("ERROR")
+}
+
+func (c *MockAcrClient) DeleteRepository(ctx context.Context, name string, options *azcontainerregistry.ClientDeleteRepositoryOptions) (azcontainerregistry.ClientDeleteRepositoryResponse, error) {
+	c.deleteRepoRequests = append(c.deleteRepoRequests, name)
+
+	if name == "existing-image" {
+		return azcontainerregistry.ClientDeleteRepositoryResponse{}, nil
+	}
+	c.deleteRepoNoops++
+	return azcontainerregistry.ClientDeleteRepositoryResponse{}, notFound("NAME_UNKNOWN")
+}
+
+func (c *MockAcrClient) DeleteTag(ctx context.Context, name string, tag string, options *azcontainerregistry.ClientDeleteTagOptions) (azcontainerregistry.ClientDeleteTagResponse, error) {
+	c.deleteTagRequests = append(c.deleteTagRequests, fmt.Sprintf("%s:%s", name, tag))
+
+	if name == "existing-image" && tag == "tag" {
+		return azcontainerregistry.ClientDeleteTagResponse{}, nil
+	}
+	c.deleteTagNoops++
+	if name == "existing-image" {
+		return azcontainerregistry.ClientDeleteTagResponse{}, notFound("TAG_UNKNOWN")
+	}
+	return azcontainerregistry.ClientDeleteTagResponse{}, notFound("NAME_UNKNOWN")
+}
+
+func (c *MockAcrClient) ExchangeAADAccessTokenForACRRefreshToken(ctx context.Context, grantType azcontainerregistry.PostContentSchemaGrantType, service string, options *azcontainerregistry.AuthenticationClientExchangeAADAccessTokenForACRRefreshTokenOptions) (azcontainerregistry.AuthenticationClientExchangeAADAccessTokenForACRRefreshTokenResponse, error) {
+	c.exchangeRequests = append(c.exchangeRequests, *options)
+
+	if grantType != azcontainerregistry.PostContentSchemaGrantTypeAccessToken || service != loginServer || *options.AccessToken != "aad-token" {
+		return azcontainerregistry.AuthenticationClientExchangeAADAccessTokenForACRRefreshTokenResponse{}, &azcore.ResponseError{StatusCode: http.StatusUnauthorized}
+	}
+
+	// Unsigned JWT, only the exp claim is read
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, timestamp().Unix())))
+	return azcontainerregistry.AuthenticationClientExchangeAADAccessTokenForACRRefreshTokenResponse{
+		ACRRefreshToken: azcontainerregistry.ACRRefreshToken{
+			RefreshToken: to.Ptr("eyJhbGciOiJub25lIn0." + payload + ".sig"),
+		},
+	}, nil
+}
+
+func (c *MockCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{
+		Token:     "aad-token",
+		ExpiresOn: timestamp().Add(-time.Hour),
+	}, nil
+}
+
+func (e *MockAcrClient) assertCounts(t *testing.T, expected map[string]int) {
+	countRequests := map[string]int{
+		"listRepos":    len(e.listRepoRequests),
+		"getRepos":     len(e.getRepoRequests),
+		"getTags":      len(e.getTagRequests),
+		"getManifests": len(e.getManifestRequests),
+		"listImages":   len(e.listImageRequests),
+		"deleteRepos":  len(e.deleteRepoRequests),
+		"deleteTags":   len(e.deleteTagRequests),
+		"exchanges":    len(e.exchangeRequests),
+	}
+	for k, v := range countRequests {
+		e := 0
+		if val, ok := expected[k]; ok {
+			e = val
+			delete(expected, k)
+		}
+		if v != e {
+			t.Errorf("Expected %d %s requests: %d", e, k, v)
+		}
+	}
+
+	countNoops := map[string]int{
+		"deleteNoops":    e.deleteRepoNoops,
+		"deleteTagNoops": e.deleteTagNoops,
+	}
+	for k, v := range countNoops {
+		e := 0
+		if val, ok := expected[k]; ok {
+			e = val
+			delete(expected, k)
+		}
+		if v != e {
+			t.Errorf("Expected %d %s: %d", e, k, v)
+		}
+	}
+
+	if len(expected) > 0 {
+		t.Errorf("Invalid expected counts: %v", expected)
+	}
+}
+
+func request(t *testing.T, method string, path string) (MockAcrClient, *http.Response, []byte, error) {
+	acrClient := MockAcrClient{}
+	a := &acrHandler{
+		loginServer: loginServer,
+		client:      &acrClient,
+		authClient:  &acrClient,
+		credential:  &MockCredential{},
+	}
+	s := &common.RegistryServer{
+		Client: a,
+	}
+
+	req := httptest.NewRequest(method, path, http.NoBody)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+	data, err := io.ReadAll(w.Result().Body)
+	return acrClient, res, data, err
+}
+
+// Tests
+
+func TestListRepos(t *testing.T) {
+	acrClient, res, data, err := request(t, "GET", "/repos/")
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+	}
+
+	acrClient.assertCounts(t, map[string]int{
+		"listRepos": 2,
+	})
+
+	var result []common.Repository
+	err2 := json.Unmarshal(data, &result)
+	if err2 != nil {
+		t.Errorf("Unexpected error: %v", err2)
+	}
+
+	if len(result) != 2 {
+		t.Fatalf("Expected 2 items: %v", result)
+	}
+	if result[0].Name != "existing-image" || result[0].URI != loginServer+"/existing-image" {
+		t.Errorf("Expected 'existing-image': %v", result[0])
+	}
+	if result[1].Name != "nested/image" || result[1].URI != loginServer+"/nested/image" {
+		t.Errorf("Expected 'nested/image': %v", result[1])
+	}
+}
+
+func TestListPaged(t *testing.T) {
+	testCases := []struct {
+		query             string
+		expectedStatus    int
+		expectedNames     []string
+		expectedNextToken string
+	}{
+		{"?limit=1", 200, []string{"existing-image"}, "existing-image"},
+		{"?page_token=existing-image", 200, []string{"nested/image"}, ""},
+		{"?limit=5000&page_token=existing-image", 200, []string{"nested/image"}, ""},
+		{"?limit=0", 400, nil, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			acrClient, res, data, err := request(t, "GET", "/repos/"+tc.query)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != tc.expectedStatus {
+				t.Errorf("Expected StatusCode %v: %v", tc.expectedStatus, res.StatusCode)
+			}
+			if tc.expectedStatus != 200 {
+				acrClient.assertCounts(t, map[string]int{})
+				return
+			}
+
+			acrClient.assertCounts(t, map[string]int{
+				"listRepos": 1,
+			})
+			if n := *acrClient.listRepoRequests[0].MaxNum; n < 1 || n > listPageSize {
+				t.Errorf("Unexpected page size: %d", n)
+			}
+			if res.Header.Get(common.NextPageTokenHeader) != tc.expectedNextToken {
+				t.Errorf("Expected next page token '%v': %v", tc.expectedNextToken, res.Header.Get(common.NextPageTokenHeader))
+			}
+
+			var result []common.Repository
+			err2 := json.Unmarshal(data, &result)
+			if err2 != nil {
+				t.Errorf("Unexpected error: %v", err2)
+			}
+			names := []string{}
+			for _, repo := range result {
+				names = append(names, repo.Name)
+			}
+			if !reflect.DeepEqual(names, tc.expectedNames) {
+				t.Errorf("Expected %v: %v", tc.expectedNames, names)
+			}
+		})
+	}
+}
+
+func TestGetRepo(t *testing.T) {
+	testCases := []struct {
+		imageName          string
+		expectedStatusCode int
+	}{
+		{"existing-image", 200},
+		{"new-image", 404},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v", tc.imageName, tc.expectedStatusCode), func(t *testing.T) {
+			acrClient, res, data, err := request(t, "GET", "/repo/"+tc.imageName)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != tc.expectedStatusCode {
+				t.Errorf("Expected StatusCode %v: %v", tc.expectedStatusCode, res.StatusCode)
+			}
+
+			acrClient.assertCounts(t, map[string]int{
+				"getRepos": 1,
+			})
+
+			if tc.expectedStatusCode == 200 {
+				var result common.Repository
+				err2 := json.Unmarshal(data, &result)
+				if err2 != nil {
+					t.Errorf("Unexpected error: %v", err2)
+				}
+
+				if result.Name != "existing-image" || result.URI != loginServer+"/existing-image" || !result.Created.Equal(timestamp()) || *result.ImageCount != 2 {
+					t.Errorf("Expected 'existing-image': %v", result)
+				}
+			} else if string(data) != "null\n" {
+				t.Errorf("Expected 'null': %v", string(data))
+			}
+		})
+	}
+}
+
+func TestGetImage(t *testing.T) {
+	testCases := []struct {
+		imageName          string
+		tag                string
+		expectedStatusCode int
+	}{
+		{"existing-image", "tag", 200},
+		{"existing-image", "new-tag", 404},
+		{"new-image", "tag", 404},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v", tc.tag, tc.expectedStatusCode), func(t *testing.T) {
+			acrClient, res, data, err := request(t, "GET", fmt.Sprintf("/image/%s:%s", tc.imageName, tc.tag))
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != tc.expectedStatusCode {
+				t.Errorf("Expected StatusCode %v: %v", tc.expectedStatusCode, res.StatusCode)
+			}
+
+			if tc.expectedStatusCode == 200 {
+				acrClient.assertCounts(t, map[string]int{
+					"getTags":      1,
+					"getManifests": 1,
+				})
+
+				var result common.Image
+				err2 := json.Unmarshal(data, &result)
+				if err2 != nil {
+					t.Errorf("Unexpected error: %v", err2)
+				}
+
+				if result.Repository != "existing-image" || result.Tag != "tag" || result.Digest != "sha256:abcdef" || result.SizeBytes != 123456 || !result.PushedAt.Equal(timestamp()) {
+					t.Errorf("Expected 'existing-image': %v", result)
+				}
+			} else {
+				acrClient.assertCounts(t, map[string]int{
+					"getTags": 1,
+				})
+
+				if string(data) != "null\n" {
+					t.Errorf("Expected 'null': %v", string(data))
+				}
+			}
+		})
+	}
+}
+
+func TestListImages(t *testing.T) {
+	{
+		acrClient, res, data, err := request(t, "GET", "/images/existing-image")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 200 {
+			t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+		}
+
+		acrClient.assertCounts(t, map[string]int{
+			"listImages": 2,
+		})
+
+		var result []common.Image
+		err2 := json.Unmarshal(data, &result)
+		if err2 != nil {
+			t.Errorf("Unexpected error: %v", err2)
+		}
+
+		if len(result) != 3 {
+			t.Fatalf("Expected 3 items: %v", result)
+		}
+		for i, tag := range []string{"tag", "latest"} {
+			if result[i].Repository != "existing-image" || result[i].Tag != tag || result[i].Digest != "sha256:1234" || result[i].SizeBytes != 123456 || !result[i].PushedAt.Equal(timestamp()) {
+				t.Errorf("Unexpected image: %v", result[i])
+			}
+		}
+		if result[2].Tag != "" || result[2].Digest != "sha256:5678" || result[2].SizeBytes != 789 {
+			t.Errorf("Expected untagged image: %v", result[2])
+		}
+	}
+
+	{
+		acrClient, res, data, err := request(t, "GET", "/images/new-image")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 404 {
+			t.Errorf("Expected StatusCode 404: %v", res.StatusCode)
+		}
+
+		acrClient.assertCounts(t, map[string]int{
+			"listImages": 1,
+		})
+
+		if string(data) != "null\n" {
+			t.Errorf("Expected 'null': %v", string(data))
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	testCases := []struct {
+		imageName string
+	}{
+		{"existing-image"},
+		{"new-image"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.imageName, func(t *testing.T) {
+			acrClient, res, data, err := request(t, "POST", "/repo/"+tc.imageName)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != 200 {
+				t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+			}
+
+			acrClient.assertCounts(t, map[string]int{
+				"getRepos": 1,
+			})
+
+			var result common.Repository
+			err2 := json.Unmarshal(data, &result)
+			if err2 != nil {
+				t.Errorf("Unexpected error: %v", err2)
+			}
+
+			if result.Name != tc.imageName || result.URI != loginServer+"/"+tc.imageName {
+				t.Errorf("Expected '%v': %v", tc.imageName, result)
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	testCases := []struct {
+		imageName string
+		delete    bool
+	}{
+		{"existing-image", true},
+		{"new-image", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v", tc.imageName, tc.delete), func(t *testing.T) {
+			acrClient, res, _, err := request(t, "DELETE", "/repo/"+tc.imageName)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != 200 {
+				t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+			}
+
+			if tc.delete {
+				acrClient.assertCounts(t, map[string]int{
+					"deleteRepos": 1,
+				})
+			} else {
+				acrClient.assertCounts(t, map[string]int{
+					"deleteRepos": 1,
+					"deleteNoops": 1,
+				})
+			}
+		})
+	}
+}
+
+func TestDeleteImage(t *testing.T) {
+	testCases := []struct {
+		imageName string
+		tag       string
+		delete    bool
+	}{
+		{"existing-image", "tag", true},
+		{"existing-image", "new-tag", false},
+		{"new-image", "tag", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v,%v", tc.imageName, tc.tag, tc.delete), func(t *testing.T) {
+			acrClient, res, _, err := request(t, "DELETE", fmt.Sprintf("/image/%s:%s", tc.imageName, tc.tag))
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != 200 {
+				t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+			}
+
+			if tc.delete {
+				acrClient.assertCounts(t, map[string]int{
+					"deleteTags": 1,
+				})
+			} else {
+				acrClient.assertCounts(t, map[string]int{
+					"deleteTags":     1,
+					"deleteTagNoops": 1,
+				})
+			}
+		})
+	}
+}
+
+func TestToken(t *testing.T) {
+	acrClient, res, data, err := request(t, "POST", "/token/existing-image:tag")
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+	}
+
+	acrClient.assertCounts(t, map[string]int{
+		"exchanges": 1,
+	})
+
+	var result map[string]string
+	err2 := json.Unmarshal(data, &result)
+	if err2 != nil {
+		t.Errorf("Unexpected error: %v", err2)
+	}
+
+	expected := map[string]string{
+		"username": "00000000-0000-0000-0000-000000000000",
+		"expires":  "2023-01-01T12:34:56Z",
+		"registry": "https://example.azurecr.io",
+	}
+	for k, v := range expected {
+		if result[k] != v {
+			t.Errorf("Expected %s=%s: %v", k, v, result[k])
+		}
+	}
+	if result["password"] == "" {
+		t.Errorf("Expected password: %v", result)
+	}
+}
+
+func TestJwtExpiry(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"exp":1672576496}`))
+	expires, err := jwtExpiry("header." + payload + ".signature")
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if !expires.Equal(timestamp()) {
+		t.Errorf("Expected %v: %v", timestamp(), expires)
+	}
+
+	_, err = jwtExpiry("invalid")
+	if err == nil {
+		t.Errorf("Expected error: %v", err)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	acrClient := MockAcrClient{}
+	a := &acrHandler{
+		loginServer: loginServer,
+		client:      &acrClient,
+	}
+	err := a.HealthCheck(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acrClient.listRepoRequests) != 1 || *acrClient.listRepoRequests[0].MaxNum != 1 {
+		t.Errorf("Unexpected requests: %v", acrClient.listRepoRequests)
+	}
+}
@@ -0,0 +1,71 @@
+package azure
+
+import (
+	"context"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/containers/azcontainerregistry"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// timeoutAcrClient wraps an IAcrClient to apply a timeout to every call
+type timeoutAcrClient struct {
+	client  IAcrClient
+	timeout time.Duration
+}
+
+func (c *timeoutAcrClient) ListRepositories(ctx context.Context, options *azcontainerregistry.ClientListRepositoriesOptions) (azcontainerregistry.ClientListRepositoriesResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.ListRepositories(ctx, options)
+}
+
+func (c *timeoutAcrClient) GetRepositoryProperties(ctx context.Context, name string, options *azcontainerregistry.ClientGetRepositoryPropertiesOptions) (azcontainerregistry.ClientGetRepositoryPropertiesResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.GetRepositoryProperties(ctx, name, options)
+}
+
+func (c *timeoutAcrClient) GetTagProperties(ctx context.Context, name string, tag string, options *azcontainerregistry.ClientGetTagPropertiesOptions) (azcontainerregistry.ClientGetTagPropertiesResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.GetTagProperties(ctx, name, tag, options)
+}
+
+func (c *timeoutAcrClient) ListManifests(ctx context.Context, name string, options *azcontainerregistry.ClientListManifestsOptions) (azcontainerregistry.ClientListManifestsResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.ListManifests(ctx, name, options)
+}
+
+func (c *timeoutAcrClient) DeleteRepository(ctx context.Context, name string, options *azcontainerregistry.ClientDeleteRepositoryOptions) (azcontainerregistry.ClientDeleteRepositoryResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.DeleteRepository(ctx, name, options)
+}
+
+func (c *timeoutAcrClient) DeleteTag(ctx context.Context, name string, tag string, options *azcontainerregistry.ClientDeleteTagOptions) (azcontainerregistry.ClientDeleteTagResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.DeleteTag(ctx, name, tag, options)
+}
+
+func (c *timeoutAcrClient) GetManifestProperties(ctx context.Context, name string, digest string, options *azcontainerregistry.ClientGetManifestPropertiesOptions) (azcontainerregistry.ClientGetManifestPropertiesResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.GetManifestProperties(ctx, name, digest, options)
+}
+
+// timeoutAcrAuthenticationClient wraps an IAcrAuthenticationClient to apply a
+// timeout to every call
+type timeoutAcrAuthenticationClient struct {
+	client  IAcrAuthenticationClient
+	timeout time.Duration
+}
+
+func (c *timeoutAcrAuthenticationClient) ExchangeAADAccessTokenForACRRefreshToken(ctx context.Context, grantType azcontainerregistry.PostContentSchemaGrantType, service string, options *azcontainerregistry.AuthenticationClientExchangeAADAccessTokenForACRRefreshTokenOptions) (azcontainerregistry.AuthenticationClientExchangeAADAccessTokenForACRRefreshTokenResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.ExchangeAADAccessTokenForACRRefreshToken(ctx, grantType, service, options)
+}
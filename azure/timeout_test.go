@@ -0,0 +1,62 @@
+package azure
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/containers/azcontainerregistry"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// slowAcrClient blocks GetRepositoryProperties until the context is done
+type slowAcrClient struct {
+	MockAcrClient
+}
+
+func (c *slowAcrClient) GetRepositoryProperties(ctx context.Context, name string, options *azcontainerregistry.ClientGetRepositoryPropertiesOptions) (azcontainerregistry.ClientGetRepositoryPropertiesResponse, error) {
+	<-ctx.Done()
+	return azcontainerregistry.ClientGetRepositoryPropertiesResponse{}, ctx.Err()
+}
+
+func TestTimeout(t *testing.T) {
+	testCases := []struct {
+		client             IAcrClient
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{&slowAcrClient{}, 504, `{"error": "upstream timeout"}` + "\n"},
+		{&MockAcrClient{}, 200, ""},
+	}
+
+	for _, tc := range testCases {
+		a := &acrHandler{
+			loginServer: loginServer,
+			client:      &timeoutAcrClient{client: tc.client, timeout: 10 * time.Millisecond},
+		}
+		s := &common.RegistryServer{
+			Client: a,
+		}
+
+		req := httptest.NewRequest("GET", "/repo/existing-image", http.NoBody)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != tc.expectedStatusCode {
+			t.Errorf("Expected StatusCode %d: %d", tc.expectedStatusCode, res.StatusCode)
+		}
+		if tc.expectedBody != "" && string(data) != tc.expectedBody {
+			t.Errorf("Unexpected body: %s", data)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	_ "github.com/manics/binderhub-container-registry-helper/azure"
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+var (
+	// Version is set at build time using the Git repository metadata
+	Version string
+)
+
+// The main entrypoint for the service
+func run(args []string) {
+	versionInfo := map[string]string{
+		"version": Version,
+	}
+
+	err := common.RunProvider("azure", versionInfo, args)
+	if err != nil {
+		slog.Error("Failed to run", "error", err)
+		os.Exit(1)
+	}
+}
+
+func main() {
+	run(os.Args[1:])
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+	_ "github.com/manics/binderhub-container-registry-helper/google"
+)
+
+var (
+	// Version is set at build time using the Git repository metadata
+	Version string
+)
+
+// The main entrypoint for the service
+func run(args []string) {
+	versionInfo := map[string]string{
+		"version": Version,
+	}
+
+	err := common.RunProvider("google", versionInfo, args)
+	if err != nil {
+		slog.Error("Failed to run", "error", err)
+		os.Exit(1)
+	}
+}
+
+func main() {
+	run(os.Args[1:])
+}
@@ -1,14 +1,11 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
 
 	"github.com/manics/binderhub-container-registry-helper/common"
-	"github.com/manics/binderhub-container-registry-helper/oracle"
-
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/collectors"
+	_ "github.com/manics/binderhub-container-registry-helper/oracle"
 )
 
 var (
@@ -18,23 +15,15 @@ var (
 
 // The main entrypoint for the service
 func run(args []string) {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-
 	versionInfo := map[string]string{
 		"version": Version,
 	}
 
-	// Custom Prometheus registry to disable default go metrics
-	promRegistry := prometheus.NewRegistry()
-	promRegistry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
-
-	registryH, err := oracle.Setup(promRegistry, args)
+	err := common.RunProvider("oracle", versionInfo, args)
 	if err != nil {
-		log.Fatalf("ERROR: %s", err)
+		slog.Error("Failed to run", "error", err)
+		os.Exit(1)
 	}
-
-	listen := "0.0.0.0:8080"
-	common.Run(registryH, versionInfo, listen, promRegistry)
 }
 
 func main() {
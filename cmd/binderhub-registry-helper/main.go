@@ -0,0 +1,65 @@
+// binderhub-registry-helper runs any of the supported registry providers,
+// selected with --provider or the REGISTRY_PROVIDER environment variable
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	_ "github.com/manics/binderhub-container-registry-helper/amazon"
+	_ "github.com/manics/binderhub-container-registry-helper/azure"
+	"github.com/manics/binderhub-container-registry-helper/common"
+	_ "github.com/manics/binderhub-container-registry-helper/distribution"
+	_ "github.com/manics/binderhub-container-registry-helper/google"
+	_ "github.com/manics/binderhub-container-registry-helper/harbor"
+	_ "github.com/manics/binderhub-container-registry-helper/oracle"
+)
+
+var (
+	// Version is set at build time using the Git repository metadata
+	Version string
+)
+
+// parseArgs returns the provider and the remaining provider arguments
+func parseArgs(args []string) (string, []string, error) {
+	flags := flag.NewFlagSet("binderhub-registry-helper", flag.ContinueOnError)
+	provider := flags.String("provider", os.Getenv(common.PROVIDER_ENV_VAR),
+		fmt.Sprintf("Registry provider, one of: %s (default $%s)", strings.Join(common.Providers(), ", "), common.PROVIDER_ENV_VAR))
+	err := flags.Parse(args)
+	if err != nil {
+		return "", nil, err
+	}
+	if *provider == "" {
+		return "", nil, errors.New("--provider or " + common.PROVIDER_ENV_VAR + " is required")
+	}
+	return *provider, flags.Args(), nil
+}
+
+// The main entrypoint for the service
+func run(args []string) {
+	provider, providerArgs, err := parseArgs(args)
+	if err != nil {
+		slog.Error("Failed to run", "error", err)
+		os.Exit(1)
+	}
+
+	versionInfo := map[string]string{
+		"version":  Version,
+		"provider": provider,
+	}
+
+	err = common.RunProvider(provider, versionInfo, providerArgs)
+	if err != nil {
+		slog.Error("Failed to run", "error", err)
+		os.Exit(1)
+	}
+}
+
+func main() {
+	run(os.Args[1:])
+}
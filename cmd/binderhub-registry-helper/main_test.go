@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+func TestProvidersRegistered(t *testing.T) {
+	expected := []string{"amazon", "azure", "distribution", "google", "harbor", "oracle"}
+	if names := common.Providers(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v: %v", expected, names)
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	testCases := []struct {
+		env              string
+		args             []string
+		expectedProvider string
+		expectedArgs     []string
+		shouldError      bool
+	}{
+		{"", []string{"--provider", "oracle", "oci-config"}, "oracle", []string{"oci-config"}, false},
+		{"amazon", []string{}, "amazon", []string{}, false},
+		{"amazon", []string{"--provider=google"}, "google", []string{}, false},
+		{"", []string{}, "", nil, true},
+		{"", []string{"--unknown"}, "", nil, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expectedProvider, func(t *testing.T) {
+			t.Setenv(common.PROVIDER_ENV_VAR, tc.env)
+
+			provider, args, err := parseArgs(tc.args)
+			if tc.shouldError {
+				if err == nil {
+					t.Errorf("Expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if provider != tc.expectedProvider || !reflect.DeepEqual(args, tc.expectedArgs) {
+				t.Errorf("Expected %s %v: %s %v", tc.expectedProvider, tc.expectedArgs, provider, args)
+			}
+		})
+	}
+}
@@ -0,0 +1,500 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	AUDIT_LOG_ENV_VAR               = "AUDIT_LOG"
+	AUDIT_LOG_MAX_SIZE_MB_ENV_VAR   = "AUDIT_LOG_MAX_SIZE_MB"
+	AUDIT_LOG_MAX_FILES_ENV_VAR     = "AUDIT_LOG_MAX_FILES"
+	AUDIT_LOG_WEBHOOK_TOKEN_ENV_VAR = "AUDIT_LOG_WEBHOOK_TOKEN"
+)
+
+const (
+	defaultAuditLogMaxSizeMB = 100
+	defaultAuditLogMaxFiles  = 5
+)
+
+// Records waiting to be sent to the webhook, if the buffer is full records are
+// dropped
+const (
+	auditWebhookBuffer  = 1000
+	auditWebhookTimeout = 5 * time.Second
+)
+
+var auditRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "audit_records_total",
+	Help:      "Total number of audit records by action and outcome.",
+}, []string{"action", "outcome"})
+
+var auditSinkErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "audit_sink_errors_total",
+	Help:      "Total number of audit records that couldn't be written.",
+})
+
+// Audited actions
+const (
+	AuditCreateRepository = "create_repository"
+	AuditDeleteRepository = "delete_repository"
+	AuditDeleteImage      = "delete_image"
+	AuditGetToken         = "get_token"
+)
+
+// Audit outcomes
+const (
+	AuditSuccess = "success"
+	// The caller isn't allowed to make the request
+	AuditDenied = "denied"
+	AuditFailed = "failed"
+	// The action would have been taken by a background task in dry-run mode
+	AuditDryRun = "dry_run"
+)
+
+// AuditRecord is a record of a mutating or credential-issuing request.
+// Request and response bodies are never recorded so it can't contain
+// passwords.
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id"`
+	Caller     string    `json:"caller"`
+	ClientIP   string    `json:"client_ip"`
+	Method     string    `json:"method"`
+	Route      string    `json:"route"`
+	Action     string    `json:"action"`
+	Repository string    `json:"repository,omitempty"`
+	Tag        string    `json:"tag,omitempty"`
+	Provider   string    `json:"provider"`
+	Outcome    string    `json:"outcome"`
+	Status     int       `json:"status,omitempty"` // 0 for dry-run records
+	// Request IDs returned by the registry API, only available for Amazon
+	// and Oracle
+	UpstreamRequestIDs []string `json:"upstream_request_ids,omitempty"`
+}
+
+// AuditSink writes audit records
+type AuditSink interface {
+	Write(record AuditRecord) error
+	Close() error
+}
+
+// writerSink writes JSON lines to a writer such as stdout
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink returns an AuditSink that writes JSON lines to w
+func NewWriterSink(w io.Writer) AuditSink {
+	return &writerSink{w: w}
+}
+
+func (s *writerSink) Write(record AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.NewEncoder(s.w).Encode(record)
+}
+
+func (s *writerSink) Close() error {
+	return nil
+}
+
+// fileSink writes JSON lines to a file. When the file reaches maxSize it's
+// renamed to filename.1, and older files are renamed to filename.2 etc up to
+// filename.{maxFiles}.
+type fileSink struct {
+	filename string
+	maxSize  int64
+	maxFiles int
+
+	mu sync.Mutex
+	// nil if the file couldn't be reopened, it's retried on the next write
+	f    *os.File
+	size int64
+}
+
+// NewFileSink returns an AuditSink that writes JSON lines to filename
+func NewFileSink(filename string, maxSize int64, maxFiles int) (AuditSink, error) {
+	s := &fileSink{
+		filename: filename,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f = f
+	s.size = info.Size()
+	return nil
+}
+
+// rotate renames the current file and opens a new one. s.f is nil afterwards
+// if this fails, and Write reopens the current file.
+func (s *fileSink) rotate() error {
+	err := s.f.Close()
+	s.f = nil
+	if err != nil {
+		return err
+	}
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", s.filename, i), fmt.Sprintf("%s.%d", s.filename, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if s.maxFiles > 0 {
+		err = os.Rename(s.filename, s.filename+".1")
+	} else {
+		err = os.Remove(s.filename)
+	}
+	if err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileSink) Write(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f != nil && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		err = s.rotate()
+		if err != nil {
+			// Keep writing to the current file, rotation is retried on the
+			// next write
+			slog.Error("Failed to rotate audit log", "error", err)
+		}
+	}
+	if s.f == nil {
+		err = s.open()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// webhookSink POSTs each record as JSON to a URL. Records are sent in the
+// background so a slow webhook doesn't delay requests.
+type webhookSink struct {
+	url    string
+	token  string
+	client *http.Client
+
+	// Guards records so requests still running after a shutdown timeout
+	// can't send on a closed channel
+	mu      sync.Mutex
+	closed  bool
+	records chan AuditRecord
+	done    chan struct{}
+}
+
+// NewWebhookSink returns an AuditSink that POSTs records to url, with token
+// as a bearer token if it's set
+func NewWebhookSink(url string, token string) AuditSink {
+	s := &webhookSink{
+		url:     url,
+		token:   token,
+		client:  &http.Client{Timeout: auditWebhookTimeout},
+		records: make(chan AuditRecord, auditWebhookBuffer),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *webhookSink) run() {
+	defer close(s.done)
+	for record := range s.records {
+		err := s.send(record)
+		if err != nil {
+			auditSinkErrors.Inc()
+			slog.Error("Failed to send audit record", "error", err, "request_id", record.RequestID)
+		}
+	}
+}
+
+func (s *webhookSink) send(record AuditRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("audit webhook returned %s", res.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) Write(record AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("audit webhook closed")
+	}
+	select {
+	case s.records <- record:
+		return nil
+	default:
+		return errors.New("audit webhook buffer full")
+	}
+}
+
+// Close sends any buffered records
+func (s *webhookSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.records)
+	s.mu.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(auditWebhookTimeout):
+		return errors.New("timed out sending audit records")
+	}
+}
+
+// AuditLog writes a record of each mutating or credential-issuing request
+type AuditLog struct {
+	provider string
+	sink     AuditSink
+}
+
+// NewAuditLog returns an AuditLog writing records for provider to sink
+func NewAuditLog(provider string, sink AuditSink) *AuditLog {
+	return &AuditLog{
+		provider: provider,
+		sink:     sink,
+	}
+}
+
+// Close flushes and closes the sink
+func (a *AuditLog) Close() error {
+	return a.sink.Close()
+}
+
+func (a *AuditLog) write(ctx context.Context, record AuditRecord) {
+	auditRecords.WithLabelValues(record.Action, record.Outcome).Inc()
+	err := a.sink.Write(record)
+	if err != nil {
+		auditSinkErrors.Inc()
+		slog.ErrorContext(ctx, "Failed to write audit record", "error", err)
+	}
+}
+
+// auditState collects details of an audited request that are only known to
+// inner handlers: the caller identity and the request IDs of calls to the
+// registry API
+type auditState struct {
+	mu          sync.Mutex
+	caller      string
+	upstreamIDs []string
+}
+
+func (s *auditState) get() (string, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.caller, s.upstreamIDs
+}
+
+// setAuditCaller records the caller identity if the request is being audited
+func setAuditCaller(ctx context.Context, identity string) {
+	state, ok := ctx.Value(auditStateKey).(*auditState)
+	if !ok {
+		return
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.caller = identity
+}
+
+// addUpstreamRequestID records an upstream request ID if the request is
+// being audited
+func addUpstreamRequestID(ctx context.Context, requestID string) {
+	state, ok := ctx.Value(auditStateKey).(*auditState)
+	if !ok || requestID == "" {
+		return
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.upstreamIDs = append(state.upstreamIDs, requestID)
+}
+
+// auditAction returns the audited action for a request, or "" if the request
+// isn't audited
+func auditAction(r *http.Request) string {
+	switch {
+	case r.Method == http.MethodPost && repoRe.MatchString(r.URL.Path):
+		return AuditCreateRepository
+	case r.Method == http.MethodDelete && repoRe.MatchString(r.URL.Path):
+		return AuditDeleteRepository
+	case r.Method == http.MethodDelete && imageRe.MatchString(r.URL.Path):
+		return AuditDeleteImage
+	case r.Method == http.MethodPost && tokenRe.MatchString(r.URL.Path):
+		return AuditGetToken
+	default:
+		return ""
+	}
+}
+
+func auditOutcome(status int) string {
+	switch {
+	case status < 400:
+		return AuditSuccess
+	case status == http.StatusUnauthorized || status == http.StatusForbidden || status == http.StatusTooManyRequests:
+		return AuditDenied
+	default:
+		return AuditFailed
+	}
+}
+
+// clientIP returns the IP address of the client connection, X-Forwarded-For
+// is ignored since it can be set by the client
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// auditMiddleware wraps originalHandler to write an audit record for each
+// mutating or credential-issuing request. It must wrap CheckAuthorised so
+// requests that fail authentication are recorded, CheckAuthorised records the
+// caller identity.
+func auditMiddleware(originalHandler http.Handler, audit *AuditLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := auditAction(r)
+		if action == "" {
+			originalHandler.ServeHTTP(w, r)
+			return
+		}
+
+		state := &auditState{}
+		ctx := context.WithValue(r.Context(), auditStateKey, state)
+		rw := statusRecorder{w, 0}
+		originalHandler.ServeHTTP(&rw, r.WithContext(ctx))
+		if rw.statusCode == 0 {
+			rw.statusCode = http.StatusOK
+		}
+		caller, upstreamIDs := state.get()
+		if caller == "" {
+			caller = UnauthenticatedIdentity
+		}
+
+		route, attrs := routeAttributes(r)
+		record := AuditRecord{
+			Time:      time.Now().UTC(),
+			RequestID: RequestID(r.Context()),
+			Caller:    caller,
+			ClientIP:  clientIP(r),
+			Method:    r.Method,
+			Route:     route,
+			Action:    action,
+			Provider:  audit.provider,
+			Outcome:   auditOutcome(rw.statusCode),
+			Status:    rw.statusCode,
+		}
+		for _, attr := range attrs {
+			switch attr.Key {
+			case RepositoryAttribute:
+				record.Repository = attr.Value.AsString()
+			case TagAttribute:
+				record.Tag = attr.Value.AsString()
+			}
+		}
+		record.UpstreamRequestIDs = upstreamIDs
+		audit.write(r.Context(), record)
+	})
+}
+
+func getAuditLog(provider string) (*AuditLog, error) {
+	destination := os.Getenv(AUDIT_LOG_ENV_VAR)
+	if destination == "" {
+		return nil, nil
+	}
+	var sink AuditSink
+	switch {
+	case destination == "stdout":
+		sink = NewWriterSink(os.Stdout)
+	case strings.HasPrefix(destination, "http://") || strings.HasPrefix(destination, "https://"):
+		sink = NewWebhookSink(destination, os.Getenv(AUDIT_LOG_WEBHOOK_TOKEN_ENV_VAR))
+	default:
+		maxSizeMB, err := envvarInt(AUDIT_LOG_MAX_SIZE_MB_ENV_VAR, defaultAuditLogMaxSizeMB, 1)
+		if err != nil {
+			return nil, err
+		}
+		maxFiles, err := envvarInt(AUDIT_LOG_MAX_FILES_ENV_VAR, defaultAuditLogMaxFiles, 0)
+		if err != nil {
+			return nil, err
+		}
+		sink, err = NewFileSink(destination, int64(maxSizeMB)*1024*1024, maxFiles)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewAuditLog(provider, sink), nil
+}
@@ -0,0 +1,324 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memorySink stores audit records
+type memorySink struct {
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+func (s *memorySink) Write(record AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	sink := &memorySink{}
+	audit := NewAuditLog("test", sink)
+	h := auditMiddleware(CheckAuthorisedTokens(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		LogUpstreamCall(r.Context(), "test.Call", time.Now(), "upstream-1", nil)
+		LogUpstreamCall(r.Context(), "test.Call", time.Now(), "upstream-2", errors.New("failed"))
+		if strings.HasPrefix(r.URL.Path, "/token/") {
+			_, _ = w.Write([]byte(`{"username": "user", "password": "secret-password"}`))
+			return
+		}
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}), "secret"), audit)
+
+	for _, req := range []struct {
+		method string
+		path   string
+		token  string
+	}{
+		{"POST", "/repo/binder/name", "secret"},
+		{"GET", "/repo/binder/name", "secret"},
+		{"DELETE", "/image/binder/name:tag", "secret"},
+		{"POST", "/token/binder/name", "secret"},
+		{"DELETE", "/repo/binder/name", "invalid"},
+	} {
+		r := httptest.NewRequest(req.method, req.path, http.NoBody)
+		r.Header.Set("Authorization", "Bearer "+req.token)
+		r.RemoteAddr = "192.0.2.1:1234"
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	if len(sink.records) != 4 {
+		t.Fatalf("Expected 4 records: %v", sink.records)
+	}
+	create := sink.records[0]
+	if create.Action != AuditCreateRepository || create.Caller != BearerTokenIdentity || create.ClientIP != "192.0.2.1" ||
+		create.Route != "/repo/{repository}" || create.Repository != "binder/name" || create.Provider != "test" ||
+		create.Outcome != AuditSuccess || create.Status != http.StatusOK || create.Time.IsZero() {
+		t.Errorf("Unexpected record: %+v", create)
+	}
+	if len(create.UpstreamRequestIDs) != 2 || create.UpstreamRequestIDs[0] != "upstream-1" || create.UpstreamRequestIDs[1] != "upstream-2" {
+		t.Errorf("Unexpected upstream request IDs: %v", create.UpstreamRequestIDs)
+	}
+	deleteImage := sink.records[1]
+	if deleteImage.Action != AuditDeleteImage || deleteImage.Repository != "binder/name" || deleteImage.Tag != "tag" ||
+		deleteImage.Outcome != AuditFailed || deleteImage.Status != http.StatusNotFound {
+		t.Errorf("Unexpected record: %+v", deleteImage)
+	}
+	token := sink.records[2]
+	if token.Action != AuditGetToken || token.Outcome != AuditSuccess {
+		t.Errorf("Unexpected record: %+v", token)
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Errorf("Record contains secrets: %s", data)
+	}
+	// Requests that fail authentication are recorded
+	denied := sink.records[3]
+	if denied.Action != AuditDeleteRepository || denied.Caller != UnauthenticatedIdentity || denied.Outcome != AuditDenied ||
+		denied.Status != http.StatusForbidden || len(denied.UpstreamRequestIDs) != 0 {
+		t.Errorf("Unexpected record: %+v", denied)
+	}
+}
+
+func TestAuditOutcome(t *testing.T) {
+	for status, expected := range map[int]string{
+		http.StatusOK:                  AuditSuccess,
+		http.StatusForbidden:           AuditDenied,
+		http.StatusTooManyRequests:     AuditDenied,
+		http.StatusNotFound:            AuditFailed,
+		http.StatusInternalServerError: AuditFailed,
+	} {
+		if outcome := auditOutcome(status); outcome != expected {
+			t.Errorf("%d: expected %s got %s", status, expected, outcome)
+		}
+	}
+}
+
+func readAuditFile(t *testing.T, filename string) []AuditRecord {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []AuditRecord{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record AuditRecord
+		err = json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestFileSink(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.jsonl")
+	// Rotate after every 2 records
+	line, err := json.Marshal(AuditRecord{RequestID: "0", Action: AuditCreateRepository})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := NewFileSink(filename, int64(2*(len(line)+1)), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, requestID := range []string{"1", "2", "3", "4", "5", "6", "7"} {
+		err = sink.Write(AuditRecord{RequestID: requestID, Action: AuditCreateRepository})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		filename:        {"7"},
+		filename + ".1": {"5", "6"},
+		filename + ".2": {"3", "4"},
+	}
+	for f, requestIDs := range expected {
+		records := readAuditFile(t, f)
+		if len(records) != len(requestIDs) {
+			t.Fatalf("%s: expected %d records: %v", f, len(requestIDs), records)
+		}
+		for i, record := range records {
+			if record.RequestID != requestIDs[i] {
+				t.Errorf("%s: expected %s got %s", f, requestIDs[i], record.RequestID)
+			}
+		}
+	}
+	if _, err = os.Stat(filename + ".3"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected old audit files to be removed: %v", err)
+	}
+}
+
+func TestFileSinkRotateError(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.jsonl")
+	line, err := json.Marshal(AuditRecord{RequestID: "0", Action: AuditCreateRepository})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := NewFileSink(filename, int64(len(line)+1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file can't be renamed over a non-empty directory
+	err = os.MkdirAll(filepath.Join(filename+".1", "block"), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(requestID string) {
+		err := sink.Write(AuditRecord{RequestID: requestID, Action: AuditCreateRepository})
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", requestID, err)
+		}
+	}
+	// Records are written to the current file while rotation fails
+	write("1")
+	write("2")
+	write("3")
+	if records := readAuditFile(t, filename); len(records) != 3 {
+		t.Errorf("Expected 3 records: %v", records)
+	}
+
+	// Rotation is retried
+	err = os.RemoveAll(filename + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("4")
+	err = sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := readAuditFile(t, filename); len(records) != 1 || records[0].RequestID != "4" {
+		t.Errorf("Expected new file: %v", records)
+	}
+	if records := readAuditFile(t, filename+".1"); len(records) != 3 {
+		t.Errorf("Expected rotated file: %v", records)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var mu sync.Mutex
+	received := []AuditRecord{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer webhook-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		var record AuditRecord
+		err := json.Unmarshal(data, &record)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, record)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL, "webhook-token")
+	for _, requestID := range []string{"1", "2"} {
+		err := sink.Write(AuditRecord{RequestID: requestID})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Close waits for buffered records to be sent
+	err := sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || received[0].RequestID != "1" || received[1].RequestID != "2" {
+		t.Errorf("Unexpected records: %v", received)
+	}
+}
+
+func TestGetAuditLog(t *testing.T) {
+	audit, err := getAuditLog("test")
+	if audit != nil || err != nil {
+		t.Errorf("Expected no audit log by default: %v %v", audit, err)
+	}
+
+	t.Setenv(AUDIT_LOG_ENV_VAR, "stdout")
+	audit, err = getAuditLog("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := audit.sink.(*writerSink); !ok {
+		t.Errorf("Expected writer sink: %T", audit.sink)
+	}
+
+	t.Setenv(AUDIT_LOG_ENV_VAR, "https://audit.example.org/")
+	audit, err = getAuditLog("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := audit.sink.(*webhookSink); !ok {
+		t.Errorf("Expected webhook sink: %T", audit.sink)
+	}
+	_ = audit.Close()
+
+	t.Setenv(AUDIT_LOG_ENV_VAR, filepath.Join(t.TempDir(), "audit.jsonl"))
+	t.Setenv(AUDIT_LOG_MAX_SIZE_MB_ENV_VAR, "0")
+	_, err = getAuditLog("test")
+	if err == nil {
+		t.Errorf("Expected error for invalid %s", AUDIT_LOG_MAX_SIZE_MB_ENV_VAR)
+	}
+	t.Setenv(AUDIT_LOG_MAX_SIZE_MB_ENV_VAR, "10")
+	audit, err = getAuditLog("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink, ok := audit.sink.(*fileSink); !ok || sink.maxSize != 10*1024*1024 || sink.maxFiles != defaultAuditLogMaxFiles {
+		t.Errorf("Unexpected file sink: %+v", audit.sink)
+	}
+	_ = audit.Close()
+}
+
+func TestWebhookSinkWriteAfterClose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL, "")
+	err := sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A request still running after a shutdown timeout mustn't panic
+	err = sink.Write(AuditRecord{RequestID: "1"})
+	if err == nil {
+		t.Errorf("Expected error writing to closed sink")
+	}
+	err = sink.Close()
+	if err != nil {
+		t.Errorf("Unexpected error closing twice: %v", err)
+	}
+}
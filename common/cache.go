@@ -0,0 +1,366 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	CACHE_REPO_TTL_SECONDS_ENV_VAR            = "CACHE_REPO_TTL_SECONDS"
+	CACHE_REPO_NOT_FOUND_TTL_SECONDS_ENV_VAR  = "CACHE_REPO_NOT_FOUND_TTL_SECONDS"
+	CACHE_IMAGE_TTL_SECONDS_ENV_VAR           = "CACHE_IMAGE_TTL_SECONDS"
+	CACHE_IMAGE_NOT_FOUND_TTL_SECONDS_ENV_VAR = "CACHE_IMAGE_NOT_FOUND_TTL_SECONDS"
+	CACHE_TOKENS_ENV_VAR                      = "CACHE_TOKENS"
+)
+
+// Cached tokens are replaced this long before they expire so callers always
+// receive a token with a reasonable lifetime
+const tokenExpiryMargin = 15 * time.Minute
+
+// If the cache grows beyond this expired responses are removed, and if it's
+// still too big it's cleared
+const maxCacheEntries = 10000
+
+var cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "cache_requests_total",
+	Help:      "Total number of cacheable requests by type and result (hit or miss).",
+}, []string{"type", "result"})
+
+// CacheConfig configures how long responses are cached, 0 disables caching
+type CacheConfig struct {
+	RepositoryTTL         time.Duration
+	RepositoryNotFoundTTL time.Duration
+	ImageTTL              time.Duration
+	ImageNotFoundTTL      time.Duration
+	// Reuse tokens until shortly before they expire
+	Tokens bool
+}
+
+// CacheConfigFromEnv reads the cache configuration from environment variables
+func CacheConfigFromEnv() (CacheConfig, error) {
+	config := CacheConfig{}
+	for envVar, ttl := range map[string]*time.Duration{
+		CACHE_REPO_TTL_SECONDS_ENV_VAR:            &config.RepositoryTTL,
+		CACHE_REPO_NOT_FOUND_TTL_SECONDS_ENV_VAR:  &config.RepositoryNotFoundTTL,
+		CACHE_IMAGE_TTL_SECONDS_ENV_VAR:           &config.ImageTTL,
+		CACHE_IMAGE_NOT_FOUND_TTL_SECONDS_ENV_VAR: &config.ImageNotFoundTTL,
+	} {
+		if v := os.Getenv(envVar); v != "" {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds < 0 {
+				return config, fmt.Errorf("invalid %s: %s", envVar, v)
+			}
+			*ttl = time.Duration(seconds) * time.Second
+		}
+	}
+	if v := os.Getenv(CACHE_TOKENS_ENV_VAR); v != "" {
+		tokens, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid %s: %s", CACHE_TOKENS_ENV_VAR, v)
+		}
+		config.Tokens = tokens
+	}
+	return config, nil
+}
+
+// Enabled returns true if anything should be cached
+func (c CacheConfig) Enabled() bool {
+	return c.RepositoryTTL > 0 || c.RepositoryNotFoundTTL > 0 || c.ImageTTL > 0 || c.ImageNotFoundTTL > 0 || c.Tokens
+}
+
+// cachedResponse is a response recorded from the wrapped client. Headers
+// aren't cached since they're set by the middleware for each request.
+type cachedResponse struct {
+	status  int
+	body    []byte
+	expires time.Time
+	// Used to invalidate all responses for a repository
+	repository string
+}
+
+// teeResponseWriter writes a response and also records it
+type teeResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader records and writes the status code
+func (t *teeResponseWriter) WriteHeader(status int) {
+	if t.status == 0 {
+		t.status = status
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+// Write records and writes the body
+func (t *teeResponseWriter) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	t.body.Write(b)
+	return t.ResponseWriter.Write(b)
+}
+
+// cachingClient wraps an IRegistryClient to cache repository and image
+// lookups, and tokens.
+// Authorisation is checked by RegistryServer before the client is called so
+// cached responses are only returned to callers who are allowed to see them.
+type cachingClient struct {
+	client IRegistryClient
+	config CacheConfig
+
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+	// Incremented by invalidate. A response isn't cached if its repository
+	// was invalidated after the request started, since it may be stale.
+	generation uint64
+	// The generation when each repository was last invalidated
+	invalidated map[string]uint64
+	// Responses from requests that started before this generation aren't
+	// cached, set when invalidated is cleared
+	minGeneration uint64
+}
+
+// IRepositoryChangeNotifier is implemented by registry clients that delete
+// images outside requests, such as a retention policy, so cached responses
+// can be invalidated
+type IRepositoryChangeNotifier interface {
+	// OnRepositoryChanged sets a function to be called with the repository
+	// name after images are deleted outside a request. It's called before
+	// the service starts.
+	OnRepositoryChanged(f func(ctx context.Context, repository string))
+}
+
+// NewCachingClient returns an IRegistryClient that caches responses from
+// client
+func NewCachingClient(client IRegistryClient, config CacheConfig) IRegistryClient {
+	c := &cachingClient{
+		client:      client,
+		config:      config,
+		entries:     map[string]*cachedResponse{},
+		invalidated: map[string]uint64{},
+	}
+	if notifier, ok := client.(IRepositoryChangeNotifier); ok {
+		notifier.OnRepositoryChanged(c.invalidate)
+	}
+	return c
+}
+
+func (c *cachingClient) get(key string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry
+}
+
+// currentGeneration returns the generation to pass to set for a request that's
+// about to start
+func (c *cachingClient) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// set caches entry unless its repository was invalidated after generation
+func (c *cachingClient) set(key string, entry *cachedResponse, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation < c.minGeneration || c.invalidated[entry.repository] > generation {
+		return
+	}
+	if len(c.entries) >= maxCacheEntries {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			c.entries = map[string]*cachedResponse{}
+		}
+	}
+	c.entries[key] = entry
+}
+
+// invalidate removes all cached responses for a repository
+func (c *cachingClient) invalidate(ctx context.Context, repository string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if e.repository == repository {
+			delete(c.entries, k)
+		}
+	}
+	c.generation++
+	if len(c.invalidated) >= maxCacheEntries {
+		c.invalidated = map[string]uint64{}
+		c.minGeneration = c.generation
+	}
+	c.invalidated[repository] = c.generation
+	slog.DebugContext(ctx, "Invalidated cache", "repository", repository)
+}
+
+// serve returns the response cached under key if there is one, otherwise it
+// calls handler and caches the response for the duration returned by ttl
+func (c *cachingClient) serve(w http.ResponseWriter, r *http.Request, cacheType string, key string, repository string, handler http.HandlerFunc, ttl func(*teeResponseWriter) time.Duration) {
+	if entry := c.get(key); entry != nil {
+		cacheRequests.WithLabelValues(cacheType, "hit").Inc()
+		w.WriteHeader(entry.status)
+		_, errw := w.Write(entry.body)
+		if errw != nil {
+			slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+		}
+		return
+	}
+	cacheRequests.WithLabelValues(cacheType, "miss").Inc()
+
+	generation := c.currentGeneration()
+	tee := &teeResponseWriter{ResponseWriter: w}
+	handler(tee, r)
+	if d := ttl(tee); d > 0 {
+		c.set(key, &cachedResponse{
+			status:     tee.status,
+			body:       bytes.Clone(tee.body.Bytes()),
+			expires:    time.Now().Add(d),
+			repository: repository,
+		}, generation)
+	}
+}
+
+// statusTTL returns a TTL function that caches 200 and 404 responses
+func statusTTL(found time.Duration, notFound time.Duration) func(*teeResponseWriter) time.Duration {
+	return func(tee *teeResponseWriter) time.Duration {
+		switch tee.status {
+		case http.StatusOK:
+			return found
+		case http.StatusNotFound:
+			return notFound
+		default:
+			return 0
+		}
+	}
+}
+
+// tokenTTL caches a token until shortly before it expires
+func tokenTTL(tee *teeResponseWriter) time.Duration {
+	if tee.status != http.StatusOK {
+		return 0
+	}
+	var token RegistryToken
+	err := json.Unmarshal(tee.body.Bytes(), &token)
+	if err != nil || token.Expires.IsZero() {
+		return 0
+	}
+	return time.Until(token.Expires) - tokenExpiryMargin
+}
+
+func (c *cachingClient) ListRepositories(w http.ResponseWriter, r *http.Request) {
+	c.client.ListRepositories(w, r)
+}
+
+func (c *cachingClient) GetRepository(w http.ResponseWriter, r *http.Request) {
+	if c.config.RepositoryTTL == 0 && c.config.RepositoryNotFoundTTL == 0 {
+		c.client.GetRepository(w, r)
+		return
+	}
+	name, err := RepoGetName(r)
+	if err != nil {
+		c.client.GetRepository(w, r)
+		return
+	}
+	c.serve(w, r, "repository", r.URL.RequestURI(), name, c.client.GetRepository, statusTTL(c.config.RepositoryTTL, c.config.RepositoryNotFoundTTL))
+}
+
+func (c *cachingClient) GetImage(w http.ResponseWriter, r *http.Request) {
+	if c.config.ImageTTL == 0 && c.config.ImageNotFoundTTL == 0 {
+		c.client.GetImage(w, r)
+		return
+	}
+	name, _, err := ImageGetNameAndTag(r)
+	if err != nil {
+		c.client.GetImage(w, r)
+		return
+	}
+	c.serve(w, r, "image", r.URL.RequestURI(), name, c.client.GetImage, statusTTL(c.config.ImageTTL, c.config.ImageNotFoundTTL))
+}
+
+func (c *cachingClient) ListImages(w http.ResponseWriter, r *http.Request) {
+	c.client.ListImages(w, r)
+}
+
+func (c *cachingClient) CreateRepository(w http.ResponseWriter, r *http.Request) {
+	if name, err := RepoGetName(r); err == nil {
+		defer c.invalidate(r.Context(), name)
+	}
+	c.client.CreateRepository(w, r)
+}
+
+func (c *cachingClient) DeleteRepository(w http.ResponseWriter, r *http.Request) {
+	if name, err := RepoGetName(r); err == nil {
+		defer c.invalidate(r.Context(), name)
+	}
+	c.client.DeleteRepository(w, r)
+}
+
+func (c *cachingClient) AllRepositories(ctx context.Context) ([]Repository, error) {
+	return c.client.AllRepositories(ctx)
+}
+
+func (c *cachingClient) AllImages(ctx context.Context, repository string) ([]Image, error) {
+	return c.client.AllImages(ctx, repository)
+}
+
+func (c *cachingClient) RemoveRepository(ctx context.Context, repository string) error {
+	defer c.invalidate(ctx, repository)
+	return c.client.RemoveRepository(ctx, repository)
+}
+
+func (c *cachingClient) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	if name, _, err := ImageGetNameAndTag(r); err == nil {
+		defer c.invalidate(r.Context(), name)
+	}
+	c.client.DeleteImage(w, r)
+}
+
+func (c *cachingClient) GetToken(w http.ResponseWriter, r *http.Request) {
+	if !c.config.Tokens {
+		c.client.GetToken(w, r)
+		return
+	}
+	repository, err := TokenGetName(r)
+	if err != nil {
+		c.client.GetToken(w, r)
+		return
+	}
+	// Tokens are shared by all repositories they're valid for, and aren't
+	// invalidated when a repository changes
+	key := "/token/" + c.TokenScope(repository)
+	c.serve(w, r, "token", key, "", c.client.GetToken, tokenTTL)
+}
+
+func (c *cachingClient) TokenScope(repository string) string {
+	return tokenScope(c.client, repository)
+}
+
+func (c *cachingClient) HealthCheck(ctx context.Context) error {
+	return c.client.HealthCheck(ctx)
+}
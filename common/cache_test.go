@@ -0,0 +1,288 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// cacheTestClient returns a fixed response for each path and counts calls
+type cacheTestClient struct {
+	mockRegistryClient
+	// path: status
+	status map[string]int
+	// path: body
+	body  map[string]string
+	calls map[string]int
+	// Called after the response is chosen, e.g. to simulate a concurrent request
+	beforeRespond func()
+}
+
+func (c *cacheTestClient) respond(w http.ResponseWriter, r *http.Request) {
+	c.calls[r.URL.Path]++
+	status, ok := c.status[r.URL.Path]
+	if !ok {
+		status = http.StatusNotFound
+	}
+	if c.beforeRespond != nil {
+		c.beforeRespond()
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(c.body[r.URL.Path]))
+}
+
+func (c *cacheTestClient) GetRepository(w http.ResponseWriter, r *http.Request) {
+	c.respond(w, r)
+}
+
+func (c *cacheTestClient) GetImage(w http.ResponseWriter, r *http.Request) {
+	c.respond(w, r)
+}
+
+func (c *cacheTestClient) GetToken(w http.ResponseWriter, r *http.Request) {
+	c.respond(w, r)
+}
+
+func newCacheTestServer(config CacheConfig) (*cacheTestClient, *RegistryServer) {
+	client := &cacheTestClient{
+		status: map[string]int{
+			"/repo/existing":           http.StatusOK,
+			"/image/existing:tag":      http.StatusOK,
+			"/image/existing:error":    http.StatusInternalServerError,
+			"/token/existing":          http.StatusOK,
+			"/token/existing-expiring": http.StatusOK,
+		},
+		body: map[string]string{
+			"/repo/existing":           `{"name": "existing"}`,
+			"/token/existing":          fmt.Sprintf(`{"username": "user", "password": "password", "expires": "%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339)),
+			"/token/existing-expiring": fmt.Sprintf(`{"username": "user", "password": "password", "expires": "%s"}`, time.Now().Add(time.Minute).Format(time.RFC3339)),
+		},
+		calls: map[string]int{},
+	}
+	return client, &RegistryServer{Client: NewCachingClient(client, config)}
+}
+
+func cacheTestRequest(t *testing.T, s *RegistryServer, method string, path string) (int, string) {
+	req := httptest.NewRequest(method, path, http.NoBody)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(data)
+}
+
+func TestCacheConfigFromEnv(t *testing.T) {
+	config, err := CacheConfigFromEnv()
+	if err != nil || config.Enabled() {
+		t.Errorf("Expected caching to be disabled by default: %v %v", config, err)
+	}
+
+	t.Setenv(CACHE_REPO_TTL_SECONDS_ENV_VAR, "60")
+	t.Setenv(CACHE_TOKENS_ENV_VAR, "true")
+	config, err = CacheConfigFromEnv()
+	if err != nil || !config.Enabled() || config.RepositoryTTL != time.Minute || !config.Tokens {
+		t.Errorf("Unexpected config: %v %v", config, err)
+	}
+
+	t.Setenv(CACHE_IMAGE_TTL_SECONDS_ENV_VAR, "-1")
+	_, err = CacheConfigFromEnv()
+	if err == nil {
+		t.Errorf("Expected error for negative TTL")
+	}
+}
+
+func TestCacheRepository(t *testing.T) {
+	client, s := newCacheTestServer(CacheConfig{
+		RepositoryTTL:         time.Minute,
+		RepositoryNotFoundTTL: time.Minute,
+	})
+	hits := testutil.ToFloat64(cacheRequests.WithLabelValues("repository", "hit"))
+
+	for i := 0; i < 2; i++ {
+		status, body := cacheTestRequest(t, s, "GET", "/repo/existing")
+		if status != http.StatusOK || body != `{"name": "existing"}` {
+			t.Errorf("Unexpected response: %d %s", status, body)
+		}
+		status, _ = cacheTestRequest(t, s, "GET", "/repo/missing")
+		if status != http.StatusNotFound {
+			t.Errorf("Expected 404: %d", status)
+		}
+	}
+	if client.calls["/repo/existing"] != 1 || client.calls["/repo/missing"] != 1 {
+		t.Errorf("Expected 1 call for each repository: %v", client.calls)
+	}
+	if h := testutil.ToFloat64(cacheRequests.WithLabelValues("repository", "hit")) - hits; h != 2 {
+		t.Errorf("Expected 2 cache hits: %f", h)
+	}
+
+	// Creating or deleting a repository invalidates the cache
+	cacheTestRequest(t, s, "POST", "/repo/missing")
+	cacheTestRequest(t, s, "DELETE", "/repo/existing")
+	cacheTestRequest(t, s, "GET", "/repo/existing")
+	cacheTestRequest(t, s, "GET", "/repo/missing")
+	if client.calls["/repo/existing"] != 2 || client.calls["/repo/missing"] != 2 {
+		t.Errorf("Expected 2 calls for each repository: %v", client.calls)
+	}
+
+	// So does deleting a repository outside a request, e.g. by the reaper
+	err := s.Client.RemoveRepository(context.Background(), "existing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheTestRequest(t, s, "GET", "/repo/existing")
+	if client.calls["/repo/existing"] != 3 {
+		t.Errorf("Expected 3 calls: %v", client.calls)
+	}
+}
+
+func TestCacheImage(t *testing.T) {
+	client, s := newCacheTestServer(CacheConfig{
+		ImageTTL: time.Minute,
+	})
+
+	for i := 0; i < 2; i++ {
+		cacheTestRequest(t, s, "GET", "/image/existing:tag")
+		cacheTestRequest(t, s, "GET", "/image/existing:missing")
+		cacheTestRequest(t, s, "GET", "/image/existing:error")
+		// Repositories aren't cached
+		cacheTestRequest(t, s, "GET", "/repo/existing")
+	}
+	expected := map[string]int{
+		"/image/existing:tag":     1,
+		"/image/existing:missing": 2,
+		"/image/existing:error":   2,
+		"/repo/existing":          2,
+	}
+	for path, calls := range expected {
+		if client.calls[path] != calls {
+			t.Errorf("Expected %d calls for %s: %v", calls, path, client.calls)
+		}
+	}
+
+	// Deleting an image invalidates all images in the repository
+	cacheTestRequest(t, s, "DELETE", "/image/existing:other")
+	cacheTestRequest(t, s, "GET", "/image/existing:tag")
+	if client.calls["/image/existing:tag"] != 2 {
+		t.Errorf("Expected cache to be invalidated: %v", client.calls)
+	}
+}
+
+func TestCacheInvalidatedDuringRequest(t *testing.T) {
+	client, s := newCacheTestServer(CacheConfig{RepositoryTTL: time.Minute, RepositoryNotFoundTTL: time.Minute})
+
+	// The repository is created while the lookup is running
+	client.beforeRespond = func() {
+		cacheTestRequest(t, s, "POST", "/repo/new")
+		client.status["/repo/new"] = http.StatusOK
+	}
+	if status, _ := cacheTestRequest(t, s, "GET", "/repo/new"); status != http.StatusNotFound {
+		t.Errorf("Expected 404: %d", status)
+	}
+	client.beforeRespond = nil
+	if status, _ := cacheTestRequest(t, s, "GET", "/repo/new"); status != http.StatusOK {
+		t.Errorf("Expected stale 404 not to be cached: %d", status)
+	}
+
+	// Other repositories are still cached
+	client.beforeRespond = func() {
+		cacheTestRequest(t, s, "POST", "/repo/other")
+	}
+	cacheTestRequest(t, s, "GET", "/repo/existing")
+	client.beforeRespond = nil
+	cacheTestRequest(t, s, "GET", "/repo/existing")
+	if client.calls["/repo/existing"] != 1 {
+		t.Errorf("Expected response to be cached: %v", client.calls)
+	}
+}
+
+// notifyingTestClient deletes images outside requests
+type notifyingTestClient struct {
+	*cacheTestClient
+	changed func(ctx context.Context, repository string)
+}
+
+func (c *notifyingTestClient) OnRepositoryChanged(f func(ctx context.Context, repository string)) {
+	c.changed = f
+}
+
+func TestCacheRepositoryChanged(t *testing.T) {
+	client, _ := newCacheTestServer(CacheConfig{})
+	notifier := &notifyingTestClient{cacheTestClient: client}
+	s := &RegistryServer{Client: NewCachingClient(notifier, CacheConfig{ImageTTL: time.Minute})}
+
+	cacheTestRequest(t, s, "GET", "/image/existing:tag")
+	notifier.changed(context.Background(), "existing")
+	cacheTestRequest(t, s, "GET", "/image/existing:tag")
+	if client.calls["/image/existing:tag"] != 2 {
+		t.Errorf("Expected cache to be invalidated: %v", client.calls)
+	}
+}
+
+// projectTokensTestClient returns tokens limited to a project
+type projectTokensTestClient struct {
+	*cacheTestClient
+}
+
+func (c *projectTokensTestClient) TokenScope(repository string) string {
+	project, _, _ := strings.Cut(repository, "/")
+	return project + "/"
+}
+
+func TestCacheToken(t *testing.T) {
+	client, s := newCacheTestServer(CacheConfig{Tokens: true})
+
+	// Registry-wide tokens are shared by all repositories and tags
+	var first string
+	for i, path := range []string{"/token/existing:1", "/token/existing:2", "/token/other:1", "/token"} {
+		client.status[path] = http.StatusOK
+		client.body[path] = client.body["/token/existing"]
+		status, body := cacheTestRequest(t, s, "POST", path)
+		if i == 0 {
+			first = body
+		}
+		if status != http.StatusOK || body != first {
+			t.Errorf("Unexpected response: %d %s", status, body)
+		}
+	}
+	if client.calls["/token/existing:1"] != 1 || len(client.calls) != 1 {
+		t.Errorf("Unexpected calls: %v", client.calls)
+	}
+
+	// Expires too soon to be cached
+	client, s = newCacheTestServer(CacheConfig{Tokens: true})
+	for i := 0; i < 2; i++ {
+		cacheTestRequest(t, s, "POST", "/token/existing-expiring")
+	}
+	if client.calls["/token/existing-expiring"] != 2 {
+		t.Errorf("Unexpected calls: %v", client.calls)
+	}
+}
+
+func TestCacheProjectToken(t *testing.T) {
+	client, _ := newCacheTestServer(CacheConfig{})
+	s := &RegistryServer{Client: NewCachingClient(&projectTokensTestClient{client}, CacheConfig{Tokens: true})}
+	for _, path := range []string{"/token/project/a:1", "/token/project/a:2", "/token/project/b:1", "/token/other/a:1"} {
+		client.status[path] = http.StatusOK
+		client.body[path] = client.body["/token/existing"]
+	}
+
+	// Tokens are shared by all repositories in a project, and the tag is ignored
+	cacheTestRequest(t, s, "POST", "/token/project/a:1")
+	cacheTestRequest(t, s, "POST", "/token/project/a:2")
+	cacheTestRequest(t, s, "POST", "/token/project/b:1")
+	cacheTestRequest(t, s, "POST", "/token/other/a:1")
+	if client.calls["/token/project/a:1"] != 1 || len(client.calls) != 2 || client.calls["/token/other/a:1"] != 1 {
+		t.Errorf("Unexpected calls: %v", client.calls)
+	}
+}
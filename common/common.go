@@ -1,19 +1,124 @@
 package common
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/singleflight"
 )
 
 const AUTH_TOKEN_ENV_VAR = "BINDERHUB_AUTH_TOKEN" // #nosec G101 -- Name of an env-var, not a secret
 
+const (
+	LISTEN_ADDRESS_ENV_VAR     = "LISTEN_ADDRESS"
+	TLS_CERT_FILE_ENV_VAR      = "TLS_CERT_FILE"
+	TLS_KEY_FILE_ENV_VAR       = "TLS_KEY_FILE"
+	TLS_CLIENT_CA_FILE_ENV_VAR = "TLS_CLIENT_CA_FILE"
+
+	SHUTDOWN_DRAIN_SECONDS_ENV_VAR        = "SHUTDOWN_DRAIN_SECONDS"
+	SHUTDOWN_GRACE_PERIOD_SECONDS_ENV_VAR = "SHUTDOWN_GRACE_PERIOD_SECONDS"
+
+	READY_CHECK_REGISTRY_ENV_VAR = "READY_CHECK_REGISTRY"
+)
+
+const defaultListenAddress = "0.0.0.0:8080"
+
+// Together less than the default Kubernetes terminationGracePeriodSeconds (30)
+const (
+	defaultShutdownDrainDelay  = 5 * time.Second
+	defaultShutdownGracePeriod = 20 * time.Second
+)
+
+// ServerConfig configures the listening server
+type ServerConfig struct {
+	Listen string
+	// PEM certificate and key, if set the server uses TLS
+	TLSCertFile string
+	TLSKeyFile  string
+	// PEM CA bundle, if set clients may authenticate with a certificate
+	// signed by this CA instead of a bearer token
+	TLSClientCAFile string
+	// Time to keep handling requests after readiness fails when shutting
+	// down, so load balancers stop sending new requests first
+	ShutdownDrainDelay time.Duration
+	// Maximum time to wait for in-flight requests when shutting down
+	ShutdownGracePeriod time.Duration
+	// If true (the default) /ready fails when the registry health check fails,
+	// otherwise it only fails when shutting down
+	ReadyCheckRegistry bool
+	// Name of the registry provider, included in audit records
+	Provider string
+	// Run in the background until the service shuts down
+	BackgroundTasks []func(ctx context.Context, scheduled bool)
+}
+
+// ServerConfigFromEnv reads the server configuration from environment variables
+func ServerConfigFromEnv() (ServerConfig, error) {
+	config := ServerConfig{
+		Listen:             os.Getenv(LISTEN_ADDRESS_ENV_VAR),
+		TLSCertFile:        os.Getenv(TLS_CERT_FILE_ENV_VAR),
+		TLSKeyFile:         os.Getenv(TLS_KEY_FILE_ENV_VAR),
+		TLSClientCAFile:    os.Getenv(TLS_CLIENT_CA_FILE_ENV_VAR),
+		ReadyCheckRegistry: true,
+	}
+	if config.Listen == "" {
+		config.Listen = defaultListenAddress
+	}
+	config.ShutdownDrainDelay = defaultShutdownDrainDelay
+	if v := os.Getenv(SHUTDOWN_DRAIN_SECONDS_ENV_VAR); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			return config, fmt.Errorf("invalid %s: %s", SHUTDOWN_DRAIN_SECONDS_ENV_VAR, v)
+		}
+		config.ShutdownDrainDelay = time.Duration(seconds) * time.Second
+	}
+	config.ShutdownGracePeriod = defaultShutdownGracePeriod
+	if v := os.Getenv(SHUTDOWN_GRACE_PERIOD_SECONDS_ENV_VAR); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			return config, fmt.Errorf("invalid %s: %s", SHUTDOWN_GRACE_PERIOD_SECONDS_ENV_VAR, v)
+		}
+		config.ShutdownGracePeriod = time.Duration(seconds) * time.Second
+	}
+	// Otherwise requests may still be running after the server is closed
+	if config.ShutdownGracePeriod < requestTimeout {
+		return config, fmt.Errorf("%s must be at least %d", SHUTDOWN_GRACE_PERIOD_SECONDS_ENV_VAR, int(requestTimeout.Seconds()))
+	}
+	if v := os.Getenv(READY_CHECK_REGISTRY_ENV_VAR); v != "" {
+		check, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid %s: %s", READY_CHECK_REGISTRY_ENV_VAR, v)
+		}
+		config.ReadyCheckRegistry = check
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return config, fmt.Errorf("%s and %s must both be set", TLS_CERT_FILE_ENV_VAR, TLS_KEY_FILE_ENV_VAR)
+	}
+	if config.TLSClientCAFile != "" && config.TLSCertFile == "" {
+		return config, fmt.Errorf("%s requires %s and %s", TLS_CLIENT_CA_FILE_ENV_VAR, TLS_CERT_FILE_ENV_VAR, TLS_KEY_FILE_ENV_VAR)
+	}
+	return config, nil
+}
+
+// TLS returns true if the server should use TLS
+func (c ServerConfig) TLS() bool {
+	return c.TLSCertFile != ""
+}
+
 // healthHandler is a http.handler that returns the version
 type healthHandler struct {
 	healthInfo *map[string]string
@@ -25,14 +130,14 @@ func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet && r.URL.Path == "/health" {
 		jsonBytes, err := json.Marshal(*h.healthInfo)
 		if err != nil {
-			log.Println("ERROR:", err)
+			slog.ErrorContext(r.Context(), "Failed to marshal health info", "error", err)
 			InternalServerError(w, r, err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
 		_, errw := w.Write(jsonBytes)
 		if errw != nil {
-			log.Println("ERROR:", errw)
+			slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
 		}
 	} else {
 		NotFound(w, r)
@@ -40,6 +145,96 @@ func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Results of the backend health check are cached for this long so that
+// readiness probes don't call the registry API every time
+const readyCacheDuration = 10 * time.Second
+
+// Less than the readiness probe timeout in the Helm chart
+const readyCheckTimeout = 4 * time.Second
+
+// readyHandler is a http.Handler that returns 503 if the backend health check
+// fails, or once the service is shutting down so that no new requests are sent
+// to it
+type readyHandler struct {
+	shuttingDown atomic.Bool
+	// If set the backend health check must pass
+	client IRegistryClient
+
+	// Concurrent probes share one check
+	group singleflight.Group
+
+	mu        sync.Mutex
+	checked   time.Time
+	lastError error
+}
+
+// healthCheck returns the cached result of the backend health check, or runs
+// the check if the result has expired
+func (h *readyHandler) healthCheck(ctx context.Context) error {
+	h.mu.Lock()
+	if time.Since(h.checked) < readyCacheDuration {
+		defer h.mu.Unlock()
+		return h.lastError
+	}
+	h.mu.Unlock()
+	// The lock isn't held during the check so probes that arrive while it's
+	// running wait for the same result instead of queueing
+	_, err, _ := h.group.Do("health", func() (interface{}, error) {
+		// The result is shared so shouldn't depend on this request being cancelled
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readyCheckTimeout)
+		defer cancel()
+		err := h.client.HealthCheck(ctx)
+		h.mu.Lock()
+		h.lastError = err
+		h.checked = time.Now()
+		h.mu.Unlock()
+		if err != nil {
+			slog.WarnContext(ctx, "Health check failed", "error", err)
+		}
+		return nil, err
+	})
+	return err
+}
+
+// ServeHTTP implements http.Handler
+func (h *readyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	if r.Method != http.MethodGet || r.URL.Path != "/ready" {
+		NotFound(w, r)
+		return
+	}
+	status := http.StatusOK
+	response := map[string]string{"status": "ready"}
+	if h.shuttingDown.Load() {
+		status = http.StatusServiceUnavailable
+		response["status"] = "shutting down"
+	} else if h.client != nil {
+		if err := h.healthCheck(r.Context()); err != nil {
+			status = http.StatusServiceUnavailable
+			response["status"] = "unavailable"
+			switch {
+			case returnErrorDetails():
+				response["reason"] = err.Error()
+			case IsTimeout(err):
+				response["reason"] = "upstream timeout"
+			default:
+				response["reason"] = "registry health check failed"
+			}
+		}
+	}
+	jsonBytes, err := json.Marshal(response)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to marshal response", "error", err)
+		InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(status)
+	_, errw := w.Write(append(jsonBytes, byte('\n')))
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
 func getAuthToken() (string, error) {
 	authToken, found := os.LookupEnv(AUTH_TOKEN_ENV_VAR)
 	if !found {
@@ -48,37 +243,175 @@ func getAuthToken() (string, error) {
 	return authToken, nil
 }
 
-// The main entrypoint for the service
-func Run(registryH IRegistryClient, healthInfo map[string]string, listen string, promRegistry *prometheus.Registry) {
+// The main entrypoint for the service, runs until SIGTERM or SIGINT is received
+func Run(registryH IRegistryClient, healthInfo map[string]string, config ServerConfig, promRegistry *prometheus.Registry) error {
 	promHandler := promhttp.HandlerFor(
 		promRegistry,
 		promhttp.HandlerOpts{EnableOpenMetrics: true},
 	)
 
+	authenticators := []BearerAuthenticator{}
+	tokens, err := getTokenFile()
+	if err != nil {
+		return err
+	}
+	if tokens != nil {
+		authenticators = append(authenticators, tokens)
+	}
+	if config.TLSClientCAFile != "" && tokens == nil {
+		slog.Warn("Client certificates are only accepted if their subject is listed in the token file", "env", AUTH_TOKEN_FILE_ENV_VAR)
+	}
+	jwtVerifier, err := getJWTVerifier()
+	if err != nil {
+		return err
+	}
+	if jwtVerifier != nil {
+		authenticators = append(authenticators, jwtVerifier)
+	}
+	// BINDERHUB_AUTH_TOKEN is optional if there are other ways to authenticate
 	authToken, err := getAuthToken()
+	if err != nil && len(authenticators) == 0 {
+		return err
+	}
+
+	limiter, err := getRateLimiter()
 	if err != nil {
-		log.Fatalln(err)
+		return err
+	}
+	audit, err := getAuditLog(config.Provider)
+	if err != nil {
+		return err
+	}
+	if audit != nil {
+		defer func() {
+			err := audit.Close()
+			if err != nil {
+				slog.Error("Failed to close audit log", "error", err)
+			}
+		}()
+	}
+
+	reaperConfig, err := ReaperConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	backgroundTasks, err := BackgroundTasksEnabled()
+	if err != nil {
+		return err
+	}
+	if !backgroundTasks {
+		slog.Info("Background tasks are disabled in this replica", "env", BACKGROUND_TASKS_ENABLED_ENV_VAR)
+		if reaperConfig.Enabled() {
+			slog.Warn("The reaper is configured but won't run since background tasks are disabled")
+		}
 	}
 
 	health := healthHandler{
 		healthInfo: &healthInfo,
 	}
+	ready := &readyHandler{}
+	if config.ReadyCheckRegistry {
+		ready.client = registryH
+	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/health", &health)
+	mux.Handle("/ready", ready)
 	mux.Handle("/metrics", promHandler)
 
-	CreateServer(mux, registryH, authToken, promRegistry)
+	CreateServer(mux, registryH, authToken, authenticators, limiter, audit, promRegistry)
+
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return err
+	}
 
-	log.Printf("Listening on %v\n", listen)
 	server := &http.Server{
-		Addr:         listen,
+		Addr:         config.Listen,
 		Handler:      mux,
+		TLSConfig:    tlsConfig,
 		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		WriteTimeout: serverWriteTimeout,
 	}
-	errw := server.ListenAndServe()
-	if errw != nil {
-		log.Fatalln(errw)
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		slog.Info("Listening", "address", config.Listen, "tls", true, "client_certificates", config.TLSClientCAFile != "")
+	} else {
+		slog.Info("Listening", "address", config.Listen)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	// Background tasks are cancelled when a signal is received, and must
+	// finish before the deferred audit log Close
+	tasks := newTaskGroup(ctx)
+	if tokens != nil {
+		tasks.Go(func(ctx context.Context) {
+			tokens.Watch(ctx, tokenFileReloadInterval)
+		})
+	}
+	for _, task := range config.BackgroundTasks {
+		task := task
+		tasks.Go(func(ctx context.Context) {
+			task(ctx, backgroundTasks)
+		})
+	}
+	if backgroundTasks && reaperConfig.Enabled() {
+		tasks.Go(NewReaper(registryH, reaperConfig, audit).Start)
+	}
+	err = serve(ctx, server, listener, ready, config.ShutdownDrainDelay, config.ShutdownGracePeriod)
+	tasks.Stop()
+	if err != nil {
+		return err
+	}
+	slog.Info("Shutdown complete")
+	return nil
+}
+
+// serve handles requests on listener until ctx is cancelled. It then fails the
+// readiness check, continues handling requests for drainDelay, stops accepting
+// connections, and waits up to gracePeriod for in-flight requests to finish.
+func serve(ctx context.Context, server *http.Server, listener net.Listener, ready *readyHandler, drainDelay time.Duration, gracePeriod time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			// Certificates are loaded by TLSConfig
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		errs <- err
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Fail the readiness check but keep serving requests until load balancers
+	// have stopped sending new ones
+	ready.shuttingDown.Store(true)
+	if drainDelay > 0 {
+		slog.Info("Shutting down, waiting for readiness to propagate", "drain_delay", drainDelay)
+		time.Sleep(drainDelay)
+	}
+
+	slog.Info("Shutting down, waiting for requests to finish", "grace_period", gracePeriod)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		server.Close()
+		return fmt.Errorf("requests still in progress after %v: %w", gracePeriod, err)
+	}
+	err = <-errs
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
+	return nil
 }
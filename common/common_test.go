@@ -1,9 +1,16 @@
 package common
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestAuthToken(t *testing.T) {
@@ -43,3 +50,278 @@ func TestAuthToken(t *testing.T) {
 		})
 	}
 }
+
+func TestServerConfigFromEnv(t *testing.T) {
+	testCases := []struct {
+		cert                string
+		key                 string
+		ca                  string
+		drain               string
+		gracePeriod         string
+		expectedDrain       time.Duration
+		expectedGracePeriod time.Duration
+		shouldError         bool
+	}{
+		{"", "", "", "", "", 5 * time.Second, 20 * time.Second, false},
+		{"tls.crt", "tls.key", "", "0", "9", 0, 9 * time.Second, false},
+		{"tls.crt", "tls.key", "ca.crt", "10", "30", 10 * time.Second, 30 * time.Second, false},
+		{"", "", "", "", "8", 0, 0, true},
+		{"", "", "", "", "0", 0, 0, true},
+		{"tls.crt", "", "", "", "", 0, 0, true},
+		{"", "tls.key", "", "", "", 0, 0, true},
+		{"", "", "ca.crt", "", "", 0, 0, true},
+		{"", "", "", "", "5s", 0, 0, true},
+		{"", "", "", "", "-1", 0, 0, true},
+		{"", "", "", "-1", "", 0, 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v,%v,%v,%v", tc.cert, tc.key, tc.ca, tc.drain, tc.gracePeriod), func(t *testing.T) {
+			t.Setenv(LISTEN_ADDRESS_ENV_VAR, "")
+			t.Setenv(TLS_CERT_FILE_ENV_VAR, tc.cert)
+			t.Setenv(TLS_KEY_FILE_ENV_VAR, tc.key)
+			t.Setenv(TLS_CLIENT_CA_FILE_ENV_VAR, tc.ca)
+			t.Setenv(SHUTDOWN_DRAIN_SECONDS_ENV_VAR, tc.drain)
+			t.Setenv(SHUTDOWN_GRACE_PERIOD_SECONDS_ENV_VAR, tc.gracePeriod)
+
+			config, err := ServerConfigFromEnv()
+			if tc.shouldError {
+				if err == nil {
+					t.Errorf("Expected error: %v", config)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if config.Listen != "0.0.0.0:8080" || config.TLS() != (tc.cert != "") || config.ShutdownGracePeriod != tc.expectedGracePeriod ||
+				config.ShutdownDrainDelay != tc.expectedDrain {
+				t.Errorf("Unexpected config: %v", config)
+			}
+		})
+	}
+}
+
+func TestServerConfigReadyCheckRegistry(t *testing.T) {
+	t.Setenv(READY_CHECK_REGISTRY_ENV_VAR, "")
+	config, err := ServerConfigFromEnv()
+	if err != nil || !config.ReadyCheckRegistry {
+		t.Errorf("Expected registry check to be enabled by default: %v %v", config, err)
+	}
+	t.Setenv(READY_CHECK_REGISTRY_ENV_VAR, "false")
+	config, err = ServerConfigFromEnv()
+	if err != nil || config.ReadyCheckRegistry {
+		t.Errorf("Expected registry check to be disabled: %v %v", config, err)
+	}
+	t.Setenv(READY_CHECK_REGISTRY_ENV_VAR, "invalid")
+	_, err = ServerConfigFromEnv()
+	if err == nil {
+		t.Errorf("Expected error for invalid %s", READY_CHECK_REGISTRY_ENV_VAR)
+	}
+}
+
+func TestServe(t *testing.T) {
+	testCases := []struct {
+		gracePeriod time.Duration
+		shouldError bool
+	}{
+		{time.Second, false},
+		{10 * time.Millisecond, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.gracePeriod.String(), func(t *testing.T) {
+			started := make(chan struct{})
+			mux := http.NewServeMux()
+			mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				time.Sleep(200 * time.Millisecond)
+				w.WriteHeader(http.StatusOK)
+			})
+			ready := &readyHandler{}
+			server := &http.Server{Handler: mux, ReadHeaderTimeout: time.Second}
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			url := "http://" + listener.Addr().String()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			serveErr := make(chan error, 1)
+			go func() {
+				serveErr <- serve(ctx, server, listener, ready, 0, tc.gracePeriod)
+			}()
+
+			// Start a request then shutdown while it's in progress
+			status := make(chan int, 1)
+			go func() {
+				res, err := http.Get(url + "/slow")
+				if err != nil {
+					status <- 0
+					return
+				}
+				res.Body.Close()
+				status <- res.StatusCode
+			}()
+			<-started
+			cancel()
+
+			err = <-serveErr
+			if tc.shouldError {
+				if err == nil {
+					t.Errorf("Expected error")
+				}
+			} else {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				if s := <-status; s != http.StatusOK {
+					t.Errorf("Expected in-flight request to complete: %d", s)
+				}
+			}
+
+			if !ready.shuttingDown.Load() {
+				t.Errorf("Expected readiness to fail")
+			}
+			_, err = http.Get(url + "/slow")
+			if err == nil {
+				t.Errorf("Expected new connections to fail")
+			}
+		})
+	}
+}
+
+func TestServeDrain(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fast", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	ready := &readyHandler{}
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: time.Second}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + listener.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, server, listener, ready, 500*time.Millisecond, time.Second)
+	}()
+	start := time.Now()
+	cancel()
+
+	// Requests are still handled after readiness fails
+	for !ready.shuttingDown.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	res, err := client.Get(url + "/fast")
+	if err != nil {
+		t.Fatalf("Expected request during drain to succeed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200: %d", res.StatusCode)
+	}
+
+	err = <-serveErr
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if d := time.Since(start); d < 500*time.Millisecond {
+		t.Errorf("Expected shutdown to wait for drain delay: %s", d)
+	}
+}
+
+func TestReady(t *testing.T) {
+	ready := &readyHandler{}
+	for _, expected := range []int{http.StatusOK, http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		ready.ServeHTTP(w, httptest.NewRequest("GET", "/ready", http.NoBody))
+		if w.Code != expected {
+			t.Errorf("Expected %d: %d", expected, w.Code)
+		}
+		ready.shuttingDown.Store(true)
+	}
+}
+
+func TestReadyHealthCheck(t *testing.T) {
+	client := &mockRegistryClient{}
+	ready := &readyHandler{client: client}
+
+	get := func() (int, string) {
+		w := httptest.NewRecorder()
+		ready.ServeHTTP(w, httptest.NewRequest("GET", "/ready", http.NoBody))
+		return w.Code, w.Body.String()
+	}
+
+	if code, body := get(); code != http.StatusOK || body != `{"status":"ready"}`+"\n" {
+		t.Errorf("Expected ready: %d %s", code, body)
+	}
+
+	// The result is cached
+	client.healthErr = errors.New("ExpiredTokenException: token expired")
+	if code, _ := get(); code != http.StatusOK || client.healthChecks != 1 {
+		t.Errorf("Expected cached result: %d %d", code, client.healthChecks)
+	}
+
+	ready.checked = time.Time{}
+	if code, body := get(); code != http.StatusServiceUnavailable || body != `{"reason":"registry health check failed","status":"unavailable"}`+"\n" {
+		t.Errorf("Expected unavailable: %d %s", code, body)
+	}
+
+	t.Setenv("RETURN_ERROR_DETAILS", "1")
+	ready.checked = time.Time{}
+	if code, body := get(); code != http.StatusServiceUnavailable || body != `{"reason":"ExpiredTokenException: token expired","status":"unavailable"}`+"\n" {
+		t.Errorf("Expected error details: %d %s", code, body)
+	}
+	if client.healthChecks != 3 {
+		t.Errorf("Expected 3 health checks: %d", client.healthChecks)
+	}
+}
+
+// slowHealthClient blocks health checks until release is closed
+type slowHealthClient struct {
+	mockRegistryClient
+	started chan struct{}
+	release chan struct{}
+	checks  atomic.Int32
+}
+
+func (c *slowHealthClient) HealthCheck(ctx context.Context) error {
+	if c.checks.Add(1) == 1 {
+		close(c.started)
+	}
+	<-c.release
+	return nil
+}
+
+func TestReadyHealthCheckConcurrent(t *testing.T) {
+	client := &slowHealthClient{started: make(chan struct{}), release: make(chan struct{})}
+	ready := &readyHandler{client: client}
+
+	codes := make(chan int, 5)
+	get := func() {
+		w := httptest.NewRecorder()
+		ready.ServeHTTP(w, httptest.NewRequest("GET", "/ready", http.NoBody))
+		codes <- w.Code
+	}
+	go get()
+	<-client.started
+	// Probes that arrive during the check wait for its result
+	for i := 0; i < 4; i++ {
+		go get()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(client.release)
+	for i := 0; i < 5; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("Expected ready: %d", code)
+		}
+	}
+	if n := client.checks.Load(); n != 1 {
+		t.Errorf("Expected 1 health check: %d", n)
+	}
+}
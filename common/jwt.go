@@ -0,0 +1,491 @@
+package common
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/sync/singleflight"
+	"gopkg.in/yaml.v3"
+)
+
+const JWT_CONFIG_FILE_ENV_VAR = "BINDERHUB_JWT_CONFIG_FILE"
+
+const (
+	// How often keys are fetched from a JWKS URL
+	jwksRefreshInterval = time.Hour
+	// Minimum time between fetches when a token has an unknown key ID, and the
+	// maximum delay before retrying a failed load
+	jwksMinRefreshInterval = time.Minute
+	// Delay before retrying the first failed load, doubled for each failure
+	jwksRetryBaseDelay = 5 * time.Second
+	// Maximum time to fetch the JWKS
+	jwksFetchTimeout = 10 * time.Second
+	// Allowed clock skew when checking exp and nbf
+	jwtLeeway = 30 * time.Second
+)
+
+// Signing algorithms that can be verified with a JWKS, symmetric algorithms
+// are not allowed
+var jwtValidMethods = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+// JWTRule grants permissions to JWTs with matching claims
+type JWTRule struct {
+	// Claims that must all match. If a claim in the token is a list one of the
+	// items must match.
+	Claims map[string]string `yaml:"claims"`
+	Scopes []string          `yaml:"scopes"`
+	// Must end in "/" so a prefix can't match part of a path segment
+	RepositoryPrefixes []string `yaml:"repository_prefixes"`
+}
+
+// JWTConfig configures the JWT issuer and the permissions granted to tokens
+type JWTConfig struct {
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// One of JWKSURL or JWKSFile is required
+	JWKSURL  string `yaml:"jwks_url"`
+	JWKSFile string `yaml:"jwks_file"`
+	// The first matching rule is used, tokens that don't match any rules are
+	// rejected
+	Rules []JWTRule `yaml:"rules"`
+}
+
+// parseJWTConfig parses and validates a YAML or JSON JWT configuration
+func parseJWTConfig(data []byte) (*JWTConfig, error) {
+	var config JWTConfig
+	err := yaml.Unmarshal(data, &config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Issuer == "" || config.Audience == "" {
+		return nil, errors.New("JWT issuer and audience are required")
+	}
+	if (config.JWKSURL == "") == (config.JWKSFile == "") {
+		return nil, errors.New("one of jwks_url or jwks_file is required")
+	}
+	if len(config.Rules) == 0 {
+		return nil, errors.New("at least one JWT rule is required")
+	}
+	for i, rule := range config.Rules {
+		if len(rule.Claims) == 0 {
+			return nil, fmt.Errorf("JWT rule %d has no claims", i)
+		}
+		for _, s := range rule.Scopes {
+			valid := false
+			for _, a := range allScopes {
+				valid = valid || s == a
+			}
+			if !valid {
+				return nil, fmt.Errorf("invalid scope for JWT rule %d: %s", i, s)
+			}
+		}
+		for _, prefix := range rule.RepositoryPrefixes {
+			if !strings.HasSuffix(prefix, "/") {
+				return nil, fmt.Errorf("repository prefix for JWT rule %d must end in /: %s", i, prefix)
+			}
+		}
+	}
+	return &config, nil
+}
+
+// jwk is a single JSON Web Key, only public keys are supported
+// https://www.rfc-editor.org/rfc/rfc7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+	}
+}
+
+// parseJWKS returns the signing keys in a JWKS indexed by key ID
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	err := json.Unmarshal(data, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// Ignore keys we don't understand, another key may be used
+			slog.Warn("Ignoring JWK", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no supported keys in JWKS")
+	}
+	return keys, nil
+}
+
+// jwksCache loads the JWKS from a file or URL. Files are reloaded when they
+// change, URLs are fetched periodically or when a token has an unknown key ID.
+// Concurrent loads share a single fetch, and requests aren't blocked by a fetch
+// if they can use the previous keys.
+type jwksCache struct {
+	url    string
+	file   string
+	client *http.Client
+	group  singleflight.Group
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	updated time.Time
+	modTime time.Time
+	// Number of consecutive failed loads, and the time of the next retry
+	failures   int
+	retryAfter time.Time
+}
+
+func (c *jwksCache) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS %s: %s", c.url, res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// stale returns true if the keys should be reloaded. modTime is the current
+// modification time of the file. Must be called with mu held.
+func (c *jwksCache) stale(modTime time.Time, unknownKey bool) bool {
+	if c.keys == nil {
+		return true
+	}
+	if time.Now().Before(c.retryAfter) {
+		return false
+	}
+	if c.file != "" {
+		return !modTime.Equal(c.modTime)
+	}
+	age := time.Since(c.updated)
+	return age >= jwksRefreshInterval || (unknownKey && age > jwksMinRefreshInterval)
+}
+
+// refresh reads or fetches the JWKS and updates the keys
+func (c *jwksCache) refresh(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var modTime time.Time
+	var err error
+	if c.file != "" {
+		var info os.FileInfo
+		info, err = os.Stat(c.file)
+		if err == nil {
+			modTime = info.ModTime()
+			data, err = os.ReadFile(c.file)
+		}
+	} else {
+		data, err = c.fetch(ctx)
+	}
+	var keys map[string]crypto.PublicKey
+	if err == nil {
+		keys, err = parseJWKS(data)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.failures++
+		c.retryAfter = time.Now().Add(jwksRetryDelay(c.failures))
+		if c.keys != nil {
+			slog.ErrorContext(ctx, "Failed to reload JWKS", "error", err, "retry_after", c.retryAfter)
+		}
+		return nil, err
+	}
+	c.keys = keys
+	c.updated = time.Now()
+	c.modTime = modTime
+	c.failures = 0
+	c.retryAfter = time.Time{}
+	return keys, nil
+}
+
+// jwksRetryDelay returns the delay before retrying after consecutive failures
+func jwksRetryDelay(failures int) time.Duration {
+	delay := jwksRetryBaseDelay << (failures - 1)
+	if delay > jwksMinRefreshInterval || delay <= 0 {
+		delay = jwksMinRefreshInterval
+	}
+	return delay
+}
+
+// load updates the keys if necessary. If this fails the previous keys are used.
+// unknownKey should be true if a token has a key ID that isn't in the cache.
+func (c *jwksCache) load(ctx context.Context, unknownKey bool) (map[string]crypto.PublicKey, error) {
+	var modTime time.Time
+	if c.file != "" {
+		// Errors are handled by refresh
+		if info, err := os.Stat(c.file); err == nil {
+			modTime = info.ModTime()
+		}
+	}
+	c.mu.Lock()
+	keys := c.keys
+	stale := c.stale(modTime, unknownKey)
+	c.mu.Unlock()
+	if !stale {
+		return keys, nil
+	}
+
+	// The fetch isn't cancelled if this request is, since other requests may
+	// be waiting for it
+	result := c.group.DoChan("jwks", func() (interface{}, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jwksFetchTimeout)
+		defer cancel()
+		return c.refresh(fetchCtx)
+	})
+	select {
+	case <-ctx.Done():
+		if keys != nil {
+			return keys, nil
+		}
+		return nil, ctx.Err()
+	case r := <-result:
+		if r.Err != nil {
+			if keys != nil {
+				return keys, nil
+			}
+			return nil, r.Err
+		}
+		return r.Val.(map[string]crypto.PublicKey), nil
+	}
+}
+
+// JWTVerifier authenticates JWTs signed by a configured issuer
+type JWTVerifier struct {
+	config *JWTConfig
+	jwks   *jwksCache
+}
+
+// NewJWTVerifier creates a JWTVerifier, the JWKS is loaded immediately
+func NewJWTVerifier(ctx context.Context, config *JWTConfig) (*JWTVerifier, error) {
+	v := &JWTVerifier{
+		config: config,
+		jwks: &jwksCache{
+			url:    config.JWKSURL,
+			file:   config.JWKSFile,
+			client: &http.Client{Timeout: jwksFetchTimeout},
+		},
+	}
+	_, err := v.jwks.load(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *JWTVerifier) keyfunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		keys, err := v.jwks.load(ctx, false)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := keys[kid]; !ok {
+			keys, err = v.jwks.load(ctx, true)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if key, ok := keys[kid]; ok {
+			return key, nil
+		}
+		if kid == "" {
+			// Try all keys
+			set := jwt.VerificationKeySet{}
+			for _, key := range keys {
+				set.Keys = append(set.Keys, key)
+			}
+			return set, nil
+		}
+		return nil, fmt.Errorf("unknown key ID: %s", kid)
+	}
+}
+
+// claimMatches returns true if claim is value, or is a list containing value
+func claimMatches(claim interface{}, value string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == value
+	case []interface{}:
+		for _, item := range c {
+			if s, ok := item.(string); ok && s == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Verify checks the signature and standard claims of token, and returns the
+// subject and the permissions from the first matching rule
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (string, *Permissions, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, v.keyfunc(ctx),
+		jwt.WithValidMethods(jwtValidMethods),
+		jwt.WithIssuer(v.config.Issuer),
+		jwt.WithAudience(v.config.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(jwtLeeway),
+	)
+	if err != nil {
+		return "", nil, err
+	}
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return "", nil, errors.New("JWT has no subject")
+	}
+	for _, rule := range v.config.Rules {
+		matched := true
+		for name, value := range rule.Claims {
+			if !claimMatches(claims[name], value) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return subject, &Permissions{
+				Scopes:             rule.Scopes,
+				RepositoryPrefixes: rule.RepositoryPrefixes,
+			}, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no rules match JWT subject %s", subject)
+}
+
+// Authenticate implements BearerAuthenticator
+func (v *JWTVerifier) Authenticate(ctx context.Context, token string) (string, *Permissions) {
+	// Avoid logging errors for other types of bearer token
+	if strings.Count(token, ".") != 2 {
+		return "", nil
+	}
+	subject, permissions, err := v.Verify(ctx, token)
+	if err != nil {
+		slog.InfoContext(ctx, "Invalid JWT", "error", err)
+		return "", nil
+	}
+	return JWTIdentityPrefix + subject, permissions
+}
+
+// getJWTVerifier returns a JWTVerifier if JWT authentication is configured
+func getJWTVerifier() (*JWTVerifier, error) {
+	filename := os.Getenv(JWT_CONFIG_FILE_ENV_VAR)
+	if filename == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseJWTConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", filename, err)
+	}
+	return NewJWTVerifier(context.Background(), config)
+}
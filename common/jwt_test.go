@@ -0,0 +1,394 @@
+package common
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testIssuer = "https://kubernetes.default.svc.cluster.local"
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// testJWKS returns a JWKS containing the public keys
+func testJWKS(t *testing.T, keys map[string]crypto.Signer) []byte {
+	jwks := map[string][]map[string]string{"keys": {}}
+	for kid, key := range keys {
+		var k map[string]string
+		switch pub := key.Public().(type) {
+		case *rsa.PublicKey:
+			k = map[string]string{"kty": "RSA", "n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())}
+		case *ecdsa.PublicKey:
+			k = map[string]string{"kty": "EC", "crv": "P-256", "x": b64(pub.X.FillBytes(make([]byte, 32))), "y": b64(pub.Y.FillBytes(make([]byte, 32)))}
+		case ed25519.PublicKey:
+			k = map[string]string{"kty": "OKP", "crv": "Ed25519", "x": b64(pub)}
+		default:
+			t.Fatalf("Unexpected key type %T", pub)
+		}
+		k["kid"] = kid
+		k["use"] = "sig"
+		jwks["keys"] = append(jwks["keys"], k)
+	}
+	data, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func signJWT(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func validClaims(sub string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss": testIssuer,
+		"aud": []string{"binderhub-registry-helper"},
+		"sub": sub,
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+}
+
+func testJWTConfig(jwksFile string, jwksURL string) *JWTConfig {
+	return &JWTConfig{
+		Issuer:   testIssuer,
+		Audience: "binderhub-registry-helper",
+		JWKSFile: jwksFile,
+		JWKSURL:  jwksURL,
+		Rules: []JWTRule{
+			{
+				Claims:             map[string]string{"sub": "system:serviceaccount:binderhub:binderhub"},
+				Scopes:             []string{ScopeRepoRead, ScopeRepoWrite, ScopeImageRead, ScopeTokenIssue},
+				RepositoryPrefixes: []string{"binder/"},
+			},
+			{
+				Claims: map[string]string{"groups": "admins"},
+				Scopes: []string{ScopeRepoRead, ScopeRepoDelete},
+			},
+		},
+	}
+}
+
+func TestParseJWTConfig(t *testing.T) {
+	config, err := parseJWTConfig([]byte(`
+issuer: https://issuer.example.org
+audience: registry
+jwks_url: https://issuer.example.org/jwks
+rules:
+  - claims:
+      sub: binderhub
+    scopes: [repo:read]
+    repository_prefixes: [binder/]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Issuer != "https://issuer.example.org" || config.Rules[0].Claims["sub"] != "binderhub" || config.Rules[0].RepositoryPrefixes[0] != "binder/" {
+		t.Errorf("Unexpected config: %v", config)
+	}
+
+	invalid := []string{
+		"audience: registry\njwks_file: f\nrules: [{claims: {sub: a}}]",
+		"issuer: i\naudience: registry\nrules: [{claims: {sub: a}}]",
+		"issuer: i\naudience: registry\njwks_file: f\njwks_url: u\nrules: [{claims: {sub: a}}]",
+		"issuer: i\naudience: registry\njwks_file: f",
+		"issuer: i\naudience: registry\njwks_file: f\nrules: [{scopes: [repo:read]}]",
+		"issuer: i\naudience: registry\njwks_file: f\nrules: [{claims: {sub: a}, scopes: [invalid]}]",
+		"issuer: i\naudience: registry\njwks_file: f\nrules: [{claims: {sub: a}, repository_prefixes: [binder]}]",
+	}
+	for _, data := range invalid {
+		_, err := parseJWTConfig([]byte(data))
+		if err == nil {
+			t.Errorf("Expected error: %s", data)
+		}
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	writeFile(t, jwksFile, testJWKS(t, map[string]crypto.Signer{"ec": ecKey, "rsa": rsaKey, "ed": edKey}), time.Now().Add(-time.Minute))
+	v, err := NewJWTVerifier(context.Background(), testJWTConfig(jwksFile, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binderhub := "system:serviceaccount:binderhub:binderhub"
+	expired := validClaims(binderhub)
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	noExpiry := validClaims(binderhub)
+	delete(noExpiry, "exp")
+	wrongAudience := validClaims(binderhub)
+	wrongAudience["aud"] = "other"
+	wrongIssuer := validClaims(binderhub)
+	wrongIssuer["iss"] = "https://other.example.org"
+	admin := validClaims("alice")
+	admin["groups"] = []string{"users", "admins"}
+
+	testCases := []struct {
+		name             string
+		token            string
+		expectedIdentity string
+		expectedScopes   int
+	}{
+		{"ec", signJWT(t, jwt.SigningMethodES256, "ec", ecKey, validClaims(binderhub)), JWTIdentityPrefix + binderhub, 4},
+		{"rsa", signJWT(t, jwt.SigningMethodRS256, "rsa", rsaKey, validClaims(binderhub)), JWTIdentityPrefix + binderhub, 4},
+		{"ed25519", signJWT(t, jwt.SigningMethodEdDSA, "ed", edKey, validClaims(binderhub)), JWTIdentityPrefix + binderhub, 4},
+		{"no-kid", signJWT(t, jwt.SigningMethodES256, "", ecKey, validClaims(binderhub)), JWTIdentityPrefix + binderhub, 4},
+		{"list-claim", signJWT(t, jwt.SigningMethodES256, "ec", ecKey, admin), JWTIdentityPrefix + "alice", 2},
+		{"no-matching-rule", signJWT(t, jwt.SigningMethodES256, "ec", ecKey, validClaims("bob")), "", 0},
+		{"expired", signJWT(t, jwt.SigningMethodES256, "ec", ecKey, expired), "", 0},
+		{"no-expiry", signJWT(t, jwt.SigningMethodES256, "ec", ecKey, noExpiry), "", 0},
+		{"wrong-audience", signJWT(t, jwt.SigningMethodES256, "ec", ecKey, wrongAudience), "", 0},
+		{"wrong-issuer", signJWT(t, jwt.SigningMethodES256, "ec", ecKey, wrongIssuer), "", 0},
+		{"wrong-key", signJWT(t, jwt.SigningMethodES256, "ec", otherKey, validClaims(binderhub)), "", 0},
+		{"unknown-kid", signJWT(t, jwt.SigningMethodES256, "other", otherKey, validClaims(binderhub)), "", 0},
+		{"hmac", signJWT(t, jwt.SigningMethodHS256, "ec", []byte("secret"), validClaims(binderhub)), "", 0},
+		{"not-jwt", "token", "", 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			identity, permissions := v.Authenticate(context.Background(), tc.token)
+			if identity != tc.expectedIdentity {
+				t.Errorf("Expected identity '%s': '%s'", tc.expectedIdentity, identity)
+			}
+			if identity != "" && len(permissions.Scopes) != tc.expectedScopes {
+				t.Errorf("Expected %d scopes: %v", tc.expectedScopes, permissions)
+			}
+		})
+	}
+
+	// Rotated keys are reloaded
+	writeFile(t, jwksFile, testJWKS(t, map[string]crypto.Signer{"other": otherKey}), time.Now())
+	token := signJWT(t, jwt.SigningMethodES256, "other", otherKey, validClaims(binderhub))
+	if identity, _ := v.Authenticate(context.Background(), token); identity != JWTIdentityPrefix+binderhub {
+		t.Errorf("Expected rotated key to be accepted: %s", identity)
+	}
+}
+
+func TestJWTVerifierURL(t *testing.T) {
+	key1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jwks atomic.Value
+	jwks.Store(testJWKS(t, map[string]crypto.Signer{"key1": key1}))
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		_, _ = w.Write(jwks.Load().([]byte))
+	}))
+	t.Cleanup(server.Close)
+
+	v, err := NewJWTVerifier(context.Background(), testJWTConfig("", server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	binderhub := "system:serviceaccount:binderhub:binderhub"
+	token1 := signJWT(t, jwt.SigningMethodES256, "key1", key1, validClaims(binderhub))
+	token2 := signJWT(t, jwt.SigningMethodES256, "key2", key2, validClaims(binderhub))
+
+	if identity, _ := v.Authenticate(context.Background(), token1); identity != JWTIdentityPrefix+binderhub {
+		t.Errorf("Expected token to be accepted: %s", identity)
+	}
+
+	// Unknown keys aren't fetched more than once a minute
+	jwks.Store(testJWKS(t, map[string]crypto.Signer{"key1": key1, "key2": key2}))
+	if identity, _ := v.Authenticate(context.Background(), token2); identity != "" {
+		t.Errorf("Expected token to be rejected: %s", identity)
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("Expected 1 fetch: %d", fetches.Load())
+	}
+
+	v.jwks.updated = time.Now().Add(-2 * time.Minute)
+	if identity, _ := v.Authenticate(context.Background(), token2); identity != JWTIdentityPrefix+binderhub {
+		t.Errorf("Expected token to be accepted: %s", identity)
+	}
+	if fetches.Load() != 2 {
+		t.Errorf("Expected 2 fetches: %d", fetches.Load())
+	}
+}
+
+func TestJWKSCacheRetry(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.WriteHeader(int(status.Load()))
+		_, _ = w.Write(testJWKS(t, map[string]crypto.Signer{"key": key}))
+	}))
+	t.Cleanup(server.Close)
+
+	v, err := NewJWTVerifier(context.Background(), testJWTConfig("", server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := v.jwks
+
+	// Failures return the previous keys and are retried after a short delay
+	status.Store(http.StatusInternalServerError)
+	cache.updated = time.Now().Add(-2 * time.Hour)
+	for i := 0; i < 2; i++ {
+		keys, err := cache.load(context.Background(), false)
+		if err != nil || keys["key"] == nil {
+			t.Errorf("Expected previous keys: %v %v", keys, err)
+		}
+	}
+	if fetches.Load() != 2 {
+		t.Errorf("Expected 2 fetches: %d", fetches.Load())
+	}
+	if delay := time.Until(cache.retryAfter); cache.failures != 1 || delay <= 0 || delay > jwksRetryBaseDelay {
+		t.Errorf("Unexpected retry: %d %s", cache.failures, delay)
+	}
+
+	status.Store(http.StatusOK)
+	cache.retryAfter = time.Now().Add(-time.Second)
+	_, err = cache.load(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches.Load() != 3 || cache.failures != 0 || time.Since(cache.updated) > time.Minute {
+		t.Errorf("Expected successful fetch: %d %d %s", fetches.Load(), cache.failures, cache.updated)
+	}
+}
+
+func TestJWKSCacheConcurrent(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		_, _ = w.Write(testJWKS(t, map[string]crypto.Signer{"key": key}))
+	}))
+	t.Cleanup(server.Close)
+
+	v, err := NewJWTVerifier(context.Background(), testJWTConfig("", server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := v.jwks
+	cache.updated = time.Now().Add(-2 * time.Hour)
+
+	// A cancelled request gets the previous keys without cancelling the fetch
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	keys, err := cache.load(ctx, false)
+	if err != nil || keys["key"] == nil {
+		t.Errorf("Expected previous keys: %v %v", keys, err)
+	}
+
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := cache.load(context.Background(), false)
+			errs <- err
+		}()
+	}
+	close(release)
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if fetches.Load() != 2 {
+		t.Errorf("Expected 2 fetches: %d", fetches.Load())
+	}
+}
+
+func TestJWTAuthorised(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	writeFile(t, jwksFile, testJWKS(t, map[string]crypto.Signer{"key": key}), time.Now())
+	v, err := NewJWTVerifier(context.Background(), testJWTConfig(jwksFile, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signJWT(t, jwt.SigningMethodES256, "key", key, validClaims("system:serviceaccount:binderhub:binderhub"))
+
+	testCases := []struct {
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		{"GET", "/repo/binder/image", 200},
+		{"POST", "/repo/binder/nested/image", 200},
+		{"POST", "/repo/other/image", 403},
+		{"DELETE", "/repo/binder/image", 403},
+		{"GET", "/repos/", 403},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s %s", tc.method, tc.path), func(t *testing.T) {
+			h := CheckAuthorisedTokens(&RegistryServer{Client: &mockRegistryClient{}}, "", v)
+			req := httptest.NewRequest(tc.method, tc.path, http.NoBody)
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			res := w.Result()
+			defer res.Body.Close()
+			if res.StatusCode != tc.expectedStatus {
+				t.Errorf("Expected %d: %d", tc.expectedStatus, res.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	LOG_FORMAT_ENV_VAR = "LOG_FORMAT"
+	LOG_LEVEL_ENV_VAR  = "LOG_LEVEL"
+)
+
+// RequestIDHeader is the request and response header containing the request ID
+const RequestIDHeader = "X-Request-ID"
+
+// Incoming request IDs that don't match this are replaced
+var validRequestIDRe = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// WithRequestID returns a copy of ctx with the request ID
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestID returns the request ID set by the request ID middleware, or ""
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestIDMiddleware wraps originalHandler to use the X-Request-ID header as
+// the request ID, or generate one. The ID is returned in the response headers
+// and added to the request context.
+func requestIDMiddleware(originalHandler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestIDRe.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+		originalHandler.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), requestID)))
+	})
+}
+
+// contextHandler adds the request ID from the context to every log record
+type contextHandler struct {
+	slog.Handler
+}
+
+// Handle implements slog.Handler
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID := RequestID(ctx); requestID != "" {
+		record.AddAttrs(slog.String("request_id", requestID))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+// WithAttrs implements slog.Handler
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup implements slog.Handler
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// NewLogHandler returns a slog.Handler writing to w. format is "text" or
+// "json", level is "debug", "info", "warn" or "error", empty strings use the
+// defaults text and info.
+func NewLogHandler(w io.Writer, format string, level string) (slog.Handler, error) {
+	var l slog.Level
+	if level != "" {
+		err := l.UnmarshalText([]byte(level))
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level: %s", level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format: %s", format)
+	}
+	return contextHandler{h}, nil
+}
+
+// SetupLogging configures the default logger from the LOG_FORMAT and
+// LOG_LEVEL environment variables. Messages from the log package are also
+// sent to this logger.
+func SetupLogging() error {
+	h, err := NewLogHandler(os.Stderr, os.Getenv(LOG_FORMAT_ENV_VAR), os.Getenv(LOG_LEVEL_ENV_VAR))
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// LogUpstreamCall logs a call to the registry API with the request ID returned
+// by the provider. Failed calls are logged as warnings so the provider request
+// ID is available without debug logging.
+// The request ID is also added to the audit record if the request is audited.
+func LogUpstreamCall(ctx context.Context, operation string, start time.Time, upstreamRequestID string, err error) {
+	addUpstreamRequestID(ctx, upstreamRequestID)
+	attrs := []any{
+		"operation", operation,
+		"upstream_request_id", upstreamRequestID,
+		"duration", time.Since(start),
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "Upstream call failed", append(attrs, "error", err)...)
+	} else {
+		slog.DebugContext(ctx, "Upstream call", attrs...)
+	}
+}
@@ -0,0 +1,165 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs sets the default logger to write JSON to the returned buffer
+// until the end of the test
+func captureLogs(t *testing.T, level string) *bytes.Buffer {
+	var buf bytes.Buffer
+	h, err := NewLogHandler(&buf, "json", level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// logRecords parses JSON log lines
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	records := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		err := json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatalf("Invalid log line %s: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestNewLogHandler(t *testing.T) {
+	testCases := []struct {
+		format      string
+		level       string
+		expected    string
+		shouldError bool
+	}{
+		{"", "", `level=INFO msg=info`, false},
+		{"text", "warn", `level=WARN msg=warn`, false},
+		{"JSON", "debug", `{"level":"DEBUG","msg":"debug"}`, false},
+		{"xml", "", "", true},
+		{"text", "verbose", "", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.format+","+tc.level, func(t *testing.T) {
+			var buf bytes.Buffer
+			h, err := NewLogHandler(&buf, tc.format, tc.level)
+			if tc.shouldError {
+				if err == nil {
+					t.Errorf("Expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Remove the time so the output is deterministic
+			logger := slog.New(removeTime{h})
+			logger.Debug("debug")
+			logger.Info("info")
+			logger.Warn("warn")
+			first := strings.SplitN(buf.String(), "\n", 2)[0]
+			if first != tc.expected {
+				t.Errorf("Expected %s: %s", tc.expected, first)
+			}
+		})
+	}
+}
+
+// removeTime is a slog.Handler that removes the time from records
+type removeTime struct {
+	slog.Handler
+}
+
+func (h removeTime) Handle(ctx context.Context, record slog.Record) error {
+	record.Time = time.Time{}
+	return h.Handler.Handle(ctx, record)
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	buf := captureLogs(t, "info")
+	h := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.InfoContext(r.Context(), "handled")
+	}))
+
+	testCases := []struct {
+		name       string
+		incoming   string
+		preserved  bool
+		expectedID string
+	}{
+		{"incoming", "abc-123", true, "abc-123"},
+		{"missing", "", false, ""},
+		{"invalid", "abc 123\n", false, ""},
+		{"too-long", strings.Repeat("a", 129), false, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf.Reset()
+			req := httptest.NewRequest("GET", "/repo/test", http.NoBody)
+			if tc.incoming != "" {
+				req.Header.Set(RequestIDHeader, tc.incoming)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			res := w.Result()
+			defer res.Body.Close()
+
+			requestID := res.Header.Get(RequestIDHeader)
+			if tc.preserved && requestID != tc.expectedID {
+				t.Errorf("Expected request ID %s: %s", tc.expectedID, requestID)
+			}
+			if !tc.preserved && (requestID == tc.incoming || len(requestID) != 32) {
+				t.Errorf("Expected generated request ID: %s", requestID)
+			}
+
+			records := logRecords(t, buf)
+			if len(records) != 1 || records[0]["request_id"] != requestID {
+				t.Errorf("Expected request_id %s in logs: %v", requestID, records)
+			}
+		})
+	}
+}
+
+func TestLogUpstreamCall(t *testing.T) {
+	buf := captureLogs(t, "info")
+	ctx := WithRequestID(context.Background(), "request-1")
+
+	// Successful calls are only logged at debug level
+	LogUpstreamCall(ctx, "ecr.DescribeRepositories", time.Now(), "upstream-1", nil)
+	LogUpstreamCall(ctx, "ecr.DescribeRepositories", time.Now(), "upstream-2", errors.New("failed"))
+
+	records := logRecords(t, buf)
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 record: %v", records)
+	}
+	expected := map[string]interface{}{
+		"level":               "WARN",
+		"operation":           "ecr.DescribeRepositories",
+		"upstream_request_id": "upstream-2",
+		"request_id":          "request-1",
+		"error":               "failed",
+	}
+	for k, v := range expected {
+		if records[0][k] != v {
+			t.Errorf("Expected %s=%v: %v", k, v, records[0])
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package common
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "upstream_request_duration_seconds",
+	Help:      "Duration of calls to the registry API.",
+}, []string{"provider", "operation"})
+
+var upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "upstream_errors_total",
+	Help:      "Total number of failed calls to the registry API.",
+}, []string{"provider", "operation", "error_code"})
+
+// upstreamErrorCode returns the provider's error code, or "timeout" if the
+// call timed out before the provider returned an error code
+func upstreamErrorCode(errorCode string, err error) string {
+	if errorCode == "" && IsTimeout(err) {
+		return "timeout"
+	}
+	return errorCode
+}
+
+// ObserveUpstreamCall records the duration of a call to the registry API, and
+// counts the call as an error if it failed. errorCode is the provider's error
+// code if known.
+func ObserveUpstreamCall(provider string, operation string, start time.Time, errorCode string, err error) {
+	upstreamDuration.WithLabelValues(provider, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		errorCode = upstreamErrorCode(errorCode, err)
+		if errorCode == "" {
+			errorCode = "unknown"
+		}
+		upstreamErrors.WithLabelValues(provider, operation, errorCode).Inc()
+	}
+}
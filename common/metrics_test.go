@@ -0,0 +1,43 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveUpstreamCall(t *testing.T) {
+	testCases := []struct {
+		name         string
+		errorCode    string
+		err          error
+		expectedCode string
+	}{
+		{"success", "", nil, ""},
+		{"provider-code", "RepositoryNotFoundException", errors.New("not found"), "RepositoryNotFoundException"},
+		{"timeout", "", fmt.Errorf("failed: %w", context.DeadlineExceeded), "timeout"},
+		{"no-code", "", errors.New("failed"), "unknown"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			operation := "test." + tc.name
+			ObserveUpstreamCall("test", operation, time.Now(), tc.errorCode, tc.err)
+
+			count := testutil.CollectAndCount(upstreamDuration, "binderhub_container_registry_helper_upstream_request_duration_seconds")
+			if count == 0 {
+				t.Errorf("Expected duration to be observed")
+			}
+			if tc.expectedCode == "" {
+				return
+			}
+			errors := testutil.ToFloat64(upstreamErrors.WithLabelValues("test", operation, tc.expectedCode))
+			if errors != 1 {
+				t.Errorf("Expected 1 error with code %s: %f", tc.expectedCode, errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Environment variable used to select the provider if it isn't passed on the
+// command line
+const PROVIDER_ENV_VAR = "REGISTRY_PROVIDER"
+
+// SetupFunc creates a registry client for a provider. args are the remaining
+// command line arguments after any flags.
+type SetupFunc func(promRegistry *prometheus.Registry, args []string) (IRegistryClient, error)
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]SetupFunc{}
+)
+
+// RegisterProvider makes a provider available by name, it should be called
+// from the provider package's init function.
+// It panics if a provider is registered twice.
+func RegisterProvider(name string, setup SetupFunc) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	if setup == nil {
+		panic("RegisterProvider setup is nil: " + name)
+	}
+	if _, dup := providers[name]; dup {
+		panic("RegisterProvider called twice for provider " + name)
+	}
+	providers[name] = setup
+}
+
+// GetProvider returns the setup function for a registered provider
+func GetProvider(name string) (SetupFunc, error) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	setup, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider '%s', expected one of: %s", name, strings.Join(providerNames(), ", "))
+	}
+	return setup, nil
+}
+
+// Providers returns the sorted names of all registered providers
+func Providers() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	return providerNames()
+}
+
+func providerNames() []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RunProvider sets up a registered provider and runs the service
+func RunProvider(name string, healthInfo map[string]string, args []string) error {
+	err := SetupLogging()
+	if err != nil {
+		return err
+	}
+	setup, err := GetProvider(name)
+	if err != nil {
+		return err
+	}
+	config, err := ServerConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	config.Provider = name
+
+	// Custom Prometheus registry to disable default go metrics
+	promRegistry := prometheus.NewRegistry()
+	promRegistry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	shutdownTracing, err := SetupTracing(context.Background(), name, healthInfo["version"])
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := shutdownTracing(context.Background())
+		if err != nil {
+			slog.Error("Failed to flush traces", "error", err)
+		}
+	}()
+
+	registryH, err := setup(promRegistry, args)
+	if err != nil {
+		return err
+	}
+	if tasks, ok := registryH.(IBackgroundTasks); ok {
+		config.BackgroundTasks = append(config.BackgroundTasks, tasks.RunBackgroundTasks)
+	}
+	cacheConfig, err := CacheConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	if cacheConfig.Enabled() {
+		slog.Info("Caching responses", "repository_ttl", cacheConfig.RepositoryTTL, "repository_not_found_ttl", cacheConfig.RepositoryNotFoundTTL,
+			"image_ttl", cacheConfig.ImageTTL, "image_not_found_ttl", cacheConfig.ImageNotFoundTTL, "tokens", cacheConfig.Tokens)
+		registryH = NewCachingClient(registryH, cacheConfig)
+	}
+
+	return Run(registryH, healthInfo, config, promRegistry)
+}
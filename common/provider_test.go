@@ -0,0 +1,43 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRegisterProvider(t *testing.T) {
+	setup := func(promRegistry *prometheus.Registry, args []string) (IRegistryClient, error) {
+		return nil, nil
+	}
+	RegisterProvider("test-b", setup)
+	RegisterProvider("test-a", setup)
+	t.Cleanup(func() {
+		providersMu.Lock()
+		defer providersMu.Unlock()
+		delete(providers, "test-a")
+		delete(providers, "test-b")
+	})
+
+	if names := Providers(); !reflect.DeepEqual(names, []string{"test-a", "test-b"}) {
+		t.Errorf("Unexpected providers: %v", names)
+	}
+
+	s, err := GetProvider("test-a")
+	if err != nil || s == nil {
+		t.Errorf("Expected provider test-a: %v", err)
+	}
+
+	_, err = GetProvider("unknown")
+	if err == nil || err.Error() != "unknown provider 'unknown', expected one of: test-a, test-b" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected duplicate provider to panic")
+		}
+	}()
+	RegisterProvider("test-a", setup)
+}
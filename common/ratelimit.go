@@ -0,0 +1,240 @@
+package common
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+const RATE_LIMIT_CONFIG_FILE_ENV_VAR = "BINDERHUB_RATE_LIMIT_CONFIG_FILE"
+
+// Route classes with separate rate limits
+const (
+	// GET requests
+	RouteClassRead = "read"
+	// Creating and deleting repositories and images
+	RouteClassWrite = "write"
+	// POST /token
+	RouteClassToken = "token"
+)
+
+var routeClasses = []string{RouteClassRead, RouteClassWrite, RouteClassToken}
+
+var rateLimitRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "rate_limit_requests_total",
+	Help:      "Total number of rate limited requests by route class and result (allowed or limited).",
+}, []string{"class", "result"})
+
+var rateLimitTokens = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "rate_limit_tokens",
+	Help:      "Requests remaining in the rate limit token bucket by caller identity and route class, as of the caller's last request.",
+}, []string{"caller", "class"})
+
+// Token buckets that haven't been used for this long are removed once they've
+// refilled, so memory doesn't grow with the number of callers
+const rateLimiterIdleTimeout = 10 * time.Minute
+
+// RateLimit is a token bucket rate limit
+type RateLimit struct {
+	// Sustained rate, 0 means unlimited
+	PerMinute float64 `yaml:"per_minute" json:"per_minute"`
+	// Maximum number of requests in a burst, default 1
+	Burst int `yaml:"burst" json:"burst"`
+}
+
+// RateLimitConfig contains the rate limits for each route class, route
+// classes without a limit are unlimited
+type RateLimitConfig struct {
+	Default map[string]RateLimit `yaml:"default" json:"default"`
+	// Override the default limits for some caller identities
+	Callers map[string]map[string]RateLimit `yaml:"callers" json:"callers"`
+}
+
+func validateRateLimits(limits map[string]RateLimit) error {
+	for class, limit := range limits {
+		valid := false
+		for _, c := range routeClasses {
+			valid = valid || class == c
+		}
+		if !valid {
+			return fmt.Errorf("invalid route class: %s", class)
+		}
+		if limit.PerMinute < 0 || limit.Burst < 0 {
+			return fmt.Errorf("rate limits must not be negative: %s", class)
+		}
+	}
+	return nil
+}
+
+// parseRateLimitConfig parses and validates a YAML or JSON rate limit file
+func parseRateLimitConfig(data []byte) (RateLimitConfig, error) {
+	var config RateLimitConfig
+	err := yaml.Unmarshal(data, &config)
+	if err != nil {
+		return config, err
+	}
+	err = validateRateLimits(config.Default)
+	if err != nil {
+		return config, err
+	}
+	for caller, limits := range config.Callers {
+		err = validateRateLimits(limits)
+		if err != nil {
+			return config, fmt.Errorf("caller %s: %w", caller, err)
+		}
+	}
+	return config, nil
+}
+
+type rateLimiterEntry struct {
+	// nil if unlimited
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter has a token bucket for each caller identity and route class
+type RateLimiter struct {
+	config RateLimitConfig
+
+	mu        sync.Mutex
+	limiters  map[[2]string]*rateLimiterEntry
+	lastSweep time.Time
+}
+
+// NewRateLimiter returns a RateLimiter for config
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		config:   config,
+		limiters: map[[2]string]*rateLimiterEntry{},
+	}
+}
+
+// sweep removes idle token buckets that have refilled, since they're the same
+// as a new bucket, and their metrics. l.mu must be held.
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, entry := range l.limiters {
+		if now.Sub(entry.lastSeen) < rateLimiterIdleTimeout {
+			continue
+		}
+		if entry.limiter == nil || entry.limiter.TokensAt(now) >= float64(entry.limiter.Burst()) {
+			delete(l.limiters, key)
+			rateLimitTokens.DeleteLabelValues(key[0], key[1])
+		}
+	}
+	l.lastSweep = now
+}
+
+// limiter returns the token bucket for a caller and route class, or nil if
+// it's unlimited
+func (l *RateLimiter) limiter(identity string, class string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= rateLimiterIdleTimeout {
+		l.sweep(now)
+	}
+	key := [2]string{identity, class}
+	if entry, ok := l.limiters[key]; ok {
+		entry.lastSeen = now
+		return entry.limiter
+	}
+	limit, ok := l.config.Callers[identity][class]
+	if !ok {
+		limit = l.config.Default[class]
+	}
+	var limiter *rate.Limiter
+	if limit.PerMinute > 0 {
+		burst := limit.Burst
+		if burst == 0 {
+			burst = 1
+		}
+		limiter = rate.NewLimiter(rate.Limit(limit.PerMinute/60), burst)
+	}
+	l.limiters[key] = &rateLimiterEntry{limiter: limiter, lastSeen: now}
+	return limiter
+}
+
+// Allow returns true if a request from identity to a route class is allowed,
+// otherwise the time until it would be allowed
+func (l *RateLimiter) Allow(identity string, class string) (bool, time.Duration) {
+	limiter := l.limiter(identity, class)
+	if limiter == nil {
+		return true, 0
+	}
+	reservation := limiter.Reserve()
+	delay := reservation.Delay()
+	if delay > 0 {
+		reservation.Cancel()
+	}
+	rateLimitTokens.WithLabelValues(identity, class).Set(limiter.Tokens())
+	return delay == 0, delay
+}
+
+// routeClass returns the rate limit route class of a request
+func routeClass(r *http.Request) string {
+	switch {
+	case r.Method == http.MethodPost && tokenRe.MatchString(r.URL.Path):
+		return RouteClassToken
+	case r.Method == http.MethodPost || r.Method == http.MethodDelete:
+		return RouteClassWrite
+	default:
+		return RouteClassRead
+	}
+}
+
+// TooManyRequests is a handler that returns a 429 HTTP error with a
+// Retry-After header
+func TooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	_, errw := w.Write([]byte(`{"error": "rate limit exceeded"}` + "\n"))
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// rateLimitMiddleware wraps originalHandler to limit the rate of requests from
+// each caller. It must be called after CheckAuthorised so the caller identity
+// is known.
+func rateLimitMiddleware(originalHandler http.Handler, limiter *RateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := CallerIdentity(r.Context())
+		class := routeClass(r)
+		allowed, retryAfter := limiter.Allow(identity, class)
+		if !allowed {
+			rateLimitRequests.WithLabelValues(class, "limited").Inc()
+			slog.InfoContext(r.Context(), "Rate limit exceeded", "caller", identity, "class", class, "retry_after", retryAfter)
+			TooManyRequests(w, r, retryAfter)
+			return
+		}
+		rateLimitRequests.WithLabelValues(class, "allowed").Inc()
+		originalHandler.ServeHTTP(w, r)
+	})
+}
+
+func getRateLimiter() (*RateLimiter, error) {
+	filename := os.Getenv(RATE_LIMIT_CONFIG_FILE_ENV_VAR)
+	if filename == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseRateLimitConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", filename, err)
+	}
+	return NewRateLimiter(config), nil
+}
@@ -0,0 +1,204 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseRateLimitConfig(t *testing.T) {
+	config, err := parseRateLimitConfig([]byte(`
+default:
+  read: {per_minute: 600, burst: 100}
+  token: {per_minute: 60}
+callers:
+  binderhub:
+    token: {per_minute: 600, burst: 10}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Default[RouteClassRead].PerMinute != 600 || config.Default[RouteClassRead].Burst != 100 {
+		t.Errorf("Unexpected default: %v", config.Default)
+	}
+	if config.Callers["binderhub"][RouteClassToken].Burst != 10 {
+		t.Errorf("Unexpected callers: %v", config.Callers)
+	}
+
+	for _, invalid := range []string{
+		"default: {delete: {per_minute: 1}}",
+		"default: {read: {per_minute: -1}}",
+		"callers: {binderhub: {write: {burst: -1}}}",
+		"default: [",
+	} {
+		_, err = parseRateLimitConfig([]byte(invalid))
+		if err == nil {
+			t.Errorf("Expected error for %s", invalid)
+		}
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{
+		Default: map[string]RateLimit{
+			RouteClassWrite: {PerMinute: 1, Burst: 2},
+		},
+		Callers: map[string]map[string]RateLimit{
+			"unlimited": {RouteClassWrite: {}},
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		if allowed, _ := limiter.Allow("caller", RouteClassWrite); !allowed {
+			t.Errorf("Expected request %d to be allowed", i)
+		}
+	}
+	allowed, retryAfter := limiter.Allow("caller", RouteClassWrite)
+	if allowed || retryAfter <= 0 {
+		t.Errorf("Expected request to be limited: %v %v", allowed, retryAfter)
+	}
+	if tokens := testutil.ToFloat64(rateLimitTokens.WithLabelValues("caller", RouteClassWrite)); tokens >= 1 {
+		t.Errorf("Expected no tokens remaining: %f", tokens)
+	}
+
+	// Limits are per caller and per route class
+	if allowed, _ := limiter.Allow("other", RouteClassWrite); !allowed {
+		t.Errorf("Expected other caller to be allowed")
+	}
+	if tokens := testutil.ToFloat64(rateLimitTokens.WithLabelValues("caller", RouteClassWrite)); tokens >= 1 {
+		t.Errorf("Expected other caller not to change tokens remaining: %f", tokens)
+	}
+	for i := 0; i < 10; i++ {
+		if allowed, _ := limiter.Allow("caller", RouteClassRead); !allowed {
+			t.Errorf("Expected read to be unlimited")
+		}
+		if allowed, _ := limiter.Allow("unlimited", RouteClassWrite); !allowed {
+			t.Errorf("Expected caller override to be unlimited")
+		}
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{
+		Default: map[string]RateLimit{
+			RouteClassWrite: {PerMinute: 60, Burst: 1},
+			RouteClassToken: {PerMinute: 0.001, Burst: 1},
+		},
+	})
+	for _, caller := range []string{"caller-1", "caller-2"} {
+		for _, class := range routeClasses {
+			limiter.Allow(caller, class)
+		}
+	}
+	if len(limiter.limiters) != 6 {
+		t.Fatalf("Expected 6 token buckets: %v", limiter.limiters)
+	}
+
+	limiter.mu.Lock()
+	limiter.sweep(time.Now())
+	if len(limiter.limiters) != 6 {
+		t.Errorf("Expected recently used token buckets to be kept: %v", limiter.limiters)
+	}
+	// Token buckets that haven't refilled are kept so they still limit the caller
+	limiter.sweep(time.Now().Add(time.Hour))
+	limiter.mu.Unlock()
+	if len(limiter.limiters) != 2 {
+		t.Errorf("Expected idle token buckets to be removed: %v", limiter.limiters)
+	}
+	for key := range limiter.limiters {
+		if key[1] != RouteClassToken {
+			t.Errorf("Unexpected token bucket: %v", key)
+		}
+	}
+	// DeleteLabelValues returns false if the metric was already removed
+	if rateLimitTokens.DeleteLabelValues("caller-1", RouteClassWrite) {
+		t.Errorf("Expected metric for idle token bucket to be removed")
+	}
+	if !rateLimitTokens.DeleteLabelValues("caller-1", RouteClassToken) {
+		t.Errorf("Expected metric for token bucket to be kept")
+	}
+}
+
+func TestRouteClass(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		path   string
+		class  string
+	}{
+		{"GET", "/repos/", RouteClassRead},
+		{"GET", "/image/name:tag", RouteClassRead},
+		{"POST", "/repo/name", RouteClassWrite},
+		{"DELETE", "/image/name:tag", RouteClassWrite},
+		{"POST", "/token/name", RouteClassToken},
+		{"POST", "/token", RouteClassToken},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, http.NoBody)
+		if class := routeClass(r); class != tc.class {
+			t.Errorf("%s %s: expected %s got %s", tc.method, tc.path, tc.class, class)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{
+		Default: map[string]RateLimit{
+			RouteClassToken: {PerMinute: 0.5, Burst: 1},
+		},
+	})
+	called := 0
+	h := CheckAuthorisedTokens(rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called++
+	}), limiter), "secret")
+	limited := testutil.ToFloat64(rateLimitRequests.WithLabelValues(RouteClassToken, "limited"))
+
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("POST", "/token/name", http.NoBody)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		res := w.Result()
+		res.Body.Close()
+		if res.StatusCode != expected {
+			t.Errorf("Request %d: expected %d got %d", i, expected, res.StatusCode)
+		}
+		if expected == http.StatusTooManyRequests {
+			if retryAfter := res.Header.Get("Retry-After"); retryAfter == "" || retryAfter == "0" {
+				t.Errorf("Expected Retry-After header: %s", retryAfter)
+			}
+		}
+	}
+	if called != 1 {
+		t.Errorf("Expected handler to be called once: %d", called)
+	}
+	if l := testutil.ToFloat64(rateLimitRequests.WithLabelValues(RouteClassToken, "limited")) - limited; l != 1 {
+		t.Errorf("Expected 1 limited request: %f", l)
+	}
+}
+
+func TestGetRateLimiter(t *testing.T) {
+	limiter, err := getRateLimiter()
+	if limiter != nil || err != nil {
+		t.Errorf("Expected no rate limiter by default: %v %v", limiter, err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "ratelimit.yaml")
+	t.Setenv(RATE_LIMIT_CONFIG_FILE_ENV_VAR, filename)
+	_, err = getRateLimiter()
+	if err == nil {
+		t.Errorf("Expected error for missing file")
+	}
+
+	err = os.WriteFile(filename, []byte(`{"default": {"write": {"per_minute": 60}}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter, err = getRateLimiter()
+	if err != nil || limiter.config.Default[RouteClassWrite].PerMinute != 60 {
+		t.Errorf("Unexpected rate limiter: %v %v", limiter, err)
+	}
+}
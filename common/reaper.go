@@ -0,0 +1,408 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	REAPER_INTERVAL_HOURS_ENV_VAR = "REAPER_INTERVAL_HOURS"
+	REAPER_MAX_AGE_DAYS_ENV_VAR   = "REAPER_MAX_AGE_DAYS"
+	REAPER_DRY_RUN_ENV_VAR        = "REAPER_DRY_RUN"
+	REAPER_MAX_DELETIONS_ENV_VAR  = "REAPER_MAX_DELETIONS"
+	REAPER_INCLUDE_ENV_VAR        = "REAPER_INCLUDE"
+	REAPER_EXCLUDE_ENV_VAR        = "REAPER_EXCLUDE"
+)
+
+const (
+	defaultReaperMaxAgeDays   = 90
+	defaultReaperMaxDeletions = 10
+)
+
+// ReaperIdentity is the caller identity used in logs and audit records for
+// repositories deleted by the reaper
+const ReaperIdentity = "reaper"
+
+// Reasons a repository is reaped
+const (
+	ReapEmpty = "empty"
+	ReapStale = "stale"
+)
+
+// Actions taken by the reaper
+const (
+	// The repository was deleted
+	ReapDeleted = "deleted"
+	// Dry-run mode, the repository would have been deleted
+	ReapWouldDelete = "would_delete"
+	// Not deleted because the maximum deletions per run was reached
+	ReapSkippedLimit = "skipped_limit"
+	// Not deleted because an image was pushed after it was checked
+	ReapSkippedActive = "skipped_active"
+	// Deleting or checking the repository failed
+	ReapFailed = "failed"
+)
+
+var reaperRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "reaper_runs_total",
+	Help:      "Total number of stale repository reaper runs by result (success or failed).",
+}, []string{"result"})
+
+var reaperRepositories = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "reaper_repositories_total",
+	Help:      "Total number of stale or empty repositories found by the reaper by action.",
+}, []string{"action"})
+
+var reaperLastRunRepositories = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "reaper_last_run_repositories",
+	Help:      "Number of stale or empty repositories found in the last reaper run by action.",
+}, []string{"action"})
+
+var reaperLastRun = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "reaper_last_run_timestamp_seconds",
+	Help:      "Time the last stale repository reaper run finished.",
+})
+
+// ReaperConfig configures the stale repository reaper
+type ReaperConfig struct {
+	// Time between runs, 0 disables the reaper
+	Interval time.Duration
+	// Repositories whose newest image was pushed, or that are empty and were
+	// created, more than this long ago are deleted
+	MaxAge time.Duration
+	// Report repositories without deleting them
+	DryRun bool
+	// Maximum number of repositories deleted in each run
+	MaxDeletions int
+	// Only repositories matching one of these globs (path.Match syntax) are
+	// deleted, if empty all repositories are included
+	Include []string
+	// Repositories matching one of these globs are never deleted
+	Exclude []string
+}
+
+func envvarPatterns(name string) ([]string, error) {
+	patterns := []string{}
+	for _, pattern := range strings.Split(os.Getenv(name), ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern: %s", name, pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// ReaperConfigFromEnv reads the reaper configuration from environment
+// variables
+func ReaperConfigFromEnv() (ReaperConfig, error) {
+	config := ReaperConfig{}
+	hours, err := envvarInt(REAPER_INTERVAL_HOURS_ENV_VAR, 0, 0)
+	if err != nil {
+		return config, err
+	}
+	config.Interval = time.Duration(hours) * time.Hour
+	days, err := envvarInt(REAPER_MAX_AGE_DAYS_ENV_VAR, defaultReaperMaxAgeDays, 1)
+	if err != nil {
+		return config, err
+	}
+	config.MaxAge = time.Duration(days) * 24 * time.Hour
+	config.MaxDeletions, err = envvarInt(REAPER_MAX_DELETIONS_ENV_VAR, defaultReaperMaxDeletions, 1)
+	if err != nil {
+		return config, err
+	}
+	// Dry-run by default so enabling the reaper never deletes anything
+	// unexpectedly
+	config.DryRun = true
+	if v := os.Getenv(REAPER_DRY_RUN_ENV_VAR); v != "" {
+		config.DryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("invalid %s: %s", REAPER_DRY_RUN_ENV_VAR, v)
+		}
+	}
+	config.Include, err = envvarPatterns(REAPER_INCLUDE_ENV_VAR)
+	if err != nil {
+		return config, err
+	}
+	config.Exclude, err = envvarPatterns(REAPER_EXCLUDE_ENV_VAR)
+	if err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// Enabled returns true if the reaper should run
+func (c ReaperConfig) Enabled() bool {
+	return c.Interval > 0
+}
+
+// matches returns true if a repository may be deleted according to the
+// include and exclude patterns
+func (c ReaperConfig) matches(repository string) bool {
+	for _, pattern := range c.Exclude {
+		if ok, _ := path.Match(pattern, repository); ok {
+			return false
+		}
+	}
+	if len(c.Include) == 0 {
+		return true
+	}
+	for _, pattern := range c.Include {
+		if ok, _ := path.Match(pattern, repository); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ReapedRepository is a repository found by the reaper
+type ReapedRepository struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+	// Time the newest image was pushed, or the repository was created if it's
+	// empty
+	LastActivity time.Time `json:"last_activity"`
+	Action       string    `json:"action"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// ReapReport is the result of a reaper run
+type ReapReport struct {
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	DryRun   bool          `json:"dry_run"`
+	// Number of repositories checked
+	Scanned int `json:"scanned"`
+	// Number of repositories skipped because their age is unknown
+	Unknown      int                `json:"unknown"`
+	Repositories []ReapedRepository `json:"repositories"`
+}
+
+// Count returns the number of repositories with an action
+func (r ReapReport) Count(action string) int {
+	n := 0
+	for _, repo := range r.Repositories {
+		if repo.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// Reaper deletes repositories whose newest image is older than the maximum
+// age, or that are empty and were created more than the maximum age ago.
+// Repositories are only deleted if their age is known.
+type Reaper struct {
+	client IRegistryClient
+	config ReaperConfig
+	// nil if audit logging is disabled
+	auditLog *AuditLog
+}
+
+// NewReaper returns a Reaper for client. audit is optional.
+func NewReaper(client IRegistryClient, config ReaperConfig, audit *AuditLog) *Reaper {
+	return &Reaper{
+		client:   client,
+		config:   config,
+		auditLog: audit,
+	}
+}
+
+// audit writes an audit record for a repository deleted, or that would have
+// been deleted in dry-run mode
+func (rp *Reaper) audit(ctx context.Context, repository string, outcome string, status int, upstreamRequestIDs []string) {
+	if rp.auditLog == nil {
+		return
+	}
+	rp.auditLog.write(ctx, AuditRecord{
+		Time:               time.Now().UTC(),
+		RequestID:          RequestID(ctx),
+		Caller:             ReaperIdentity,
+		Method:             http.MethodDelete,
+		Route:              "/repo/{repository}",
+		Action:             AuditDeleteRepository,
+		Repository:         repository,
+		Provider:           rp.auditLog.provider,
+		Outcome:            outcome,
+		Status:             status,
+		UpstreamRequestIDs: upstreamRequestIDs,
+	})
+}
+
+func (rp *Reaper) deleteRepository(ctx context.Context, repository string) error {
+	state := &auditState{}
+	ctx = context.WithValue(ctx, auditStateKey, state)
+	err := rp.client.RemoveRepository(ctx, repository)
+	_, ids := state.get()
+	if err != nil {
+		rp.audit(ctx, repository, AuditFailed, http.StatusInternalServerError, ids)
+		return err
+	}
+	rp.audit(ctx, repository, AuditSuccess, http.StatusOK, ids)
+	return nil
+}
+
+// check returns the repository if it should be reaped, or nil. unknown is
+// true if the repository's age is unknown.
+func (rp *Reaper) check(ctx context.Context, repo Repository, cutoff time.Time) (reaped *ReapedRepository, unknown bool, err error) {
+	images, err := rp.client.AllImages(ctx, repo.Name)
+	if errors.Is(err, ErrRepositoryNotFound) {
+		// Deleted since it was listed
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(images) == 0 {
+		if repo.Created == nil {
+			return nil, true, nil
+		}
+		if repo.Created.Before(cutoff) {
+			return &ReapedRepository{Name: repo.Name, Reason: ReapEmpty, LastActivity: *repo.Created}, false, nil
+		}
+		return nil, false, nil
+	}
+	var newest time.Time
+	for _, image := range images {
+		if image.PushedAt == nil {
+			return nil, true, nil
+		}
+		if image.PushedAt.After(newest) {
+			newest = *image.PushedAt
+		}
+	}
+	if newest.Before(cutoff) {
+		return &ReapedRepository{Name: repo.Name, Reason: ReapStale, LastActivity: newest}, false, nil
+	}
+	return nil, false, nil
+}
+
+// Run checks all repositories and deletes stale and empty repositories, or
+// only reports them in dry-run mode
+func (rp *Reaper) Run(ctx context.Context) (ReapReport, error) {
+	report := ReapReport{
+		Start:        time.Now(),
+		DryRun:       rp.config.DryRun,
+		Repositories: []ReapedRepository{},
+	}
+	ctx = WithCallerIdentity(WithRequestID(ctx, newRequestID()), ReaperIdentity)
+	cutoff := report.Start.Add(-rp.config.MaxAge)
+
+	repos, err := rp.client.AllRepositories(ctx)
+	if err != nil {
+		return report, err
+	}
+	byName := map[string]Repository{}
+	for _, repo := range repos {
+		byName[repo.Name] = repo
+	}
+	for _, repo := range repos {
+		if !rp.config.matches(repo.Name) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		report.Scanned++
+		reaped, unknown, err := rp.check(ctx, repo, cutoff)
+		switch {
+		case err != nil:
+			slog.WarnContext(ctx, "Reaper failed to check repository", "repository", repo.Name, "error", err)
+			report.Repositories = append(report.Repositories, ReapedRepository{Name: repo.Name, Action: ReapFailed, Error: err.Error()})
+		case unknown:
+			report.Unknown++
+		case reaped != nil:
+			report.Repositories = append(report.Repositories, *reaped)
+		}
+	}
+
+	// Delete the least recently used repositories first
+	sort.SliceStable(report.Repositories, func(i, j int) bool {
+		return report.Repositories[i].LastActivity.Before(report.Repositories[j].LastActivity)
+	})
+	deletions := 0
+	for i := range report.Repositories {
+		repo := &report.Repositories[i]
+		switch {
+		case repo.Action == ReapFailed:
+		case deletions >= rp.config.MaxDeletions:
+			repo.Action = ReapSkippedLimit
+		case rp.config.DryRun:
+			repo.Action = ReapWouldDelete
+			deletions++
+			rp.audit(ctx, repo.Name, AuditDryRun, 0, nil)
+		default:
+			// Checking all repositories can take a long time, so check
+			// again in case an image has been pushed since
+			reaped, unknown, err := rp.check(ctx, byName[repo.Name], cutoff)
+			if err == nil && (reaped == nil || unknown) {
+				repo.Action = ReapSkippedActive
+				break
+			}
+			deletions++
+			if err == nil {
+				err = rp.deleteRepository(ctx, repo.Name)
+			}
+			if err != nil {
+				slog.WarnContext(ctx, "Reaper failed to delete repository", "repository", repo.Name, "error", err)
+				repo.Action = ReapFailed
+				repo.Error = err.Error()
+			} else {
+				repo.Action = ReapDeleted
+			}
+		}
+		reaperRepositories.WithLabelValues(repo.Action).Inc()
+		slog.InfoContext(ctx, "Reaper repository", "repository", repo.Name, "reason", repo.Reason,
+			"last_activity", repo.LastActivity, "action", repo.Action, "error", repo.Error)
+	}
+	report.Duration = time.Since(report.Start)
+	return report, nil
+}
+
+// Start runs the reaper immediately and then every interval until ctx is
+// cancelled
+func (rp *Reaper) Start(ctx context.Context) {
+	slog.Info("Starting reaper", "interval", rp.config.Interval, "max_age", rp.config.MaxAge, "dry_run", rp.config.DryRun,
+		"max_deletions", rp.config.MaxDeletions, "include", rp.config.Include, "exclude", rp.config.Exclude)
+	ticker := time.NewTicker(rp.config.Interval)
+	defer ticker.Stop()
+	for {
+		report, err := rp.Run(ctx)
+		reaperLastRun.SetToCurrentTime()
+		if err != nil {
+			reaperRuns.WithLabelValues("failed").Inc()
+			slog.Error("Reaper run failed", "error", err)
+		} else {
+			reaperRuns.WithLabelValues("success").Inc()
+			for _, action := range []string{ReapDeleted, ReapWouldDelete, ReapSkippedLimit, ReapSkippedActive, ReapFailed} {
+				reaperLastRunRepositories.WithLabelValues(action).Set(float64(report.Count(action)))
+			}
+			slog.Info("Reaper run finished", "dry_run", report.DryRun, "duration", report.Duration, "scanned", report.Scanned,
+				"unknown", report.Unknown, "deleted", report.Count(ReapDeleted), "would_delete", report.Count(ReapWouldDelete),
+				"skipped_limit", report.Count(ReapSkippedLimit), "skipped_active", report.Count(ReapSkippedActive), "failed", report.Count(ReapFailed))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// reaperTestClient returns fixed repositories and images
+type reaperTestClient struct {
+	mockRegistryClient
+	repos  []Repository
+	images map[string][]Image
+	// Repository: error returned by AllImages
+	errors  map[string]error
+	deleted []string
+	// Called by AllImages, e.g. to simulate an image being pushed
+	onAllImages func(repository string)
+}
+
+func (c *reaperTestClient) AllRepositories(ctx context.Context) ([]Repository, error) {
+	return c.repos, nil
+}
+
+func (c *reaperTestClient) AllImages(ctx context.Context, repository string) ([]Image, error) {
+	if c.onAllImages != nil {
+		c.onAllImages(repository)
+	}
+	if err, ok := c.errors[repository]; ok {
+		return nil, err
+	}
+	images := c.images[repository]
+	if images == nil {
+		images = []Image{}
+	}
+	return images, nil
+}
+
+func (c *reaperTestClient) RemoveRepository(ctx context.Context, repository string) error {
+	LogUpstreamCall(ctx, "test.DeleteRepository", time.Now(), "upstream-"+repository, nil)
+	c.deleted = append(c.deleted, repository)
+	return nil
+}
+
+func daysAgo(days int) *time.Time {
+	t := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	return &t
+}
+
+func newReaperTestClient() *reaperTestClient {
+	return &reaperTestClient{
+		repos: []Repository{
+			{Name: "binder/stale-1", Created: daysAgo(300)},
+			{Name: "binder/stale-2", Created: daysAgo(300)},
+			{Name: "binder/recent", Created: daysAgo(300)},
+			{Name: "binder/empty-old", Created: daysAgo(100)},
+			{Name: "binder/empty-new", Created: daysAgo(1)},
+			{Name: "binder/empty-unknown"},
+			{Name: "binder/no-push-time"},
+			{Name: "binder/error"},
+			{Name: "binder/deleted"},
+			{Name: "other/stale"},
+			{Name: "binder/keep"},
+		},
+		images: map[string][]Image{
+			"binder/stale-1": {
+				{Tag: "a", PushedAt: daysAgo(200)},
+				{Tag: "b", PushedAt: daysAgo(95)},
+			},
+			"binder/stale-2":      {{Tag: "a", PushedAt: daysAgo(150)}},
+			"binder/recent":       {{Tag: "a", PushedAt: daysAgo(200)}, {Tag: "b", PushedAt: daysAgo(2)}},
+			"binder/no-push-time": {{Tag: "a"}},
+			"other/stale":         {{Tag: "a", PushedAt: daysAgo(200)}},
+			"binder/keep":         {{Tag: "a", PushedAt: daysAgo(200)}},
+		},
+		errors: map[string]error{
+			"binder/error":   errors.New("list images failed"),
+			"binder/deleted": ErrRepositoryNotFound,
+		},
+	}
+}
+
+func TestReaperConfigFromEnv(t *testing.T) {
+	config, err := ReaperConfigFromEnv()
+	if err != nil || config.Enabled() || !config.DryRun || config.MaxAge != 90*24*time.Hour || config.MaxDeletions != 10 {
+		t.Errorf("Unexpected default config: %+v %v", config, err)
+	}
+
+	t.Setenv(REAPER_INTERVAL_HOURS_ENV_VAR, "24")
+	t.Setenv(REAPER_DRY_RUN_ENV_VAR, "false")
+	t.Setenv(REAPER_INCLUDE_ENV_VAR, "binder/*, other/*")
+	config, err = ReaperConfigFromEnv()
+	if err != nil || !config.Enabled() || config.DryRun || len(config.Include) != 2 || config.Include[1] != "other/*" {
+		t.Errorf("Unexpected config: %+v %v", config, err)
+	}
+
+	t.Setenv(REAPER_EXCLUDE_ENV_VAR, "[")
+	_, err = ReaperConfigFromEnv()
+	if err == nil {
+		t.Errorf("Expected error for invalid pattern")
+	}
+}
+
+func TestReaperDryRun(t *testing.T) {
+	client := newReaperTestClient()
+	sink := &memorySink{}
+	reaper := NewReaper(client, ReaperConfig{
+		MaxAge:       90 * 24 * time.Hour,
+		DryRun:       true,
+		MaxDeletions: 10,
+		Include:      []string{"binder/*"},
+		Exclude:      []string{"binder/keep"},
+	}, NewAuditLog("test", sink))
+	wouldDelete := testutil.ToFloat64(reaperRepositories.WithLabelValues(ReapWouldDelete))
+
+	report, err := reaper.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.deleted) != 0 {
+		t.Errorf("Expected no deletions in dry-run mode: %v", client.deleted)
+	}
+	if report.Scanned != 9 || report.Unknown != 2 || !report.DryRun {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	// Failures first since they have no last activity, then oldest first
+	expected := []ReapedRepository{
+		{Name: "binder/error", Action: ReapFailed},
+		{Name: "binder/stale-2", Reason: ReapStale, Action: ReapWouldDelete},
+		{Name: "binder/empty-old", Reason: ReapEmpty, Action: ReapWouldDelete},
+		{Name: "binder/stale-1", Reason: ReapStale, Action: ReapWouldDelete},
+	}
+	if len(report.Repositories) != len(expected) {
+		t.Fatalf("Unexpected repositories: %+v", report.Repositories)
+	}
+	for i, e := range expected {
+		r := report.Repositories[i]
+		if r.Name != e.Name || r.Reason != e.Reason || r.Action != e.Action {
+			t.Errorf("Expected %+v got %+v", e, r)
+		}
+	}
+	if report.Repositories[0].Error == "" {
+		t.Errorf("Expected error: %+v", report.Repositories[0])
+	}
+	if n := testutil.ToFloat64(reaperRepositories.WithLabelValues(ReapWouldDelete)) - wouldDelete; n != 3 {
+		t.Errorf("Expected 3 would_delete: %f", n)
+	}
+
+	// Dry-run deletions are audited so they can be reviewed
+	if len(sink.records) != 3 {
+		t.Fatalf("Expected 3 audit records: %v", sink.records)
+	}
+	for i, record := range sink.records {
+		if record.Caller != ReaperIdentity || record.Outcome != AuditDryRun || record.Repository != expected[i+1].Name {
+			t.Errorf("Unexpected audit record: %+v", record)
+		}
+	}
+}
+
+func TestReaperDelete(t *testing.T) {
+	client := newReaperTestClient()
+	sink := &memorySink{}
+	reaper := NewReaper(client, ReaperConfig{
+		MaxAge:       90 * 24 * time.Hour,
+		MaxDeletions: 2,
+		Exclude:      []string{"binder/keep"},
+	}, NewAuditLog("test", sink))
+
+	report, err := reaper.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The oldest repositories are deleted first
+	if len(client.deleted) != 2 || client.deleted[0] != "other/stale" || client.deleted[1] != "binder/stale-2" {
+		t.Errorf("Unexpected deletions: %v", client.deleted)
+	}
+	if report.Count(ReapDeleted) != 2 || report.Count(ReapSkippedLimit) != 2 || report.Count(ReapFailed) != 1 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+
+	if len(sink.records) != 2 {
+		t.Fatalf("Expected 2 audit records: %v", sink.records)
+	}
+	record := sink.records[0]
+	if record.Caller != ReaperIdentity || record.Action != AuditDeleteRepository || record.Repository != "other/stale" ||
+		record.Outcome != AuditSuccess || len(record.UpstreamRequestIDs) != 1 || record.UpstreamRequestIDs[0] != "upstream-other/stale" {
+		t.Errorf("Unexpected audit record: %+v", record)
+	}
+}
+
+func TestReaperRecheck(t *testing.T) {
+	client := newReaperTestClient()
+	// Push an image to binder/stale-2 after it has been checked
+	checked := map[string]bool{}
+	client.onAllImages = func(repository string) {
+		if repository == "binder/stale-2" && checked[repository] {
+			client.images[repository] = append(client.images[repository], Image{Tag: "new", PushedAt: daysAgo(0)})
+		}
+		checked[repository] = true
+	}
+	reaper := NewReaper(client, ReaperConfig{
+		MaxAge:       90 * 24 * time.Hour,
+		MaxDeletions: 10,
+		Include:      []string{"binder/stale-*"},
+	}, nil)
+
+	report, err := reaper.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.deleted) != 1 || client.deleted[0] != "binder/stale-1" {
+		t.Errorf("Unexpected deletions: %v", client.deleted)
+	}
+	if report.Count(ReapDeleted) != 1 || report.Count(ReapSkippedActive) != 1 {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+}
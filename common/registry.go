@@ -4,13 +4,16 @@
 package common
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -26,58 +29,270 @@ type RegistryToken struct {
 	Expires  time.Time `json:"expires"`
 }
 
+// Repository is the provider independent response for a repository
+type Repository struct {
+	Name string `json:"name"`
+	// Image name including the registry host, for use with docker pull/push
+	URI     string     `json:"uri"`
+	Created *time.Time `json:"created,omitempty"`
+	// Omitted if the provider doesn't return them
+	ImageCount *int64 `json:"image_count,omitempty"`
+	SizeBytes  *int64 `json:"size_bytes,omitempty"`
+	// The raw provider response
+	Provider interface{} `json:"provider,omitempty"`
+}
+
+// Image is the provider independent response for a single tagged (or
+// untagged) image in a repository
+type Image struct {
+	Repository string `json:"repo"`
+	// Empty for untagged images
+	Tag       string     `json:"tag"`
+	Digest    string     `json:"digest"`
+	PushedAt  *time.Time `json:"pushed_at,omitempty"`
+	SizeBytes int64      `json:"size_bytes"`
+	// The raw provider response
+	Provider interface{} `json:"provider,omitempty"`
+}
+
+// NewImages returns an Image for each tag of an image, or a single untagged
+// Image if there are no tags
+func NewImages(repository string, tags []string, digest string, sizeBytes int64, pushedAt *time.Time, provider interface{}) []Image {
+	if len(tags) == 0 {
+		tags = []string{""}
+	}
+	images := make([]Image, len(tags))
+	for i, tag := range tags {
+		images[i] = Image{
+			Repository: repository,
+			Tag:        tag,
+			Digest:     digest,
+			PushedAt:   pushedAt,
+			SizeBytes:  sizeBytes,
+			Provider:   provider,
+		}
+	}
+	return images
+}
+
+// NextPageTokenHeader is the response header containing the token for the
+// next page of a paged list, it is omitted on the last page
+const NextPageTokenHeader = "X-Next-Page-Token"
+
+// ListParams contains the optional paging parameters for list requests
+type ListParams struct {
+	// Maximum number of items to return, 0 means the provider default
+	Limit int
+	// Token from a previous NextPageTokenHeader
+	PageToken string
+}
+
+// Paged returns true if the caller requested a single page of results,
+// otherwise all pages should be returned
+func (p ListParams) Paged() bool {
+	return p.Limit > 0 || p.PageToken != ""
+}
+
 var httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 	Namespace: "binderhub_container_registry_helper",
 	Name:      "api_response_time_seconds",
 	Help:      "Duration of API requests.",
 }, []string{"method", "path", "status"})
 
-// CheckAuthorised wraps originalHandler to check for a valid Authorization header
-// and returns a http.Handler
+type contextKey int
+
+const (
+	callerIdentityKey contextKey = iota
+	callerPermissionsKey
+	requestIDKey
+	spanAttributesKey
+	auditStateKey
+)
+
+// Caller identities used when a client certificate isn't used
+const (
+	AnonymousIdentity   = "anonymous"
+	BearerTokenIdentity = "bearer-token"
+	// Recorded in the audit log for requests that fail authentication
+	UnauthenticatedIdentity = "unauthenticated"
+)
+
+// Prefixes of caller identities from each authentication method, so a name in
+// one can't be mistaken for another or for the fixed identities above
+const (
+	TokenIdentityPrefix       = "token:"
+	CertificateIdentityPrefix = "cert:"
+	JWTIdentityPrefix         = "jwt:"
+)
+
+// WithCallerIdentity returns a copy of ctx with the identity of the caller
+func WithCallerIdentity(ctx context.Context, identity string) context.Context {
+	setAuditCaller(ctx, identity)
+	return context.WithValue(ctx, callerIdentityKey, identity)
+}
+
+// CallerIdentity returns the identity of the caller set by CheckAuthorised:
+// the prefixed API token name, client certificate subject or JWT subject,
+// BearerTokenIdentity, or AnonymousIdentity if authentication is disabled
+func CallerIdentity(ctx context.Context) string {
+	identity, ok := ctx.Value(callerIdentityKey).(string)
+	if !ok {
+		return AnonymousIdentity
+	}
+	return identity
+}
+
+// clientCertificateSubject returns the subject of a verified client
+// certificate, or "" if there isn't one
+func clientCertificateSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.String()
+}
+
+// BearerAuthenticator authenticates bearer tokens other than the shared
+// BINDERHUB_AUTH_TOKEN
+type BearerAuthenticator interface {
+	// Authenticate returns the caller identity and permissions for token, or
+	// "" if token isn't valid
+	Authenticate(ctx context.Context, token string) (string, *Permissions)
+}
+
+// CertificateAuthenticator is implemented by BearerAuthenticators that also
+// grant permissions to client certificates
+type CertificateAuthenticator interface {
+	// AuthenticateCertificate returns the permissions for a verified client
+	// certificate subject, or nil if the subject isn't allowed
+	AuthenticateCertificate(ctx context.Context, subject string) *Permissions
+}
+
+// certificatePermissions returns the permissions for the verified client
+// certificate of r, or nil if there isn't one or it isn't listed by any of
+// authenticators
+func certificatePermissions(r *http.Request, authenticators []BearerAuthenticator) (string, *Permissions) {
+	subject := clientCertificateSubject(r)
+	if subject == "" {
+		return "", nil
+	}
+	for _, a := range authenticators {
+		if c, ok := a.(CertificateAuthenticator); ok {
+			if permissions := c.AuthenticateCertificate(r.Context(), subject); permissions != nil {
+				return CertificateIdentityPrefix + subject, permissions
+			}
+		}
+	}
+	slog.InfoContext(r.Context(), "Client certificate subject not allowed", "subject", subject)
+	return "", nil
+}
+
+// CheckAuthorised wraps originalHandler to check for a valid Authorization
+// header and returns a http.Handler
 func CheckAuthorised(originalHandler http.Handler, authToken string) http.Handler {
+	return CheckAuthorisedTokens(originalHandler, authToken)
+}
+
+// CheckAuthorisedTokens is like CheckAuthorised but also accepts bearer tokens
+// that are valid for one of authenticators, and verified client certificates
+// with a subject listed by an authenticator that implements
+// CertificateAuthenticator, and adds their permissions to the request context.
+// authToken has full access.
+// Authentication is disabled if authToken is empty and there are no
+// authenticators.
+func CheckAuthorisedTokens(originalHandler http.Handler, authToken string, authenticators ...BearerAuthenticator) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authorised := false
-		if authToken == "" {
-			authorised = true
-		} else {
+		identity, permissions := certificatePermissions(r, authenticators)
+		switch {
+		case identity != "":
+			// Authenticated by the client certificate
+		case authToken == "" && len(authenticators) == 0:
+			identity = AnonymousIdentity
+		default:
 			authHeader := r.Header.Get("Authorization")
 			if strings.HasPrefix(authHeader, "Bearer ") {
 				bearerToken := strings.TrimPrefix(authHeader, "Bearer ")
-				authorised = (authToken == bearerToken)
+				if authToken != "" && subtle.ConstantTimeCompare([]byte(authToken), []byte(bearerToken)) == 1 {
+					identity = BearerTokenIdentity
+				} else {
+					for _, a := range authenticators {
+						identity, permissions = a.Authenticate(r.Context(), bearerToken)
+						if identity != "" {
+							break
+						}
+					}
+				}
 			}
 		}
 
-		if !authorised {
+		if identity == "" {
 			NotAuthorised(w, r)
 			return
 		}
-		originalHandler.ServeHTTP(w, r)
+		ctx := WithCallerIdentity(r.Context(), identity)
+		if permissions != nil {
+			ctx = WithCallerPermissions(ctx, permissions)
+		}
+		originalHandler.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-// InternalServerError is a handler that returns a 500 HTTP error
-func InternalServerError(w http.ResponseWriter, r *http.Request, errorResponse error) {
-	errObj := map[string]string{
-		"error": errorResponse.Error(),
-	}
-	jsonBytes := []byte(`{"error": "internal server error"}`)
-	var err error
-
+// returnErrorDetails returns true if internal error details should be
+// returned to clients
+func returnErrorDetails() bool {
 	return_error := strings.ToLower(os.Getenv("RETURN_ERROR_DETAILS"))
 	for _, v := range []string{"true", "1", "yes"} {
 		if return_error == v {
-			jsonBytes, err = json.Marshal(errObj)
-			if err != nil {
-				log.Println("ERROR:", err)
-			}
-			break
+			return true
+		}
+	}
+	return false
+}
+
+// InternalServerError is a handler that returns a 500 HTTP error, a 504 if
+// the error is caused by a call to the registry timing out, or a 503 if the
+// circuit breaker is open
+func InternalServerError(w http.ResponseWriter, r *http.Request, errorResponse error) {
+	if IsTimeout(errorResponse) {
+		GatewayTimeout(w, r, errorResponse)
+		return
+	}
+	var openErr *CircuitOpenError
+	if errors.As(errorResponse, &openErr) {
+		ServiceUnavailable(w, r, openErr)
+		return
+	}
+
+	jsonBytes := []byte(`{"error": "internal server error"}`)
+	if returnErrorDetails() {
+		var err error
+		jsonBytes, err = json.Marshal(map[string]string{
+			"error": errorResponse.Error(),
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to marshal error", "error", err)
 		}
 	}
 	jsonBytes = append(jsonBytes, byte('\n'))
 	w.WriteHeader(http.StatusInternalServerError)
 	_, errw := w.Write(jsonBytes)
 	if errw != nil {
-		log.Println("ERROR:", errw)
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// BadRequest is a handler that returns a 400 HTTP error
+func BadRequest(w http.ResponseWriter, r *http.Request, errorResponse error) {
+	jsonBytes, err := json.Marshal(map[string]string{
+		"error": errorResponse.Error(),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to marshal error", "error", err)
+	}
+	jsonBytes = append(jsonBytes, byte('\n'))
+	w.WriteHeader(http.StatusBadRequest)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
 	}
 }
 
@@ -86,17 +301,17 @@ func NotFound(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 	_, errw := w.Write([]byte("null\n"))
 	if errw != nil {
-		log.Println("ERROR:", errw)
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
 	}
 }
 
 // NotAuthorised is a handler that returns a 403 HTTP error
 func NotAuthorised(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("NotAuthorised %r", r)
+	slog.InfoContext(r.Context(), "Not authorised", "method", r.Method, "path", r.URL.Path)
 	w.WriteHeader(http.StatusForbidden)
 	_, errw := w.Write([]byte(`{"error": "not authorised"}` + "\n"))
 	if errw != nil {
-		log.Println("ERROR:", errw)
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
 	}
 }
 
@@ -110,6 +325,16 @@ func RepoGetName(r *http.Request) (string, error) {
 	return name, nil
 }
 
+// ImagesGetName extracts the repository name from an /images/ request path
+func ImagesGetName(r *http.Request) (string, error) {
+	if !strings.HasPrefix(r.URL.Path, "/images/") {
+		err := fmt.Sprintf("Invalid path: %s", r.URL.Path)
+		return "", errors.New(err)
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/images/")
+	return name, nil
+}
+
 // ImageGetNameAndTag extracts the repository name and tag from the request path
 func ImageGetNameAndTag(r *http.Request) (string, string, error) {
 	if !strings.HasPrefix(r.URL.Path, "/image/") {
@@ -134,21 +359,99 @@ func ImageGetNameAndTag(r *http.Request) (string, string, error) {
 	return repoName, tag, nil
 }
 
+// TokenGetName extracts the repository name from a /token request path. The
+// tag is removed since BinderHub requests /token/{name}:{tag}, and the name
+// is empty for /token.
+func TokenGetName(r *http.Request) (string, error) {
+	match := tokenRe.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		err := fmt.Sprintf("Invalid path: %s", r.URL.Path)
+		return "", errors.New(err)
+	}
+	name := strings.TrimPrefix(match[1], "/")
+	if sep := strings.LastIndex(name, ":"); sep > -1 {
+		name = name[:sep]
+	}
+	return name, nil
+}
+
+// ListGetParams extracts the limit and page_token query parameters
+func ListGetParams(r *http.Request) (ListParams, error) {
+	params := ListParams{
+		PageToken: r.URL.Query().Get("page_token"),
+	}
+	limit := r.URL.Query().Get("limit")
+	if limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 {
+			return params, fmt.Errorf("invalid limit: %s", limit)
+		}
+		params.Limit = l
+	}
+	return params, nil
+}
+
 var (
 	listReposRe = regexp.MustCompile(`^/repos/$`)
 	repoRe      = regexp.MustCompile(`^/repo/(\S+)$`)
 	imageRe     = regexp.MustCompile(`^/image/(\S+)$`)
+	imagesRe    = regexp.MustCompile(`^/images/(\S+)$`)
 	tokenRe     = regexp.MustCompile(`^/token(/\S*)?$`)
 )
 
+// ErrRepositoryNotFound is returned by IRepositoryManager if a repository
+// doesn't exist
+var ErrRepositoryNotFound = errors.New("repository not found")
+
+// IRepositoryManager lists and deletes repositories outside an HTTP request,
+// for background tasks such as the reaper
+type IRepositoryManager interface {
+	// AllRepositories returns all repositories, following pagination
+	AllRepositories(ctx context.Context) ([]Repository, error)
+	// AllImages returns all images in a repository, or ErrRepositoryNotFound
+	AllImages(ctx context.Context, repository string) ([]Image, error)
+	// RemoveRepository deletes a repository, it must succeed if the repository
+	// doesn't exist
+	RemoveRepository(ctx context.Context, repository string) error
+}
+
 // IRegistryClient is an interface that all registry helpers must implement
 type IRegistryClient interface {
+	IRepositoryManager
 	ListRepositories(w http.ResponseWriter, r *http.Request)
 	GetRepository(w http.ResponseWriter, r *http.Request)
 	GetImage(w http.ResponseWriter, r *http.Request)
+	// ListImages returns a list of Image in a repository
+	ListImages(w http.ResponseWriter, r *http.Request)
 	CreateRepository(w http.ResponseWriter, r *http.Request)
 	DeleteRepository(w http.ResponseWriter, r *http.Request)
+	// DeleteImage deletes a single image tag, it must succeed if the tag
+	// doesn't exist
+	DeleteImage(w http.ResponseWriter, r *http.Request)
 	GetToken(w http.ResponseWriter, r *http.Request)
+	// HealthCheck makes a cheap call to the registry API to check it's
+	// reachable and the credentials are valid
+	HealthCheck(ctx context.Context) error
+}
+
+// IRepositoryTokens is implemented by registry clients whose GetToken
+// credentials aren't valid for the whole registry. Other clients return
+// credentials that can push to any repository in the registry.
+type IRepositoryTokens interface {
+	// TokenScope returns the prefix of the repositories that the GetToken
+	// credentials for repository can access, e.g. "project/" if they're valid
+	// for every repository in a project, or "" for the whole registry
+	TokenScope(repository string) string
+}
+
+// tokenScope returns the prefix of the repositories that client's credentials
+// for repository can access, "" means the whole registry
+func tokenScope(client IRegistryClient, repository string) string {
+	scoped, ok := client.(IRepositoryTokens)
+	if !ok {
+		return ""
+	}
+	return scoped.TokenScope(repository)
 }
 
 // RegistryServer is http.handler that passes requests to the registry helper implementation
@@ -185,47 +488,128 @@ func prometheusMiddleware(originalHandler http.Handler) http.Handler {
 	})
 }
 
+// imageRepository returns the repository name from an /image/ path, or "" if
+// the path is invalid
+func imageRepository(r *http.Request) string {
+	name, _, err := ImageGetNameAndTag(r)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// allowed checks the caller has scope for repository, and returns a 403 error
+// if not
+func allowed(w http.ResponseWriter, r *http.Request, scope string, repository string) bool {
+	if !CallerPermissions(r.Context()).Allowed(scope, repository) {
+		slog.InfoContext(r.Context(), "Caller does not have scope", "caller", CallerIdentity(r.Context()), "scope", scope, "repository", repository)
+		NotAuthorised(w, r)
+		return false
+	}
+	return true
+}
+
+// allowedAll returns true if the caller has scope for every repository
+// starting with prefix, otherwise it returns a 403 error
+func allowedAll(w http.ResponseWriter, r *http.Request, scope string, prefix string) bool {
+	if !CallerPermissions(r.Context()).AllowedAll(scope, prefix) {
+		slog.InfoContext(r.Context(), "Caller does not have scope for all repositories", "caller", CallerIdentity(r.Context()), "scope", scope, "prefix", prefix)
+		NotAuthorised(w, r)
+		return false
+	}
+	return true
+}
+
 // ServeHTTP passes requests to the registry helper implementation
 func (h *RegistryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("content-type", "application/json")
 	switch {
 	case r.Method == http.MethodGet && listReposRe.MatchString(r.URL.Path):
-		h.Client.ListRepositories(w, r)
+		if allowed(w, r, ScopeRepoRead, "") {
+			h.Client.ListRepositories(w, r)
+		}
 		return
 	case r.Method == http.MethodGet && repoRe.MatchString(r.URL.Path):
-		h.Client.GetRepository(w, r)
+		if allowed(w, r, ScopeRepoRead, repoRe.FindStringSubmatch(r.URL.Path)[1]) {
+			h.Client.GetRepository(w, r)
+		}
 		return
 	case r.Method == http.MethodGet && imageRe.MatchString(r.URL.Path):
-		h.Client.GetImage(w, r)
+		if allowed(w, r, ScopeImageRead, imageRepository(r)) {
+			h.Client.GetImage(w, r)
+		}
+		return
+	case r.Method == http.MethodGet && imagesRe.MatchString(r.URL.Path):
+		if allowed(w, r, ScopeImageRead, imagesRe.FindStringSubmatch(r.URL.Path)[1]) {
+			h.Client.ListImages(w, r)
+		}
 		return
 	case r.Method == http.MethodPost && repoRe.MatchString(r.URL.Path):
-		h.Client.CreateRepository(w, r)
+		if allowed(w, r, ScopeRepoWrite, repoRe.FindStringSubmatch(r.URL.Path)[1]) {
+			h.Client.CreateRepository(w, r)
+		}
 		return
 	case r.Method == http.MethodDelete && repoRe.MatchString(r.URL.Path):
-		h.Client.DeleteRepository(w, r)
+		if allowed(w, r, ScopeRepoDelete, repoRe.FindStringSubmatch(r.URL.Path)[1]) {
+			h.Client.DeleteRepository(w, r)
+		}
+		return
+	case r.Method == http.MethodDelete && imageRe.MatchString(r.URL.Path):
+		if allowed(w, r, ScopeRepoDelete, imageRepository(r)) {
+			h.Client.DeleteImage(w, r)
+		}
 		return
 	case r.Method == http.MethodPost && tokenRe.MatchString(r.URL.Path):
-		h.Client.GetToken(w, r)
+		repository, _ := TokenGetName(r)
+		// The credentials can push to every repository in their scope, not
+		// just the requested one
+		if allowed(w, r, ScopeTokenIssue, repository) && allowedAll(w, r, ScopeTokenIssue, tokenScope(h.Client, repository)) {
+			h.Client.GetToken(w, r)
+		}
 		return
 	default:
-		log.Printf("Invalid request: %s %s", r.Method, r.URL.Path)
+		slog.InfoContext(r.Context(), "Invalid request", "method", r.Method, "path", r.URL.Path)
 		NotFound(w, r)
 		return
 	}
 }
 
-// CreateServer configures a new http handler for the registry helper
-func CreateServer(mux *http.ServeMux, registryH IRegistryClient, authToken string, promRegistry *prometheus.Registry) {
-	serverH := &RegistryServer{
+// CreateServer configures a new http handler for the registry helper.
+// limiter and audit are optional, if nil requests aren't rate limited or
+// audited.
+func CreateServer(mux *http.ServeMux, registryH IRegistryClient, authToken string, authenticators []BearerAuthenticator, limiter *RateLimiter, audit *AuditLog, promRegistry *prometheus.Registry) {
+	var serverH http.Handler = &RegistryServer{
 		Client: registryH,
 	}
-	authorisedH := CheckAuthorised(serverH, authToken)
-	h := prometheusMiddleware(authorisedH)
+	if limiter != nil {
+		serverH = rateLimitMiddleware(serverH, limiter)
+	}
+	authorisedH := CheckAuthorisedTokens(serverH, authToken, authenticators...)
+	// Outside authentication so requests that fail it are audited
+	if audit != nil {
+		authorisedH = auditMiddleware(authorisedH, audit)
+	}
+	h := tracingMiddleware(requestIDMiddleware(prometheusMiddleware(requestDeadlineMiddleware(authorisedH))))
 
 	mux.Handle("/repos/", h)
 	mux.Handle("/repo/", h)
 	mux.Handle("/image/", h)
+	mux.Handle("/images/", h)
 	mux.Handle("/token/", h)
 
 	promRegistry.MustRegister(httpDuration)
+	promRegistry.MustRegister(upstreamDuration)
+	promRegistry.MustRegister(upstreamErrors)
+	promRegistry.MustRegister(cacheRequests)
+	promRegistry.MustRegister(upstreamRetries)
+	promRegistry.MustRegister(circuitBreakerState)
+	promRegistry.MustRegister(circuitBreakerTransitions)
+	promRegistry.MustRegister(rateLimitRequests)
+	promRegistry.MustRegister(rateLimitTokens)
+	promRegistry.MustRegister(auditRecords)
+	promRegistry.MustRegister(auditSinkErrors)
+	promRegistry.MustRegister(reaperRuns)
+	promRegistry.MustRegister(reaperRepositories)
+	promRegistry.MustRegister(reaperLastRun)
+	promRegistry.MustRegister(reaperLastRunRepositories)
 }
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 type mockHandler struct {
@@ -106,3 +107,100 @@ func TestImageGetNameAndTag(t *testing.T) {
 		}
 	}
 }
+
+func TestTokenGetName(t *testing.T) {
+	testCases := []struct {
+		path     string
+		expected string
+		valid    bool
+	}{
+		{"/token", "", true},
+		{"/token/", "", true},
+		{"/token/binder/image", "binder/image", true},
+		{"/token/binder/image:tag", "binder/image", true},
+		{"/repo/binder/image", "", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tc.path, http.NoBody)
+			name, err := TokenGetName(req)
+			if (err == nil) != tc.valid || name != tc.expected {
+				t.Errorf("Unexpected result: %s %v", name, err)
+			}
+		})
+	}
+}
+
+func TestListGetParams(t *testing.T) {
+	testCases := []struct {
+		query     string
+		limit     int
+		pageToken string
+		paged     bool
+		valid     bool
+	}{
+		{"", 0, "", false, true},
+		{"?limit=10", 10, "", true, true},
+		{"?page_token=abc%3D", 0, "abc=", true, true},
+		{"?limit=5&page_token=abc", 5, "abc", true, true},
+		{"?limit=0", 0, "", false, false},
+		{"?limit=-1", 0, "", false, false},
+		{"?limit=x", 0, "", false, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/repos/"+tc.query, http.NoBody)
+			params, err := ListGetParams(req)
+			if tc.valid != (err == nil) {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if !tc.valid {
+				return
+			}
+			if params.Limit != tc.limit || params.PageToken != tc.pageToken || params.Paged() != tc.paged {
+				t.Errorf("Unexpected params: %v", params)
+			}
+		})
+	}
+}
+
+func TestImagesGetName(t *testing.T) {
+	{
+		req := httptest.NewRequest("GET", "/image/existing-image", http.NoBody)
+		_, err := ImagesGetName(req)
+		if err == nil {
+			t.Errorf("Expected error: %v", err)
+		}
+	}
+
+	{
+		req := httptest.NewRequest("GET", "/images/nested/existing-image", http.NoBody)
+		r, err := ImagesGetName(req)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if r != "nested/existing-image" {
+			t.Errorf("Unexpected repository name: %v", r)
+		}
+	}
+}
+
+func TestNewImages(t *testing.T) {
+	pushed := time.Date(2023, 1, 1, 12, 34, 56, 0, time.UTC)
+
+	images := NewImages("repo", []string{"a", "b"}, "sha256:1234", 10, &pushed, map[string]string{"id": "1"})
+	if len(images) != 2 || images[0].Tag != "a" || images[1].Tag != "b" {
+		t.Errorf("Unexpected images: %v", images)
+	}
+	for _, image := range images {
+		if image.Repository != "repo" || image.Digest != "sha256:1234" || image.SizeBytes != 10 || !image.PushedAt.Equal(pushed) || image.Provider.(map[string]string)["id"] != "1" {
+			t.Errorf("Unexpected image: %v", image)
+		}
+	}
+
+	untagged := NewImages("repo", nil, "sha256:5678", 0, nil, nil)
+	if len(untagged) != 1 || untagged[0].Tag != "" || untagged[0].Digest != "sha256:5678" {
+		t.Errorf("Unexpected images: %v", untagged)
+	}
+}
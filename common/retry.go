@@ -0,0 +1,330 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	UPSTREAM_RETRY_MAX_ATTEMPTS_ENV_VAR           = "UPSTREAM_RETRY_MAX_ATTEMPTS"
+	UPSTREAM_CIRCUIT_BREAKER_FAILURES_ENV_VAR     = "UPSTREAM_CIRCUIT_BREAKER_FAILURES"
+	UPSTREAM_CIRCUIT_BREAKER_OPEN_SECONDS_ENV_VAR = "UPSTREAM_CIRCUIT_BREAKER_OPEN_SECONDS"
+)
+
+const (
+	defaultRetryMaxAttempts          = 3
+	defaultCircuitBreakerFailures    = 5
+	defaultCircuitBreakerOpenSeconds = 30
+)
+
+// Exponential backoff between attempts, the actual delay is a random duration
+// up to this
+const (
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 2 * time.Second
+)
+
+// The retry budget is a token bucket: each retry costs one token, each
+// successful call refunds a fraction of a token. This stops retries from
+// multiplying the load on the registry API when most calls are failing.
+const (
+	retryBudgetMax    = 10
+	retryBudgetRefund = 0.1
+)
+
+var upstreamRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "upstream_retries_total",
+	Help:      "Total number of retried calls to the registry API.",
+}, []string{"provider", "operation"})
+
+var circuitBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "circuit_breaker_state",
+	Help:      "State of the registry API circuit breaker: 0 closed, 1 half-open, 2 open.",
+}, []string{"provider"})
+
+var circuitBreakerTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "circuit_breaker_transitions_total",
+	Help:      "Total number of registry API circuit breaker state changes by new state.",
+}, []string{"provider", "state"})
+
+// RetryConfig configures retries and the circuit breaker for calls to the
+// registry API
+type RetryConfig struct {
+	// Maximum number of attempts for each call, 1 disables retries
+	MaxAttempts int
+	// Number of consecutive failed calls before the circuit breaker opens, 0
+	// disables the circuit breaker
+	CircuitBreakerFailures int
+	// Time the circuit breaker stays open before a trial call is allowed
+	CircuitBreakerOpen time.Duration
+}
+
+func envvarInt(name string, defaultValue int, minimum int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return defaultValue, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < minimum {
+		return 0, fmt.Errorf("invalid %s: %s", name, v)
+	}
+	return i, nil
+}
+
+// RetryConfigFromEnv reads the retry configuration from environment variables
+func RetryConfigFromEnv() (RetryConfig, error) {
+	config := RetryConfig{}
+	var err error
+	config.MaxAttempts, err = envvarInt(UPSTREAM_RETRY_MAX_ATTEMPTS_ENV_VAR, defaultRetryMaxAttempts, 1)
+	if err != nil {
+		return config, err
+	}
+	config.CircuitBreakerFailures, err = envvarInt(UPSTREAM_CIRCUIT_BREAKER_FAILURES_ENV_VAR, defaultCircuitBreakerFailures, 0)
+	if err != nil {
+		return config, err
+	}
+	openSeconds, err := envvarInt(UPSTREAM_CIRCUIT_BREAKER_OPEN_SECONDS_ENV_VAR, defaultCircuitBreakerOpenSeconds, 1)
+	if err != nil {
+		return config, err
+	}
+	config.CircuitBreakerOpen = time.Duration(openSeconds) * time.Second
+	return config, nil
+}
+
+// CircuitOpenError is returned without calling the registry API when the
+// circuit breaker is open
+type CircuitOpenError struct {
+	Provider   string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s registry API unavailable, retry after %v", e.Provider, e.RetryAfter)
+}
+
+// ServiceUnavailable is a handler that returns a 503 HTTP error with a
+// Retry-After header
+func ServiceUnavailable(w http.ResponseWriter, r *http.Request, errorResponse *CircuitOpenError) {
+	jsonBytes := []byte(`{"error": "upstream unavailable"}`)
+	if returnErrorDetails() {
+		var err error
+		jsonBytes, err = json.Marshal(map[string]string{
+			"error":   "upstream unavailable",
+			"details": errorResponse.Error(),
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to marshal error", "error", err)
+		}
+	}
+	jsonBytes = append(jsonBytes, byte('\n'))
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(errorResponse.RetryAfter.Seconds()))))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker fails calls without calling the registry API after too many
+// consecutive failures. Once it has been open for openDuration a single trial
+// call is allowed: if it succeeds the breaker closes, otherwise it reopens.
+type circuitBreaker struct {
+	provider     string
+	threshold    int
+	openDuration time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	if state == b.state {
+		return
+	}
+	slog.Warn("Circuit breaker state changed", "provider", b.provider, "from", b.state.String(), "to", state.String())
+	b.state = state
+	circuitBreakerState.WithLabelValues(b.provider).Set(float64(state))
+	circuitBreakerTransitions.WithLabelValues(b.provider, state.String()).Inc()
+}
+
+// allow returns nil if a call may be made, otherwise a CircuitOpenError
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen {
+		if remaining := b.openDuration - time.Since(b.openedAt); remaining > 0 {
+			return &CircuitOpenError{Provider: b.provider, RetryAfter: remaining}
+		}
+		b.setState(breakerHalfOpen)
+	}
+	if b.state == breakerHalfOpen {
+		if b.trial {
+			return &CircuitOpenError{Provider: b.provider, RetryAfter: time.Second}
+		}
+		b.trial = true
+	}
+	return nil
+}
+
+// record records the result of a call allowed by allow
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if !failed {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// Retrier retries calls to the registry API that fail with a retryable error
+type Retrier struct {
+	provider    string
+	maxAttempts int
+	// Returns true if the call failed with an error that may succeed if
+	// retried, such as throttling
+	retryable func(error) bool
+	// nil if disabled
+	breaker *circuitBreaker
+
+	mu     sync.Mutex
+	budget float64
+}
+
+// NewRetrier returns a Retrier for a provider. retryable classifies the
+// provider's errors.
+func NewRetrier(provider string, config RetryConfig, retryable func(error) bool) *Retrier {
+	r := &Retrier{
+		provider:    provider,
+		maxAttempts: config.MaxAttempts,
+		retryable:   retryable,
+		budget:      retryBudgetMax,
+	}
+	if config.CircuitBreakerFailures > 0 {
+		r.breaker = &circuitBreaker{
+			provider:     provider,
+			threshold:    config.CircuitBreakerFailures,
+			openDuration: config.CircuitBreakerOpen,
+		}
+		circuitBreakerState.WithLabelValues(provider).Set(float64(breakerClosed))
+	}
+	return r
+}
+
+// withdraw takes a token from the retry budget, returning false if it's empty
+func (r *Retrier) withdraw() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.budget < 1 {
+		return false
+	}
+	r.budget--
+	return true
+}
+
+func (r *Retrier) refund() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.budget = math.Min(r.budget+retryBudgetRefund, retryBudgetMax)
+}
+
+// backoffLimit returns the maximum delay before retry attempt (starting from 1)
+func backoffLimit(attempt int) time.Duration {
+	limit := retryBaseDelay << (attempt - 1)
+	if limit > retryMaxDelay || limit <= 0 {
+		limit = retryMaxDelay
+	}
+	return limit
+}
+
+// backoff returns a random delay up to limit
+func backoff(limit time.Duration) time.Duration {
+	// #nosec G404 -- jitter doesn't need a secure random number
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+// Retry calls call until it succeeds, fails with an error that isn't
+// retryable, or runs out of attempts or retry budget.
+// All attempts share the deadline of ctx, so retrying stops if the time
+// remaining is less than the backoff.
+// Timeouts and retryable errors count as failures for the circuit breaker.
+func Retry[T any](ctx context.Context, r *Retrier, operation string, call func(context.Context) (T, error)) (T, error) {
+	var response T
+	var err error
+	for attempt := 1; ; attempt++ {
+		if r.breaker != nil {
+			if openErr := r.breaker.allow(); openErr != nil {
+				return response, openErr
+			}
+		}
+		response, err = call(ctx)
+		retryable := err != nil && r.retryable(err)
+		if r.breaker != nil {
+			r.breaker.record(retryable || (err != nil && IsTimeout(err)))
+		}
+		if err == nil {
+			r.refund()
+			return response, nil
+		}
+		limit := backoffLimit(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < limit {
+			return response, err
+		}
+		if !retryable || attempt >= r.maxAttempts || ctx.Err() != nil || !r.withdraw() {
+			return response, err
+		}
+
+		upstreamRetries.WithLabelValues(r.provider, operation).Inc()
+		delay := backoff(limit)
+		slog.DebugContext(ctx, "Retrying upstream call", "operation", operation, "attempt", attempt, "delay", delay, "error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return response, err
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var errRetryable = errors.New("throttled")
+
+func isRetryable(err error) bool {
+	return errors.Is(err, errRetryable)
+}
+
+// failingCall returns a call that fails with err the first n times
+func failingCall(n int, err error) (func(context.Context) (string, error), *int) {
+	calls := 0
+	return func(ctx context.Context) (string, error) {
+		calls++
+		if calls <= n {
+			return "", err
+		}
+		return "ok", nil
+	}, &calls
+}
+
+func TestRetryConfigFromEnv(t *testing.T) {
+	config, err := RetryConfigFromEnv()
+	if err != nil || config.MaxAttempts != 3 || config.CircuitBreakerFailures != 5 || config.CircuitBreakerOpen != 30*time.Second {
+		t.Errorf("Unexpected default config: %v %v", config, err)
+	}
+
+	t.Setenv(UPSTREAM_RETRY_MAX_ATTEMPTS_ENV_VAR, "0")
+	_, err = RetryConfigFromEnv()
+	if err == nil {
+		t.Errorf("Expected error for 0 attempts")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	testCases := []struct {
+		name          string
+		failures      int
+		err           error
+		expectedCalls int
+		shouldError   bool
+	}{
+		{"success", 0, nil, 1, false},
+		{"retried", 2, errRetryable, 3, false},
+		{"attempts-exceeded", 3, errRetryable, 3, true},
+		{"not-retryable", 1, errors.New("not found"), 1, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewRetrier("test", RetryConfig{MaxAttempts: 3}, isRetryable)
+			retries := testutil.ToFloat64(upstreamRetries.WithLabelValues("test", tc.name))
+			call, calls := failingCall(tc.failures, tc.err)
+			response, err := Retry(context.Background(), r, tc.name, call)
+			if (err != nil) != tc.shouldError || (err == nil && response != "ok") {
+				t.Errorf("Unexpected result: %s %v", response, err)
+			}
+			if *calls != tc.expectedCalls {
+				t.Errorf("Expected %d calls: %d", tc.expectedCalls, *calls)
+			}
+			if r := testutil.ToFloat64(upstreamRetries.WithLabelValues("test", tc.name)) - retries; r != float64(tc.expectedCalls-1) {
+				t.Errorf("Expected %d retries: %f", tc.expectedCalls-1, r)
+			}
+		})
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	r := NewRetrier("test", RetryConfig{MaxAttempts: 10}, isRetryable)
+	// Enough time for the first backoff but not the second
+	ctx, cancel := context.WithTimeout(context.Background(), retryBaseDelay+retryBaseDelay/2)
+	defer cancel()
+
+	call, calls := failingCall(10, errRetryable)
+	_, err := Retry(ctx, r, "test", call)
+	if !errors.Is(err, errRetryable) {
+		t.Errorf("Expected the last error: %v", err)
+	}
+	if *calls != 2 {
+		t.Errorf("Expected 2 calls: %d", *calls)
+	}
+	if ctx.Err() != nil {
+		t.Errorf("Expected retrying to stop before the deadline")
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	r := NewRetrier("test", RetryConfig{MaxAttempts: 2}, isRetryable)
+	r.budget = 1
+
+	call, calls := failingCall(10, errRetryable)
+	_, _ = Retry(context.Background(), r, "test", call)
+	_, _ = Retry(context.Background(), r, "test", call)
+	// Only the first call is retried
+	if *calls != 3 {
+		t.Errorf("Expected 3 calls: %d", *calls)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	r := NewRetrier("test-breaker", RetryConfig{MaxAttempts: 1, CircuitBreakerFailures: 2, CircuitBreakerOpen: 50 * time.Millisecond}, isRetryable)
+	opened := testutil.ToFloat64(circuitBreakerTransitions.WithLabelValues("test-breaker", "open"))
+
+	call, calls := failingCall(3, errRetryable)
+	for i := 0; i < 2; i++ {
+		_, err := Retry(context.Background(), r, "test", call)
+		if !errors.Is(err, errRetryable) {
+			t.Errorf("Expected upstream error: %v", err)
+		}
+	}
+
+	// Open
+	_, err := Retry(context.Background(), r, "test", call)
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) || openErr.RetryAfter <= 0 || *calls != 2 {
+		t.Errorf("Expected circuit to be open: %v %d", err, *calls)
+	}
+	if s := testutil.ToFloat64(circuitBreakerState.WithLabelValues("test-breaker")); s != float64(breakerOpen) {
+		t.Errorf("Expected open state: %f", s)
+	}
+	if o := testutil.ToFloat64(circuitBreakerTransitions.WithLabelValues("test-breaker", "open")) - opened; o != 1 {
+		t.Errorf("Expected 1 open transition: %f", o)
+	}
+
+	// Half-open, the trial call fails so it reopens
+	time.Sleep(60 * time.Millisecond)
+	_, err = Retry(context.Background(), r, "test", call)
+	if !errors.Is(err, errRetryable) || *calls != 3 {
+		t.Errorf("Expected trial call: %v %d", err, *calls)
+	}
+	_, err = Retry(context.Background(), r, "test", call)
+	if !errors.As(err, &openErr) {
+		t.Errorf("Expected circuit to be open: %v", err)
+	}
+
+	// Half-open, the trial call succeeds so it closes
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		_, err = Retry(context.Background(), r, "test", call)
+		if err != nil {
+			t.Errorf("Expected success: %v", err)
+		}
+	}
+	if s := testutil.ToFloat64(circuitBreakerState.WithLabelValues("test-breaker")); s != float64(breakerClosed) {
+		t.Errorf("Expected closed state: %f", s)
+	}
+}
+
+func TestServiceUnavailable(t *testing.T) {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/repo/test", http.NoBody)
+	InternalServerError(w, req, &CircuitOpenError{Provider: "test", RetryAfter: 1500 * time.Millisecond})
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "2" || w.Body.String() != `{"error": "upstream unavailable"}`+"\n" {
+		t.Errorf("Unexpected response: %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+}
@@ -0,0 +1,64 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const BACKGROUND_TASKS_ENABLED_ENV_VAR = "BACKGROUND_TASKS_ENABLED"
+
+// BackgroundTasksEnabled returns true if periodic tasks that modify the
+// registry, such as the reaper, should run in this process. There's no leader
+// election, so this is disabled by default and should only be enabled in one
+// replica.
+func BackgroundTasksEnabled() (bool, error) {
+	v := os.Getenv(BACKGROUND_TASKS_ENABLED_ENV_VAR)
+	if v == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %s", BACKGROUND_TASKS_ENABLED_ENV_VAR, v)
+	}
+	return enabled, nil
+}
+
+// IBackgroundTasks is implemented by registry clients that do work outside
+// requests, such as enforcing a retention policy
+type IBackgroundTasks interface {
+	// RunBackgroundTasks runs until ctx is cancelled. scheduled is false if
+	// BACKGROUND_TASKS_ENABLED is false, in which case periodic tasks that
+	// modify the registry must not run unless they're safe to run in every
+	// replica.
+	RunBackgroundTasks(ctx context.Context, scheduled bool)
+}
+
+// taskGroup runs goroutines that are stopped when the service shuts down
+type taskGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newTaskGroup(ctx context.Context) *taskGroup {
+	ctx, cancel := context.WithCancel(ctx)
+	return &taskGroup{ctx: ctx, cancel: cancel}
+}
+
+// Go runs task in a goroutine, task must return when ctx is cancelled
+func (g *taskGroup) Go(task func(ctx context.Context)) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		task(g.ctx)
+	}()
+}
+
+// Stop cancels all tasks and waits for them to return
+func (g *taskGroup) Stop() {
+	g.cancel()
+	g.wg.Wait()
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackgroundTasksEnabled(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected bool
+		err      bool
+	}{
+		{"", false, false},
+		{"true", true, false},
+		{"false", false, false},
+		{"invalid", false, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			t.Setenv(BACKGROUND_TASKS_ENABLED_ENV_VAR, tc.value)
+			enabled, err := BackgroundTasksEnabled()
+			if enabled != tc.expected || (err != nil) != tc.err {
+				t.Errorf("Unexpected result: %t %v", enabled, err)
+			}
+		})
+	}
+}
+
+func TestTaskGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tasks := newTaskGroup(ctx)
+	finished := make(chan string, 2)
+	for _, name := range []string{"a", "b"} {
+		name := name
+		tasks.Go(func(ctx context.Context) {
+			<-ctx.Done()
+			// Stop waits for tasks that take time to clean up
+			time.Sleep(10 * time.Millisecond)
+			finished <- name
+		})
+	}
+
+	tasks.Stop()
+	if len(finished) != 2 {
+		t.Errorf("Expected Stop to wait for all tasks: %d", len(finished))
+	}
+	if ctx.Err() != nil {
+		t.Errorf("Stop shouldn't cancel the parent context")
+	}
+}
@@ -0,0 +1,152 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader loads the server certificate and client CAs, and reloads them
+// if the files are modified, e.g. when a Kubernetes secret is updated
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu        sync.Mutex
+	modTimes  map[string]time.Time
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func newCertReloader(config ServerConfig) (*certReloader, error) {
+	c := &certReloader{
+		certFile: config.TLSCertFile,
+		keyFile:  config.TLSKeyFile,
+		caFile:   config.TLSClientCAFile,
+	}
+	// Fail immediately if the initial files are invalid
+	_, _, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) files() []string {
+	files := []string{c.certFile, c.keyFile}
+	if c.caFile != "" {
+		files = append(files, c.caFile)
+	}
+	return files
+}
+
+// load returns the current certificate and client CAs, reloading them if any
+// of the files have changed
+func (c *certReloader) load() (*tls.Certificate, *x509.CertPool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The files may be part way through being updated, keep using the old
+	// certificates if there are any
+	failed := func(err error) (*tls.Certificate, *x509.CertPool, error) {
+		if c.cert != nil {
+			slog.Error("Failed to reload TLS certificates", "error", err)
+			return c.cert, c.clientCAs, nil
+		}
+		return nil, nil, err
+	}
+
+	modTimes := map[string]time.Time{}
+	changed := c.cert == nil
+	for _, f := range c.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return failed(err)
+		}
+		modTimes[f] = info.ModTime()
+		if !info.ModTime().Equal(c.modTimes[f]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return c.cert, c.clientCAs, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return failed(err)
+	}
+
+	var clientCAs *x509.CertPool
+	if c.caFile != "" {
+		pem, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return failed(err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return failed(fmt.Errorf("no certificates found in %s", c.caFile))
+		}
+	}
+
+	if c.cert != nil {
+		slog.Info("Reloaded TLS certificates")
+	}
+	c.cert = &cert
+	c.clientCAs = clientCAs
+	c.modTimes = modTimes
+	return c.cert, c.clientCAs, nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _, err := c.load()
+	return cert, err
+}
+
+// configForClient returns a copy of the server's base config, so settings such
+// as NextProtos are kept, with the current certificate and client CAs
+func (c *certReloader) configForClient(base *tls.Config) (*tls.Config, error) {
+	cert, clientCAs, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	config := base.Clone()
+	config.GetCertificate = nil
+	config.GetConfigForClient = nil
+	config.Certificates = []tls.Certificate{*cert}
+	if clientCAs != nil {
+		// Client certificates are optional so that health checks and bearer
+		// tokens still work
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		config.ClientCAs = clientCAs
+	}
+	return config, nil
+}
+
+// newTLSConfig returns a TLS configuration that reloads the certificates
+// when they change, or nil if TLS is disabled
+func newTLSConfig(config ServerConfig) (*tls.Config, error) {
+	if !config.TLS() {
+		return nil, nil
+	}
+	reloader, err := newCertReloader(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+		// http.Server only adds these to a copy of the config, so they must
+		// be set here to be kept by configForClient
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return reloader.configForClient(tlsConfig)
+	}
+	return tlsConfig, nil
+}
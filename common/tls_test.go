@@ -0,0 +1,275 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA if
+// parent is nil
+func newTestCert(t *testing.T, cn string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"binderhub"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	err := os.WriteFile(path, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ensure the modification time changes even if the filesystem has a
+	// coarse resolution
+	err = os.Chtimes(path, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil, 0)
+	server := newTestCert(t, "server-1", ca, x509.ExtKeyUsageServerAuth)
+	client := newTestCert(t, "binderhub", ca, x509.ExtKeyUsageClientAuth)
+	// Signed by the CA but not listed in the token file
+	unlisted := newTestCert(t, "other-workload", ca, x509.ExtKeyUsageClientAuth)
+	untrusted := newTestCert(t, "untrusted", newTestCert(t, "other-ca", nil, 0), x509.ExtKeyUsageClientAuth)
+
+	config := ServerConfig{
+		TLSCertFile:     filepath.Join(dir, "tls.crt"),
+		TLSKeyFile:      filepath.Join(dir, "tls.key"),
+		TLSClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	modTime := time.Now().Add(-time.Minute)
+	writeFile(t, config.TLSCertFile, server.certPEM, modTime)
+	writeFile(t, config.TLSKeyFile, server.keyPEM, modTime)
+	writeFile(t, config.TLSClientCAFile, ca.certPEM, modTime)
+
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenFile := filepath.Join(dir, "tokens.yaml")
+	writeFile(t, tokenFile, []byte(`
+client_certificates:
+  - subject: CN=binderhub,O=binderhub
+    scopes: [repo:read]
+`), modTime)
+	tokens, err := NewTokenFile(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := CheckAuthorisedTokens(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		canDelete := CallerPermissions(r.Context()).Allowed(ScopeRepoDelete, "")
+		_, _ = fmt.Fprintf(w, "%s %t", CallerIdentity(r.Context()), canDelete)
+	}), "token", tokens)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &http.Server{Handler: handler, ReadHeaderTimeout: time.Second}
+	go func() { _ = s.Serve(tls.NewListener(listener, tlsConfig)) }()
+	t.Cleanup(func() { s.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	get := func(clientCert *testCert, bearer string) (int, string, string) {
+		clientTLS := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+		if clientCert != nil {
+			pair, err := tls.X509KeyPair(clientCert.certPEM, clientCert.keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientTLS.Certificates = []tls.Certificate{pair}
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+		req, err := http.NewRequest("GET", "https://"+listener.Addr().String()+"/", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			return 0, "", ""
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, string(body), res.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	testCases := []struct {
+		name             string
+		clientCert       *testCert
+		bearer           string
+		expectedStatus   int
+		expectedIdentity string
+	}{
+		{"client-cert", client, "", 200, "cert:CN=binderhub,O=binderhub false"},
+		{"client-cert-and-token", client, "incorrect", 200, "cert:CN=binderhub,O=binderhub false"},
+		{"unlisted-cert", unlisted, "", 403, ""},
+		{"unlisted-cert-and-token", unlisted, "token", 200, BearerTokenIdentity + " true"},
+		{"token", nil, "token", 200, BearerTokenIdentity + " true"},
+		{"no-auth", nil, "", 403, ""},
+		// The client won't send a certificate that isn't signed by one of
+		// the CAs requested by the server
+		{"untrusted-cert", untrusted, "token", 200, BearerTokenIdentity + " true"},
+		{"untrusted-cert-no-token", untrusted, "", 403, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			status, body, serverCN := get(tc.clientCert, tc.bearer)
+			if status != tc.expectedStatus {
+				t.Errorf("Expected status %d: %d", tc.expectedStatus, status)
+			}
+			if status == 200 && (body != tc.expectedIdentity || serverCN != "server-1") {
+				t.Errorf("Unexpected identity or server certificate: %s %s", body, serverCN)
+			}
+		})
+	}
+
+	// Rotate the server certificate
+	rotated := newTestCert(t, "server-2", ca, x509.ExtKeyUsageServerAuth)
+	writeFile(t, config.TLSCertFile, rotated.certPEM, time.Now())
+	writeFile(t, config.TLSKeyFile, rotated.keyPEM, time.Now())
+	if _, _, serverCN := get(nil, "token"); serverCN != "server-2" {
+		t.Errorf("Expected reloaded certificate: %s", serverCN)
+	}
+
+	// Invalid certificates are ignored
+	writeFile(t, config.TLSCertFile, []byte("invalid"), time.Now().Add(time.Minute))
+	if _, _, serverCN := get(nil, "token"); serverCN != "server-2" {
+		t.Errorf("Expected previous certificate: %s", serverCN)
+	}
+}
+
+func TestTLSHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil, 0)
+	server := newTestCert(t, "server-1", ca, x509.ExtKeyUsageServerAuth)
+	config := ServerConfig{
+		TLSCertFile:     filepath.Join(dir, "tls.crt"),
+		TLSKeyFile:      filepath.Join(dir, "tls.key"),
+		TLSClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	writeFile(t, config.TLSCertFile, server.certPEM, time.Now())
+	writeFile(t, config.TLSKeyFile, server.keyPEM, time.Now())
+	writeFile(t, config.TLSClientCAFile, ca.certPEM, time.Now())
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &http.Server{Handler: http.NotFoundHandler(), TLSConfig: tlsConfig, ReadHeaderTimeout: time.Second}
+	go func() { _ = s.ServeTLS(listener, "", "") }()
+	t.Cleanup(func() { s.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	for _, protocol := range []string{"h2", "http/1.1"} {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			RootCAs:    roots,
+			NextProtos: []string{protocol},
+			MinVersion: tls.VersionTLS12,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if negotiated := conn.ConnectionState().NegotiatedProtocol; negotiated != protocol {
+			t.Errorf("Expected %s: %s", protocol, negotiated)
+		}
+		conn.Close()
+	}
+}
+
+func TestTLSInvalid(t *testing.T) {
+	dir := t.TempDir()
+	config := ServerConfig{
+		TLSCertFile: filepath.Join(dir, "tls.crt"),
+		TLSKeyFile:  filepath.Join(dir, "tls.key"),
+	}
+	_, err := newTLSConfig(config)
+	if err == nil {
+		t.Errorf("Expected error for missing files")
+	}
+
+	writeFile(t, config.TLSCertFile, []byte("invalid"), time.Now())
+	writeFile(t, config.TLSKeyFile, []byte("invalid"), time.Now())
+	_, err = newTLSConfig(config)
+	if err == nil {
+		t.Errorf("Expected error for invalid files")
+	}
+
+	tlsConfig, err := newTLSConfig(ServerConfig{})
+	if tlsConfig != nil || err != nil {
+		t.Errorf("Expected TLS to be disabled: %v %v", tlsConfig, err)
+	}
+}
@@ -0,0 +1,327 @@
+package common
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const AUTH_TOKEN_FILE_ENV_VAR = "BINDERHUB_AUTH_TOKEN_FILE" // #nosec G101 -- Name of an env-var, not a secret
+
+// Scopes that can be granted to an API token
+const (
+	ScopeRepoRead   = "repo:read"
+	ScopeRepoWrite  = "repo:write"
+	ScopeRepoDelete = "repo:delete"
+	ScopeImageRead  = "image:read"
+	ScopeTokenIssue = "token:issue"
+)
+
+var allScopes = []string{ScopeRepoRead, ScopeRepoWrite, ScopeRepoDelete, ScopeImageRead, ScopeTokenIssue}
+
+// APIToken is a named bearer token with a limited set of permissions
+type APIToken struct {
+	// Name of the token, used as the caller identity with the prefix
+	// TokenIdentityPrefix
+	Name  string `yaml:"name" json:"name"`
+	Token string `yaml:"token" json:"token"`
+	// Scopes granted to the token
+	Scopes []string `yaml:"scopes" json:"scopes"`
+	// Optional globs (path.Match syntax) restricting the repositories the
+	// token can be used with, if empty all repositories are allowed
+	Repositories []string `yaml:"repositories" json:"repositories"`
+}
+
+// ClientCertificate grants scopes to callers authenticated with a client
+// certificate signed by TLS_CLIENT_CA_FILE
+type ClientCertificate struct {
+	// Certificate subject, e.g. "CN=binderhub,O=example", used as the caller
+	// identity with the prefix CertificateIdentityPrefix
+	Subject string `yaml:"subject" json:"subject"`
+	// Scopes granted to the certificate
+	Scopes []string `yaml:"scopes" json:"scopes"`
+	// Optional globs (path.Match syntax) restricting the repositories the
+	// certificate can be used with, if empty all repositories are allowed
+	Repositories []string `yaml:"repositories" json:"repositories"`
+}
+
+// Permissions are the scopes and repositories a caller is allowed to access
+type Permissions struct {
+	Scopes []string
+	// Globs and prefixes of the allowed repositories, if both are empty all
+	// repositories are allowed
+	Repositories       []string
+	RepositoryPrefixes []string
+}
+
+// Allowed returns true if scope is granted for repository. repository is
+// empty for requests that aren't for a single repository, these are only
+// allowed if the permissions aren't restricted to some repositories.
+func (p *Permissions) Allowed(scope string, repository string) bool {
+	if p == nil {
+		return true
+	}
+	if !p.granted(scope) {
+		return false
+	}
+	if !p.restricted() {
+		return true
+	}
+	if repository == "" {
+		return false
+	}
+	for _, pattern := range p.Repositories {
+		if ok, _ := path.Match(pattern, repository); ok {
+			return true
+		}
+	}
+	for _, prefix := range p.RepositoryPrefixes {
+		if strings.HasPrefix(repository, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedAll returns true if scope is granted for every repository starting
+// with prefix, "" means every repository. A glob only covers the prefix if
+// it's the prefix followed by "*".
+func (p *Permissions) AllowedAll(scope string, prefix string) bool {
+	if p == nil {
+		return true
+	}
+	if !p.granted(scope) {
+		return false
+	}
+	if !p.restricted() {
+		return true
+	}
+	if prefix == "" {
+		return false
+	}
+	for _, pattern := range p.Repositories {
+		if pattern == prefix+"*" {
+			return true
+		}
+	}
+	for _, allowedPrefix := range p.RepositoryPrefixes {
+		if strings.HasPrefix(prefix, allowedPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// granted returns true if scope is one of the granted scopes
+func (p *Permissions) granted(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// restricted returns true if the permissions are limited to some
+// repositories
+func (p *Permissions) restricted() bool {
+	return p != nil && (len(p.Repositories) > 0 || len(p.RepositoryPrefixes) > 0)
+}
+
+// WithCallerPermissions returns a copy of ctx with the permissions of the caller
+func WithCallerPermissions(ctx context.Context, permissions *Permissions) context.Context {
+	return context.WithValue(ctx, callerPermissionsKey, permissions)
+}
+
+// CallerPermissions returns the permissions of the caller set by
+// CheckAuthorised, nil means the caller has full access
+func CallerPermissions(ctx context.Context) *Permissions {
+	permissions, _ := ctx.Value(callerPermissionsKey).(*Permissions)
+	return permissions
+}
+
+type tokenFileContents struct {
+	Tokens             []APIToken          `yaml:"tokens" json:"tokens"`
+	ClientCertificates []ClientCertificate `yaml:"client_certificates" json:"client_certificates"`
+}
+
+// validateScopes checks scopes and repository patterns are valid, name is
+// used in error messages
+func validateScopes(name string, scopes []string, repositories []string) error {
+	for _, s := range scopes {
+		valid := false
+		for _, a := range allScopes {
+			valid = valid || s == a
+		}
+		if !valid {
+			return fmt.Errorf("invalid scope for %s: %s", name, s)
+		}
+	}
+	for _, pattern := range repositories {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid repository pattern for %s: %s", name, pattern)
+		}
+	}
+	return nil
+}
+
+// parseTokens parses and validates a YAML or JSON token file
+func parseTokens(data []byte) (*tokenFileContents, error) {
+	var contents tokenFileContents
+	err := yaml.Unmarshal(data, &contents)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, t := range contents.Tokens {
+		if t.Name == "" || t.Token == "" {
+			return nil, fmt.Errorf("tokens must have a name and token")
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate token name: %s", t.Name)
+		}
+		names[t.Name] = true
+		err = validateScopes("token "+t.Name, t.Scopes, t.Repositories)
+		if err != nil {
+			return nil, err
+		}
+	}
+	subjects := map[string]bool{}
+	for _, c := range contents.ClientCertificates {
+		if c.Subject == "" {
+			return nil, fmt.Errorf("client certificates must have a subject")
+		}
+		if subjects[c.Subject] {
+			return nil, fmt.Errorf("duplicate client certificate subject: %s", c.Subject)
+		}
+		subjects[c.Subject] = true
+		err = validateScopes("client certificate "+c.Subject, c.Scopes, c.Repositories)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &contents, nil
+}
+
+// How often the token file is checked for changes
+const tokenFileReloadInterval = 10 * time.Second
+
+// TokenFile loads API tokens and client certificate permissions from a file. Watch reloads them if the file is
+// modified, e.g. when a Kubernetes secret is updated.
+type TokenFile struct {
+	filename string
+	// Only used by reload, which isn't called concurrently
+	modTime time.Time
+	// Replaced on reload so Lookup doesn't need a lock
+	contents atomic.Pointer[tokenFileContents]
+}
+
+// NewTokenFile loads API tokens from filename
+func NewTokenFile(filename string) (*TokenFile, error) {
+	f := &TokenFile{filename: filename}
+	// Fail immediately if the initial file is invalid
+	err := f.reload()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *TokenFile) reload() error {
+	info, err := os.Stat(f.filename)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(f.modTime) && f.contents.Load() != nil {
+		return nil
+	}
+	data, err := os.ReadFile(f.filename)
+	if err != nil {
+		return err
+	}
+	contents, err := parseTokens(data)
+	if err != nil {
+		return err
+	}
+	if f.contents.Load() != nil {
+		slog.Info("Reloaded API tokens")
+	}
+	f.modTime = info.ModTime()
+	f.contents.Store(contents)
+	return nil
+}
+
+// Watch reloads the file every interval if it has changed, until ctx is
+// cancelled. If this fails the previous tokens are used.
+func (f *TokenFile) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// The file may be part way through being updated
+		err := f.reload()
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to reload API tokens", "error", err)
+		}
+	}
+}
+
+// Lookup returns the API token matching bearer, or nil
+func (f *TokenFile) Lookup(bearer string) *APIToken {
+	tokens := f.contents.Load().Tokens
+	// Compare against every token so the time taken doesn't depend on which
+	// token matched
+	var found *APIToken
+	for i := range tokens {
+		if subtle.ConstantTimeCompare([]byte(tokens[i].Token), []byte(bearer)) == 1 {
+			found = &tokens[i]
+		}
+	}
+	return found
+}
+
+// Authenticate implements BearerAuthenticator
+func (f *TokenFile) Authenticate(ctx context.Context, bearer string) (string, *Permissions) {
+	token := f.Lookup(bearer)
+	if token == nil {
+		return "", nil
+	}
+	return TokenIdentityPrefix + token.Name, &Permissions{
+		Scopes:       token.Scopes,
+		Repositories: token.Repositories,
+	}
+}
+
+// AuthenticateCertificate implements CertificateAuthenticator
+func (f *TokenFile) AuthenticateCertificate(ctx context.Context, subject string) *Permissions {
+	for _, c := range f.contents.Load().ClientCertificates {
+		if c.Subject == subject {
+			return &Permissions{
+				Scopes:       c.Scopes,
+				Repositories: c.Repositories,
+			}
+		}
+	}
+	return nil
+}
+
+// getTokenFile returns the API tokens file if one is configured
+func getTokenFile() (*TokenFile, error) {
+	filename := os.Getenv(AUTH_TOKEN_FILE_ENV_VAR)
+	if filename == "" {
+		return nil, nil
+	}
+	return NewTokenFile(filename)
+}
@@ -0,0 +1,297 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mockRegistryClient records the last method called
+type mockRegistryClient struct {
+	called string
+	// Returned by TokenScope
+	tokenScope string
+	// Returned by HealthCheck
+	healthErr    error
+	healthChecks int
+}
+
+func (c *mockRegistryClient) handle(name string, w http.ResponseWriter) {
+	c.called = name
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *mockRegistryClient) ListRepositories(w http.ResponseWriter, r *http.Request) {
+	c.handle("ListRepositories", w)
+}
+
+func (c *mockRegistryClient) GetRepository(w http.ResponseWriter, r *http.Request) {
+	c.handle("GetRepository", w)
+}
+
+func (c *mockRegistryClient) GetImage(w http.ResponseWriter, r *http.Request) {
+	c.handle("GetImage", w)
+}
+
+func (c *mockRegistryClient) ListImages(w http.ResponseWriter, r *http.Request) {
+	c.handle("ListImages", w)
+}
+
+func (c *mockRegistryClient) CreateRepository(w http.ResponseWriter, r *http.Request) {
+	c.handle("CreateRepository", w)
+}
+
+func (c *mockRegistryClient) DeleteRepository(w http.ResponseWriter, r *http.Request) {
+	c.handle("DeleteRepository", w)
+}
+
+func (c *mockRegistryClient) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	c.handle("DeleteImage", w)
+}
+
+func (c *mockRegistryClient) GetToken(w http.ResponseWriter, r *http.Request) {
+	c.handle("GetToken", w)
+}
+
+func (c *mockRegistryClient) TokenScope(repository string) string {
+	return c.tokenScope
+}
+
+func (c *mockRegistryClient) AllRepositories(ctx context.Context) ([]Repository, error) {
+	c.called = "AllRepositories"
+	return []Repository{}, nil
+}
+
+func (c *mockRegistryClient) AllImages(ctx context.Context, repository string) ([]Image, error) {
+	c.called = "AllImages"
+	return []Image{}, nil
+}
+
+func (c *mockRegistryClient) RemoveRepository(ctx context.Context, repository string) error {
+	c.called = "RemoveRepository"
+	return nil
+}
+
+func (c *mockRegistryClient) HealthCheck(ctx context.Context) error {
+	c.healthChecks++
+	return c.healthErr
+}
+
+const testTokens = `
+tokens:
+  - name: binderhub
+    token: binderhub-secret
+    scopes: [repo:read, repo:write, image:read, token:issue]
+    repositories: ["binder/*"]
+  - name: admin
+    token: admin-secret
+    scopes: [repo:read, repo:write, repo:delete, image:read, token:issue]
+`
+
+func TestParseTokens(t *testing.T) {
+	contents, err := parseTokens([]byte(testTokens))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := contents.Tokens
+	if len(tokens) != 2 || tokens[0].Name != "binderhub" || len(tokens[0].Scopes) != 4 || tokens[0].Repositories[0] != "binder/*" {
+		t.Errorf("Unexpected tokens: %v", tokens)
+	}
+
+	// JSON is also accepted
+	contents, err = parseTokens([]byte(`{"tokens": [{"name": "a", "token": "b", "scopes": ["repo:read"]}]}`))
+	if err != nil || len(contents.Tokens) != 1 || contents.Tokens[0].Scopes[0] != ScopeRepoRead {
+		t.Errorf("Unexpected tokens: %v %v", contents, err)
+	}
+
+	contents, err = parseTokens([]byte("client_certificates: [{subject: CN=binderhub, scopes: [repo:read]}]"))
+	if err != nil || len(contents.ClientCertificates) != 1 || contents.ClientCertificates[0].Subject != "CN=binderhub" {
+		t.Errorf("Unexpected client certificates: %v %v", contents, err)
+	}
+
+	invalid := []string{
+		"tokens: invalid",
+		"tokens: [{name: a, scopes: [repo:read]}]",
+		"tokens: [{name: a, token: b}, {name: a, token: c}]",
+		"tokens: [{name: a, token: b, scopes: [repo:admin]}]",
+		"tokens: [{name: a, token: b, repositories: ['[']}]",
+		"client_certificates: [{scopes: [repo:read]}]",
+		"client_certificates: [{subject: a}, {subject: a}]",
+		"client_certificates: [{subject: a, scopes: [repo:admin]}]",
+	}
+	for _, data := range invalid {
+		_, err := parseTokens([]byte(data))
+		if err == nil {
+			t.Errorf("Expected error: %s", data)
+		}
+	}
+}
+
+func TestPermissionsAllowed(t *testing.T) {
+	restricted := &Permissions{
+		Scopes:       []string{ScopeRepoRead},
+		Repositories: []string{"binder/*", "other"},
+	}
+	unrestricted := &Permissions{
+		Scopes: []string{ScopeRepoRead},
+	}
+	testCases := []struct {
+		permissions *Permissions
+		scope       string
+		repository  string
+		expected    bool
+	}{
+		{nil, ScopeRepoDelete, "", true},
+		{restricted, ScopeRepoRead, "binder/image", true},
+		{restricted, ScopeRepoRead, "other", true},
+		{restricted, ScopeRepoRead, "binder/nested/image", false},
+		{restricted, ScopeRepoRead, "private", false},
+		{restricted, ScopeRepoRead, "", false},
+		{restricted, ScopeRepoWrite, "binder/image", false},
+		{unrestricted, ScopeRepoRead, "", true},
+		{unrestricted, ScopeRepoRead, "private", true},
+		{unrestricted, ScopeRepoDelete, "private", false},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%s,%s", tc.permissions, tc.scope, tc.repository), func(t *testing.T) {
+			if tc.permissions.Allowed(tc.scope, tc.repository) != tc.expected {
+				t.Errorf("Expected %t", tc.expected)
+			}
+		})
+	}
+}
+
+func TestTokenFileReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tokens.yaml")
+	writeFile(t, filename, []byte(testTokens), time.Now().Add(-time.Minute))
+
+	tokens, err := NewTokenFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := tokens.Lookup("admin-secret"); token == nil || token.Name != "admin" {
+		t.Errorf("Expected admin token: %v", token)
+	}
+	if token := tokens.Lookup("incorrect"); token != nil {
+		t.Errorf("Unexpected token: %v", token)
+	}
+	if identity, _ := tokens.Authenticate(context.Background(), "admin-secret"); identity != TokenIdentityPrefix+"admin" {
+		t.Errorf("Expected prefixed identity: %s", identity)
+	}
+
+	writeFile(t, filename, []byte("tokens: [{name: new, token: new-secret}]"), time.Now())
+	err = tokens.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := tokens.Lookup("admin-secret"); token != nil {
+		t.Errorf("Expected admin token to be removed: %v", token)
+	}
+	if token := tokens.Lookup("new-secret"); token == nil || token.Name != "new" {
+		t.Errorf("Expected new token: %v", token)
+	}
+
+	// Invalid files are ignored
+	writeFile(t, filename, []byte("tokens: invalid"), time.Now().Add(time.Minute))
+	err = tokens.reload()
+	if err == nil {
+		t.Errorf("Expected error for invalid file")
+	}
+	if token := tokens.Lookup("new-secret"); token == nil {
+		t.Errorf("Expected previous tokens")
+	}
+
+	_, err = NewTokenFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err == nil {
+		t.Errorf("Expected error for missing file")
+	}
+}
+
+func TestTokenFileWatch(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tokens.yaml")
+	writeFile(t, filename, []byte(testTokens), time.Now().Add(-time.Minute))
+	tokens, err := NewTokenFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tokens.Watch(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	writeFile(t, filename, []byte("tokens: [{name: new, token: new-secret}]"), time.Now())
+	deadline := time.Now().Add(5 * time.Second)
+	for tokens.Lookup("new-secret") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected new token to be loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+}
+
+func TestScopedTokens(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tokens.yaml")
+	writeFile(t, filename, []byte(testTokens), time.Now())
+	tokens, err := NewTokenFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		token          string
+		method         string
+		path           string
+		tokenScope     string
+		expectedStatus int
+		expectedCalled string
+	}{
+		{"binderhub-secret", "GET", "/repos/", "", 403, ""},
+		{"binderhub-secret", "GET", "/repo/binder/image", "", 200, "GetRepository"},
+		{"binderhub-secret", "GET", "/repo/private", "", 403, ""},
+		{"binderhub-secret", "POST", "/repo/binder/image", "", 200, "CreateRepository"},
+		{"binderhub-secret", "DELETE", "/repo/binder/image", "", 403, ""},
+		{"binderhub-secret", "GET", "/image/binder/image:tag", "", 200, "GetImage"},
+		{"binderhub-secret", "GET", "/images/binder/image", "", 200, "ListImages"},
+		{"binderhub-secret", "DELETE", "/image/binder/image:tag", "", 403, ""},
+		// Registry-wide credentials would bypass the repository restriction
+		{"binderhub-secret", "POST", "/token/binder/image", "", 403, ""},
+		{"binderhub-secret", "POST", "/token/binder/image", "binder/", 200, "GetToken"},
+		{"binderhub-secret", "POST", "/token/binder/image:tag", "binder/", 200, "GetToken"},
+		{"binderhub-secret", "POST", "/token/private:tag", "private/", 403, ""},
+		// The credentials are valid for repositories the caller can't access
+		{"binderhub-secret", "POST", "/token/binder/image", "bin", 403, ""},
+		{"binderhub-secret", "POST", "/token/binder/image", "binder/image", 403, ""},
+		{"binderhub-secret", "POST", "/token", "", 403, ""},
+		{"admin-secret", "GET", "/repos/", "", 200, "ListRepositories"},
+		{"admin-secret", "DELETE", "/repo/private", "", 200, "DeleteRepository"},
+		{"admin-secret", "DELETE", "/image/private:tag", "", 200, "DeleteImage"},
+		{"admin-secret", "POST", "/token", "", 200, "GetToken"},
+		{"shared-secret", "DELETE", "/repo/private", "", 200, "DeleteRepository"},
+		{"incorrect", "GET", "/repo/binder/image", "", 403, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s %s %s %s", tc.token, tc.method, tc.path, tc.tokenScope), func(t *testing.T) {
+			client := &mockRegistryClient{tokenScope: tc.tokenScope}
+			h := CheckAuthorisedTokens(&RegistryServer{Client: client}, "shared-secret", tokens)
+			req := httptest.NewRequest(tc.method, tc.path, http.NoBody)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			res := w.Result()
+			defer res.Body.Close()
+
+			if res.StatusCode != tc.expectedStatus || client.called != tc.expectedCalled {
+				t.Errorf("Expected %d %s: %d %s", tc.expectedStatus, tc.expectedCalled, res.StatusCode, client.called)
+			}
+		})
+	}
+}
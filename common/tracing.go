@@ -0,0 +1,157 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Standard OpenTelemetry environment variable, the OTLP exporter is also
+// configured with the standard OTEL_EXPORTER_OTLP_* variables
+const TRACES_EXPORTER_ENV_VAR = "OTEL_TRACES_EXPORTER"
+
+const tracerName = "github.com/manics/binderhub-container-registry-helper"
+
+// Span attributes
+const (
+	ProviderAttribute   = attribute.Key("registry.provider")
+	RepositoryAttribute = attribute.Key("registry.repository")
+	TagAttribute        = attribute.Key("registry.tag")
+	ErrorCodeAttribute  = attribute.Key("registry.error_code")
+)
+
+// SetupTracing configures the global OpenTelemetry tracer provider from the
+// OTEL_TRACES_EXPORTER environment variable: "otlp", "console" (stdout), or
+// "none" (default). The returned function flushes any remaining spans.
+func SetupTracing(ctx context.Context, provider string, version string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterName := strings.ToLower(os.Getenv(TRACES_EXPORTER_ENV_VAR)); exporterName {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "console":
+		exporter, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("invalid %s: %s", TRACES_EXPORTER_ENV_VAR, exporterName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName("binderhub-container-registry-helper"),
+		semconv.ServiceVersion(version),
+		ProviderAttribute.String(provider),
+	))
+	if err != nil {
+		return nil, err
+	}
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	return tracerProvider.Shutdown, nil
+}
+
+// routeAttributes returns the route, and the repository and tag if the
+// request is for a single repository or image
+func routeAttributes(r *http.Request) (string, []attribute.KeyValue) {
+	switch {
+	case listReposRe.MatchString(r.URL.Path):
+		return "/repos/", nil
+	case repoRe.MatchString(r.URL.Path):
+		return "/repo/{repository}", []attribute.KeyValue{
+			RepositoryAttribute.String(repoRe.FindStringSubmatch(r.URL.Path)[1]),
+		}
+	case imageRe.MatchString(r.URL.Path):
+		name, tag, err := ImageGetNameAndTag(r)
+		if err != nil {
+			return "/image/{image}", nil
+		}
+		return "/image/{image}", []attribute.KeyValue{
+			RepositoryAttribute.String(name),
+			TagAttribute.String(tag),
+		}
+	case imagesRe.MatchString(r.URL.Path):
+		return "/images/{repository}", []attribute.KeyValue{
+			RepositoryAttribute.String(imagesRe.FindStringSubmatch(r.URL.Path)[1]),
+		}
+	case tokenRe.MatchString(r.URL.Path):
+		repository := strings.TrimPrefix(tokenRe.FindStringSubmatch(r.URL.Path)[1], "/")
+		if repository == "" {
+			return "/token", nil
+		}
+		return "/token/{repository}", []attribute.KeyValue{
+			RepositoryAttribute.String(repository),
+		}
+	default:
+		return "unknown", nil
+	}
+}
+
+// tracingMiddleware wraps originalHandler to create a server span for each
+// request, continuing the trace from the incoming traceparent header.
+// The repository and tag are added to the server span, and to the spans for
+// calls to the registry API.
+func tracingMiddleware(originalHandler http.Handler) http.Handler {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, attrs := routeAttributes(r)
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(semconv.HTTPRoute(route))
+		span.SetAttributes(attrs...)
+		ctx := context.WithValue(r.Context(), spanAttributesKey, attrs)
+		originalHandler.ServeHTTP(w, r.WithContext(ctx))
+	})
+	return otelhttp.NewHandler(h, "binderhub-registry-helper",
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			route, _ := routeAttributes(r)
+			return r.Method + " " + route
+		}),
+	)
+}
+
+// StartUpstreamSpan starts a client span for a call to the registry API.
+// operation is the name of the API method.
+func StartUpstreamSpan(ctx context.Context, provider string, operation string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{ProviderAttribute.String(provider)}
+	if routeAttrs, ok := ctx.Value(spanAttributesKey).([]attribute.KeyValue); ok {
+		attrs = append(attrs, routeAttrs...)
+	}
+	return otel.Tracer(tracerName).Start(ctx, operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// EndUpstreamSpan records the result of a call to the registry API and ends
+// the span. errorCode is the provider's error code if known.
+func EndUpstreamSpan(span trace.Span, errorCode string, err error) {
+	if err != nil {
+		errorCode = upstreamErrorCode(errorCode, err)
+		if errorCode != "" {
+			span.SetAttributes(ErrorCodeAttribute.String(errorCode))
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,142 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans sets the global tracer provider to record spans until the end
+// of the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	previousPropagator := otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+	return recorder
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) string {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestSetupTracing(t *testing.T) {
+	for _, exporter := range []string{"", "none", "console"} {
+		t.Run(exporter, func(t *testing.T) {
+			t.Setenv(TRACES_EXPORTER_ENV_VAR, exporter)
+			shutdown, err := SetupTracing(context.Background(), "test", "1.0.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = shutdown(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	t.Setenv(TRACES_EXPORTER_ENV_VAR, "invalid")
+	_, err := SetupTracing(context.Background(), "test", "1.0.0")
+	if err == nil {
+		t.Errorf("Expected error for invalid exporter")
+	}
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	recorder := recordSpans(t)
+
+	h := tracingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := StartUpstreamSpan(r.Context(), "test", "test.GetImage")
+		EndUpstreamSpan(span, "ImageNotFoundException", errors.New("not found"))
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "/image/binder/image:tag", http.NoBody)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans: %v", spans)
+	}
+	upstream, server := spans[0], spans[1]
+
+	if server.Name() != "GET /image/{image}" || server.SpanContext().TraceID().String() != traceID {
+		t.Errorf("Unexpected server span: %s %s", server.Name(), server.SpanContext().TraceID())
+	}
+	if spanAttribute(server, RepositoryAttribute) != "binder/image" || spanAttribute(server, TagAttribute) != "tag" {
+		t.Errorf("Unexpected server span attributes: %v", server.Attributes())
+	}
+
+	if upstream.Name() != "test.GetImage" || upstream.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("Unexpected upstream span: %s %s", upstream.Name(), upstream.Parent().SpanID())
+	}
+	expected := map[attribute.Key]string{
+		ProviderAttribute:   "test",
+		RepositoryAttribute: "binder/image",
+		TagAttribute:        "tag",
+		ErrorCodeAttribute:  "ImageNotFoundException",
+	}
+	for k, v := range expected {
+		if spanAttribute(upstream, k) != v {
+			t.Errorf("Expected %s=%s: %v", k, v, upstream.Attributes())
+		}
+	}
+	if upstream.Status().Code != codes.Error {
+		t.Errorf("Expected error status: %v", upstream.Status())
+	}
+}
+
+func TestRouteAttributes(t *testing.T) {
+	testCases := []struct {
+		method        string
+		path          string
+		expectedRoute string
+		expectedRepo  string
+	}{
+		{"GET", "/repos/", "/repos/", ""},
+		{"POST", "/repo/binder/image", "/repo/{repository}", "binder/image"},
+		{"GET", "/images/binder/image", "/images/{repository}", "binder/image"},
+		{"POST", "/token", "/token", ""},
+		{"POST", "/token/binder/image", "/token/{repository}", "binder/image"},
+		{"GET", "/other", "unknown", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, http.NoBody)
+			route, attrs := routeAttributes(req)
+			repo := ""
+			for _, kv := range attrs {
+				if kv.Key == RepositoryAttribute {
+					repo = kv.Value.AsString()
+				}
+			}
+			if route != tc.expectedRoute || repo != tc.expectedRepo {
+				t.Errorf("Expected %s %s: %s %s", tc.expectedRoute, tc.expectedRepo, route, repo)
+			}
+		})
+	}
+}
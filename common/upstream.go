@@ -0,0 +1,99 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const UPSTREAM_TIMEOUT_SECONDS_ENV_VAR = "UPSTREAM_TIMEOUT_SECONDS"
+
+const serverWriteTimeout = 10 * time.Second
+
+// Less than the server WriteTimeout so the timeout can be returned to the client
+const defaultUpstreamTimeout = 8 * time.Second
+
+// Deadline for handling a request, including retried calls to the registry
+// API. Less than the server WriteTimeout so the timeout can be returned to the
+// client instead of the connection being closed.
+const requestTimeout = serverWriteTimeout - time.Second
+
+// UpstreamTimeout returns the maximum duration of a single call to the
+// registry API, 0 means no timeout
+func UpstreamTimeout() (time.Duration, error) {
+	v := os.Getenv(UPSTREAM_TIMEOUT_SECONDS_ENV_VAR)
+	if v == "" {
+		return defaultUpstreamTimeout, nil
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", UPSTREAM_TIMEOUT_SECONDS_ENV_VAR, v)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// UpstreamContext returns a context for a single call to the registry API
+func UpstreamContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// requestDeadlineMiddleware wraps originalHandler to cancel the request
+// context after requestTimeout
+func requestDeadlineMiddleware(originalHandler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+		defer cancel()
+		originalHandler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// IsTimeout returns true if err is caused by a call to the registry API
+// timing out
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) && grpcErr.GRPCStatus().Code() == codes.DeadlineExceeded {
+		return true
+	}
+	return false
+}
+
+// GatewayTimeout is a handler that returns a 504 HTTP error
+func GatewayTimeout(w http.ResponseWriter, r *http.Request, errorResponse error) {
+	jsonBytes := []byte(`{"error": "upstream timeout"}`)
+	if returnErrorDetails() {
+		var err error
+		jsonBytes, err = json.Marshal(map[string]string{
+			"error":   "upstream timeout",
+			"details": errorResponse.Error(),
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to marshal error", "error", err)
+		}
+	}
+	jsonBytes = append(jsonBytes, byte('\n'))
+	w.WriteHeader(http.StatusGatewayTimeout)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
@@ -0,0 +1,126 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type netTimeoutError struct{}
+
+func (netTimeoutError) Error() string   { return "i/o timeout" }
+func (netTimeoutError) Timeout() bool   { return true }
+func (netTimeoutError) Temporary() bool { return true }
+
+func TestUpstreamTimeout(t *testing.T) {
+	testCases := []struct {
+		env      string
+		expected time.Duration
+		err      bool
+	}{
+		{"", 8 * time.Second, false},
+		{"30", 30 * time.Second, false},
+		{"0", 0, false},
+		{"-1", 0, true},
+		{"invalid", 0, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.env, func(t *testing.T) {
+			t.Setenv(UPSTREAM_TIMEOUT_SECONDS_ENV_VAR, tc.env)
+			timeout, err := UpstreamTimeout()
+			if (err != nil) != tc.err {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if timeout != tc.expected {
+				t.Errorf("Expected %s: %s", tc.expected, timeout)
+			}
+		})
+	}
+}
+
+func TestUpstreamContext(t *testing.T) {
+	ctx, cancel := UpstreamContext(context.Background(), 0)
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("Expected no deadline")
+	}
+	cancel()
+
+	ctx, cancel = UpstreamContext(context.Background(), time.Minute)
+	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Errorf("Expected deadline")
+	}
+}
+
+func TestRequestDeadlineMiddleware(t *testing.T) {
+	var deadline time.Time
+	var ok bool
+	h := requestDeadlineMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, ok = r.Context().Deadline()
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/repos/", http.NoBody))
+	if !ok || time.Until(deadline) > requestTimeout || requestTimeout >= serverWriteTimeout {
+		t.Errorf("Unexpected deadline: %v %v", deadline, ok)
+	}
+}
+
+func TestIsTimeout(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"deadline", fmt.Errorf("wrapped: %w", context.DeadlineExceeded), true},
+		{"net", &url.Error{Op: "Get", URL: "http://example.org", Err: netTimeoutError{}}, true},
+		{"grpc", status.Error(codes.DeadlineExceeded, "deadline exceeded"), true},
+		{"grpc-other", status.Error(codes.NotFound, "not found"), false},
+		{"canceled", context.Canceled, false},
+		{"other", errors.New("other"), false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if IsTimeout(tc.err) != tc.expected {
+				t.Errorf("Expected %t: %v", tc.expected, tc.err)
+			}
+		})
+	}
+}
+
+func TestInternalServerErrorTimeout(t *testing.T) {
+	testCases := []struct {
+		err          error
+		details      string
+		expectedCode int
+		expectedBody string
+	}{
+		{errors.New("other"), "", 500, `{"error": "internal server error"}` + "\n"},
+		{context.DeadlineExceeded, "", 504, `{"error": "upstream timeout"}` + "\n"},
+		{context.DeadlineExceeded, "true", 504, `{"details":"context deadline exceeded","error":"upstream timeout"}` + "\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%d-%s", tc.expectedCode, tc.details), func(t *testing.T) {
+			t.Setenv("RETURN_ERROR_DETAILS", tc.details)
+			req := httptest.NewRequest("GET", "/", http.NoBody)
+			w := httptest.NewRecorder()
+			InternalServerError(w, req, tc.err)
+			res := w.Result()
+			defer res.Body.Close()
+			data, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tc.expectedCode || string(data) != tc.expectedBody {
+				t.Errorf("Unexpected response: %d %s", res.StatusCode, data)
+			}
+		})
+	}
+}
@@ -0,0 +1,471 @@
+package distribution
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Media types accepted when fetching manifests
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// registryError is returned when the registry returns an unexpected status code
+type registryError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *registryError) Error() string {
+	return fmt.Sprintf("registry returned %d: %s", e.StatusCode, e.Body)
+}
+
+func isNotFound(err error) bool {
+	var regErr *registryError
+	return errors.As(err, &regErr) && regErr.StatusCode == http.StatusNotFound
+}
+
+// isUnsupported returns true if the registry doesn't support an operation,
+// e.g. deleting a manifest by tag
+func isUnsupported(err error) bool {
+	var regErr *registryError
+	return errors.As(err, &regErr) && (regErr.StatusCode == http.StatusBadRequest || regErr.StatusCode == http.StatusMethodNotAllowed)
+}
+
+type bearerToken struct {
+	token   string
+	expires time.Time
+}
+
+// registryClient is a minimal OCI Distribution Spec client supporting
+// basic authentication and the bearer token challenge flow
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md
+// https://distribution.github.io/distribution/spec/auth/token/
+type registryClient struct {
+	baseURL  *url.URL
+	username string
+	password string
+	client   *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]bearerToken
+}
+
+func newRegistryClient(baseURL string, username string, password string, timeout time.Duration) (*registryClient, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid registry URL: %s", baseURL)
+	}
+	return &registryClient{
+		baseURL:  u,
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: timeout},
+		tokens:   map[string]bearerToken{},
+	}, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// Bearer realm="https://auth.example.org/token",service="registry",scope="repository:foo:pull"
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			v, remaining, _ := strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(v)
+			rest = remaining
+		}
+	}
+	return strings.ToLower(scheme), params
+}
+
+// fetchToken requests a bearer token from the token service in the challenge
+func (c *registryClient) fetchToken(ctx context.Context, params map[string]string) (bearerToken, error) {
+	realm, ok := params["realm"]
+	if !ok {
+		return bearerToken{}, errors.New("bearer challenge has no realm")
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return bearerToken{}, err
+	}
+	q := u.Query()
+	if service, ok := params["service"]; ok {
+		q.Set("service", service)
+	}
+	if scope, ok := params["scope"]; ok {
+		q.Set("scope", scope)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), http.NoBody)
+	if err != nil {
+		return bearerToken{}, err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return bearerToken{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return bearerToken{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return bearerToken{}, &registryError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.Unmarshal(body, &tokenResponse)
+	if err != nil {
+		return bearerToken{}, err
+	}
+	token := bearerToken{
+		token: tokenResponse.Token,
+	}
+	if token.token == "" {
+		token.token = tokenResponse.AccessToken
+	}
+	if token.token == "" {
+		return bearerToken{}, errors.New("token service returned no token")
+	}
+	// Default lifetime from the token specification
+	expiresIn := 60
+	if tokenResponse.ExpiresIn > 0 {
+		expiresIn = tokenResponse.ExpiresIn
+	}
+	token.expires = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	return token, nil
+}
+
+func (c *registryClient) cachedToken(scope string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	token, ok := c.tokens[scope]
+	if ok && time.Now().Add(10*time.Second).Before(token.expires) {
+		return token.token
+	}
+	return ""
+}
+
+// resolve returns the URL of an API path relative to the registry URL, which
+// may include a path prefix. Paths from Link headers may include a query, and
+// may already include the prefix.
+func (c *registryClient) resolve(path string) (*url.URL, error) {
+	ref, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	if ref.IsAbs() || ref.Host != "" {
+		return c.baseURL.ResolveReference(ref), nil
+	}
+	p := ref.Path
+	if prefix := c.baseURL.Path; prefix != "" && (p == prefix || strings.HasPrefix(p, prefix+"/")) {
+		p = strings.TrimPrefix(p, prefix)
+	}
+	u := c.baseURL.JoinPath(p)
+	u.RawQuery = ref.RawQuery
+	return u, nil
+}
+
+func (c *registryClient) newRequest(ctx context.Context, method string, path string, header http.Header, scope string) (*http.Request, error) {
+	u, err := c.resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if token := c.cachedToken(scope); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return req, nil
+}
+
+// do sends a request to the registry, handling a bearer token challenge if
+// necessary. scope is used to cache bearer tokens.
+// The caller must close the response body.
+func (c *registryClient) do(ctx context.Context, method string, path string, header http.Header, scope string) (*http.Response, error) {
+	req, err := c.newRequest(ctx, method, path, header, scope)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	resp.Body.Close()
+	if scheme != "bearer" {
+		return nil, &registryError{StatusCode: http.StatusUnauthorized, Body: "unauthorized"}
+	}
+	if _, ok := params["scope"]; !ok && scope != "" {
+		params["scope"] = scope
+	}
+	token, err := c.fetchToken(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "Obtained registry token", "scope", params["scope"])
+	c.mu.Lock()
+	c.tokens[scope] = token
+	c.mu.Unlock()
+
+	req, err = c.newRequest(ctx, method, path, header, scope)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.Do(req)
+}
+
+// doJSON sends a request and unmarshals a JSON response into v, returning
+// the response headers
+func (c *registryClient) doJSON(ctx context.Context, path string, scope string, v interface{}) (http.Header, error) {
+	resp, err := c.do(ctx, http.MethodGet, path, http.Header{"Accept": {"application/json"}}, scope)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &registryError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return resp.Header, json.Unmarshal(body, v)
+}
+
+// nextLink returns the path of the next page from a Link header, or ""
+func nextLink(header http.Header) string {
+	for _, link := range header.Values("Link") {
+		target, params, found := strings.Cut(link, ";")
+		if !found || !strings.Contains(params, `rel="next"`) {
+			continue
+		}
+		return strings.Trim(strings.TrimSpace(target), "<>")
+	}
+	return ""
+}
+
+// Ping checks the registry implements the Distribution API and the
+// credentials are valid
+func (c *registryClient) Ping(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodGet, "/v2/", nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return &registryError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return nil
+}
+
+// Catalog returns all repository names, following Link header pagination
+func (c *registryClient) Catalog(ctx context.Context, pageSize int) ([]string, error) {
+	names := []string{}
+	path := fmt.Sprintf("/v2/_catalog?n=%d", pageSize)
+	for path != "" {
+		var catalog struct {
+			Repositories []string `json:"repositories"`
+		}
+		header, err := c.doJSON(ctx, path, "registry:catalog:*", &catalog)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, catalog.Repositories...)
+		path = nextLink(header)
+	}
+	return names, nil
+}
+
+// CatalogPage returns up to n repository names after last, and the last
+// repository name to request the next page from, or "" if this is the last
+// page
+func (c *registryClient) CatalogPage(ctx context.Context, n int, last string) ([]string, string, error) {
+	query := url.Values{"n": {strconv.Itoa(n)}}
+	if last != "" {
+		query.Set("last", last)
+	}
+	var catalog struct {
+		Repositories []string `json:"repositories"`
+	}
+	header, err := c.doJSON(ctx, "/v2/_catalog?"+query.Encode(), "registry:catalog:*", &catalog)
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if link := nextLink(header); link != "" && len(catalog.Repositories) > 0 {
+		next = catalog.Repositories[len(catalog.Repositories)-1]
+	}
+	return catalog.Repositories, next, nil
+}
+
+// Tags returns all tags in a repository, following Link header pagination
+func (c *registryClient) Tags(ctx context.Context, name string) ([]string, error) {
+	tags := []string{}
+	path := fmt.Sprintf("/v2/%s/tags/list", name)
+	for path != "" {
+		var tagList struct {
+			Tags []string `json:"tags"`
+		}
+		header, err := c.doJSON(ctx, path, fmt.Sprintf("repository:%s:pull", name), &tagList)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tagList.Tags...)
+		path = nextLink(header)
+	}
+	return tags, nil
+}
+
+// manifestDescriptor describes a manifest
+type manifestDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// Manifest returns the descriptor of a manifest. A HEAD request is tried
+// first, falling back to GET if the registry doesn't return the digest.
+func (c *registryClient) Manifest(ctx context.Context, name string, reference string) (*manifestDescriptor, error) {
+	header := http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}}
+	scope := fmt.Sprintf("repository:%s:pull", name)
+	path := fmt.Sprintf("/v2/%s/manifests/%s", name, reference)
+
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		resp, err := c.do(ctx, method, path, header, scope)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, &registryError{StatusCode: resp.StatusCode, Body: string(body)}
+		}
+		digest := resp.Header.Get("Docker-Content-Digest")
+		size := resp.ContentLength
+		if digest == "" {
+			if method == http.MethodHead {
+				continue
+			}
+			digest = fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+			size = int64(len(body))
+		}
+		return &manifestDescriptor{
+			MediaType: resp.Header.Get("Content-Type"),
+			Digest:    digest,
+			Size:      size,
+		}, nil
+	}
+	return nil, fmt.Errorf("registry didn't return a digest for %s:%s", name, reference)
+}
+
+// ImageSize returns the total size of the config and layers of an image
+// manifest, or 0 for other manifest types such as an index
+func (c *registryClient) ImageSize(ctx context.Context, name string, reference string) (int64, error) {
+	header := http.Header{"Accept": {strings.Join(manifestMediaTypes, ", ")}}
+	path := fmt.Sprintf("/v2/%s/manifests/%s", name, reference)
+	resp, err := c.do(ctx, http.MethodGet, path, header, fmt.Sprintf("repository:%s:pull", name))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, &registryError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var manifest struct {
+		Config *manifestDescriptor  `json:"config"`
+		Layers []manifestDescriptor `json:"layers"`
+	}
+	err = json.Unmarshal(body, &manifest)
+	if err != nil {
+		return 0, err
+	}
+	if manifest.Config == nil {
+		return 0, nil
+	}
+	size := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	return size, nil
+}
+
+// DeleteManifest deletes a manifest by digest, or a tag if the registry
+// supports it
+func (c *registryClient) DeleteManifest(ctx context.Context, name string, reference string) error {
+	path := fmt.Sprintf("/v2/%s/manifests/%s", name, reference)
+	resp, err := c.do(ctx, http.MethodDelete, path, nil, fmt.Sprintf("repository:%s:delete", name))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return &registryError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return nil
+}
@@ -0,0 +1,543 @@
+// Generic OCI Distribution Spec (registry v2) registry, e.g. registry:2 or Zot
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md
+
+package distribution
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// Number of repositories to request per catalog page
+const catalogPageSize = 1000
+
+// repository is returned as the provider response by the repository endpoints
+type repository struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+type distributionHandler struct {
+	client *registryClient
+	// Credentials returned by GetToken, these should only be able to pull and
+	// push since they are given to BinderHub
+	pushUsername string
+	pushPassword string
+}
+
+// repositoryResponse converts a repository to the common response. The
+// Distribution Spec doesn't record when a repository was created.
+func (c *distributionHandler) repositoryResponse(repo repository) common.Repository {
+	return common.Repository{
+		Name:     repo.Name,
+		URI:      fmt.Sprintf("%s/%s", c.client.baseURL.Host, repo.Name),
+		Provider: repo,
+	}
+}
+
+// listRepositories returns all repositories, or a single page if params is
+// paged, and the token for the next page. The page token is the last
+// repository name of the previous page.
+func (c *distributionHandler) listRepositories(ctx context.Context, params common.ListParams) ([]common.Repository, string, error) {
+	slog.InfoContext(ctx, "Listing repos")
+	var names []string
+	var err error
+	next := ""
+	if params.Paged() {
+		limit := catalogPageSize
+		if params.Limit > 0 {
+			limit = min(params.Limit, catalogPageSize)
+		}
+		names, next, err = c.client.CatalogPage(ctx, limit, params.PageToken)
+	} else {
+		names, err = c.client.Catalog(ctx, catalogPageSize)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	repositories := make([]common.Repository, len(names))
+	for i, name := range names {
+		repositories[i] = c.repositoryResponse(repository{Name: name})
+	}
+	return repositories, next, nil
+}
+
+// AllRepositories returns all repositories, following pagination
+func (c *distributionHandler) AllRepositories(ctx context.Context) ([]common.Repository, error) {
+	repositories, _, err := c.listRepositories(ctx, common.ListParams{})
+	return repositories, err
+}
+
+// ListRepositories returns all repositories, or a single page if limit or
+// page_token are given
+func (c *distributionHandler) ListRepositories(w http.ResponseWriter, r *http.Request) {
+	params, err := common.ListGetParams(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
+		common.BadRequest(w, r, err)
+		return
+	}
+
+	repositories, next, err := c.listRepositories(r.Context(), params)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	jsonBytes, err := json.Marshal(repositories)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	if next != "" {
+		w.Header().Set(common.NextPageTokenHeader, next)
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+func (c *distributionHandler) getRepoByName(ctx context.Context, name string) (*repository, error) {
+	tags, err := c.client.Tags(ctx, name)
+	if err != nil {
+		if isNotFound(err) {
+			slog.InfoContext(ctx, "Repo not found", "repo", name)
+			return nil, nil
+		}
+		slog.ErrorContext(ctx, "getRepoByName failed", "error", err)
+		return nil, err
+	}
+	slog.InfoContext(ctx, "Repo found", "repo", name, "tags", len(tags))
+	return &repository{Name: name, Tags: tags}, nil
+}
+
+func (c *distributionHandler) GetRepository(w http.ResponseWriter, r *http.Request) {
+	name, err := common.RepoGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Getting repo", "repo", name)
+
+	repo, err := c.getRepoByName(r.Context(), name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	if repo == nil {
+		common.NotFound(w, r)
+		return
+	}
+	jsonBytes, err := json.Marshal(c.repositoryResponse(*repo))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+func (c *distributionHandler) GetImage(w http.ResponseWriter, r *http.Request) {
+	repoName, tag, err := common.ImageGetNameAndTag(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	fullname := fmt.Sprintf("%s:%s", repoName, tag)
+
+	slog.InfoContext(r.Context(), "Getting image", "image", fullname)
+
+	manifest, err := c.client.Manifest(r.Context(), repoName, tag)
+	if err != nil {
+		if isNotFound(err) {
+			slog.InfoContext(r.Context(), "Image not found", "image", fullname)
+			common.NotFound(w, r)
+			return
+		}
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Image found", "image", fullname, "digest", manifest.Digest)
+	size, err := c.client.ImageSize(r.Context(), repoName, manifest.Digest)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	jsonBytes, err := json.Marshal(common.Image{
+		Repository: repoName,
+		Tag:        tag,
+		Digest:     manifest.Digest,
+		SizeBytes:  size,
+		Provider:   manifest,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// AllImages returns all tags in a repository. The Distribution Spec doesn't
+// record when an image was pushed so PushedAt is nil.
+func (c *distributionHandler) AllImages(ctx context.Context, name string) ([]common.Image, error) {
+	slog.InfoContext(ctx, "Listing images", "repo", name)
+
+	repo, err := c.getRepoByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if repo == nil {
+		return nil, common.ErrRepositoryNotFound
+	}
+
+	images := []common.Image{}
+	// Multiple tags may reference the same digest
+	sizes := map[string]int64{}
+	for _, tag := range repo.Tags {
+		manifest, err := c.client.Manifest(ctx, name, tag)
+		if err != nil {
+			// Tag may have been deleted
+			if isNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		size, ok := sizes[manifest.Digest]
+		if !ok {
+			size, err = c.client.ImageSize(ctx, name, manifest.Digest)
+			if err != nil {
+				return nil, err
+			}
+			sizes[manifest.Digest] = size
+		}
+		images = append(images, common.Image{
+			Repository: name,
+			Tag:        tag,
+			Digest:     manifest.Digest,
+			SizeBytes:  size,
+			Provider:   manifest,
+		})
+	}
+	return images, nil
+}
+
+// ListImages returns all tags in a repository. The Distribution Spec doesn't
+// record when an image was pushed so pushed_at is omitted.
+func (c *distributionHandler) ListImages(w http.ResponseWriter, r *http.Request) {
+	name, err := common.ImagesGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	images, err := c.AllImages(r.Context(), name)
+	if errors.Is(err, common.ErrRepositoryNotFound) {
+		common.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(images)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// CreateRepository is a no-op since registries create repositories on push.
+// If the repository already exists it is returned, otherwise a placeholder is
+// returned containing the repository name.
+func (c *distributionHandler) CreateRepository(w http.ResponseWriter, r *http.Request) {
+	name, err := common.RepoGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	repo, err := c.getRepoByName(r.Context(), name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	if repo == nil {
+		slog.InfoContext(r.Context(), "Repo will be created on push", "repo", name)
+		repo = &repository{Name: name}
+	} else {
+		slog.InfoContext(r.Context(), "Repo already exists", "repo", name)
+	}
+
+	jsonBytes, err := json.Marshal(c.repositoryResponse(*repo))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// RemoveRepository deletes all manifests referenced by tags in the repository.
+// The Distribution Spec has no API for deleting a repository, most registries
+// remove it once it is empty or after garbage collection.
+func (c *distributionHandler) RemoveRepository(ctx context.Context, name string) error {
+	slog.InfoContext(ctx, "Deleting repo", "repo", name)
+
+	repo, err := c.getRepoByName(ctx, name)
+	if err != nil {
+		return err
+	}
+	if repo == nil {
+		return nil
+	}
+
+	// Multiple tags may reference the same digest
+	digests := map[string]bool{}
+	for _, tag := range repo.Tags {
+		manifest, err := c.client.Manifest(ctx, name, tag)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return err
+		}
+		digests[manifest.Digest] = true
+	}
+
+	for digest := range digests {
+		err := c.client.DeleteManifest(ctx, name, digest)
+		if err != nil {
+			// Ignore if it didn't exist
+			if isNotFound(err) {
+				slog.InfoContext(ctx, "Manifest not found", "repo", name, "digest", digest)
+				continue
+			}
+			return err
+		}
+		slog.InfoContext(ctx, "Manifest deleted", "repo", name, "digest", digest)
+	}
+	return nil
+}
+
+// DeleteRepository deletes all manifests referenced by tags in the repository
+func (c *distributionHandler) DeleteRepository(w http.ResponseWriter, r *http.Request) {
+	name, err := common.RepoGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	err = c.RemoveRepository(r.Context(), name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteImage deletes a single tag. Not all registries support deleting tags,
+// in which case the manifest is deleted if no other tags reference it.
+func (c *distributionHandler) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	name, tag, err := common.ImageGetNameAndTag(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	fullname := fmt.Sprintf("%s:%s", name, tag)
+
+	slog.InfoContext(r.Context(), "Deleting image", "image", fullname)
+
+	err = c.client.DeleteManifest(r.Context(), name, tag)
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	// Ignore if it didn't exist
+	if isNotFound(err) {
+		slog.InfoContext(r.Context(), "Image not found", "image", fullname)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !isUnsupported(err) {
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Deleting tags not supported, deleting manifest", "image", fullname)
+	repo, err := c.getRepoByName(r.Context(), name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	if repo == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	digests := map[string]string{}
+	for _, t := range repo.Tags {
+		manifest, err := c.client.Manifest(r.Context(), name, t)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+			common.InternalServerError(w, r, err)
+			return
+		}
+		digests[t] = manifest.Digest
+	}
+
+	digest, ok := digests[tag]
+	if !ok {
+		slog.InfoContext(r.Context(), "Image not found", "image", fullname)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	for t, d := range digests {
+		if t != tag && d == digest {
+			err := fmt.Errorf("registry doesn't support deleting tags and %s is also tagged %s", fullname, t)
+			slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+			common.InternalServerError(w, r, err)
+			return
+		}
+	}
+
+	err = c.client.DeleteManifest(r.Context(), name, digest)
+	if err != nil && !isNotFound(err) {
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Manifest deleted", "repo", name, "digest", digest)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetToken returns the configured push credentials, the Distribution Spec has
+// no standard way to issue short-lived credentials. The helper's own
+// credentials are never returned since they can delete repositories.
+func (c *distributionHandler) GetToken(w http.ResponseWriter, r *http.Request) {
+	if c.pushUsername == "" {
+		slog.InfoContext(r.Context(), "GetToken: no push credentials configured")
+		common.NotFound(w, r)
+		return
+	}
+
+	ret := &common.RegistryToken{
+		Username: c.pushUsername,
+		Password: c.pushPassword,
+		Registry: c.client.baseURL.String(),
+	}
+
+	jsonBytes, err := json.Marshal(ret)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// HealthCheck checks the registry's API version endpoint, which also checks
+// the credentials are valid
+func (c *distributionHandler) HealthCheck(ctx context.Context) error {
+	return c.client.Ping(ctx)
+}
+
+func init() {
+	common.RegisterProvider("distribution", Setup)
+}
+
+func Setup(promRegistry *prometheus.Registry, args []string) (common.IRegistryClient, error) {
+	if len(args) != 0 {
+		return nil, errors.New("no arguments expected")
+	}
+
+	registryURL := os.Getenv("DISTRIBUTION_URL")
+	if registryURL == "" {
+		return nil, errors.New("DISTRIBUTION_URL is required")
+	}
+	timeout, err := common.UpstreamTimeout()
+	if err != nil {
+		return nil, err
+	}
+	client, err := newRegistryClient(registryURL, os.Getenv("DISTRIBUTION_USERNAME"), os.Getenv("DISTRIBUTION_PASSWORD"), timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	pushUsername := os.Getenv("DISTRIBUTION_PUSH_USERNAME")
+	pushPassword := os.Getenv("DISTRIBUTION_PUSH_PASSWORD")
+	if (pushUsername == "") != (pushPassword == "") {
+		return nil, errors.New("DISTRIBUTION_PUSH_USERNAME and DISTRIBUTION_PUSH_PASSWORD must both be set")
+	}
+
+	slog.Info("Registry", "registry", client.baseURL.String())
+	if pushUsername == "" {
+		slog.Info("DISTRIBUTION_PUSH_USERNAME not set, GetToken is disabled")
+	}
+
+	distributionH := &distributionHandler{
+		client:       client,
+		pushUsername: pushUsername,
+		pushPassword: pushPassword,
+	}
+
+	return distributionH, nil
+}
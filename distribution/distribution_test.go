@@ -0,0 +1,786 @@
+package distribution
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// MockRegistry is a minimal in-memory OCI Distribution registry
+type MockRegistry struct {
+	// repository: tag: digest
+	repos map[string]map[string]string
+	// "", "basic" or "bearer"
+	auth string
+	// Whether tags can be deleted, registry:2 only supports deleting digests
+	deleteTags bool
+
+	catalogRequests  int
+	tagsRequests     int
+	manifestRequests int
+	deleteRequests   int
+	tokenRequests    int
+
+	server *httptest.Server
+}
+
+const manifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+
+func newMockRegistry(auth string) *MockRegistry {
+	m := &MockRegistry{
+		repos: map[string]map[string]string{
+			"existing-image": {
+				"tag":    "sha256:1111",
+				"latest": "sha256:1111",
+				"other":  "sha256:2222",
+			},
+			"nested/image": {
+				"tag": "sha256:3333",
+			},
+		},
+		auth: auth,
+	}
+	m.server = httptest.NewServer(m)
+	return m
+}
+
+func (m *MockRegistry) authorised(w http.ResponseWriter, r *http.Request) bool {
+	switch m.auth {
+	case "basic":
+		username, password, ok := r.BasicAuth()
+		if ok && username == "user" && password == "password" {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+	case "bearer":
+		if r.Header.Get("Authorization") == "Bearer registry-token" {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+			`Bearer realm="%s/token",service="mock-registry",scope="repository:x:pull,push"`, m.server.URL))
+	default:
+		return true
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	return false
+}
+
+func (m *MockRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		m.tokenRequests++
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "user" || password != "password" || r.URL.Query().Get("service") != "mock-registry" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"token": "registry-token", "expires_in": 300}`))
+		return
+	}
+
+	if !m.authorised(w, r) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case path == "":
+		_, _ = w.Write([]byte(`{}`))
+	case path == "_catalog":
+		m.catalogRequests++
+		m.catalog(w, r)
+	case strings.HasSuffix(path, "/tags/list"):
+		m.tagsRequests++
+		name := strings.TrimSuffix(path, "/tags/list")
+		tags, ok := m.repos[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors": [{"code": "NAME_UNKNOWN"}]}`))
+			return
+		}
+		tagList := []string{}
+		for tag := range tags {
+			tagList = append(tagList, tag)
+		}
+		sort.Strings(tagList)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "tags": tagList})
+	case strings.Contains(path, "/manifests/"):
+		sep := strings.LastIndex(path, "/manifests/")
+		name := path[:sep]
+		reference := path[sep+len("/manifests/"):]
+		m.manifest(w, r, name, reference)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (m *MockRegistry) catalog(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	for name := range m.repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	last := r.URL.Query().Get("last")
+	n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+	// Force pagination with one item per page
+	n = min(n, 1)
+	page := []string{}
+	for _, name := range names {
+		if name > last && len(page) < n {
+			page = append(page, name)
+		}
+	}
+	if len(page) > 0 && page[len(page)-1] != names[len(names)-1] {
+		w.Header().Set("Link", fmt.Sprintf(`</v2/_catalog?last=%s&n=%d>; rel="next"`, page[len(page)-1], n))
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"repositories": page})
+}
+
+func (m *MockRegistry) manifest(w http.ResponseWriter, r *http.Request, name string, reference string) {
+	tags, ok := m.repos[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodDelete && !strings.HasPrefix(reference, "sha256:") {
+		m.deleteRequests++
+		if !m.deleteTags {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			_, _ = w.Write([]byte(`{"errors": [{"code": "UNSUPPORTED"}]}`))
+			return
+		}
+		if _, ok := tags[reference]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(tags, reference)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		m.deleteRequests++
+		found := false
+		for tag, digest := range tags {
+			if digest == reference {
+				delete(tags, tag)
+				found = true
+			}
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	m.manifestRequests++
+	digest, ok := tags[reference]
+	if !ok {
+		// Reference may be a digest
+		for _, d := range tags {
+			if d == reference {
+				digest, ok = d, true
+			}
+		}
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body := fmt.Sprintf(`{"schemaVersion": 2, "mediaType": "%s", "config": {"size": 100}, "layers": [{"size": 1000}, {"size": 2000}]}`, manifestMediaType)
+	w.Header().Set("Content-Type", manifestMediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Docker-Content-Digest", digest)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write([]byte(body))
+	}
+}
+
+func (m *MockRegistry) assertCounts(t *testing.T, expected map[string]int) {
+	countRequests := map[string]int{
+		"catalog":   m.catalogRequests,
+		"tags":      m.tagsRequests,
+		"manifests": m.manifestRequests,
+		"deletes":   m.deleteRequests,
+		"tokens":    m.tokenRequests,
+	}
+	for k, v := range countRequests {
+		e := 0
+		if val, ok := expected[k]; ok {
+			e = val
+			delete(expected, k)
+		}
+		if v != e {
+			t.Errorf("Expected %d %s requests: %d", e, k, v)
+		}
+	}
+
+	if len(expected) > 0 {
+		t.Errorf("Invalid expected counts: %v", expected)
+	}
+}
+
+func request(t *testing.T, auth string, method string, path string) (*MockRegistry, *http.Response, []byte, error) {
+	registry := newMockRegistry(auth)
+	return requestRegistry(t, registry, method, path)
+}
+
+func requestRegistry(t *testing.T, registry *MockRegistry, method string, path string) (*MockRegistry, *http.Response, []byte, error) {
+	t.Cleanup(registry.server.Close)
+
+	username := ""
+	password := ""
+	if registry.auth != "" {
+		username = "user"
+		password = "password"
+	}
+	client, err := newRegistryClient(registry.server.URL, username, password, 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return requestHandler(t, registry, &distributionHandler{client: client}, method, path)
+}
+
+func requestHandler(t *testing.T, registry *MockRegistry, d *distributionHandler, method string, path string) (*MockRegistry, *http.Response, []byte, error) {
+	s := &common.RegistryServer{
+		Client: d,
+	}
+
+	req := httptest.NewRequest(method, path, http.NoBody)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+	data, err := io.ReadAll(w.Result().Body)
+	return registry, res, data, err
+}
+
+// Tests
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.org/token",service="registry.example.org",scope="repository:foo/bar:pull,push"`)
+	if scheme != "bearer" {
+		t.Errorf("Unexpected scheme: %s", scheme)
+	}
+	expected := map[string]string{
+		"realm":   "https://auth.example.org/token",
+		"service": "registry.example.org",
+		"scope":   "repository:foo/bar:pull,push",
+	}
+	for k, v := range expected {
+		if params[k] != v {
+			t.Errorf("Expected %s=%s: %v", k, v, params[k])
+		}
+	}
+}
+
+func TestNextLink(t *testing.T) {
+	header := http.Header{"Link": {`</v2/_catalog?last=b&n=2>; rel="next"`}}
+	if nextLink(header) != "/v2/_catalog?last=b&n=2" {
+		t.Errorf("Unexpected link: %s", nextLink(header))
+	}
+	if nextLink(http.Header{}) != "" {
+		t.Errorf("Expected no link")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	testCases := []struct {
+		baseURL  string
+		path     string
+		expected string
+	}{
+		{"https://registry.example.org", "/v2/_catalog", "https://registry.example.org/v2/_catalog"},
+		{"https://registry.example.org", "/v2/_catalog?last=b&n=2", "https://registry.example.org/v2/_catalog?last=b&n=2"},
+		{"https://example.org/registry/", "/v2/_catalog", "https://example.org/registry/v2/_catalog"},
+		{"https://example.org/registry", "/v2/_catalog?last=b&n=2", "https://example.org/registry/v2/_catalog?last=b&n=2"},
+		{"https://example.org/registry", "/registry/v2/_catalog?last=b&n=2", "https://example.org/registry/v2/_catalog?last=b&n=2"},
+		{"https://example.org/registry", "https://other.example.org/v2/_catalog?last=b", "https://other.example.org/v2/_catalog?last=b"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.baseURL+tc.path, func(t *testing.T) {
+			client, err := newRegistryClient(tc.baseURL, "", "", time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := client.resolve(tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.String() != tc.expected {
+				t.Errorf("Expected %s: %s", tc.expected, u)
+			}
+		})
+	}
+}
+
+func TestListRepos(t *testing.T) {
+	for _, auth := range []string{"", "basic", "bearer"} {
+		t.Run(auth, func(t *testing.T) {
+			registry, res, data, err := request(t, auth, "GET", "/repos/")
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != 200 {
+				t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+			}
+
+			expected := map[string]int{
+				"catalog": 2,
+			}
+			if auth == "bearer" {
+				// Initial unauthorised request is retried with a token
+				expected["tokens"] = 1
+			}
+			registry.assertCounts(t, expected)
+
+			var result []common.Repository
+			err2 := json.Unmarshal(data, &result)
+			if err2 != nil {
+				t.Errorf("Unexpected error: %v", err2)
+			}
+
+			if len(result) != 2 {
+				t.Fatalf("Expected 2 items: %v", result)
+			}
+			if result[0].Name != "existing-image" || result[1].Name != "nested/image" || !strings.HasSuffix(result[1].URI, "/nested/image") {
+				t.Errorf("Unexpected result: %v", result)
+			}
+		})
+	}
+}
+
+func TestListPaged(t *testing.T) {
+	testCases := []struct {
+		query             string
+		expectedStatus    int
+		expectedNames     []string
+		expectedNextToken string
+	}{
+		// The mock registry returns one repository per page
+		{"?limit=1", 200, []string{"existing-image"}, "existing-image"},
+		{"?limit=5&page_token=existing-image", 200, []string{"nested/image"}, ""},
+		{"?page_token=existing-image", 200, []string{"nested/image"}, ""},
+		{"?limit=0", 400, nil, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			registry, res, data, err := request(t, "basic", "GET", "/repos/"+tc.query)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != tc.expectedStatus {
+				t.Errorf("Expected StatusCode %v: %v", tc.expectedStatus, res.StatusCode)
+			}
+			if tc.expectedStatus != 200 {
+				registry.assertCounts(t, map[string]int{})
+				return
+			}
+
+			registry.assertCounts(t, map[string]int{
+				"catalog": 1,
+			})
+			if res.Header.Get(common.NextPageTokenHeader) != tc.expectedNextToken {
+				t.Errorf("Expected next page token '%v': %v", tc.expectedNextToken, res.Header.Get(common.NextPageTokenHeader))
+			}
+
+			var result []common.Repository
+			err2 := json.Unmarshal(data, &result)
+			if err2 != nil {
+				t.Errorf("Unexpected error: %v", err2)
+			}
+			names := []string{}
+			for _, repo := range result {
+				names = append(names, repo.Name)
+			}
+			if !reflect.DeepEqual(names, tc.expectedNames) {
+				t.Errorf("Expected %v: %v", tc.expectedNames, names)
+			}
+		})
+	}
+}
+
+func TestGetRepo(t *testing.T) {
+	testCases := []struct {
+		imageName          string
+		expectedStatusCode int
+	}{
+		{"existing-image", 200},
+		{"nested/image", 200},
+		{"new-image", 404},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v", tc.imageName, tc.expectedStatusCode), func(t *testing.T) {
+			registry, res, data, err := request(t, "basic", "GET", "/repo/"+tc.imageName)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != tc.expectedStatusCode {
+				t.Errorf("Expected StatusCode %v: %v", tc.expectedStatusCode, res.StatusCode)
+			}
+
+			registry.assertCounts(t, map[string]int{
+				"tags": 1,
+			})
+
+			if tc.expectedStatusCode == 200 {
+				var result common.Repository
+				err2 := json.Unmarshal(data, &result)
+				if err2 != nil {
+					t.Errorf("Unexpected error: %v", err2)
+				}
+
+				if result.Name != tc.imageName || !strings.HasPrefix(result.URI, "127.0.0.1:") {
+					t.Errorf("Expected '%s': %v", tc.imageName, result)
+				}
+			} else if string(data) != "null\n" {
+				t.Errorf("Expected 'null': %v", string(data))
+			}
+		})
+	}
+}
+
+func TestGetImage(t *testing.T) {
+	testCases := []struct {
+		imageName          string
+		tag                string
+		expectedStatusCode int
+	}{
+		{"existing-image", "tag", 200},
+		{"existing-image", "new-tag", 404},
+		{"new-image", "tag", 404},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v", tc.tag, tc.expectedStatusCode), func(t *testing.T) {
+			registry, res, data, err := request(t, "bearer", "GET", fmt.Sprintf("/image/%s:%s", tc.imageName, tc.tag))
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != tc.expectedStatusCode {
+				t.Errorf("Expected StatusCode %v: %v", tc.expectedStatusCode, res.StatusCode)
+			}
+
+			expected := map[string]int{
+				"tokens": 1,
+			}
+			if tc.expectedStatusCode == 200 {
+				// Manifest and size
+				expected["manifests"] = 2
+			} else if tc.imageName == "existing-image" {
+				expected["manifests"] = 1
+			}
+			registry.assertCounts(t, expected)
+
+			if tc.expectedStatusCode == 200 {
+				var result common.Image
+				err2 := json.Unmarshal(data, &result)
+				if err2 != nil {
+					t.Errorf("Unexpected error: %v", err2)
+				}
+
+				if result.Repository != tc.imageName || result.Tag != tc.tag || result.Digest != "sha256:1111" || result.SizeBytes != 3100 {
+					t.Errorf("Unexpected result: %v", result)
+				}
+			} else if string(data) != "null\n" {
+				t.Errorf("Expected 'null': %v", string(data))
+			}
+		})
+	}
+}
+
+func TestListImages(t *testing.T) {
+	{
+		registry, res, data, err := request(t, "basic", "GET", "/images/existing-image")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 200 {
+			t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+		}
+
+		// 3 tags but only 2 unique digests
+		registry.assertCounts(t, map[string]int{
+			"tags":      1,
+			"manifests": 5,
+		})
+
+		var result []common.Image
+		err2 := json.Unmarshal(data, &result)
+		if err2 != nil {
+			t.Errorf("Unexpected error: %v", err2)
+		}
+
+		expected := []struct {
+			tag    string
+			digest string
+		}{
+			{"latest", "sha256:1111"},
+			{"other", "sha256:2222"},
+			{"tag", "sha256:1111"},
+		}
+		if len(result) != len(expected) {
+			t.Fatalf("Expected %d items: %v", len(expected), result)
+		}
+		for i, e := range expected {
+			if result[i].Repository != "existing-image" || result[i].Tag != e.tag || result[i].Digest != e.digest || result[i].SizeBytes != 3100 || result[i].PushedAt != nil {
+				t.Errorf("Unexpected image: %v", result[i])
+			}
+		}
+	}
+
+	{
+		registry, res, data, err := request(t, "basic", "GET", "/images/new-image")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 404 {
+			t.Errorf("Expected StatusCode 404: %v", res.StatusCode)
+		}
+
+		registry.assertCounts(t, map[string]int{
+			"tags": 1,
+		})
+
+		if string(data) != "null\n" {
+			t.Errorf("Expected 'null': %v", string(data))
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	for _, imageName := range []string{"existing-image", "new-image"} {
+		t.Run(imageName, func(t *testing.T) {
+			registry, res, data, err := request(t, "", "POST", "/repo/"+imageName)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != 200 {
+				t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+			}
+
+			registry.assertCounts(t, map[string]int{
+				"tags": 1,
+			})
+
+			var result common.Repository
+			err2 := json.Unmarshal(data, &result)
+			if err2 != nil {
+				t.Errorf("Unexpected error: %v", err2)
+			}
+
+			if result.Name != imageName {
+				t.Errorf("Expected '%v': %v", imageName, result)
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	{
+		registry, res, _, err := request(t, "basic", "DELETE", "/repo/existing-image")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 200 {
+			t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+		}
+
+		// 3 tags but only 2 unique digests
+		registry.assertCounts(t, map[string]int{
+			"tags":      1,
+			"manifests": 3,
+			"deletes":   2,
+		})
+
+		if len(registry.repos["existing-image"]) != 0 {
+			t.Errorf("Expected all tags to be deleted: %v", registry.repos["existing-image"])
+		}
+	}
+
+	{
+		registry, res, _, err := request(t, "basic", "DELETE", "/repo/new-image")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 200 {
+			t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+		}
+
+		registry.assertCounts(t, map[string]int{
+			"tags": 1,
+		})
+	}
+}
+
+func TestDeleteImage(t *testing.T) {
+	testCases := []struct {
+		deleteTags         bool
+		image              string
+		expectedStatusCode int
+		expectedCounts     map[string]int
+		expectedTags       []string
+	}{
+		// Tag deletion supported
+		{true, "existing-image:tag", 200, map[string]int{"deletes": 1}, []string{"latest", "other"}},
+		{true, "existing-image:new-tag", 200, map[string]int{"deletes": 1}, []string{"latest", "other", "tag"}},
+		{true, "new-image:tag", 200, map[string]int{}, nil},
+		// Fallback to deleting the manifest if it isn't shared with another tag
+		{false, "existing-image:other", 200, map[string]int{"deletes": 2, "tags": 1, "manifests": 3}, []string{"latest", "tag"}},
+		{false, "existing-image:tag", 500, map[string]int{"deletes": 1, "tags": 1, "manifests": 3}, []string{"latest", "other", "tag"}},
+		{false, "existing-image:new-tag", 200, map[string]int{"deletes": 1, "tags": 1, "manifests": 3}, []string{"latest", "other", "tag"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v", tc.deleteTags, tc.image), func(t *testing.T) {
+			registry := newMockRegistry("basic")
+			registry.deleteTags = tc.deleteTags
+			_, res, _, err := requestRegistry(t, registry, "DELETE", "/image/"+tc.image)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != tc.expectedStatusCode {
+				t.Errorf("Expected StatusCode %v: %v", tc.expectedStatusCode, res.StatusCode)
+			}
+
+			registry.assertCounts(t, tc.expectedCounts)
+
+			if tc.expectedTags != nil {
+				tags := []string{}
+				for tag := range registry.repos["existing-image"] {
+					tags = append(tags, tag)
+				}
+				sort.Strings(tags)
+				if !reflect.DeepEqual(tags, tc.expectedTags) {
+					t.Errorf("Expected tags %v: %v", tc.expectedTags, tags)
+				}
+			}
+		})
+	}
+}
+
+func TestToken(t *testing.T) {
+	{
+		registry := newMockRegistry("basic")
+		t.Cleanup(registry.server.Close)
+		client, err := newRegistryClient(registry.server.URL, "user", "password", 30*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &distributionHandler{
+			client:       client,
+			pushUsername: "push-user",
+			pushPassword: "push-password",
+		}
+		_, res, data, err := requestHandler(t, registry, d, "POST", "/token/existing-image:tag")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 200 {
+			t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+		}
+
+		var result map[string]string
+		err2 := json.Unmarshal(data, &result)
+		if err2 != nil {
+			t.Errorf("Unexpected error: %v", err2)
+		}
+		if result["username"] != "push-user" || result["password"] != "push-password" || !strings.HasPrefix(result["registry"], "http://127.0.0.1:") {
+			t.Errorf("Unexpected result: %v", result)
+		}
+	}
+
+	// The helper's own credentials are never returned
+	{
+		_, res, _, err := request(t, "basic", "POST", "/token/existing-image:tag")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 404 {
+			t.Errorf("Expected StatusCode 404: %v", res.StatusCode)
+		}
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	t.Cleanup(slow.Close)
+
+	client, err := newRegistryClient(slow.URL, "", "", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &common.RegistryServer{
+		Client: &distributionHandler{client: client},
+	}
+
+	req := httptest.NewRequest("GET", "/repo/existing-image", http.NoBody)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 504 || string(data) != `{"error": "upstream timeout"}`+"\n" {
+		t.Errorf("Expected 504 upstream timeout: %d %s", res.StatusCode, data)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	for _, auth := range []string{"", "basic", "bearer"} {
+		t.Run(auth, func(t *testing.T) {
+			registry := newMockRegistry(auth)
+			t.Cleanup(registry.server.Close)
+
+			for _, tc := range []struct {
+				password    string
+				shouldError bool
+			}{
+				{"password", false},
+				{"expired", auth != ""},
+			} {
+				client, err := newRegistryClient(registry.server.URL, "user", tc.password, 30*time.Second)
+				if err != nil {
+					t.Fatal(err)
+				}
+				d := &distributionHandler{client: client}
+				err = d.HealthCheck(context.Background())
+				if (err != nil) != tc.shouldError {
+					t.Errorf("Unexpected health check result for password %s: %v", tc.password, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,695 @@
+// Google Artifact Registry
+// SDK: https://pkg.go.dev/cloud.google.com/go/artifactregistry/apiv1
+
+package google
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	artifactregistry "cloud.google.com/go/artifactregistry/apiv1"
+	"cloud.google.com/go/artifactregistry/apiv1/artifactregistrypb"
+	"golang.org/x/oauth2"
+	googleauth "golang.org/x/oauth2/google"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// Number of packages to request per page
+const listPageSize = 1000
+
+// IArtifactRegistryClient is a subset of the Artifact Registry API.
+// The SDK returns iterators and long-running operations which can't easily be
+// mocked, so this interface returns the underlying responses instead.
+type IArtifactRegistryClient interface {
+	ListPackages(ctx context.Context, request *artifactregistrypb.ListPackagesRequest) (response *artifactregistrypb.ListPackagesResponse, err error)
+
+	GetPackage(ctx context.Context, request *artifactregistrypb.GetPackageRequest) (response *artifactregistrypb.Package, err error)
+
+	GetTag(ctx context.Context, request *artifactregistrypb.GetTagRequest) (response *artifactregistrypb.Tag, err error)
+
+	GetVersion(ctx context.Context, request *artifactregistrypb.GetVersionRequest) (response *artifactregistrypb.Version, err error)
+
+	ListVersions(ctx context.Context, request *artifactregistrypb.ListVersionsRequest) (response *artifactregistrypb.ListVersionsResponse, err error)
+
+	DeletePackage(ctx context.Context, request *artifactregistrypb.DeletePackageRequest) (err error)
+
+	DeleteTag(ctx context.Context, request *artifactregistrypb.DeleteTagRequest) (err error)
+}
+
+// artifactRegistryClient implements IArtifactRegistryClient using the Artifact Registry SDK
+type artifactRegistryClient struct {
+	client *artifactregistry.Client
+}
+
+func (c *artifactRegistryClient) ListPackages(ctx context.Context, request *artifactregistrypb.ListPackagesRequest) (*artifactregistrypb.ListPackagesResponse, error) {
+	it := c.client.ListPackages(ctx, request)
+	var packages []*artifactregistrypb.Package
+	nextPageToken, err := iterator.NewPager(it, int(request.PageSize), request.PageToken).NextPage(&packages)
+	if err != nil {
+		return nil, err
+	}
+	return &artifactregistrypb.ListPackagesResponse{
+		Packages:      packages,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+func (c *artifactRegistryClient) GetPackage(ctx context.Context, request *artifactregistrypb.GetPackageRequest) (*artifactregistrypb.Package, error) {
+	return c.client.GetPackage(ctx, request)
+}
+
+func (c *artifactRegistryClient) GetTag(ctx context.Context, request *artifactregistrypb.GetTagRequest) (*artifactregistrypb.Tag, error) {
+	return c.client.GetTag(ctx, request)
+}
+
+func (c *artifactRegistryClient) GetVersion(ctx context.Context, request *artifactregistrypb.GetVersionRequest) (*artifactregistrypb.Version, error) {
+	return c.client.GetVersion(ctx, request)
+}
+
+func (c *artifactRegistryClient) ListVersions(ctx context.Context, request *artifactregistrypb.ListVersionsRequest) (*artifactregistrypb.ListVersionsResponse, error) {
+	it := c.client.ListVersions(ctx, request)
+	var versions []*artifactregistrypb.Version
+	nextPageToken, err := iterator.NewPager(it, int(request.PageSize), request.PageToken).NextPage(&versions)
+	if err != nil {
+		return nil, err
+	}
+	return &artifactregistrypb.ListVersionsResponse{
+		Versions:      versions,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+func (c *artifactRegistryClient) DeletePackage(ctx context.Context, request *artifactregistrypb.DeletePackageRequest) error {
+	op, err := c.client.DeletePackage(ctx, request)
+	if err != nil {
+		return err
+	}
+	return op.Wait(ctx)
+}
+
+func (c *artifactRegistryClient) DeleteTag(ctx context.Context, request *artifactregistrypb.DeleteTagRequest) error {
+	return c.client.DeleteTag(ctx, request)
+}
+
+type artifactRegistryHandler struct {
+	project     string
+	location    string
+	repository  string
+	client      IArtifactRegistryClient
+	tokenSource oauth2.TokenSource
+	// Maximum time to fetch a token, 0 means no timeout
+	tokenTimeout time.Duration
+}
+
+func isNotFound(err error) bool {
+	return status.Code(err) == codes.NotFound
+}
+
+// repositoryPath is the full resource name of the Artifact Registry repository
+func (c *artifactRegistryHandler) repositoryPath() string {
+	return fmt.Sprintf("projects/%s/locations/%s/repositories/%s", c.project, c.location, c.repository)
+}
+
+// packagePath is the full resource name of a package, any "/" in the
+// package name must be escaped
+func (c *artifactRegistryHandler) packagePath(name string) string {
+	return fmt.Sprintf("%s/packages/%s", c.repositoryPath(), url.PathEscape(name))
+}
+
+func (c *artifactRegistryHandler) registryHost() string {
+	return fmt.Sprintf("%s-docker.pkg.dev", c.location)
+}
+
+func (c *artifactRegistryHandler) dropPrefix(fullRepository string) (string, error) {
+	// Artifact Registry images have a project and repository prefix which
+	// isn't part of the package name:
+	// LOCATION-docker.pkg.dev/PROJECT/REPOSITORY/PACKAGE:TAG
+	prefix := fmt.Sprintf("%s/%s/", c.project, c.repository)
+	name, found := strings.CutPrefix(fullRepository, prefix)
+	if !found || name == "" {
+		return "", fmt.Errorf("repository does not match %s: %s", prefix, fullRepository)
+	}
+	return name, nil
+}
+
+// packageRepository converts a package to the common response, the name includes the
+// project and repository prefix
+func (c *artifactRegistryHandler) packageRepository(pkg *artifactregistrypb.Package) common.Repository {
+	name := pkg.Name[strings.LastIndex(pkg.Name, "/")+1:]
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		name = unescaped
+	}
+	fullRepository := fmt.Sprintf("%s/%s/%s", c.project, c.repository, name)
+	repo := common.Repository{
+		Name:     fullRepository,
+		URI:      fmt.Sprintf("%s/%s", c.registryHost(), fullRepository),
+		Provider: pkg,
+	}
+	if pkg.CreateTime != nil {
+		created := pkg.CreateTime.AsTime()
+		repo.Created = &created
+	}
+	return repo
+}
+
+// listRepositories returns all repositories, or a single page if params is
+// paged, and the token for the next page
+func (c *artifactRegistryHandler) listRepositories(ctx context.Context, params common.ListParams) ([]common.Repository, string, error) {
+	slog.InfoContext(ctx, "Listing repos")
+	repositories := []common.Repository{}
+	request := artifactregistrypb.ListPackagesRequest{
+		Parent:    c.repositoryPath(),
+		PageSize:  listPageSize,
+		PageToken: params.PageToken,
+	}
+	if params.Limit > 0 {
+		request.PageSize = int32(min(params.Limit, listPageSize))
+	}
+	nextPageToken := ""
+	for {
+		response, err := c.client.ListPackages(ctx, &request)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, pkg := range response.Packages {
+			repositories = append(repositories, c.packageRepository(pkg))
+		}
+		nextPageToken = response.NextPageToken
+		if nextPageToken == "" || params.Paged() {
+			break
+		}
+		request.PageToken = nextPageToken
+	}
+	return repositories, nextPageToken, nil
+}
+
+// AllRepositories returns all repositories, following pagination
+func (c *artifactRegistryHandler) AllRepositories(ctx context.Context) ([]common.Repository, error) {
+	repositories, _, err := c.listRepositories(ctx, common.ListParams{})
+	return repositories, err
+}
+
+// ListRepositories returns all repositories, or a single page if limit or
+// page_token are given
+func (c *artifactRegistryHandler) ListRepositories(w http.ResponseWriter, r *http.Request) {
+	params, err := common.ListGetParams(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
+		common.BadRequest(w, r, err)
+		return
+	}
+
+	repositories, nextPageToken, err := c.listRepositories(r.Context(), params)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	jsonBytes, err := json.Marshal(repositories)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	if nextPageToken != "" {
+		w.Header().Set(common.NextPageTokenHeader, nextPageToken)
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+func (c *artifactRegistryHandler) getByName(r *http.Request) (*artifactregistrypb.Package, string, error) {
+	fullRepository, err := common.RepoGetName(r)
+	if err != nil {
+		return nil, "", err
+	}
+	name, err := c.dropPrefix(fullRepository)
+	if err != nil {
+		return nil, "", err
+	}
+	pkg, err := c.getPackage(r.Context(), name)
+	return pkg, name, err
+}
+
+func (c *artifactRegistryHandler) getPackage(ctx context.Context, name string) (*artifactregistrypb.Package, error) {
+	pkg, err := c.client.GetPackage(ctx, &artifactregistrypb.GetPackageRequest{
+		Name: c.packagePath(name),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			slog.InfoContext(ctx, "Repo not found", "repo", name)
+			return nil, nil
+		}
+		slog.ErrorContext(ctx, "getPackage failed", "error", err)
+		return nil, err
+	}
+	slog.InfoContext(ctx, "Repo found", "repo", name, "package", pkg.Name)
+	return pkg, nil
+}
+
+// versionImages converts a Docker package version to a list of Image
+func versionImages(repository string, version *artifactregistrypb.Version) []common.Image {
+	digest, tags, size, pushedAt := versionDetails(version)
+	return common.NewImages(repository, tags, digest, size, pushedAt, version)
+}
+
+// versionDetails returns the digest, tags, size and creation time of a Docker
+// package version
+func versionDetails(version *artifactregistrypb.Version) (string, []string, int64, *time.Time) {
+	// Version names end with the digest
+	digest := version.Name[strings.LastIndex(version.Name, "/")+1:]
+	if unescaped, err := url.PathUnescape(digest); err == nil {
+		digest = unescaped
+	}
+	tags := []string{}
+	for _, tag := range version.RelatedTags {
+		tags = append(tags, tag.Name[strings.LastIndex(tag.Name, "/")+1:])
+	}
+	var size int64
+	if sizeValue, ok := version.Metadata.GetFields()["imageSizeBytes"]; ok {
+		// The size may be a string or a number
+		size, _ = strconv.ParseInt(sizeValue.GetStringValue(), 10, 64)
+		if size == 0 {
+			size = int64(sizeValue.GetNumberValue())
+		}
+	}
+	var pushedAt *time.Time
+	if version.CreateTime != nil {
+		t := version.CreateTime.AsTime()
+		pushedAt = &t
+	}
+	return digest, tags, size, pushedAt
+}
+
+// AllImages returns all versions of a package
+func (c *artifactRegistryHandler) AllImages(ctx context.Context, fullRepository string) ([]common.Image, error) {
+	name, err := c.dropPrefix(fullRepository)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "Listing images", "repo", name)
+
+	pkg, err := c.getPackage(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if pkg == nil {
+		return nil, common.ErrRepositoryNotFound
+	}
+
+	images := []common.Image{}
+	request := artifactregistrypb.ListVersionsRequest{
+		Parent:   c.packagePath(name),
+		PageSize: listPageSize,
+		View:     artifactregistrypb.VersionView_FULL,
+	}
+	for {
+		response, err := c.client.ListVersions(ctx, &request)
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range response.Versions {
+			images = append(images, versionImages(fullRepository, version)...)
+		}
+		if response.NextPageToken == "" {
+			break
+		}
+		request.PageToken = response.NextPageToken
+	}
+	return images, nil
+}
+
+// ListImages returns all versions of a package
+func (c *artifactRegistryHandler) ListImages(w http.ResponseWriter, r *http.Request) {
+	fullRepository, err := common.ImagesGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	images, err := c.AllImages(r.Context(), fullRepository)
+	if errors.Is(err, common.ErrRepositoryNotFound) {
+		common.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(images)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+func (c *artifactRegistryHandler) GetRepository(w http.ResponseWriter, r *http.Request) {
+	pkg, name, err := c.getByName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Getting repo", "repo", name)
+
+	if pkg == nil {
+		common.NotFound(w, r)
+		return
+	}
+	jsonBytes, err := json.Marshal(c.packageRepository(pkg))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+func (c *artifactRegistryHandler) GetImage(w http.ResponseWriter, r *http.Request) {
+	fullRepository, tag, err := common.ImageGetNameAndTag(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	name, err := c.dropPrefix(fullRepository)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	fullname := fmt.Sprintf("%s:%s", name, tag)
+
+	slog.InfoContext(r.Context(), "Getting image", "image", fullname)
+
+	image, err := c.client.GetTag(r.Context(), &artifactregistrypb.GetTagRequest{
+		Name: fmt.Sprintf("%s/tags/%s", c.packagePath(name), tag),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			slog.InfoContext(r.Context(), "Image not found", "image", fullname)
+			common.NotFound(w, r)
+			return
+		}
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Image found", "image", fullname, "version", image.Version)
+	// The tag only contains the version name
+	version, err := c.client.GetVersion(r.Context(), &artifactregistrypb.GetVersionRequest{
+		Name: image.Version,
+		View: artifactregistrypb.VersionView_FULL,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	digest, _, size, pushedAt := versionDetails(version)
+	jsonBytes, err := json.Marshal(common.Image{
+		Repository: fullRepository,
+		Tag:        tag,
+		Digest:     digest,
+		PushedAt:   pushedAt,
+		SizeBytes:  size,
+		Provider:   image,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// CreateRepository is a no-op since Artifact Registry creates packages on push.
+// If the package already exists it is returned, otherwise a placeholder is
+// returned containing the package name.
+func (c *artifactRegistryHandler) CreateRepository(w http.ResponseWriter, r *http.Request) {
+	pkg, name, err := c.getByName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	if pkg == nil {
+		slog.InfoContext(r.Context(), "Repo will be created on push", "repo", name)
+		pkg = &artifactregistrypb.Package{
+			Name: c.packagePath(name),
+		}
+	} else {
+		slog.InfoContext(r.Context(), "Repo already exists", "repo", name)
+	}
+
+	jsonBytes, err := json.Marshal(c.packageRepository(pkg))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// RemoveRepository deletes a package, it succeeds if the package doesn't
+// exist
+func (c *artifactRegistryHandler) RemoveRepository(ctx context.Context, fullRepository string) error {
+	name, err := c.dropPrefix(fullRepository)
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Deleting repo", "repo", name)
+
+	err = c.client.DeletePackage(ctx, &artifactregistrypb.DeletePackageRequest{
+		Name: c.packagePath(name),
+	})
+	if err != nil {
+		// Ignore if it didn't exist
+		if isNotFound(err) {
+			slog.InfoContext(ctx, "Repo not found", "repo", name)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *artifactRegistryHandler) DeleteRepository(w http.ResponseWriter, r *http.Request) {
+	fullRepository, err := common.RepoGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	err = c.RemoveRepository(r.Context(), fullRepository)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteImage deletes a single tag, the untagged version is left for the
+// repository cleanup policies
+func (c *artifactRegistryHandler) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	fullRepository, tag, err := common.ImageGetNameAndTag(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	name, err := c.dropPrefix(fullRepository)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	fullname := fmt.Sprintf("%s:%s", name, tag)
+
+	slog.InfoContext(r.Context(), "Deleting image", "image", fullname)
+
+	err = c.client.DeleteTag(r.Context(), &artifactregistrypb.DeleteTagRequest{
+		Name: fmt.Sprintf("%s/tags/%s", c.packagePath(name), tag),
+	})
+	if err != nil {
+		// Ignore if it didn't exist
+		if isNotFound(err) {
+			slog.InfoContext(r.Context(), "Image not found", "image", fullname)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *artifactRegistryHandler) GetToken(w http.ResponseWriter, r *http.Request) {
+	token, err := tokenWithTimeout(r.Context(), c.tokenSource, c.tokenTimeout)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	// https://cloud.google.com/artifact-registry/docs/docker/authentication#token
+	ret := &common.RegistryToken{
+		Username: "oauth2accesstoken",
+		Password: token.AccessToken,
+		Registry: fmt.Sprintf("https://%s", c.registryHost()),
+		Expires:  token.Expiry,
+	}
+
+	jsonBytes, err := json.Marshal(ret)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// HealthCheck lists a single package to check the credentials are valid and
+// the repository exists
+func (c *artifactRegistryHandler) HealthCheck(ctx context.Context) error {
+	_, err := c.client.ListPackages(ctx, &artifactregistrypb.ListPackagesRequest{
+		Parent:   c.repositoryPath(),
+		PageSize: 1,
+	})
+	return err
+}
+
+func init() {
+	common.RegisterProvider("google", Setup)
+}
+
+func Setup(promRegistry *prometheus.Registry, args []string) (common.IRegistryClient, error) {
+	var creds *googleauth.Credentials
+	var err error
+
+	ctx := context.TODO()
+
+	switch len(args) {
+	case 0:
+		// Application default credentials, e.g. GKE workload identity
+		creds, err = googleauth.FindDefaultCredentials(ctx, cloudPlatformScope)
+		if err != nil {
+			slog.Error("Failed to load configuration", "error", err)
+			return nil, err
+		}
+	case 1:
+		// Service account key file
+		credsFile := args[0]
+		jsonBytes, err := os.ReadFile(credsFile) // #nosec G304 -- File is provided by the administrator
+		if err != nil {
+			slog.Error("Failed to read credentials", "error", err)
+			return nil, err
+		}
+		creds, err = googleauth.CredentialsFromJSON(ctx, jsonBytes, cloudPlatformScope)
+		if err != nil {
+			slog.Error("Failed to load configuration", "error", err)
+			return nil, err
+		}
+	default:
+		return nil, errors.New("arguments: [google-credentials-file]")
+	}
+
+	project := os.Getenv("GOOGLE_PROJECT")
+	if project == "" {
+		project = creds.ProjectID
+	}
+	if project == "" {
+		return nil, errors.New("GOOGLE_PROJECT is required")
+	}
+	location := os.Getenv("GOOGLE_LOCATION")
+	if location == "" {
+		return nil, errors.New("GOOGLE_LOCATION is required")
+	}
+	repository := os.Getenv("GOOGLE_REPOSITORY")
+	if repository == "" {
+		return nil, errors.New("GOOGLE_REPOSITORY is required")
+	}
+
+	client, err := artifactregistry.NewClient(ctx, option.WithCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Project", "project", project)
+	slog.Info("Location", "location", location)
+	slog.Info("Repository", "repository", repository)
+
+	timeout, err := common.UpstreamTimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	arH := &artifactRegistryHandler{
+		project:      project,
+		location:     location,
+		repository:   repository,
+		client:       &timeoutArtifactRegistryClient{client: &artifactRegistryClient{client: client}, timeout: timeout},
+		tokenSource:  creds.TokenSource,
+		tokenTimeout: timeout,
+	}
+
+	return arH, nil
+}
@@ -0,0 +1,664 @@
+package google
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/artifactregistry/apiv1/artifactregistrypb"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+const repositoryPath = "projects/project/locations/europe-west2/repositories/binder"
+
+type MockArtifactRegistryClient struct {
+	listRequests    []*artifactregistrypb.ListPackagesRequest
+	getRequests     []*artifactregistrypb.GetPackageRequest
+	getTagRequests  []*artifactregistrypb.GetTagRequest
+	versionRequests []*artifactregistrypb.ListVersionsRequest
+	getVersionReqs  []*artifactregistrypb.GetVersionRequest
+	deleteRequests  []*artifactregistrypb.DeletePackageRequest
+	deleteTagReqs   []*artifactregistrypb.DeleteTagRequest
+
+	deleteRepoNoops int
+	deleteTagNoops  int
+}
+
+func (c *MockArtifactRegistryClient) pkg(name string) *artifactregistrypb.Package {
+	return &artifactregistrypb.Package{
+		Name:       fmt.Sprintf("%s/packages/%s", repositoryPath, name),
+		CreateTime: timestamppb.New(timestamp()),
+	}
+}
+
+func (c *MockArtifactRegistryClient) ListPackages(ctx context.Context, request *artifactregistrypb.ListPackagesRequest) (*artifactregistrypb.ListPackagesResponse, error) {
+	c.listRequests = append(c.listRequests, request)
+
+	if request.PageToken == "" {
+		return &artifactregistrypb.ListPackagesResponse{
+			Packages: []*artifactregistrypb.Package{
+				c.pkg("existing-image"),
+			},
+			NextPageToken: "page-2",
+		}, nil
+	}
+	if request.PageToken == "page-2" {
+		return &artifactregistrypb.ListPackagesResponse{
+			Packages: []*artifactregistrypb.Package{
+				c.pkg("another%2Fimage"),
+			},
+		}, nil
+	}
+
+	panic("ERROR")
+}
+
+func (c *MockArtifactRegistryClient) GetPackage(ctx context.Context, request *artifactregistrypb.GetPackageRequest) (*artifactregistrypb.Package, error) {
+	c.getRequests = append(c.getRequests, request)
+
+	if request.Name == repositoryPath+"/packages/existing-image" {
+		return c.pkg("existing-image"), nil
+	}
+	return nil, status.Error(codes.NotFound, "Package not found")
+}
+
+func (c *MockArtifactRegistryClient) GetTag(ctx context.Context, request *artifactregistrypb.GetTagRequest) (*artifactregistrypb.Tag, error) {
+	c.getTagRequests = append(c.getTagRequests, request)
+
+	if request.Name == repositoryPath+"/packages/existing-image/tags/tag" {
+		return &artifactregistrypb.Tag{
+			Name:    request.Name,
+			Version: repositoryPath + "/packages/existing-image/versions/sha256:abcdef",
+		}, nil
+	}
+	return nil, status.Error(codes.NotFound, "Tag not found")
+}
+
+func (c *MockArtifactRegistryClient) GetVersion(ctx context.Context, request *artifactregistrypb.GetVersionRequest) (*artifactregistrypb.Version, error) {
+	c.getVersionReqs = append(c.getVersionReqs, request)
+
+	if request.Name == repositoryPath+"/packages/existing-image/versions/sha256:abcdef" && request.View == artifactregistrypb.VersionView_FULL {
+		return &artifactregistrypb.Version{
+			Name:       request.Name,
+			CreateTime: timestamppb.New(timestamp()),
+			RelatedTags: []*artifactregistrypb.Tag{
+				{Name: repositoryPath + "/packages/existing-image/tags/tag"},
+			},
+			Metadata: &structpb.Struct{
+				Fields: map[string]*structpb.Value{
+					"imageSizeBytes": structpb.NewStringValue("123456"),
+				},
+			},
+		}, nil
+	}
+	return nil, status.Error(codes.NotFound, "Version not found")
+}
+
+func (c *MockArtifactRegistryClient) ListVersions(ctx context.Context, request *artifactregistrypb.ListVersionsRequest) (*artifactregistrypb.ListVersionsResponse, error) {
+	c.versionRequests = append(c.versionRequests, request)
+
+	packagePath := repositoryPath + "/packages/existing-image"
+	if request.Parent != packagePath || request.View != artifactregistrypb.VersionView_FULL {
+		panic("ERROR")
+	}
+	if request.PageToken == "" {
+		return &artifactregistrypb.ListVersionsResponse{
+			Versions: []*artifactregistrypb.Version{
+				{
+					Name:       packagePath + "/versions/sha256:1234",
+					CreateTime: timestamppb.New(timestamp()),
+					RelatedTags: []*artifactregistrypb.Tag{
+						{Name: packagePath + "/tags/tag"},
+						{Name: packagePath + "/tags/latest"},
+					},
+					Metadata: &structpb.Struct{
+						Fields: map[string]*structpb.Value{
+							"imageSizeBytes": structpb.NewStringValue("123456"),
+						},
+					},
+				},
+			},
+			NextPageToken: "page-2",
+		}, nil
+	}
+	return &artifactregistrypb.ListVersionsResponse{
+		Versions: []*artifactregistrypb.Version{
+			{
+				Name:       packagePath + "/versions/sha256:5678",
+				CreateTime: timestamppb.New(timestamp()),
+				Metadata: &structpb.Struct{
+					Fields: map[string]*structpb.Value{
+						"imageSizeBytes": structpb.NewNumberValue(789),
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+func (c *MockArtifactRegistryClient) DeletePackage(ctx context.Context, request *artifactregistrypb.DeletePackageRequest) error {
+	c.deleteRequests = append(c.deleteRequests, request)
+
+	if request.Name == repositoryPath+"/packages/existing-image" {
+		return nil
+	}
+	c.deleteRepoNoops++
+	return status.Error(codes.NotFound, "Package not found")
+}
+
+func (c *MockArtifactRegistryClient) DeleteTag(ctx context.Context, request *artifactregistrypb.DeleteTagRequest) error {
+	c.deleteTagReqs = append(c.deleteTagReqs, request)
+
+	if request.Name == repositoryPath+"/packages/existing-image/tags/tag" {
+		return nil
+	}
+	c.deleteTagNoops++
+	return status.Error(codes.NotFound, "Tag not found")
+}
+
+func (e *MockArtifactRegistryClient) assertCounts(t *testing.T, expected map[string]int) {
+	countRequests := map[string]int{
+		"listRepos":    len(e.listRequests),
+		"getRepos":     len(e.getRequests),
+		"getTags":      len(e.getTagRequests),
+		"listVersions": len(e.versionRequests),
+		"getVersions":  len(e.getVersionReqs),
+		"deleteRepos":  len(e.deleteRequests),
+		"deleteTags":   len(e.deleteTagReqs),
+	}
+	for k, v := range countRequests {
+		e := 0
+		if val, ok := expected[k]; ok {
+			e = val
+			delete(expected, k)
+		}
+		if v != e {
+			t.Errorf("Expected %d %s requests: %d", e, k, v)
+		}
+	}
+
+	countNoops := map[string]int{
+		"deleteNoops":    e.deleteRepoNoops,
+		"deleteTagNoops": e.deleteTagNoops,
+	}
+	for k, v := range countNoops {
+		e := 0
+		if val, ok := expected[k]; ok {
+			e = val
+			delete(expected, k)
+		}
+		if v != e {
+			t.Errorf("Expected %d %s: %d", e, k, v)
+		}
+	}
+
+	if len(expected) > 0 {
+		t.Errorf("Invalid expected counts: %v", expected)
+	}
+}
+
+func timestamp() time.Time {
+	return time.Date(2023, time.January, 1, 12, 34, 56, 0, time.UTC)
+}
+
+func request(t *testing.T, method string, path string) (MockArtifactRegistryClient, *http.Response, []byte, error) {
+	arClient := MockArtifactRegistryClient{}
+	a := &artifactRegistryHandler{
+		project:    "project",
+		location:   "europe-west2",
+		repository: "binder",
+		client:     &arClient,
+		tokenSource: oauth2.StaticTokenSource(&oauth2.Token{
+			AccessToken: "token",
+			Expiry:      timestamp(),
+		}),
+	}
+	s := &common.RegistryServer{
+		Client: a,
+	}
+
+	req := httptest.NewRequest(method, path, http.NoBody)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+	data, err := io.ReadAll(w.Result().Body)
+	return arClient, res, data, err
+}
+
+// Tests
+
+func TestDropPrefix(t *testing.T) {
+	a := &artifactRegistryHandler{
+		project:    "project",
+		location:   "europe-west2",
+		repository: "binder",
+	}
+
+	testCases := []struct {
+		fullname    string
+		expected    string
+		shouldError bool
+	}{
+		{"project/binder/existing-image", "existing-image", false},
+		{"project/binder/nested/image", "nested/image", false},
+		{"project/binder/", "", true},
+		{"project/other/existing-image", "", true},
+		{"existing-image", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.fullname, func(t *testing.T) {
+			name, err := a.dropPrefix(tc.fullname)
+			if tc.shouldError {
+				if err == nil {
+					t.Errorf("Expected error: %v", name)
+				}
+			} else if name != tc.expected {
+				t.Errorf("Expected %s: %s", tc.expected, name)
+			}
+		})
+	}
+
+	if a.packagePath("nested/image") != repositoryPath+"/packages/nested%2Fimage" {
+		t.Errorf("Unexpected package path: %s", a.packagePath("nested/image"))
+	}
+}
+
+func TestListRepos(t *testing.T) {
+	arClient, res, data, err := request(t, "GET", "/repos/")
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+	}
+
+	arClient.assertCounts(t, map[string]int{
+		"listRepos": 2,
+	})
+
+	var result []common.Repository
+	err2 := json.Unmarshal(data, &result)
+	if err2 != nil {
+		t.Errorf("Unexpected error: %v", err2)
+	}
+
+	if len(result) != 2 {
+		t.Fatalf("Expected 2 items: %v", result)
+	}
+	if result[0].Name != "project/binder/existing-image" || result[0].URI != "europe-west2-docker.pkg.dev/project/binder/existing-image" || !result[0].Created.Equal(timestamp()) {
+		t.Errorf("Expected 'existing-image': %v", result[0])
+	}
+	if result[1].Name != "project/binder/another/image" || result[1].Provider.(map[string]interface{})["name"] != repositoryPath+"/packages/another%2Fimage" {
+		t.Errorf("Expected 'another/image': %v", result[1])
+	}
+}
+
+func TestListPaged(t *testing.T) {
+	testCases := []struct {
+		query             string
+		expectedStatus    int
+		expectedNames     []string
+		expectedNextToken string
+	}{
+		{"?limit=1", 200, []string{"project/binder/existing-image"}, "page-2"},
+		{"?page_token=page-2", 200, []string{"project/binder/another/image"}, ""},
+		{"?limit=5000&page_token=page-2", 200, []string{"project/binder/another/image"}, ""},
+		{"?limit=0", 400, nil, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			arClient, res, data, err := request(t, "GET", "/repos/"+tc.query)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != tc.expectedStatus {
+				t.Errorf("Expected StatusCode %v: %v", tc.expectedStatus, res.StatusCode)
+			}
+			if tc.expectedStatus != 200 {
+				arClient.assertCounts(t, map[string]int{})
+				return
+			}
+
+			arClient.assertCounts(t, map[string]int{
+				"listRepos": 1,
+			})
+			if arClient.listRequests[0].PageSize < 1 || arClient.listRequests[0].PageSize > listPageSize {
+				t.Errorf("Unexpected page size: %d", arClient.listRequests[0].PageSize)
+			}
+			if res.Header.Get(common.NextPageTokenHeader) != tc.expectedNextToken {
+				t.Errorf("Expected next page token '%v': %v", tc.expectedNextToken, res.Header.Get(common.NextPageTokenHeader))
+			}
+
+			var result []common.Repository
+			err2 := json.Unmarshal(data, &result)
+			if err2 != nil {
+				t.Errorf("Unexpected error: %v", err2)
+			}
+			names := []string{}
+			for _, repo := range result {
+				names = append(names, repo.Name)
+			}
+			if !reflect.DeepEqual(names, tc.expectedNames) {
+				t.Errorf("Expected %v: %v", tc.expectedNames, names)
+			}
+		})
+	}
+}
+
+func TestGetRepo(t *testing.T) {
+	testCases := []struct {
+		imageName          string
+		expectedStatusCode int
+	}{
+		{"existing-image", 200},
+		{"new-image", 404},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v", tc.imageName, tc.expectedStatusCode), func(t *testing.T) {
+			arClient, res, data, err := request(t, "GET", "/repo/project/binder/"+tc.imageName)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != tc.expectedStatusCode {
+				t.Errorf("Expected StatusCode %v: %v", tc.expectedStatusCode, res.StatusCode)
+			}
+
+			arClient.assertCounts(t, map[string]int{
+				"getRepos": 1,
+			})
+
+			if tc.expectedStatusCode == 200 {
+				var result common.Repository
+				err2 := json.Unmarshal(data, &result)
+				if err2 != nil {
+					t.Errorf("Unexpected error: %v", err2)
+				}
+
+				if result.Name != "project/binder/existing-image" {
+					t.Errorf("Expected 'existing-image': %v", result)
+				}
+			} else if string(data) != "null\n" {
+				t.Errorf("Expected 'null': %v", string(data))
+			}
+		})
+	}
+}
+
+func TestGetImage(t *testing.T) {
+	testCases := []struct {
+		imageName          string
+		tag                string
+		expectedStatusCode int
+	}{
+		{"existing-image", "tag", 200},
+		{"existing-image", "new-tag", 404},
+		{"new-image", "tag", 404},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v", tc.tag, tc.expectedStatusCode), func(t *testing.T) {
+			arClient, res, data, err := request(t, "GET", fmt.Sprintf("/image/project/binder/%s:%s", tc.imageName, tc.tag))
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != tc.expectedStatusCode {
+				t.Errorf("Expected StatusCode %v: %v", tc.expectedStatusCode, res.StatusCode)
+			}
+
+			if tc.expectedStatusCode == 200 {
+				arClient.assertCounts(t, map[string]int{
+					"getTags":     1,
+					"getVersions": 1,
+				})
+
+				var result common.Image
+				err2 := json.Unmarshal(data, &result)
+				if err2 != nil {
+					t.Errorf("Unexpected error: %v", err2)
+				}
+
+				if result.Repository != "project/binder/existing-image" || result.Tag != "tag" || result.Digest != "sha256:abcdef" || result.SizeBytes != 123456 || !result.PushedAt.Equal(timestamp()) {
+					t.Errorf("Expected 'existing-image': %v", result)
+				}
+				if result.Provider.(map[string]interface{})["version"] != repositoryPath+"/packages/existing-image/versions/sha256:abcdef" {
+					t.Errorf("Expected provider response: %v", result.Provider)
+				}
+			} else {
+				arClient.assertCounts(t, map[string]int{
+					"getTags": 1,
+				})
+
+				if string(data) != "null\n" {
+					t.Errorf("Expected 'null': %v", string(data))
+				}
+			}
+		})
+	}
+}
+
+func TestListImages(t *testing.T) {
+	{
+		arClient, res, data, err := request(t, "GET", "/images/project/binder/existing-image")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 200 {
+			t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+		}
+
+		arClient.assertCounts(t, map[string]int{
+			"getRepos":     1,
+			"listVersions": 2,
+		})
+
+		var result []common.Image
+		err2 := json.Unmarshal(data, &result)
+		if err2 != nil {
+			t.Errorf("Unexpected error: %v", err2)
+		}
+
+		if len(result) != 3 {
+			t.Fatalf("Expected 3 items: %v", result)
+		}
+		for i, tag := range []string{"tag", "latest"} {
+			if result[i].Repository != "project/binder/existing-image" || result[i].Tag != tag || result[i].Digest != "sha256:1234" || result[i].SizeBytes != 123456 || !result[i].PushedAt.Equal(timestamp()) {
+				t.Errorf("Unexpected image: %v", result[i])
+			}
+		}
+		if result[2].Tag != "" || result[2].Digest != "sha256:5678" || result[2].SizeBytes != 789 {
+			t.Errorf("Expected untagged image: %v", result[2])
+		}
+	}
+
+	{
+		arClient, res, data, err := request(t, "GET", "/images/project/binder/new-image")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 404 {
+			t.Errorf("Expected StatusCode 404: %v", res.StatusCode)
+		}
+
+		arClient.assertCounts(t, map[string]int{
+			"getRepos": 1,
+		})
+
+		if string(data) != "null\n" {
+			t.Errorf("Expected 'null': %v", string(data))
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	testCases := []struct {
+		imageName string
+	}{
+		{"existing-image"},
+		{"new-image"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.imageName, func(t *testing.T) {
+			arClient, res, data, err := request(t, "POST", "/repo/project/binder/"+tc.imageName)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != 200 {
+				t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+			}
+
+			arClient.assertCounts(t, map[string]int{
+				"getRepos": 1,
+			})
+
+			var result common.Repository
+			err2 := json.Unmarshal(data, &result)
+			if err2 != nil {
+				t.Errorf("Unexpected error: %v", err2)
+			}
+
+			if result.Name != "project/binder/"+tc.imageName {
+				t.Errorf("Expected '%v': %v", tc.imageName, result)
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	testCases := []struct {
+		imageName string
+		delete    bool
+	}{
+		{"existing-image", true},
+		{"new-image", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v", tc.imageName, tc.delete), func(t *testing.T) {
+			arClient, res, _, err := request(t, "DELETE", "/repo/project/binder/"+tc.imageName)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != 200 {
+				t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+			}
+
+			if tc.delete {
+				arClient.assertCounts(t, map[string]int{
+					"deleteRepos": 1,
+				})
+			} else {
+				arClient.assertCounts(t, map[string]int{
+					"deleteRepos": 1,
+					"deleteNoops": 1,
+				})
+			}
+		})
+	}
+}
+
+func TestDeleteImage(t *testing.T) {
+	testCases := []struct {
+		imageName string
+		tag       string
+		delete    bool
+	}{
+		{"existing-image", "tag", true},
+		{"existing-image", "new-tag", false},
+		{"new-image", "tag", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v,%v", tc.imageName, tc.tag, tc.delete), func(t *testing.T) {
+			arClient, res, _, err := request(t, "DELETE", fmt.Sprintf("/image/project/binder/%s:%s", tc.imageName, tc.tag))
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != 200 {
+				t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+			}
+
+			if tc.delete {
+				arClient.assertCounts(t, map[string]int{
+					"deleteTags": 1,
+				})
+			} else {
+				arClient.assertCounts(t, map[string]int{
+					"deleteTags":     1,
+					"deleteTagNoops": 1,
+				})
+			}
+		})
+	}
+}
+
+func TestToken(t *testing.T) {
+	_, res, data, err := request(t, "POST", "/token/project/binder/existing-image:tag")
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+	}
+
+	var result map[string]string
+	err2 := json.Unmarshal(data, &result)
+	if err2 != nil {
+		t.Errorf("Unexpected error: %v", err2)
+	}
+
+	expected := map[string]string{
+		"username": "oauth2accesstoken",
+		"password": "token",
+		"expires":  "2023-01-01T12:34:56Z",
+		"registry": "https://europe-west2-docker.pkg.dev",
+	}
+	for k, v := range expected {
+		if result[k] != v {
+			t.Errorf("Expected %s=%s: %v", k, v, result[k])
+		}
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	arClient := MockArtifactRegistryClient{}
+	a := &artifactRegistryHandler{
+		project:    "project",
+		location:   "europe-west2",
+		repository: "binder",
+		client:     &arClient,
+	}
+	err := a.HealthCheck(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arClient.listRequests) != 1 || arClient.listRequests[0].PageSize != 1 || arClient.listRequests[0].Parent != "projects/project/locations/europe-west2/repositories/binder" {
+		t.Errorf("Unexpected requests: %v", arClient.listRequests)
+	}
+}
@@ -0,0 +1,85 @@
+package google
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/artifactregistry/apiv1/artifactregistrypb"
+	"golang.org/x/oauth2"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// timeoutArtifactRegistryClient wraps an IArtifactRegistryClient to apply a
+// timeout to every call
+type timeoutArtifactRegistryClient struct {
+	client  IArtifactRegistryClient
+	timeout time.Duration
+}
+
+func (c *timeoutArtifactRegistryClient) ListPackages(ctx context.Context, request *artifactregistrypb.ListPackagesRequest) (*artifactregistrypb.ListPackagesResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.ListPackages(ctx, request)
+}
+
+func (c *timeoutArtifactRegistryClient) GetPackage(ctx context.Context, request *artifactregistrypb.GetPackageRequest) (*artifactregistrypb.Package, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.GetPackage(ctx, request)
+}
+
+func (c *timeoutArtifactRegistryClient) GetTag(ctx context.Context, request *artifactregistrypb.GetTagRequest) (*artifactregistrypb.Tag, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.GetTag(ctx, request)
+}
+
+func (c *timeoutArtifactRegistryClient) GetVersion(ctx context.Context, request *artifactregistrypb.GetVersionRequest) (*artifactregistrypb.Version, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.GetVersion(ctx, request)
+}
+
+func (c *timeoutArtifactRegistryClient) ListVersions(ctx context.Context, request *artifactregistrypb.ListVersionsRequest) (*artifactregistrypb.ListVersionsResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.ListVersions(ctx, request)
+}
+
+func (c *timeoutArtifactRegistryClient) DeletePackage(ctx context.Context, request *artifactregistrypb.DeletePackageRequest) error {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.DeletePackage(ctx, request)
+}
+
+func (c *timeoutArtifactRegistryClient) DeleteTag(ctx context.Context, request *artifactregistrypb.DeleteTagRequest) error {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.DeleteTag(ctx, request)
+}
+
+// tokenWithTimeout returns a token from source, or an error if ctx is done or
+// timeout (0 means no timeout) expires first. oauth2.TokenSource doesn't take
+// a context so a hung request to the metadata server or STS can't be
+// cancelled, it's left to finish in the background.
+func tokenWithTimeout(ctx context.Context, source oauth2.TokenSource, timeout time.Duration) (*oauth2.Token, error) {
+	ctx, cancel := common.UpstreamContext(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		token *oauth2.Token
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		token, err := source.Token()
+		done <- result{token, err}
+	}()
+	select {
+	case r := <-done:
+		return r.token, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,102 @@
+package google
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/artifactregistry/apiv1/artifactregistrypb"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// slowArtifactRegistryClient blocks GetPackage until the context is done and
+// returns the same error as gRPC
+type slowArtifactRegistryClient struct {
+	MockArtifactRegistryClient
+}
+
+func (c *slowArtifactRegistryClient) GetPackage(ctx context.Context, request *artifactregistrypb.GetPackageRequest) (*artifactregistrypb.Package, error) {
+	<-ctx.Done()
+	return nil, status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+}
+
+func TestTimeout(t *testing.T) {
+	testCases := []struct {
+		client             IArtifactRegistryClient
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{&slowArtifactRegistryClient{}, 504, `{"error": "upstream timeout"}` + "\n"},
+		{&MockArtifactRegistryClient{}, 200, ""},
+	}
+
+	for _, tc := range testCases {
+		a := &artifactRegistryHandler{
+			project:    "project",
+			location:   "europe-west2",
+			repository: "binder",
+			client:     &timeoutArtifactRegistryClient{client: tc.client, timeout: 10 * time.Millisecond},
+		}
+		s := &common.RegistryServer{
+			Client: a,
+		}
+
+		req := httptest.NewRequest("GET", "/repo/project/binder/existing-image", http.NoBody)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != tc.expectedStatusCode {
+			t.Errorf("Expected StatusCode %d: %d", tc.expectedStatusCode, res.StatusCode)
+		}
+		if tc.expectedBody != "" && string(data) != tc.expectedBody {
+			t.Errorf("Unexpected body: %s", data)
+		}
+	}
+}
+
+// slowTokenSource blocks until release is closed
+type slowTokenSource struct {
+	release chan struct{}
+}
+
+func (s *slowTokenSource) Token() (*oauth2.Token, error) {
+	<-s.release
+	return &oauth2.Token{AccessToken: "token"}, nil
+}
+
+func TestTokenTimeout(t *testing.T) {
+	source := &slowTokenSource{release: make(chan struct{})}
+	t.Cleanup(func() { close(source.release) })
+	s := &common.RegistryServer{
+		Client: &artifactRegistryHandler{
+			project:      "project",
+			location:     "europe-west2",
+			repository:   "binder",
+			client:       &MockArtifactRegistryClient{},
+			tokenSource:  source,
+			tokenTimeout: 10 * time.Millisecond,
+		},
+	}
+
+	req := httptest.NewRequest("POST", "/token/project/binder/existing-image:tag", http.NoBody)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Expected StatusCode 504: %d", res.StatusCode)
+	}
+}
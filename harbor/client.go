@@ -0,0 +1,297 @@
+package harbor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Default number of items to request per page, the Harbor maximum is 100
+const defaultPageSize = 100
+
+// harborError is returned when Harbor returns an unexpected status code
+type harborError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *harborError) Error() string {
+	return fmt.Sprintf("harbor returned %d: %s", e.StatusCode, e.Body)
+}
+
+func isNotFound(err error) bool {
+	var harborErr *harborError
+	return errors.As(err, &harborErr) && harborErr.StatusCode == http.StatusNotFound
+}
+
+func isConflict(err error) bool {
+	var harborErr *harborError
+	return errors.As(err, &harborErr) && harborErr.StatusCode == http.StatusConflict
+}
+
+// Repository is a Harbor repository
+type Repository struct {
+	Id            int64     `json:"id"`
+	Name          string    `json:"name"`
+	ProjectId     int64     `json:"project_id"`
+	ArtifactCount int64     `json:"artifact_count"`
+	PullCount     int64     `json:"pull_count"`
+	CreationTime  time.Time `json:"creation_time"`
+	UpdateTime    time.Time `json:"update_time"`
+}
+
+// Tag is a Harbor artifact tag
+type Tag struct {
+	Name     string    `json:"name"`
+	PushTime time.Time `json:"push_time"`
+}
+
+// Artifact is a Harbor artifact (image)
+type Artifact struct {
+	Id        int64     `json:"id"`
+	Digest    string    `json:"digest"`
+	MediaType string    `json:"media_type"`
+	Size      int64     `json:"size"`
+	PushTime  time.Time `json:"push_time"`
+	Tags      []Tag     `json:"tags"`
+}
+
+// RobotPermission grants access to resources in a namespace (project)
+type RobotPermission struct {
+	Kind      string        `json:"kind"`
+	Namespace string        `json:"namespace"`
+	Access    []RobotAccess `json:"access"`
+}
+
+// RobotAccess is an action on a resource
+type RobotAccess struct {
+	Resource string `json:"resource"`
+	Action   string `json:"action"`
+}
+
+// RobotCreate is the request to create a robot account
+type RobotCreate struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Level       string            `json:"level"`
+	Duration    int               `json:"duration"`
+	Permissions []RobotPermission `json:"permissions"`
+}
+
+// Robot is a Harbor robot account
+type Robot struct {
+	Id        int64  `json:"id"`
+	Name      string `json:"name"`
+	Secret    string `json:"secret,omitempty"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// harborClient is a minimal client for the Harbor v2 API
+// https://goharbor.io/docs/main/build-customize-contribute/configure-swagger/
+type harborClient struct {
+	baseURL  *url.URL
+	username string
+	password string
+	pageSize int
+	client   *http.Client
+}
+
+func newHarborClient(baseURL string, username string, password string, timeout time.Duration) (*harborClient, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid Harbor URL: %s", baseURL)
+	}
+	return &harborClient{
+		baseURL:  u,
+		username: username,
+		password: password,
+		pageSize: defaultPageSize,
+		client:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// escapeRepository encodes a repository name, Harbor requires "/" to be
+// double encoded
+func escapeRepository(name string) string {
+	return url.PathEscape(url.PathEscape(name))
+}
+
+// do sends a request to the Harbor API. If in is not nil it is sent as a JSON
+// body, if out is not nil the JSON response is unmarshalled into it.
+func (c *harborClient) do(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader = http.NoBody
+	if in != nil {
+		jsonBytes, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(jsonBytes)
+	}
+	// path is already escaped so can't use JoinPath
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL.String()+"/api/v2.0"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.SetBasicAuth(c.username, c.password)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &harborError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+	if out != nil {
+		return json.Unmarshal(respBody, out)
+	}
+	return nil
+}
+
+// ProjectExists checks whether a project exists
+func (c *harborClient) ProjectExists(ctx context.Context, project string) (bool, error) {
+	err := c.do(ctx, http.MethodHead, "/projects?project_name="+url.QueryEscape(project), nil, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// CreateProject creates a private project
+func (c *harborClient) CreateProject(ctx context.Context, project string) error {
+	request := map[string]interface{}{
+		"project_name": project,
+		"metadata": map[string]string{
+			"public": "false",
+		},
+	}
+	return c.do(ctx, http.MethodPost, "/projects", request, nil)
+}
+
+// ListRepositories lists all repositories in all projects visible to the user
+func (c *harborClient) ListRepositories(ctx context.Context) ([]Repository, error) {
+	repositories := []Repository{}
+	for page := 1; ; page++ {
+		repos, err := c.ListRepositoriesPage(ctx, page, c.pageSize)
+		if err != nil {
+			return nil, err
+		}
+		repositories = append(repositories, repos...)
+		if len(repos) < c.pageSize {
+			return repositories, nil
+		}
+	}
+}
+
+// ListRepositoriesPage lists a single page of repositories, pages start from 1
+func (c *harborClient) ListRepositoriesPage(ctx context.Context, page int, pageSize int) ([]Repository, error) {
+	repos := []Repository{}
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/repositories?page=%d&page_size=%d", page, pageSize), nil, &repos)
+	return repos, err
+}
+
+// Ping lists a single repository to check Harbor is reachable and the
+// credentials are valid
+func (c *harborClient) Ping(ctx context.Context) error {
+	var repos []Repository
+	return c.do(ctx, http.MethodGet, "/repositories?page=1&page_size=1", nil, &repos)
+}
+
+// GetRepository gets a repository
+func (c *harborClient) GetRepository(ctx context.Context, project string, name string) (*Repository, error) {
+	var repo Repository
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/projects/%s/repositories/%s", url.PathEscape(project), escapeRepository(name)), nil, &repo)
+	if err != nil {
+		return nil, err
+	}
+	return &repo, nil
+}
+
+// DeleteRepository deletes a repository and all its artifacts
+func (c *harborClient) DeleteRepository(ctx context.Context, project string, name string) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/projects/%s/repositories/%s", url.PathEscape(project), escapeRepository(name)), nil, nil)
+}
+
+// GetArtifact gets an artifact by tag or digest
+func (c *harborClient) GetArtifact(ctx context.Context, project string, name string, reference string) (*Artifact, error) {
+	var artifact Artifact
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/projects/%s/repositories/%s/artifacts/%s", url.PathEscape(project), escapeRepository(name), url.PathEscape(reference)), nil, &artifact)
+	if err != nil {
+		return nil, err
+	}
+	return &artifact, nil
+}
+
+// ListArtifacts lists all artifacts in a repository including their tags
+func (c *harborClient) ListArtifacts(ctx context.Context, project string, name string) ([]Artifact, error) {
+	artifacts := []Artifact{}
+	for page := 1; ; page++ {
+		var pageArtifacts []Artifact
+		err := c.do(ctx, http.MethodGet, fmt.Sprintf("/projects/%s/repositories/%s/artifacts?with_tag=true&page=%d&page_size=%d", url.PathEscape(project), escapeRepository(name), page, c.pageSize), nil, &pageArtifacts)
+		if err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, pageArtifacts...)
+		if len(pageArtifacts) < c.pageSize {
+			return artifacts, nil
+		}
+	}
+}
+
+// DeleteTag deletes a tag, the artifact is not deleted
+func (c *harborClient) DeleteTag(ctx context.Context, project string, name string, tag string) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/projects/%s/repositories/%s/artifacts/%s/tags/%s", url.PathEscape(project), escapeRepository(name), url.PathEscape(tag), url.PathEscape(tag)), nil, nil)
+}
+
+// CreateRobot creates a robot account, the response includes the secret
+func (c *harborClient) CreateRobot(ctx context.Context, robot RobotCreate) (*Robot, error) {
+	var created Robot
+	err := c.do(ctx, http.MethodPost, "/robots", robot, &created)
+	if err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// ListRobots lists all robot accounts whose name contains a string
+func (c *harborClient) ListRobots(ctx context.Context, nameContains string) ([]Robot, error) {
+	robots := []Robot{}
+	q := url.QueryEscape(fmt.Sprintf("name=~%s", nameContains))
+	for page := 1; ; page++ {
+		var pageRobots []Robot
+		err := c.do(ctx, http.MethodGet, fmt.Sprintf("/robots?q=%s&page=%d&page_size=%d", q, page, c.pageSize), nil, &pageRobots)
+		if err != nil {
+			return nil, err
+		}
+		robots = append(robots, pageRobots...)
+		if len(pageRobots) < c.pageSize {
+			return robots, nil
+		}
+	}
+}
+
+// DeleteRobot deletes a robot account
+func (c *harborClient) DeleteRobot(ctx context.Context, id int64) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/robots/%d", id), nil, nil)
+}
@@ -0,0 +1,660 @@
+// Harbor registry
+// https://goharbor.io/docs/main/working-with-projects/
+//
+// Repositories are named {project}/{repository}, projects are created if they
+// don't exist. Tokens are short-lived project-scoped robot accounts.
+
+package harbor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// Prefix for the names of robot accounts created by GetToken
+const robotPrefix = "binderhub-"
+
+// Time between deleting expired robot accounts, they expire after a whole
+// number of days so this doesn't need to be frequent
+const robotCleanupInterval = time.Hour
+
+type harborHandler struct {
+	client *harborClient
+	// Lifetime of robot accounts in days, the smallest unit supported by Harbor
+	robotDurationDays int
+}
+
+var newProjectsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "new_projects_total",
+	Help:      "Total number of new projects created",
+})
+
+// errInvalidName is returned for repository names that aren't
+// {project}/{repository}, handlers return 400
+var errInvalidName = errors.New("invalid repository name, expected {project}/{repository}")
+
+// splitName splits a name into a project and repository
+func splitName(name string) (string, string, error) {
+	project, repo, found := strings.Cut(name, "/")
+	if !found || project == "" || repo == "" {
+		return "", "", fmt.Errorf("%w: %s", errInvalidName, name)
+	}
+	return project, repo, nil
+}
+
+// tokenGetProject extracts the project from a /token/{project}/{repository}:{tag} path
+func tokenGetProject(r *http.Request) (string, error) {
+	name, err := common.TokenGetName(r)
+	if err != nil {
+		return "", err
+	}
+	project, _, err := splitName(name)
+	return project, err
+}
+
+// repository converts a Harbor repository to the common response. The
+// placeholder returned by CreateRepository has no creation time or count.
+func (c *harborHandler) repository(repo Repository) common.Repository {
+	ret := common.Repository{
+		Name:     repo.Name,
+		URI:      fmt.Sprintf("%s/%s", c.client.baseURL.Host, repo.Name),
+		Provider: repo,
+	}
+	if !repo.CreationTime.IsZero() {
+		ret.Created = &repo.CreationTime
+		ret.ImageCount = &repo.ArtifactCount
+	}
+	return ret
+}
+
+func (c *harborHandler) repositories(repos []Repository) []common.Repository {
+	repositories := make([]common.Repository, len(repos))
+	for i, repo := range repos {
+		repositories[i] = c.repository(repo)
+	}
+	return repositories
+}
+
+// AllRepositories returns all repositories, following pagination
+func (c *harborHandler) AllRepositories(ctx context.Context) ([]common.Repository, error) {
+	slog.InfoContext(ctx, "Listing repos")
+	repos, err := c.client.ListRepositories(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.repositories(repos), nil
+}
+
+// ListRepositories returns all repositories, or a single page if limit or
+// page_token are given. The page token is the Harbor page number, so the
+// same limit must be used for each page.
+func (c *harborHandler) ListRepositories(w http.ResponseWriter, r *http.Request) {
+	params, err := common.ListGetParams(r)
+	page := 1
+	if err == nil && params.PageToken != "" {
+		page, err = strconv.Atoi(params.PageToken)
+		if err != nil || page < 1 {
+			err = fmt.Errorf("invalid page_token: %s", params.PageToken)
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
+		common.BadRequest(w, r, err)
+		return
+	}
+
+	var repositories []common.Repository
+	next := ""
+	if params.Paged() {
+		slog.InfoContext(r.Context(), "Listing repos", "page", page)
+		pageSize := c.client.pageSize
+		if params.Limit > 0 {
+			pageSize = min(params.Limit, defaultPageSize)
+		}
+		var repos []Repository
+		repos, err = c.client.ListRepositoriesPage(r.Context(), page, pageSize)
+		// The next page may be empty
+		if len(repos) == pageSize {
+			next = strconv.Itoa(page + 1)
+		}
+		repositories = c.repositories(repos)
+	} else {
+		repositories, err = c.AllRepositories(r.Context())
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	jsonBytes, err := json.Marshal(repositories)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	if next != "" {
+		w.Header().Set(common.NextPageTokenHeader, next)
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+func (c *harborHandler) getRepoByName(ctx context.Context, name string) (*Repository, error) {
+	project, repoName, err := splitName(name)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := c.client.GetRepository(ctx, project, repoName)
+	if err != nil {
+		if isNotFound(err) {
+			slog.InfoContext(ctx, "Repo not found", "repo", name)
+			return nil, nil
+		}
+		slog.ErrorContext(ctx, "getRepoByName failed", "error", err)
+		return nil, err
+	}
+	slog.InfoContext(ctx, "Repo found", "repo", name, "id", repo.Id)
+	return repo, nil
+}
+
+func (c *harborHandler) GetRepository(w http.ResponseWriter, r *http.Request) {
+	name, err := common.RepoGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Getting repo", "repo", name)
+
+	repo, err := c.getRepoByName(r.Context(), name)
+	if errors.Is(err, errInvalidName) {
+		slog.InfoContext(r.Context(), "GetRepository failed", "error", err)
+		common.BadRequest(w, r, err)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	if repo == nil {
+		common.NotFound(w, r)
+		return
+	}
+	jsonBytes, err := json.Marshal(c.repository(*repo))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+func (c *harborHandler) GetImage(w http.ResponseWriter, r *http.Request) {
+	repoName, tag, err := common.ImageGetNameAndTag(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	fullname := fmt.Sprintf("%s:%s", repoName, tag)
+
+	slog.InfoContext(r.Context(), "Getting image", "image", fullname)
+
+	project, name, err := splitName(repoName)
+	if err != nil {
+		slog.InfoContext(r.Context(), "GetImage failed", "error", err)
+		common.BadRequest(w, r, err)
+		return
+	}
+
+	artifact, err := c.client.GetArtifact(r.Context(), project, name, tag)
+	if err != nil {
+		if isNotFound(err) {
+			slog.InfoContext(r.Context(), "Image not found", "image", fullname)
+			common.NotFound(w, r)
+			return
+		}
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Image found", "image", fullname, "digest", artifact.Digest)
+	jsonBytes, err := json.Marshal(common.Image{
+		Repository: repoName,
+		Tag:        tag,
+		Digest:     artifact.Digest,
+		PushedAt:   &artifact.PushTime,
+		SizeBytes:  artifact.Size,
+		Provider:   artifact,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// AllImages returns all artifacts in a repository
+func (c *harborHandler) AllImages(ctx context.Context, name string) ([]common.Image, error) {
+	slog.InfoContext(ctx, "Listing images", "repo", name)
+
+	repo, err := c.getRepoByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if repo == nil {
+		return nil, common.ErrRepositoryNotFound
+	}
+
+	project, repoName, err := splitName(name)
+	if err != nil {
+		return nil, err
+	}
+	artifacts, err := c.client.ListArtifacts(ctx, project, repoName)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []common.Image{}
+	for _, artifact := range artifacts {
+		tags := []string{}
+		for _, tag := range artifact.Tags {
+			tags = append(tags, tag.Name)
+		}
+		pushedAt := artifact.PushTime
+		images = append(images, common.NewImages(name, tags, artifact.Digest, artifact.Size, &pushedAt, artifact)...)
+	}
+	return images, nil
+}
+
+func (c *harborHandler) ListImages(w http.ResponseWriter, r *http.Request) {
+	name, err := common.ImagesGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	images, err := c.AllImages(r.Context(), name)
+	if errors.Is(err, common.ErrRepositoryNotFound) {
+		common.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, errInvalidName) {
+		slog.InfoContext(r.Context(), "ListImages failed", "error", err)
+		common.BadRequest(w, r, err)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(images)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// ensureProject creates a project if it doesn't exist
+func (c *harborHandler) ensureProject(ctx context.Context, project string) error {
+	exists, err := c.client.ProjectExists(ctx, project)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	err = c.client.CreateProject(ctx, project)
+	if err != nil {
+		// Another request may have created it
+		if isConflict(err) {
+			return nil
+		}
+		return err
+	}
+	slog.InfoContext(ctx, "Created project", "project", project)
+	newProjectsCounter.Inc()
+	return nil
+}
+
+// CreateRepository creates the project if necessary. Harbor creates
+// repositories on push, so if the repository doesn't exist a placeholder is
+// returned containing the repository name.
+func (c *harborHandler) CreateRepository(w http.ResponseWriter, r *http.Request) {
+	name, err := common.RepoGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	project, _, err := splitName(name)
+	if err != nil {
+		slog.InfoContext(r.Context(), "CreateRepository failed", "error", err)
+		common.BadRequest(w, r, err)
+		return
+	}
+	err = c.ensureProject(r.Context(), project)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	repo, err := c.getRepoByName(r.Context(), name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	if repo == nil {
+		slog.InfoContext(r.Context(), "Repo will be created on push", "repo", name)
+		repo = &Repository{Name: name}
+	} else {
+		slog.InfoContext(r.Context(), "Repo already exists", "repo", name)
+	}
+
+	jsonBytes, err := json.Marshal(c.repository(*repo))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// RemoveRepository deletes a repository, it succeeds if the repository
+// doesn't exist
+func (c *harborHandler) RemoveRepository(ctx context.Context, name string) error {
+	slog.InfoContext(ctx, "Deleting repo", "repo", name)
+
+	project, repoName, err := splitName(name)
+	if err != nil {
+		return err
+	}
+
+	err = c.client.DeleteRepository(ctx, project, repoName)
+	if err != nil {
+		// Ignore if it didn't exist
+		if isNotFound(err) {
+			slog.InfoContext(ctx, "Repo not found", "repo", name)
+			return nil
+		}
+		return err
+	}
+	slog.InfoContext(ctx, "Repo deleted", "repo", name)
+	return nil
+}
+
+func (c *harborHandler) DeleteRepository(w http.ResponseWriter, r *http.Request) {
+	name, err := common.RepoGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	err = c.RemoveRepository(r.Context(), name)
+	if errors.Is(err, errInvalidName) {
+		slog.InfoContext(r.Context(), "DeleteRepository failed", "error", err)
+		common.BadRequest(w, r, err)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteImage deletes a single tag, the untagged artifact is left for the
+// project retention policy and garbage collection
+func (c *harborHandler) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	repoName, tag, err := common.ImageGetNameAndTag(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	fullname := fmt.Sprintf("%s:%s", repoName, tag)
+
+	slog.InfoContext(r.Context(), "Deleting image", "image", fullname)
+
+	project, name, err := splitName(repoName)
+	if err != nil {
+		slog.InfoContext(r.Context(), "DeleteImage failed", "error", err)
+		common.BadRequest(w, r, err)
+		return
+	}
+
+	err = c.client.DeleteTag(r.Context(), project, name, tag)
+	if err != nil {
+		// Ignore if it didn't exist
+		if isNotFound(err) {
+			slog.InfoContext(r.Context(), "Image not found", "image", fullname)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Image deleted", "image", fullname)
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteExpiredRobots deletes robot accounts previously created by GetToken
+// that have expired, since Harbor doesn't remove them
+func (c *harborHandler) deleteExpiredRobots(ctx context.Context) {
+	robots, err := c.client.ListRobots(ctx, robotPrefix)
+	if err != nil {
+		slog.ErrorContext(ctx, "deleteExpiredRobots failed", "error", err)
+		return
+	}
+	now := time.Now().Unix()
+	for _, robot := range robots {
+		if !strings.Contains(robot.Name, robotPrefix) || robot.ExpiresAt <= 0 || robot.ExpiresAt > now {
+			continue
+		}
+		err := c.client.DeleteRobot(ctx, robot.Id)
+		if err != nil && !isNotFound(err) {
+			slog.ErrorContext(ctx, "deleteExpiredRobots failed", "error", err)
+			continue
+		}
+		slog.InfoContext(ctx, "Deleted expired robot account", "robot", robot.Name)
+	}
+}
+
+// TokenScope implements common.IRepositoryTokens, robot accounts can push to
+// every repository in the requested project
+func (c *harborHandler) TokenScope(repository string) string {
+	project, _, err := splitName(repository)
+	if err != nil {
+		return ""
+	}
+	return project + "/"
+}
+
+// RunBackgroundTasks deletes expired robot accounts immediately and then every
+// robotCleanupInterval until ctx is cancelled. Only expired accounts are
+// deleted so it's safe to run in every replica, and it runs even if scheduled
+// is false.
+func (c *harborHandler) RunBackgroundTasks(ctx context.Context, scheduled bool) {
+	ticker := time.NewTicker(robotCleanupInterval)
+	defer ticker.Stop()
+	for {
+		c.deleteExpiredRobots(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetToken creates a robot account that can push and pull to the project
+// in the path /token/{project}/{repository}:{tag}
+func (c *harborHandler) GetToken(w http.ResponseWriter, r *http.Request) {
+	project, err := tokenGetProject(r)
+	if err != nil {
+		slog.InfoContext(r.Context(), "GetToken failed", "error", err)
+		common.BadRequest(w, r, err)
+		return
+	}
+
+	err = c.ensureProject(r.Context(), project)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	suffix := make([]byte, 8)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	robot, err := c.client.CreateRobot(r.Context(), RobotCreate{
+		Name:        robotPrefix + hex.EncodeToString(suffix),
+		Description: "BinderHub temporary push token",
+		Level:       "project",
+		Duration:    c.robotDurationDays,
+		Permissions: []RobotPermission{
+			{
+				Kind:      "project",
+				Namespace: project,
+				Access: []RobotAccess{
+					{Resource: "repository", Action: "pull"},
+					{Resource: "repository", Action: "push"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Created robot account", "robot", robot.Name, "expires_at", robot.ExpiresAt)
+
+	ret := &common.RegistryToken{
+		Username: robot.Name,
+		Password: robot.Secret,
+		Registry: c.client.baseURL.String(),
+		Expires:  time.Unix(robot.ExpiresAt, 0).UTC(),
+	}
+
+	jsonBytes, err := json.Marshal(ret)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// HealthCheck lists a single repository to check the credentials are valid
+func (c *harborHandler) HealthCheck(ctx context.Context) error {
+	return c.client.Ping(ctx)
+}
+
+func init() {
+	common.RegisterProvider("harbor", Setup)
+}
+
+func Setup(promRegistry *prometheus.Registry, args []string) (common.IRegistryClient, error) {
+	if len(args) != 0 {
+		return nil, errors.New("no arguments expected")
+	}
+
+	harborURL := os.Getenv("HARBOR_URL")
+	if harborURL == "" {
+		return nil, errors.New("HARBOR_URL is required")
+	}
+	username := os.Getenv("HARBOR_USERNAME")
+	password := os.Getenv("HARBOR_PASSWORD")
+	if username == "" || password == "" {
+		return nil, errors.New("HARBOR_USERNAME and HARBOR_PASSWORD are required")
+	}
+	timeout, err := common.UpstreamTimeout()
+	if err != nil {
+		return nil, err
+	}
+	client, err := newHarborClient(harborURL, username, password, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	robotDurationDays := 1
+	if v := os.Getenv("HARBOR_ROBOT_DURATION_DAYS"); v != "" {
+		robotDurationDays, err = strconv.Atoi(v)
+		if err != nil || robotDurationDays < 1 {
+			return nil, fmt.Errorf("HARBOR_ROBOT_DURATION_DAYS must be an integer greater than 0: %s", v)
+		}
+	}
+
+	slog.Info("Harbor", "url", client.baseURL.String())
+	slog.Info("Robot account duration", "days", robotDurationDays)
+
+	harborH := &harborHandler{
+		client:            client,
+		robotDurationDays: robotDurationDays,
+	}
+
+	promRegistry.MustRegister(newProjectsCounter)
+
+	return harborH, nil
+}
@@ -0,0 +1,861 @@
+package harbor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// MockHarbor is a minimal in-memory Harbor v2 API
+type MockHarbor struct {
+	projects map[string]bool
+	// project/repository: tag: artifact
+	repos  map[string]map[string]Artifact
+	robots []Robot
+
+	projectRequests       int
+	createProjectRequests int
+	listRequests          int
+	getRequests           int
+	deleteRequests        int
+	artifactRequests      int
+	deleteTagRequests     int
+	listArtifactRequests  int
+	createRobotRequests   int
+	listRobotRequests     int
+	deleteRobotRequests   int
+
+	robotRequest RobotCreate
+
+	server *httptest.Server
+}
+
+func timestamp() time.Time {
+	return time.Date(2023, 1, 1, 12, 34, 56, 0, time.UTC)
+}
+
+func newMockHarbor() *MockHarbor {
+	m := &MockHarbor{
+		projects: map[string]bool{
+			"binder": true,
+		},
+		repos: map[string]map[string]Artifact{
+			"binder/existing-image": {
+				"tag":         {Id: 1, Digest: "sha256:1111", Size: 123, PushTime: timestamp(), Tags: []Tag{{Name: "tag"}, {Name: "latest"}}},
+				"latest":      {Id: 1, Digest: "sha256:1111", Size: 123, PushTime: timestamp(), Tags: []Tag{{Name: "tag"}, {Name: "latest"}}},
+				"sha256:3333": {Id: 3, Digest: "sha256:3333", Size: 789, PushTime: timestamp()},
+			},
+			"binder/nested/image": {
+				"tag": {Id: 2, Digest: "sha256:2222", Size: 456, PushTime: timestamp(), Tags: []Tag{{Name: "tag"}}},
+			},
+		},
+		robots: []Robot{
+			{Id: 1, Name: "robot$binder+binderhub-expired", ExpiresAt: timestamp().Unix()},
+			{Id: 2, Name: "robot$binder+binderhub-never", ExpiresAt: -1},
+			{Id: 3, Name: "robot$binder+other", ExpiresAt: timestamp().Unix()},
+		},
+	}
+	m.server = httptest.NewServer(m)
+	return m
+}
+
+func (m *MockHarbor) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (m *MockHarbor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok || username != "admin" || password != "password" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v2.0")
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	switch {
+	case path == "/projects" && r.Method == http.MethodHead:
+		m.projectRequests++
+		if !m.projects[r.URL.Query().Get("project_name")] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case path == "/projects" && r.Method == http.MethodPost:
+		m.createProjectRequests++
+		var project struct {
+			ProjectName string            `json:"project_name"`
+			Metadata    map[string]string `json:"metadata"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&project)
+		if m.projects[project.ProjectName] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if project.Metadata["public"] != "false" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m.projects[project.ProjectName] = true
+		w.WriteHeader(http.StatusCreated)
+	case path == "/repositories" && r.Method == http.MethodGet:
+		m.listRequests++
+		m.listRepositories(w, r)
+	case len(segments) >= 4 && segments[0] == "projects" && segments[2] == "repositories":
+		// r.URL.Path has been decoded once, the repository is double encoded
+		repoName, err := url.PathUnescape(segments[3])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		name := segments[1] + "/" + repoName
+		tags, ok := m.repos[name]
+		switch {
+		case len(segments) == 4 && r.Method == http.MethodGet:
+			m.getRequests++
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			m.writeJSON(w, http.StatusOK, Repository{Id: 10, Name: name, ArtifactCount: int64(len(tags)), CreationTime: timestamp()})
+		case len(segments) == 4 && r.Method == http.MethodDelete:
+			m.deleteRequests++
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(m.repos, name)
+			w.WriteHeader(http.StatusOK)
+		case len(segments) == 5 && segments[4] == "artifacts" && r.Method == http.MethodGet:
+			m.listArtifactRequests++
+			m.listArtifacts(w, r, tags)
+		case len(segments) == 8 && segments[4] == "artifacts" && segments[6] == "tags" && r.Method == http.MethodDelete:
+			m.deleteTagRequests++
+			if _, ok := tags[segments[7]]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(tags, segments[7])
+			w.WriteHeader(http.StatusOK)
+		case len(segments) == 6 && segments[4] == "artifacts" && r.Method == http.MethodGet:
+			m.artifactRequests++
+			artifact, ok := tags[segments[5]]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			m.writeJSON(w, http.StatusOK, artifact)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case path == "/robots" && r.Method == http.MethodPost:
+		m.createRobotRequests++
+		_ = json.NewDecoder(r.Body).Decode(&m.robotRequest)
+		if len(m.robotRequest.Permissions) != 1 || !m.projects[m.robotRequest.Permissions[0].Namespace] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		robot := Robot{
+			Id:        int64(len(m.robots) + 100),
+			Name:      fmt.Sprintf("robot$%s+%s", m.robotRequest.Permissions[0].Namespace, m.robotRequest.Name),
+			Secret:    "robot-secret",
+			ExpiresAt: timestamp().Unix() + int64(m.robotRequest.Duration)*86400 + 1000000000,
+		}
+		m.robots = append(m.robots, robot)
+		m.writeJSON(w, http.StatusCreated, robot)
+	case path == "/robots" && r.Method == http.MethodGet:
+		m.listRobotRequests++
+		q := strings.TrimPrefix(r.URL.Query().Get("q"), "name=~")
+		matching := []Robot{}
+		for _, robot := range m.robots {
+			if strings.Contains(robot.Name, q) {
+				matching = append(matching, robot)
+			}
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		pageSize, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+		robots := []Robot{}
+		for i := (page - 1) * pageSize; i < len(matching) && i < page*pageSize; i++ {
+			robots = append(robots, matching[i])
+		}
+		m.writeJSON(w, http.StatusOK, robots)
+	case len(segments) == 2 && segments[0] == "robots" && r.Method == http.MethodDelete:
+		m.deleteRobotRequests++
+		id, _ := strconv.ParseInt(segments[1], 10, 64)
+		for i, robot := range m.robots {
+			if robot.Id == id {
+				m.robots = append(m.robots[:i], m.robots[i+1:]...)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (m *MockHarbor) listRepositories(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	for name := range m.repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+	repos := []Repository{}
+	for i := (page - 1) * pageSize; i < len(names) && i < page*pageSize; i++ {
+		repos = append(repos, Repository{Name: names[i]})
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(names)))
+	m.writeJSON(w, http.StatusOK, repos)
+}
+
+func (m *MockHarbor) listArtifacts(w http.ResponseWriter, r *http.Request, tags map[string]Artifact) {
+	if r.URL.Query().Get("with_tag") != "true" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// Multiple tags may reference the same artifact
+	byId := map[int64]Artifact{}
+	for _, artifact := range tags {
+		byId[artifact.Id] = artifact
+	}
+	all := []Artifact{}
+	for _, artifact := range byId {
+		all = append(all, artifact)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Id < all[j].Id })
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+	artifacts := []Artifact{}
+	for i := (page - 1) * pageSize; i < len(all) && i < page*pageSize; i++ {
+		artifacts = append(artifacts, all[i])
+	}
+	m.writeJSON(w, http.StatusOK, artifacts)
+}
+
+func (m *MockHarbor) assertCounts(t *testing.T, expected map[string]int) {
+	countRequests := map[string]int{
+		"project":       m.projectRequests,
+		"createProject": m.createProjectRequests,
+		"list":          m.listRequests,
+		"get":           m.getRequests,
+		"delete":        m.deleteRequests,
+		"artifact":      m.artifactRequests,
+		"deleteTag":     m.deleteTagRequests,
+		"listArtifact":  m.listArtifactRequests,
+		"createRobot":   m.createRobotRequests,
+		"listRobot":     m.listRobotRequests,
+		"deleteRobot":   m.deleteRobotRequests,
+	}
+	for k, v := range countRequests {
+		e := 0
+		if val, ok := expected[k]; ok {
+			e = val
+			delete(expected, k)
+		}
+		if v != e {
+			t.Errorf("Expected %d %s requests: %d", e, k, v)
+		}
+	}
+	if len(expected) > 0 {
+		t.Errorf("Invalid expected counts: %v", expected)
+	}
+}
+
+func request(t *testing.T, method string, path string) (*MockHarbor, *http.Response, []byte, error) {
+	harbor := newMockHarbor()
+	t.Cleanup(harbor.server.Close)
+
+	client, err := newHarborClient(harbor.server.URL+"/", "admin", "password", 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Force pagination
+	client.pageSize = 1
+	h := &harborHandler{
+		client:            client,
+		robotDurationDays: 1,
+	}
+	s := &common.RegistryServer{
+		Client: h,
+	}
+
+	req := httptest.NewRequest(method, path, http.NoBody)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+	data, err := io.ReadAll(w.Result().Body)
+	return harbor, res, data, err
+}
+
+// Tests
+
+func TestSplitName(t *testing.T) {
+	testCases := []struct {
+		name    string
+		project string
+		repo    string
+		valid   bool
+	}{
+		{"binder/image", "binder", "image", true},
+		{"binder/nested/image", "binder", "nested/image", true},
+		{"image", "", "", false},
+		{"binder/", "", "", false},
+		{"/image", "", "", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			project, repo, err := splitName(tc.name)
+			if tc.valid != (err == nil) {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if project != tc.project || repo != tc.repo {
+				t.Errorf("Unexpected result: %s %s", project, repo)
+			}
+		})
+	}
+}
+
+func TestEscapeRepository(t *testing.T) {
+	if escapeRepository("nested/image") != "nested%252Fimage" {
+		t.Errorf("Unexpected result: %s", escapeRepository("nested/image"))
+	}
+}
+
+func TestListRepos(t *testing.T) {
+	harbor, res, data, err := request(t, "GET", "/repos/")
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+	}
+
+	// Final empty page
+	harbor.assertCounts(t, map[string]int{
+		"list": 3,
+	})
+
+	var result []common.Repository
+	err2 := json.Unmarshal(data, &result)
+	if err2 != nil {
+		t.Errorf("Unexpected error: %v", err2)
+	}
+
+	if len(result) != 2 {
+		t.Fatalf("Expected 2 items: %v", result)
+	}
+	if result[0].Name != "binder/existing-image" || result[1].Name != "binder/nested/image" || !strings.HasSuffix(result[1].URI, "/binder/nested/image") {
+		t.Errorf("Unexpected result: %v", result)
+	}
+}
+
+func TestListPaged(t *testing.T) {
+	testCases := []struct {
+		query             string
+		expectedStatus    int
+		expectedNames     []string
+		expectedNextToken string
+	}{
+		{"?limit=1", 200, []string{"binder/existing-image"}, "2"},
+		{"?limit=1&page_token=2", 200, []string{"binder/nested/image"}, "3"},
+		{"?limit=1&page_token=3", 200, []string{}, ""},
+		{"?limit=5", 200, []string{"binder/existing-image", "binder/nested/image"}, ""},
+		{"?limit=0", 400, nil, ""},
+		{"?page_token=0", 400, nil, ""},
+		{"?page_token=invalid", 400, nil, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			harbor, res, data, err := request(t, "GET", "/repos/"+tc.query)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != tc.expectedStatus {
+				t.Errorf("Expected StatusCode %v: %v", tc.expectedStatus, res.StatusCode)
+			}
+			if tc.expectedStatus != 200 {
+				harbor.assertCounts(t, map[string]int{})
+				return
+			}
+
+			harbor.assertCounts(t, map[string]int{
+				"list": 1,
+			})
+			if res.Header.Get(common.NextPageTokenHeader) != tc.expectedNextToken {
+				t.Errorf("Expected next page token '%v': %v", tc.expectedNextToken, res.Header.Get(common.NextPageTokenHeader))
+			}
+
+			var result []common.Repository
+			err2 := json.Unmarshal(data, &result)
+			if err2 != nil {
+				t.Errorf("Unexpected error: %v", err2)
+			}
+			names := []string{}
+			for _, repo := range result {
+				names = append(names, repo.Name)
+			}
+			if !reflect.DeepEqual(names, tc.expectedNames) {
+				t.Errorf("Expected %v: %v", tc.expectedNames, names)
+			}
+		})
+	}
+}
+
+func TestGetRepo(t *testing.T) {
+	testCases := []struct {
+		imageName          string
+		expectedStatusCode int
+	}{
+		{"binder/existing-image", 200},
+		{"binder/nested/image", 200},
+		{"binder/new-image", 404},
+		{"other/existing-image", 404},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v", tc.imageName, tc.expectedStatusCode), func(t *testing.T) {
+			harbor, res, data, err := request(t, "GET", "/repo/"+tc.imageName)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != tc.expectedStatusCode {
+				t.Errorf("Expected StatusCode %v: %v", tc.expectedStatusCode, res.StatusCode)
+			}
+
+			harbor.assertCounts(t, map[string]int{
+				"get": 1,
+			})
+
+			if tc.expectedStatusCode == 200 {
+				var result common.Repository
+				err2 := json.Unmarshal(data, &result)
+				if err2 != nil {
+					t.Errorf("Unexpected error: %v", err2)
+				}
+
+				if result.Name != tc.imageName || !strings.HasSuffix(result.URI, "/"+tc.imageName) || !result.Created.Equal(timestamp()) || result.ImageCount == nil {
+					t.Errorf("Expected '%s': %v", tc.imageName, result)
+				}
+			} else if string(data) != "null\n" {
+				t.Errorf("Expected 'null': %v", string(data))
+			}
+		})
+	}
+}
+
+func TestInvalidName(t *testing.T) {
+	for _, path := range []string{
+		"GET /repo/no-project",
+		"POST /repo/no-project",
+		"DELETE /repo/no-project",
+		"GET /image/no-project:tag",
+		"GET /images/no-project",
+		"DELETE /image/no-project:tag",
+	} {
+		t.Run(path, func(t *testing.T) {
+			method, p, _ := strings.Cut(path, " ")
+			harbor, res, _, err := request(t, method, p)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != 400 {
+				t.Errorf("Expected StatusCode 400: %v", res.StatusCode)
+			}
+
+			harbor.assertCounts(t, map[string]int{})
+		})
+	}
+}
+
+func TestGetImage(t *testing.T) {
+	testCases := []struct {
+		imageName          string
+		tag                string
+		expectedStatusCode int
+	}{
+		{"binder/existing-image", "tag", 200},
+		{"binder/nested/image", "tag", 200},
+		{"binder/existing-image", "new-tag", 404},
+		{"binder/new-image", "tag", 404},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v,%v,%v", tc.imageName, tc.tag, tc.expectedStatusCode), func(t *testing.T) {
+			harbor, res, data, err := request(t, "GET", fmt.Sprintf("/image/%s:%s", tc.imageName, tc.tag))
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != tc.expectedStatusCode {
+				t.Errorf("Expected StatusCode %v: %v", tc.expectedStatusCode, res.StatusCode)
+			}
+
+			harbor.assertCounts(t, map[string]int{
+				"artifact": 1,
+			})
+
+			if tc.expectedStatusCode == 200 {
+				var result common.Image
+				err2 := json.Unmarshal(data, &result)
+				if err2 != nil {
+					t.Errorf("Unexpected error: %v", err2)
+				}
+
+				if result.Digest == "" || result.Tag != tc.tag || result.SizeBytes == 0 || !result.PushedAt.Equal(timestamp()) {
+					t.Errorf("Unexpected result: %v", result)
+				}
+			} else if string(data) != "null\n" {
+				t.Errorf("Expected 'null': %v", string(data))
+			}
+		})
+	}
+}
+
+func TestListImages(t *testing.T) {
+	{
+		harbor, res, data, err := request(t, "GET", "/images/binder/existing-image")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 200 {
+			t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+		}
+
+		// Final empty page
+		harbor.assertCounts(t, map[string]int{
+			"get":          1,
+			"listArtifact": 3,
+		})
+
+		var result []common.Image
+		err2 := json.Unmarshal(data, &result)
+		if err2 != nil {
+			t.Errorf("Unexpected error: %v", err2)
+		}
+
+		if len(result) != 3 {
+			t.Fatalf("Expected 3 items: %v", result)
+		}
+		for i, tag := range []string{"tag", "latest"} {
+			if result[i].Repository != "binder/existing-image" || result[i].Tag != tag || result[i].Digest != "sha256:1111" || result[i].SizeBytes != 123 || !result[i].PushedAt.Equal(timestamp()) {
+				t.Errorf("Unexpected image: %v", result[i])
+			}
+		}
+		if result[2].Tag != "" || result[2].Digest != "sha256:3333" || result[2].SizeBytes != 789 {
+			t.Errorf("Expected untagged image: %v", result[2])
+		}
+	}
+
+	{
+		harbor, res, data, err := request(t, "GET", "/images/binder/new-image")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 404 {
+			t.Errorf("Expected StatusCode 404: %v", res.StatusCode)
+		}
+
+		harbor.assertCounts(t, map[string]int{
+			"get": 1,
+		})
+
+		if string(data) != "null\n" {
+			t.Errorf("Expected 'null': %v", string(data))
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	testCases := []struct {
+		imageName     string
+		createProject int
+	}{
+		{"binder/existing-image", 0},
+		{"binder/new-image", 0},
+		{"new-project/new-image", 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.imageName, func(t *testing.T) {
+			harbor, res, data, err := request(t, "POST", "/repo/"+tc.imageName)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != 200 {
+				t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+			}
+
+			harbor.assertCounts(t, map[string]int{
+				"project":       1,
+				"createProject": tc.createProject,
+				"get":           1,
+			})
+
+			project := strings.Split(tc.imageName, "/")[0]
+			if !harbor.projects[project] {
+				t.Errorf("Expected project '%s' to exist", project)
+			}
+
+			var result common.Repository
+			err2 := json.Unmarshal(data, &result)
+			if err2 != nil {
+				t.Errorf("Unexpected error: %v", err2)
+			}
+
+			if result.Name != tc.imageName {
+				t.Errorf("Expected '%v': %v", tc.imageName, result)
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	for _, imageName := range []string{"binder/nested/image", "binder/new-image"} {
+		t.Run(imageName, func(t *testing.T) {
+			harbor, res, _, err := request(t, "DELETE", "/repo/"+imageName)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != 200 {
+				t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+			}
+
+			harbor.assertCounts(t, map[string]int{
+				"delete": 1,
+			})
+
+			if _, ok := harbor.repos[imageName]; ok {
+				t.Errorf("Expected '%s' to be deleted", imageName)
+			}
+		})
+	}
+}
+
+func TestDeleteImage(t *testing.T) {
+	for _, image := range []string{"binder/existing-image:tag", "binder/existing-image:new-tag", "binder/new-image:tag"} {
+		t.Run(image, func(t *testing.T) {
+			harbor, res, _, err := request(t, "DELETE", "/image/"+image)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != 200 {
+				t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+			}
+
+			harbor.assertCounts(t, map[string]int{
+				"deleteTag": 1,
+			})
+
+			if _, ok := harbor.repos["binder/existing-image"]["tag"]; ok == (image == "binder/existing-image:tag") {
+				t.Errorf("Unexpected tags: %v", harbor.repos["binder/existing-image"])
+			}
+		})
+	}
+
+	{
+		harbor, res, _, err := request(t, "DELETE", "/image/no-project:tag")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 400 {
+			t.Errorf("Expected StatusCode 400: %v", res.StatusCode)
+		}
+
+		harbor.assertCounts(t, map[string]int{})
+	}
+}
+
+func TestToken(t *testing.T) {
+	testCases := []struct {
+		path          string
+		project       string
+		createProject int
+	}{
+		{"/token/binder/existing-image:tag", "binder", 0},
+		{"/token/binder/nested/image", "binder", 0},
+		{"/token/new-project/new-image:tag", "new-project", 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			harbor, res, data, err := request(t, "POST", tc.path)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != 200 {
+				t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+			}
+
+			// Expired robots are deleted in the background
+			harbor.assertCounts(t, map[string]int{
+				"project":       1,
+				"createProject": tc.createProject,
+				"createRobot":   1,
+			})
+			if len(harbor.robots) != 4 {
+				t.Errorf("Expected 4 robots: %v", harbor.robots)
+			}
+
+			robot := harbor.robotRequest
+			if !strings.HasPrefix(robot.Name, robotPrefix) || robot.Level != "project" || robot.Duration != 1 {
+				t.Errorf("Unexpected robot request: %v", robot)
+			}
+			if robot.Permissions[0].Kind != "project" || robot.Permissions[0].Namespace != tc.project || len(robot.Permissions[0].Access) != 2 {
+				t.Errorf("Unexpected robot permissions: %v", robot.Permissions)
+			}
+
+			var result common.RegistryToken
+			err2 := json.Unmarshal(data, &result)
+			if err2 != nil {
+				t.Errorf("Unexpected error: %v", err2)
+			}
+			expectedUsername := fmt.Sprintf("robot$%s+%s", tc.project, robot.Name)
+			expectedExpires := time.Unix(timestamp().Unix()+86400+1000000000, 0)
+			if result.Username != expectedUsername || result.Password != "robot-secret" || result.Registry != harbor.server.URL || !result.Expires.Equal(expectedExpires) {
+				t.Errorf("Unexpected result: %v", result)
+			}
+		})
+	}
+}
+
+func TestTokenInvalidPath(t *testing.T) {
+	harbor, res, _, err := request(t, "POST", "/token/no-project:tag")
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if res.StatusCode != 400 {
+		t.Errorf("Expected StatusCode 400: %v", res.StatusCode)
+	}
+
+	harbor.assertCounts(t, map[string]int{})
+}
+
+func TestTokenScope(t *testing.T) {
+	h := &harborHandler{}
+	for repository, expected := range map[string]string{
+		"project/repo":        "project/",
+		"project/nested/repo": "project/",
+		"no-project":          "",
+	} {
+		if scope := h.TokenScope(repository); scope != expected {
+			t.Errorf("Expected %q for %s: %q", expected, repository, scope)
+		}
+	}
+}
+
+func TestDeleteExpiredRobots(t *testing.T) {
+	harbor := newMockHarbor()
+	t.Cleanup(harbor.server.Close)
+	harbor.robots = append(harbor.robots,
+		Robot{Id: 4, Name: "robot$binder+binderhub-expired-2", ExpiresAt: timestamp().Unix()},
+		Robot{Id: 5, Name: "robot$binder+binderhub-valid", ExpiresAt: time.Now().Add(time.Hour).Unix()},
+	)
+	client, err := newHarborClient(harbor.server.URL, "admin", "password", 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Force pagination
+	client.pageSize = 1
+	h := &harborHandler{client: client, robotDurationDays: 1}
+
+	h.deleteExpiredRobots(context.Background())
+
+	// Only expired robots created by this helper are deleted, on all pages
+	harbor.assertCounts(t, map[string]int{
+		"listRobot":   5,
+		"deleteRobot": 2,
+	})
+	names := []string{}
+	for _, robot := range harbor.robots {
+		names = append(names, robot.Name)
+	}
+	expected := []string{"robot$binder+binderhub-never", "robot$binder+other", "robot$binder+binderhub-valid"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Unexpected robots: %v", names)
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	t.Cleanup(slow.Close)
+
+	client, err := newHarborClient(slow.URL, "admin", "password", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &common.RegistryServer{
+		Client: &harborHandler{client: client, robotDurationDays: 1},
+	}
+
+	req := httptest.NewRequest("GET", "/repo/binderhub/existing-image", http.NoBody)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 504 || string(data) != `{"error": "upstream timeout"}`+"\n" {
+		t.Errorf("Expected 504 upstream timeout: %d %s", res.StatusCode, data)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	harbor := newMockHarbor()
+	t.Cleanup(harbor.server.Close)
+
+	for _, tc := range []struct {
+		password    string
+		shouldError bool
+	}{
+		{"password", false},
+		{"expired", true},
+	} {
+		client, err := newHarborClient(harbor.server.URL, "admin", tc.password, 30*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := &harborHandler{client: client}
+		err = h.HealthCheck(context.Background())
+		if (err != nil) != tc.shouldError {
+			t.Errorf("Unexpected health check result for password %s: %v", tc.password, err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package oracle
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/artifacts"
+	ocicommon "github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/identity"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// logOciCall logs a call to the OCI API with the OCI request ID
+func logOciCall(ctx context.Context, operation string, start time.Time, opcRequestID *string, err error) {
+	requestID := ""
+	if opcRequestID != nil {
+		requestID = *opcRequestID
+	}
+	var serviceErr ocicommon.ServiceError
+	if requestID == "" && errors.As(err, &serviceErr) {
+		requestID = serviceErr.GetOpcRequestID()
+	}
+	common.LogUpstreamCall(ctx, "oci."+operation, start, requestID, err)
+}
+
+// loggingArtifactsClient wraps an IArtifactsClient to log every call
+type loggingArtifactsClient struct {
+	client IArtifactsClient
+}
+
+func (c *loggingArtifactsClient) ListContainerRepositories(ctx context.Context, request artifacts.ListContainerRepositoriesRequest) (artifacts.ListContainerRepositoriesResponse, error) {
+	start := time.Now()
+	response, err := c.client.ListContainerRepositories(ctx, request)
+	logOciCall(ctx, "ListContainerRepositories", start, response.OpcRequestId, err)
+	return response, err
+}
+
+func (c *loggingArtifactsClient) ListContainerImages(ctx context.Context, request artifacts.ListContainerImagesRequest) (artifacts.ListContainerImagesResponse, error) {
+	start := time.Now()
+	response, err := c.client.ListContainerImages(ctx, request)
+	logOciCall(ctx, "ListContainerImages", start, response.OpcRequestId, err)
+	return response, err
+}
+
+func (c *loggingArtifactsClient) GetContainerImage(ctx context.Context, request artifacts.GetContainerImageRequest) (artifacts.GetContainerImageResponse, error) {
+	start := time.Now()
+	response, err := c.client.GetContainerImage(ctx, request)
+	logOciCall(ctx, "GetContainerImage", start, response.OpcRequestId, err)
+	return response, err
+}
+
+func (c *loggingArtifactsClient) RemoveContainerVersion(ctx context.Context, request artifacts.RemoveContainerVersionRequest) (artifacts.RemoveContainerVersionResponse, error) {
+	start := time.Now()
+	response, err := c.client.RemoveContainerVersion(ctx, request)
+	logOciCall(ctx, "RemoveContainerVersion", start, response.OpcRequestId, err)
+	return response, err
+}
+
+func (c *loggingArtifactsClient) DeleteContainerImage(ctx context.Context, request artifacts.DeleteContainerImageRequest) (artifacts.DeleteContainerImageResponse, error) {
+	start := time.Now()
+	response, err := c.client.DeleteContainerImage(ctx, request)
+	logOciCall(ctx, "DeleteContainerImage", start, response.OpcRequestId, err)
+	return response, err
+}
+
+func (c *loggingArtifactsClient) CreateContainerRepository(ctx context.Context, request artifacts.CreateContainerRepositoryRequest) (artifacts.CreateContainerRepositoryResponse, error) {
+	start := time.Now()
+	response, err := c.client.CreateContainerRepository(ctx, request)
+	logOciCall(ctx, "CreateContainerRepository", start, response.OpcRequestId, err)
+	return response, err
+}
+
+func (c *loggingArtifactsClient) DeleteContainerRepository(ctx context.Context, request artifacts.DeleteContainerRepositoryRequest) (artifacts.DeleteContainerRepositoryResponse, error) {
+	start := time.Now()
+	response, err := c.client.DeleteContainerRepository(ctx, request)
+	logOciCall(ctx, "DeleteContainerRepository", start, response.OpcRequestId, err)
+	return response, err
+}
+
+// loggingIdentityClient wraps an IIdentityClient to log every call
+type loggingIdentityClient struct {
+	client IIdentityClient
+}
+
+func (c *loggingIdentityClient) ListAuthTokens(ctx context.Context, request identity.ListAuthTokensRequest) (identity.ListAuthTokensResponse, error) {
+	start := time.Now()
+	response, err := c.client.ListAuthTokens(ctx, request)
+	logOciCall(ctx, "ListAuthTokens", start, response.OpcRequestId, err)
+	return response, err
+}
+
+func (c *loggingIdentityClient) CreateAuthToken(ctx context.Context, request identity.CreateAuthTokenRequest) (identity.CreateAuthTokenResponse, error) {
+	start := time.Now()
+	response, err := c.client.CreateAuthToken(ctx, request)
+	logOciCall(ctx, "CreateAuthToken", start, response.OpcRequestId, err)
+	return response, err
+}
+
+func (c *loggingIdentityClient) DeleteAuthToken(ctx context.Context, request identity.DeleteAuthTokenRequest) (identity.DeleteAuthTokenResponse, error) {
+	start := time.Now()
+	response, err := c.client.DeleteAuthToken(ctx, request)
+	logOciCall(ctx, "DeleteAuthToken", start, response.OpcRequestId, err)
+	return response, err
+}
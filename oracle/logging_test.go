@@ -0,0 +1,76 @@
+package oracle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/oracle/oci-go-sdk/v65/artifacts"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// requestIDArtifactsClient returns an OCI request ID from ListContainerRepositories
+type requestIDArtifactsClient struct {
+	MockArtifactsClient
+}
+
+func (c *requestIDArtifactsClient) ListContainerRepositories(ctx context.Context, request artifacts.ListContainerRepositoriesRequest) (artifacts.ListContainerRepositoriesResponse, error) {
+	response, err := c.MockArtifactsClient.ListContainerRepositories(ctx, request)
+	requestID := "oci-request-1"
+	response.OpcRequestId = &requestID
+	return response, err
+}
+
+func TestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := common.NewLogHandler(&buf, "json", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	a := &artifactsHandler{
+		compartmentId: "compartmentId",
+		client:        &loggingArtifactsClient{client: &requestIDArtifactsClient{}},
+		namespace:     "namespace",
+		registryHost:  "ocir.uk-london-1.oci.oraclecloud.com",
+	}
+	s := &common.RegistryServer{
+		Client: a,
+	}
+	req := httptest.NewRequest("GET", "/repo/namespace/existing-image", http.NoBody)
+	req = req.WithContext(common.WithRequestID(req.Context(), "request-1"))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]interface{}
+		err := json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record["request_id"] != "request-1" {
+			t.Errorf("Expected request_id: %v", record)
+		}
+		if record["operation"] == "oci.ListContainerRepositories" {
+			found = true
+			if record["upstream_request_id"] != "oci-request-1" {
+				t.Errorf("Expected upstream_request_id: %v", record)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected upstream call to be logged: %s", buf.String())
+	}
+}
@@ -0,0 +1,118 @@
+package oracle
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/artifacts"
+	ocicommon "github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/identity"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+var repositoriesDeletedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "repositories_deleted_total",
+	Help:      "Total number of repositories deleted",
+})
+
+// errorCode returns the OCI error code if err is a service error
+func errorCode(err error) string {
+	var serviceErr ocicommon.ServiceError
+	if errors.As(err, &serviceErr) {
+		return serviceErr.GetCode()
+	}
+	return ""
+}
+
+func observe(operation string, start time.Time, err error) {
+	common.ObserveUpstreamCall("oracle", operation, start, errorCode(err), err)
+}
+
+// metricsArtifactsClient wraps an IArtifactsClient to record the duration and
+// errors of every call
+type metricsArtifactsClient struct {
+	client IArtifactsClient
+}
+
+func (c *metricsArtifactsClient) ListContainerRepositories(ctx context.Context, request artifacts.ListContainerRepositoriesRequest) (artifacts.ListContainerRepositoriesResponse, error) {
+	start := time.Now()
+	response, err := c.client.ListContainerRepositories(ctx, request)
+	observe("oci.ListContainerRepositories", start, err)
+	return response, err
+}
+
+func (c *metricsArtifactsClient) ListContainerImages(ctx context.Context, request artifacts.ListContainerImagesRequest) (artifacts.ListContainerImagesResponse, error) {
+	start := time.Now()
+	response, err := c.client.ListContainerImages(ctx, request)
+	observe("oci.ListContainerImages", start, err)
+	return response, err
+}
+
+func (c *metricsArtifactsClient) GetContainerImage(ctx context.Context, request artifacts.GetContainerImageRequest) (artifacts.GetContainerImageResponse, error) {
+	start := time.Now()
+	response, err := c.client.GetContainerImage(ctx, request)
+	observe("oci.GetContainerImage", start, err)
+	return response, err
+}
+
+func (c *metricsArtifactsClient) RemoveContainerVersion(ctx context.Context, request artifacts.RemoveContainerVersionRequest) (artifacts.RemoveContainerVersionResponse, error) {
+	start := time.Now()
+	response, err := c.client.RemoveContainerVersion(ctx, request)
+	observe("oci.RemoveContainerVersion", start, err)
+	return response, err
+}
+
+func (c *metricsArtifactsClient) DeleteContainerImage(ctx context.Context, request artifacts.DeleteContainerImageRequest) (artifacts.DeleteContainerImageResponse, error) {
+	start := time.Now()
+	response, err := c.client.DeleteContainerImage(ctx, request)
+	observe("oci.DeleteContainerImage", start, err)
+	return response, err
+}
+
+func (c *metricsArtifactsClient) CreateContainerRepository(ctx context.Context, request artifacts.CreateContainerRepositoryRequest) (artifacts.CreateContainerRepositoryResponse, error) {
+	start := time.Now()
+	response, err := c.client.CreateContainerRepository(ctx, request)
+	observe("oci.CreateContainerRepository", start, err)
+	return response, err
+}
+
+func (c *metricsArtifactsClient) DeleteContainerRepository(ctx context.Context, request artifacts.DeleteContainerRepositoryRequest) (artifacts.DeleteContainerRepositoryResponse, error) {
+	start := time.Now()
+	response, err := c.client.DeleteContainerRepository(ctx, request)
+	observe("oci.DeleteContainerRepository", start, err)
+	if err == nil {
+		repositoriesDeletedCounter.Inc()
+	}
+	return response, err
+}
+
+// metricsIdentityClient wraps an IIdentityClient to record the duration and
+// errors of every call
+type metricsIdentityClient struct {
+	client IIdentityClient
+}
+
+func (c *metricsIdentityClient) ListAuthTokens(ctx context.Context, request identity.ListAuthTokensRequest) (identity.ListAuthTokensResponse, error) {
+	start := time.Now()
+	response, err := c.client.ListAuthTokens(ctx, request)
+	observe("oci.ListAuthTokens", start, err)
+	return response, err
+}
+
+func (c *metricsIdentityClient) CreateAuthToken(ctx context.Context, request identity.CreateAuthTokenRequest) (identity.CreateAuthTokenResponse, error) {
+	start := time.Now()
+	response, err := c.client.CreateAuthToken(ctx, request)
+	observe("oci.CreateAuthToken", start, err)
+	return response, err
+}
+
+func (c *metricsIdentityClient) DeleteAuthToken(ctx context.Context, request identity.DeleteAuthTokenRequest) (identity.DeleteAuthTokenResponse, error) {
+	start := time.Now()
+	response, err := c.client.DeleteAuthToken(ctx, request)
+	observe("oci.DeleteAuthToken", start, err)
+	return response, err
+}
@@ -0,0 +1,33 @@
+package oracle
+
+import (
+	"context"
+	"testing"
+
+	"github.com/oracle/oci-go-sdk/v65/artifacts"
+	ocicommon "github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	client := &metricsArtifactsClient{client: &MockArtifactsClient{}}
+
+	_, err := client.GetContainerImage(context.Background(), artifacts.GetContainerImageRequest{ImageId: ocicommon.String("missing")})
+	if code := errorCode(err); code != "NotAuthorizedOrNotFound" {
+		t.Errorf("Expected NotAuthorizedOrNotFound: %s", code)
+	}
+
+	before := testutil.ToFloat64(repositoriesDeletedCounter)
+	// Only successful deletions are counted
+	_, err = client.DeleteContainerRepository(context.Background(), artifacts.DeleteContainerRepositoryRequest{RepositoryId: ocicommon.String("id-existing-image")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.DeleteContainerRepository(context.Background(), artifacts.DeleteContainerRepositoryRequest{RepositoryId: ocicommon.String("id-missing")})
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if deleted := testutil.ToFloat64(repositoriesDeletedCounter) - before; deleted != 1 {
+		t.Errorf("Expected 1 deleted repository: %f", deleted)
+	}
+}
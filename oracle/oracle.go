@@ -8,14 +8,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/oracle/oci-go-sdk/v65/artifacts"
 	ocicommon "github.com/oracle/oci-go-sdk/v65/common"
 	"github.com/oracle/oci-go-sdk/v65/common/auth"
+	"github.com/oracle/oci-go-sdk/v65/identity"
 	"github.com/oracle/oci-go-sdk/v65/objectstorage"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -28,15 +32,62 @@ type IArtifactsClient interface {
 
 	ListContainerImages(ctx context.Context, request artifacts.ListContainerImagesRequest) (response artifacts.ListContainerImagesResponse, err error)
 
+	GetContainerImage(ctx context.Context, request artifacts.GetContainerImageRequest) (response artifacts.GetContainerImageResponse, err error)
+
+	RemoveContainerVersion(ctx context.Context, request artifacts.RemoveContainerVersionRequest) (response artifacts.RemoveContainerVersionResponse, err error)
+
+	DeleteContainerImage(ctx context.Context, request artifacts.DeleteContainerImageRequest) (response artifacts.DeleteContainerImageResponse, err error)
+
 	CreateContainerRepository(ctx context.Context, request artifacts.CreateContainerRepositoryRequest) (response artifacts.CreateContainerRepositoryResponse, err error)
 
 	DeleteContainerRepository(ctx context.Context, request artifacts.DeleteContainerRepositoryRequest) (response artifacts.DeleteContainerRepositoryResponse, err error)
 }
 
+// IIdentityClient is used to manage the auth tokens returned by GetToken
+type IIdentityClient interface {
+	ListAuthTokens(ctx context.Context, request identity.ListAuthTokensRequest) (response identity.ListAuthTokensResponse, err error)
+
+	CreateAuthToken(ctx context.Context, request identity.CreateAuthTokenRequest) (response identity.CreateAuthTokenResponse, err error)
+
+	DeleteAuthToken(ctx context.Context, request identity.DeleteAuthTokenRequest) (response identity.DeleteAuthTokenResponse, err error)
+}
+
+// Description of auth tokens created by GetToken, used to identify tokens
+// that can be deleted
+const authTokenDescription = "binderhub-container-registry-helper"
+
+// Renew the cached auth token if it expires within this time
+const authTokenRenewBefore = 10 * time.Minute
+
+// Maximum number of auth tokens OCI allows per user
+const maxAuthTokens = 2
+
 type artifactsHandler struct {
 	compartmentId string
 	client        IArtifactsClient
 	namespace     string
+
+	// Optional, if nil GetToken is disabled
+	identityClient IIdentityClient
+	// User who owns the auth tokens
+	userId string
+	// OCIR login username {namespace}/{username}
+	registryUsername string
+	// Regional OCIR host, e.g. ocir.uk-london-1.oci.oraclecloud.com
+	registryHost string
+	// Auth tokens don't expire so they are rotated after this time
+	authTokenLifetime time.Duration
+
+	// Deletes old images, disabled by default
+	retention retentionPolicy
+	// Repositories to enforce the retention policy for after CreateRepository
+	retentionQueue chan retentionRequest
+	// Optional, called after the retention policy deletes images from a
+	// repository so cached responses can be invalidated
+	repositoryChanged func(ctx context.Context, repository string)
+
+	mu        sync.Mutex
+	authToken *common.RegistryToken
 }
 
 var newRepositoriesCounter = prometheus.NewCounter(prometheus.CounterOpts{
@@ -45,26 +96,118 @@ var newRepositoriesCounter = prometheus.NewCounter(prometheus.CounterOpts{
 	Help:      "Total number of new repositories created",
 })
 
-func (c *artifactsHandler) ListRepositories(w http.ResponseWriter, r *http.Request) {
-	log.Println("Listing repos")
-	repos, err := c.client.ListContainerRepositories(context.Background(), artifacts.ListContainerRepositoriesRequest{
+// repository converts an OCI repository (ContainerRepositorySummary or
+// ContainerRepository) to the common response, the name includes the namespace
+func (c *artifactsHandler) repository(displayName *string, timeCreated *ocicommon.SDKTime, imageCount *int, sizeBytes *int64, provider interface{}) common.Repository {
+	name := fmt.Sprintf("%s/%s", c.namespace, *displayName)
+	repo := common.Repository{
+		Name:      name,
+		URI:       fmt.Sprintf("%s/%s", c.registryHost, name),
+		SizeBytes: sizeBytes,
+		Provider:  provider,
+	}
+	if timeCreated != nil {
+		repo.Created = &timeCreated.Time
+	}
+	if imageCount != nil {
+		count := int64(*imageCount)
+		repo.ImageCount = &count
+	}
+	return repo
+}
+
+// image converts an OCI image to the common response
+func image(namespacedRepository string, tag string, image artifacts.ContainerImage) common.Image {
+	return imageTags(namespacedRepository, []string{tag}, image)[0]
+}
+
+// imageTags converts an OCI image to the common response for each tag
+func imageTags(namespacedRepository string, tags []string, image artifacts.ContainerImage) []common.Image {
+	var pushedAt *time.Time
+	if image.TimeCreated != nil {
+		pushedAt = &image.TimeCreated.Time
+	}
+	var sizeBytes int64
+	if image.LayersSizeInBytes != nil {
+		sizeBytes = *image.LayersSizeInBytes
+	}
+	return common.NewImages(namespacedRepository, tags, *image.Digest, sizeBytes, pushedAt, image)
+}
+
+// Maximum number of results per ListContainerRepositories request
+const maxLimit = 1000
+
+// listRepositories returns all repositories, or a single page if params is
+// paged, and the token for the next page
+func (c *artifactsHandler) listRepositories(ctx context.Context, params common.ListParams) ([]common.Repository, string, error) {
+	slog.InfoContext(ctx, "Listing repos")
+	request := artifacts.ListContainerRepositoriesRequest{
 		CompartmentId: &c.compartmentId,
-	})
+	}
+	if params.Limit > 0 {
+		request.Limit = ocicommon.Int(min(params.Limit, maxLimit))
+	}
+	if params.PageToken != "" {
+		request.Page = &params.PageToken
+	}
+
+	items := []common.Repository{}
+	for {
+		repos, err := c.client.ListContainerRepositories(ctx, request)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, repo := range repos.Items {
+			items = append(items, c.repository(repo.DisplayName, repo.TimeCreated, repo.ImageCount, repo.LayersSizeInBytes, repo))
+		}
+		request.Page = repos.OpcNextPage
+		if request.Page == nil || params.Paged() {
+			break
+		}
+	}
+	nextPage := ""
+	if request.Page != nil {
+		nextPage = *request.Page
+	}
+	return items, nextPage, nil
+}
+
+// AllRepositories returns all repositories, following pagination
+func (c *artifactsHandler) AllRepositories(ctx context.Context) ([]common.Repository, error) {
+	items, _, err := c.listRepositories(ctx, common.ListParams{})
+	return items, err
+}
+
+// ListRepositories returns all repositories, or a single page if limit or
+// page_token are given
+func (c *artifactsHandler) ListRepositories(w http.ResponseWriter, r *http.Request) {
+	params, err := common.ListGetParams(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
+		common.BadRequest(w, r, err)
+		return
+	}
+
+	items, nextPage, err := c.listRepositories(r.Context(), params)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
-	jsonBytes, err := json.Marshal(repos.Items)
+
+	jsonBytes, err := json.Marshal(items)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "ListRepositories failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
+	if nextPage != "" {
+		w.Header().Set(common.NextPageTokenHeader, nextPage)
+	}
 	w.WriteHeader(http.StatusOK)
 	_, errw := w.Write(jsonBytes)
 	if errw != nil {
-		log.Println("ERROR:", errw)
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
 	}
 }
 
@@ -90,48 +233,52 @@ func (c *artifactsHandler) getByName(r *http.Request) (*artifacts.ContainerRepos
 	if err != nil {
 		return nil, "", err
 	}
+	repo, err := c.getRepoByName(r.Context(), name)
+	return repo, name, err
+}
 
-	repos, err := c.client.ListContainerRepositories(context.Background(), artifacts.ListContainerRepositoriesRequest{
+func (c *artifactsHandler) getRepoByName(ctx context.Context, name string) (*artifacts.ContainerRepositorySummary, error) {
+	repos, err := c.client.ListContainerRepositories(ctx, artifacts.ListContainerRepositoriesRequest{
 		CompartmentId: &c.compartmentId,
 		DisplayName:   &name,
 	})
 	if err != nil {
-		log.Println("ERROR:", err)
-		return nil, "", err
+		slog.ErrorContext(ctx, "getRepoByName failed", "error", err)
+		return nil, err
 	}
 	if len(repos.Items) == 0 {
-		log.Printf("Repo '%s' not found\n", name)
-		return nil, name, nil
+		slog.InfoContext(ctx, "Repo not found", "repo", name)
+		return nil, nil
 	} else {
-		log.Printf("Repo '%s' found: %s\n", name, *repos.Items[0].Id)
-		return &repos.Items[0], name, nil
+		slog.InfoContext(ctx, "Repo found", "repo", name, "id", *repos.Items[0].Id)
+		return &repos.Items[0], nil
 	}
 }
 
 func (c *artifactsHandler) GetRepository(w http.ResponseWriter, r *http.Request) {
 	repo, name, err := c.getByName(r)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "GetRepository failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
 
-	log.Printf("Getting repo %s", name)
+	slog.InfoContext(r.Context(), "Getting repo", "repo", name)
 
 	if repo == nil {
 		common.NotFound(w, r)
 		return
 	} else {
-		jsonBytes, err := json.Marshal(repo)
+		jsonBytes, err := json.Marshal(c.repository(repo.DisplayName, repo.TimeCreated, repo.ImageCount, repo.LayersSizeInBytes, repo))
 		if err != nil {
-			log.Println("ERROR:", err)
+			slog.ErrorContext(r.Context(), "GetRepository failed", "error", err)
 			common.InternalServerError(w, r, err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
 		_, errw := w.Write(jsonBytes)
 		if errw != nil {
-			log.Println("ERROR:", errw)
+			slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
 		}
 	}
 }
@@ -139,67 +286,160 @@ func (c *artifactsHandler) GetRepository(w http.ResponseWriter, r *http.Request)
 func (c *artifactsHandler) GetImage(w http.ResponseWriter, r *http.Request) {
 	namespacedRepository, tag, err := common.ImageGetNameAndTag(r)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
 		common.InternalServerError(w, r, err)
+		return
 	}
 	repoName, err := c.dropNamespace(namespacedRepository)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
 		common.InternalServerError(w, r, err)
+		return
 	}
 
 	fullname := fmt.Sprintf("%s:%s", repoName, tag)
 
-	log.Printf("Getting image %s", fullname)
+	slog.InfoContext(r.Context(), "Getting image", "image", fullname)
 
-	images, err := c.client.ListContainerImages(context.Background(), artifacts.ListContainerImagesRequest{
+	images, err := c.client.ListContainerImages(r.Context(), artifacts.ListContainerImagesRequest{
 		CompartmentId:  &c.compartmentId,
 		DisplayName:    &fullname,
 		RepositoryName: &repoName,
 	})
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
 		common.InternalServerError(w, r, err)
+		return
 	}
 
 	if len(images.Items) == 0 {
-		log.Printf("Image '%s' not found\n", fullname)
+		slog.InfoContext(r.Context(), "Image not found", "image", fullname)
+		common.NotFound(w, r)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Image found", "image", fullname, "id", *images.Items[0].Id)
+	// The summary doesn't include the size
+	response, err := c.client.GetContainerImage(r.Context(), artifacts.GetContainerImageRequest{
+		ImageId: images.Items[0].Id,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	jsonBytes, err := json.Marshal(image(namespacedRepository, tag, response.ContainerImage))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
+}
+
+// AllImages returns all images in a repository. The image summaries don't
+// include all tags or the size so each image is fetched.
+func (c *artifactsHandler) AllImages(ctx context.Context, namespacedRepository string) ([]common.Image, error) {
+	repoName, err := c.dropNamespace(namespacedRepository)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "Listing images", "repo", repoName)
+
+	repo, err := c.getRepoByName(ctx, repoName)
+	if err != nil {
+		return nil, err
+	}
+	if repo == nil {
+		return nil, common.ErrRepositoryNotFound
+	}
+
+	images := []common.Image{}
+	request := artifacts.ListContainerImagesRequest{
+		CompartmentId: &c.compartmentId,
+		RepositoryId:  repo.Id,
+	}
+	for {
+		response, err := c.client.ListContainerImages(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		for _, summary := range response.Items {
+			response, err := c.client.GetContainerImage(ctx, artifacts.GetContainerImageRequest{
+				ImageId: summary.Id,
+			})
+			if err != nil {
+				return nil, err
+			}
+			tags := []string{}
+			for _, version := range response.Versions {
+				tags = append(tags, *version.Version)
+			}
+			images = append(images, imageTags(namespacedRepository, tags, response.ContainerImage)...)
+		}
+		if response.OpcNextPage == nil {
+			break
+		}
+		request.Page = response.OpcNextPage
+	}
+	return images, nil
+}
+
+// ListImages returns all images in a repository
+func (c *artifactsHandler) ListImages(w http.ResponseWriter, r *http.Request) {
+	namespacedRepository, err := common.ImagesGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	images, err := c.AllImages(r.Context(), namespacedRepository)
+	if errors.Is(err, common.ErrRepositoryNotFound) {
 		common.NotFound(w, r)
 		return
 	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
 
-	image := images.Items[0]
-	log.Printf("Image '%s' found: %s\n", fullname, *image.Id)
-	jsonBytes, err := json.Marshal(image)
+	jsonBytes, err := json.Marshal(images)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "ListImages failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	_, errw := w.Write(jsonBytes)
 	if errw != nil {
-		log.Println("ERROR:", errw)
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
 	}
 }
 
 func (c *artifactsHandler) CreateRepository(w http.ResponseWriter, r *http.Request) {
 	namespacedRepository, err := common.RepoGetName(r)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
 	name, err := c.dropNamespace(namespacedRepository)
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
 
-	log.Println("Creating repo", name)
+	slog.InfoContext(r.Context(), "Creating repo", "repo", name)
 
-	createResponse, err := c.client.CreateContainerRepository(context.Background(), artifacts.CreateContainerRepositoryRequest{
+	createResponse, err := c.client.CreateContainerRepository(r.Context(), artifacts.CreateContainerRepositoryRequest{
 		CreateContainerRepositoryDetails: artifacts.CreateContainerRepositoryDetails{
 			CompartmentId: &c.compartmentId,
 			DisplayName:   &name,
@@ -207,27 +447,32 @@ func (c *artifactsHandler) CreateRepository(w http.ResponseWriter, r *http.Reque
 	})
 
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
 		serviceErr, ok := ocicommon.IsServiceError(err)
 		if ok && serviceErr.GetCode() == "NAMESPACE_CONFLICT" {
-			log.Printf("Repository already exists: %v\n", err)
+			slog.InfoContext(r.Context(), "Repo already exists", "repo", name, "error", err)
 
 			repo, name, err := c.getByName(r)
 			if err != nil {
-				log.Println("ERROR:", err)
+				slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
 				common.InternalServerError(w, r, err)
 				return
 			}
 
 			if repo == nil {
-				log.Printf("NAMESPACE_CONFLICT but repository not found %s: %v", name, err)
+				slog.ErrorContext(r.Context(), "NAMESPACE_CONFLICT but repository not found", "repo", name, "error", err)
 				common.InternalServerError(w, r, err)
 				return
 			}
 
-			jsonBytes, err := json.Marshal(repo)
+			// A new repository has no images so the retention policy only
+			// needs to be enforced for existing repositories. This is done in
+			// the background so it doesn't delay new images being pushed.
+			c.queueRetention(r.Context(), repo.Id, name)
+
+			jsonBytes, err := json.Marshal(c.repository(repo.DisplayName, repo.TimeCreated, repo.ImageCount, repo.LayersSizeInBytes, repo))
 			if err != nil {
-				log.Println("ERROR:", err)
+				slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
 				common.InternalServerError(w, r, err)
 				return
 			}
@@ -235,7 +480,7 @@ func (c *artifactsHandler) CreateRepository(w http.ResponseWriter, r *http.Reque
 			w.WriteHeader(http.StatusOK)
 			_, errw := w.Write(jsonBytes)
 			if errw != nil {
-				log.Println("ERROR:", errw)
+				slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
 			}
 			return
 		} else {
@@ -246,46 +491,251 @@ func (c *artifactsHandler) CreateRepository(w http.ResponseWriter, r *http.Reque
 		newRepositoriesCounter.Inc()
 	}
 
-	jsonBytes, err := json.Marshal(createResponse.ContainerRepository)
+	repo := createResponse.ContainerRepository
+	jsonBytes, err := json.Marshal(c.repository(repo.DisplayName, repo.TimeCreated, repo.ImageCount, repo.LayersSizeInBytes, repo))
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "CreateRepository failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 	_, errw := w.Write(jsonBytes)
 	if errw != nil {
-		log.Println("ERROR:", errw)
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
 	}
 }
 
+// RemoveRepository deletes a repository, it succeeds if the repository
+// doesn't exist
+func (c *artifactsHandler) RemoveRepository(ctx context.Context, namespacedRepository string) error {
+	name, err := c.dropNamespace(namespacedRepository)
+	if err != nil {
+		return err
+	}
+	repo, err := c.getRepoByName(ctx, name)
+	if err != nil || repo == nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Deleting repo", "repo", name)
+
+	_, err = c.client.DeleteContainerRepository(ctx, artifacts.DeleteContainerRepositoryRequest{
+		RepositoryId: repo.Id,
+	})
+	return err
+}
+
 func (c *artifactsHandler) DeleteRepository(w http.ResponseWriter, r *http.Request) {
-	repo, name, err := c.getByName(r)
+	namespacedRepository, err := common.RepoGetName(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	err = c.RemoveRepository(r.Context(), namespacedRepository)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteRepository failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteImage deletes a single image tag. If the image has other tags only
+// this tag (version) is removed, otherwise the image is deleted.
+func (c *artifactsHandler) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	namespacedRepository, tag, err := common.ImageGetNameAndTag(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+	repoName, err := c.dropNamespace(namespacedRepository)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	fullname := fmt.Sprintf("%s:%s", repoName, tag)
+
+	slog.InfoContext(r.Context(), "Deleting image", "image", fullname)
+
+	images, err := c.client.ListContainerImages(r.Context(), artifacts.ListContainerImagesRequest{
+		CompartmentId:  &c.compartmentId,
+		DisplayName:    &fullname,
+		RepositoryName: &repoName,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	// Ignore if it didn't exist
+	if len(images.Items) == 0 {
+		slog.InfoContext(r.Context(), "Image not found", "image", fullname)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	imageId := images.Items[0].Id
+	image, err := c.client.GetContainerImage(r.Context(), artifacts.GetContainerImageRequest{
+		ImageId: imageId,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
+		common.InternalServerError(w, r, err)
+		return
+	}
+
+	if len(image.Versions) > 1 {
+		slog.InfoContext(r.Context(), "Removing version from image", "tag", tag, "image_id", *imageId)
+		_, err = c.client.RemoveContainerVersion(r.Context(), artifacts.RemoveContainerVersionRequest{
+			ImageId: imageId,
+			RemoveContainerVersionDetails: artifacts.RemoveContainerVersionDetails{
+				Version: &tag,
+			},
+		})
+	} else {
+		slog.InfoContext(r.Context(), "Deleting image", "image_id", *imageId)
+		_, err = c.client.DeleteContainerImage(r.Context(), artifacts.DeleteContainerImageRequest{
+			ImageId: imageId,
+		})
+	}
 	if err != nil {
-		log.Println("ERROR:", err)
+		slog.ErrorContext(r.Context(), "DeleteImage failed", "error", err)
 		common.InternalServerError(w, r, err)
 		return
 	}
 
-	if repo != nil {
-		log.Println("Deleting repo", name)
+	w.WriteHeader(http.StatusOK)
+}
 
-		_, err := c.client.DeleteContainerRepository(context.Background(), artifacts.DeleteContainerRepositoryRequest{
-			RepositoryId: repo.Id,
+// createAuthToken creates a new auth token. OCI only allows two auth tokens
+// per user. Tokens created by this service may be cached by another replica,
+// or have been returned before a restart, so they are only deleted once they
+// are older than authTokenLifetime, which is the latest Expires returned for
+// them.
+func (c *artifactsHandler) createAuthToken(ctx context.Context) (*common.RegistryToken, error) {
+	tokens, err := c.identityClient.ListAuthTokens(ctx, identity.ListAuthTokensRequest{
+		UserId: &c.userId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	inUse := 0
+	for i := range tokens.Items {
+		token := &tokens.Items[i]
+		if token.LifecycleState != identity.AuthTokenLifecycleStateActive {
+			continue
+		}
+		if token.Description == nil || *token.Description != authTokenDescription ||
+			token.TimeCreated == nil || now.Before(token.TimeCreated.Add(c.authTokenLifetime)) {
+			inUse++
+			continue
+		}
+		slog.InfoContext(ctx, "Deleting auth token", "id", *token.Id)
+		_, err := c.identityClient.DeleteAuthToken(ctx, identity.DeleteAuthTokenRequest{
+			UserId:      &c.userId,
+			AuthTokenId: token.Id,
 		})
 		if err != nil {
-			log.Println("ERROR:", err)
+			// Another replica may have deleted it
+			serviceErr, ok := ocicommon.IsServiceError(err)
+			if ok && serviceErr.GetHTTPStatusCode() == http.StatusNotFound {
+				continue
+			}
+			return nil, err
+		}
+	}
+	if inUse >= maxAuthTokens {
+		return nil, fmt.Errorf("user already has %d auth tokens that may be in use", inUse)
+	}
+
+	created, err := c.identityClient.CreateAuthToken(ctx, identity.CreateAuthTokenRequest{
+		UserId: &c.userId,
+		CreateAuthTokenDetails: identity.CreateAuthTokenDetails{
+			Description: ocicommon.String(authTokenDescription),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	slog.InfoContext(ctx, "Created auth token", "id", *created.Id)
+
+	timeCreated := time.Now()
+	if created.TimeCreated != nil {
+		timeCreated = created.TimeCreated.Time
+	}
+	expires := timeCreated.Add(c.authTokenLifetime)
+	if created.TimeExpires != nil && created.TimeExpires.Before(expires) {
+		expires = created.TimeExpires.Time
+	}
+
+	return &common.RegistryToken{
+		Username: c.registryUsername,
+		Password: *created.Token,
+		Registry: "https://" + c.registryHost,
+		Expires:  expires.UTC(),
+	}, nil
+}
+
+// GetToken returns an OCI auth token that can be used to login to OCIR.
+// Tokens are cached and reused until they are close to expiry.
+func (c *artifactsHandler) GetToken(w http.ResponseWriter, r *http.Request) {
+	if c.identityClient == nil {
+		slog.InfoContext(r.Context(), "GetToken: no user configured")
+		common.NotFound(w, r)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.authToken == nil || time.Now().Add(authTokenRenewBefore).After(c.authToken.Expires) {
+		token, err := c.createAuthToken(r.Context())
+		if err == nil {
+			c.authToken = token
+		} else if c.authToken != nil && time.Now().Before(c.authToken.Expires) {
+			// Older tokens may not be deletable yet, keep using the cached
+			// token until it expires
+			slog.WarnContext(r.Context(), "Failed to renew auth token", "error", err, "expires", c.authToken.Expires)
+		} else {
+			slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
 			common.InternalServerError(w, r, err)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
+	}
+
+	jsonBytes, err := json.Marshal(c.authToken)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "GetToken failed", "error", err)
+		common.InternalServerError(w, r, err)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+	_, errw := w.Write(jsonBytes)
+	if errw != nil {
+		slog.ErrorContext(r.Context(), "Failed to write response", "error", errw)
+	}
 }
 
-func (c *artifactsHandler) GetToken(w http.ResponseWriter, r *http.Request) {
-	log.Println("GetToken not implemented")
-	common.NotFound(w, r)
+// HealthCheck lists a single repository to check the credentials are valid
+// and the compartment exists
+func (c *artifactsHandler) HealthCheck(ctx context.Context) error {
+	_, err := c.client.ListContainerRepositories(ctx, artifacts.ListContainerRepositoriesRequest{
+		CompartmentId: &c.compartmentId,
+		Limit:         ocicommon.Int(1),
+	})
+	return err
+}
+
+func init() {
+	common.RegisterProvider("oracle", Setup)
 }
 
 func Setup(promRegistry *prometheus.Registry, args []string) (common.IRegistryClient, error) {
@@ -298,7 +748,7 @@ func Setup(promRegistry *prometheus.Registry, args []string) (common.IRegistryCl
 		// https://github.com/oracle/oci-go-sdk/blob/v65.28.1/example/example_instance_principals_test.go
 		cfg, err = auth.InstancePrincipalConfigurationProvider()
 		if err != nil {
-			log.Printf("failed to load configuration, %v", err)
+			slog.Error("Failed to load configuration", "error", err)
 			return nil, err
 		}
 	case 1:
@@ -306,7 +756,7 @@ func Setup(promRegistry *prometheus.Registry, args []string) (common.IRegistryCl
 		cfg_file := args[0]
 		cfg, err = ocicommon.ConfigurationProviderFromFile(cfg_file, "")
 		if err != nil {
-			log.Printf("failed to load configuration, %v", err)
+			slog.Error("Failed to load configuration", "error", err)
 			return nil, err
 		}
 	default:
@@ -333,21 +783,101 @@ func Setup(promRegistry *prometheus.Registry, args []string) (common.IRegistryCl
 	if err != nil {
 		return nil, err
 	}
+	// Retries and the circuit breaker are handled by retryingArtifactsClient
+	noRetry := ocicommon.NoRetryPolicy()
+	artifactsClient.SetCustomClientConfiguration(ocicommon.CustomClientConfiguration{RetryPolicy: &noRetry})
 
 	compartmentId := os.Getenv("OCI_COMPARTMENT_ID")
 	if compartmentId == "" {
 		compartmentId = tenancyID
 	}
-	log.Println("Compartment ID:", compartmentId)
-	log.Println("Namespace:", namespace)
+	slog.Info("Compartment ID", "compartment_id", compartmentId)
+	slog.Info("Namespace", "namespace", namespace)
+
+	region, err := cfg.Region()
+	if err != nil {
+		return nil, err
+	}
+	registryHost := ocicommon.StringToRegion(region).Endpoint("ocir")
+	slog.Info("Registry", "registry", registryHost)
+
+	timeout, err := common.UpstreamTimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	retryConfig, err := common.RetryConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	retrier := common.NewRetrier("oracle", retryConfig, retryable)
+
+	// Every call is traced and logged once, each attempt has a timeout and is
+	// recorded in the metrics
+	var client IArtifactsClient = &timeoutArtifactsClient{client: &artifactsClient, timeout: timeout}
+	client = &metricsArtifactsClient{client: client}
+	client = &retryingArtifactsClient{client: client, retrier: retrier}
+	client = &loggingArtifactsClient{client: client}
+	client = &tracingArtifactsClient{client: client}
 
 	artifactsH := &artifactsHandler{
 		compartmentId: compartmentId,
-		client:        &artifactsClient,
+		client:        client,
 		namespace:     namespace,
+		registryHost:  registryHost,
+	}
+
+	artifactsH.retention, err = retentionPolicyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if artifactsH.retention.enabled() {
+		slog.Info("Image retention policy", "keep_last_n", artifactsH.retention.keepLastN,
+			"expires_after_push", artifactsH.retention.expiresAfterPush, "interval", artifactsH.retention.interval)
+		artifactsH.retentionQueue = make(chan retentionRequest, retentionQueueSize)
+	}
+
+	// Auth tokens can only be created for users, so with instance principals
+	// OCI_USER_ID must be set
+	userId := os.Getenv("OCI_USER_ID")
+	if userId == "" && len(args) == 1 {
+		userId, err = cfg.UserOCID()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if userId != "" {
+		lifetimeHours := 24
+		if s := os.Getenv("OCI_AUTH_TOKEN_LIFETIME_HOURS"); s != "" {
+			lifetimeHours, err = strconv.Atoi(s)
+			if err != nil || lifetimeHours < 1 {
+				return nil, fmt.Errorf("OCI_AUTH_TOKEN_LIFETIME_HOURS must be an integer greater than 0: %s", s)
+			}
+		}
+
+		identityClient, err := identity.NewIdentityClientWithConfigurationProvider(cfg)
+		if err != nil {
+			return nil, err
+		}
+		user, err := identityClient.GetUser(context.Background(), identity.GetUserRequest{
+			UserId: &userId,
+		})
+		if err != nil {
+			return nil, err
+		}
+		artifactsH.identityClient = &tracingIdentityClient{client: &loggingIdentityClient{client: &metricsIdentityClient{client: &timeoutIdentityClient{client: &identityClient, timeout: timeout}}}}
+		artifactsH.userId = userId
+		// Federated users already include the identity provider prefix
+		artifactsH.registryUsername = fmt.Sprintf("%s/%s", namespace, *user.Name)
+		artifactsH.authTokenLifetime = time.Duration(lifetimeHours) * time.Hour
+		slog.Info("Registry username", "username", artifactsH.registryUsername)
+	} else {
+		slog.Info("OCI_USER_ID not set, GetToken is disabled")
 	}
 
 	promRegistry.MustRegister(newRepositoriesCounter)
+	promRegistry.MustRegister(repositoriesDeletedCounter)
+	promRegistry.MustRegister(imagesExpiredCounter)
 
 	return artifactsH, nil
 }
@@ -7,10 +7,15 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/oracle/oci-go-sdk/v65/artifacts"
 	ocicommon "github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/identity"
 
 	"github.com/manics/binderhub-container-registry-helper/common"
 )
@@ -18,11 +23,12 @@ import (
 // Helpers
 
 type MockServiceError struct {
-	code string
+	code   string
+	status int
 }
 
 func (e MockServiceError) GetHTTPStatusCode() int {
-	panic("Not implemented")
+	return e.status
 }
 
 func (e MockServiceError) GetMessage() string {
@@ -44,8 +50,11 @@ func (e MockServiceError) Error() string {
 type MockArtifactsClient struct {
 	listRequests       []artifacts.ListContainerRepositoriesRequest
 	listImagesRequests []artifacts.ListContainerImagesRequest
+	getImageRequests   []artifacts.GetContainerImageRequest
 	createRequests     []artifacts.CreateContainerRepositoryRequest
 	deleteRequests     []artifacts.DeleteContainerRepositoryRequest
+	removeVersionReqs  []artifacts.RemoveContainerVersionRequest
+	deleteImageReqs    []artifacts.DeleteContainerImageRequest
 
 	createRepoNoops int
 	deleteRepoNoops int
@@ -56,12 +65,12 @@ func (c *MockArtifactsClient) containerRepositorySummary(name string) *artifacts
 		CompartmentId:     nil,
 		DisplayName:       ocicommon.String(name),
 		Id:                ocicommon.String("id-" + name),
-		ImageCount:        nil,
+		ImageCount:        ocicommon.Int(2),
 		IsPublic:          nil,
 		LayerCount:        nil,
-		LayersSizeInBytes: nil,
+		LayersSizeInBytes: ocicommon.Int64(123456),
 		LifecycleState:    "",
-		TimeCreated:       nil,
+		TimeCreated:       &ocicommon.SDKTime{Time: timestamp()},
 		BillableSizeInGBs: nil,
 	}
 }
@@ -90,14 +99,27 @@ func (c *MockArtifactsClient) ListContainerRepositories(ctx context.Context, req
 
 	if request.DisplayName == nil {
 		fmt.Println(request.DisplayName, request)
-		return artifacts.ListContainerRepositoriesResponse{
-			ContainerRepositoryCollection: artifacts.ContainerRepositoryCollection{
-				Items: []artifacts.ContainerRepositorySummary{
-					*c.containerRepositorySummary("existing-image"),
-					*c.containerRepositorySummary("another-image"),
-				},
-			},
-		}, nil
+		// Paginated, the next page is the index of the next repository
+		names := []string{"existing-image", "another-image", "third-image"}
+		start := 0
+		if request.Page != nil {
+			start, err = strconv.Atoi(*request.Page)
+			if err != nil {
+				return artifacts.ListContainerRepositoriesResponse{}, MockServiceError{code: "InvalidParameter"}
+			}
+		}
+		end := start + 2
+		if request.Limit != nil {
+			end = start + *request.Limit
+		}
+		response := artifacts.ListContainerRepositoriesResponse{}
+		for i := start; i < end && i < len(names); i++ {
+			response.Items = append(response.Items, *c.containerRepositorySummary(names[i]))
+		}
+		if end < len(names) {
+			response.OpcNextPage = ocicommon.String(strconv.Itoa(end))
+		}
+		return response, nil
 	}
 
 	if *request.DisplayName == "existing-image" {
@@ -116,6 +138,27 @@ func (c *MockArtifactsClient) ListContainerRepositories(ctx context.Context, req
 func (c *MockArtifactsClient) ListContainerImages(ctx context.Context, request artifacts.ListContainerImagesRequest) (response artifacts.ListContainerImagesResponse, err error) {
 	c.listImagesRequests = append(c.listImagesRequests, request)
 
+	if request.DisplayName == nil {
+		// List all images in a repository, one image per page
+		if *request.RepositoryId != "id-existing-image" {
+			return artifacts.ListContainerImagesResponse{}, nil
+		}
+		id := "id-existing-image@sha256:1234"
+		var next *string = ocicommon.String("2")
+		if request.Page != nil {
+			id = "id-existing-image@sha256:5678"
+			next = nil
+		}
+		return artifacts.ListContainerImagesResponse{
+			ContainerImageCollection: artifacts.ContainerImageCollection{
+				Items: []artifacts.ContainerImageSummary{
+					{Id: ocicommon.String(id)},
+				},
+			},
+			OpcNextPage: next,
+		}, nil
+	}
+
 	existing := artifacts.ContainerImageSummary{
 		DisplayName:    ocicommon.String("existing-image:tag"),
 		Id:             ocicommon.String("id-existing-image:tag"),
@@ -133,9 +176,54 @@ func (c *MockArtifactsClient) ListContainerImages(ctx context.Context, request a
 		}, nil
 	}
 
+	if *request.DisplayName == "existing-image:only-tag" {
+		return artifacts.ListContainerImagesResponse{
+			ContainerImageCollection: artifacts.ContainerImageCollection{
+				Items: []artifacts.ContainerImageSummary{
+					{
+						DisplayName:    ocicommon.String("existing-image:only-tag"),
+						Id:             ocicommon.String("id-existing-image@sha256:9abc"),
+						RepositoryName: ocicommon.String("existing-image"),
+					},
+				},
+			},
+		}, nil
+	}
+
 	return artifacts.ListContainerImagesResponse{}, nil
 }
 
+func (c *MockArtifactsClient) GetContainerImage(ctx context.Context, request artifacts.GetContainerImageRequest) (response artifacts.GetContainerImageResponse, err error) {
+	c.getImageRequests = append(c.getImageRequests, request)
+
+	image := artifacts.ContainerImage{
+		Id:                request.ImageId,
+		RepositoryName:    ocicommon.String("existing-image"),
+		LayersSizeInBytes: ocicommon.Int64(123456),
+		TimeCreated:       &ocicommon.SDKTime{Time: timestamp()},
+	}
+	switch *request.ImageId {
+	case "id-existing-image@sha256:1234", "id-existing-image:tag":
+		image.Digest = ocicommon.String("sha256:1234")
+		image.Versions = []artifacts.ContainerVersion{
+			{Version: ocicommon.String("tag")},
+			{Version: ocicommon.String("latest")},
+		}
+	case "id-existing-image@sha256:5678":
+		image.Digest = ocicommon.String("sha256:5678")
+	case "id-existing-image@sha256:9abc":
+		image.Digest = ocicommon.String("sha256:9abc")
+		image.Versions = []artifacts.ContainerVersion{
+			{Version: ocicommon.String("only-tag")},
+		}
+	default:
+		return artifacts.GetContainerImageResponse{}, MockServiceError{code: "NotAuthorizedOrNotFound"}
+	}
+	return artifacts.GetContainerImageResponse{
+		ContainerImage: image,
+	}, nil
+}
+
 func (c *MockArtifactsClient) CreateContainerRepository(ctx context.Context, request artifacts.CreateContainerRepositoryRequest) (response artifacts.CreateContainerRepositoryResponse, err error) {
 
 	c.createRequests = append(c.createRequests, request)
@@ -163,12 +251,33 @@ func (c *MockArtifactsClient) DeleteContainerRepository(ctx context.Context, req
 	return artifacts.DeleteContainerRepositoryResponse{}, fmt.Errorf("Image doesn't exist")
 }
 
+func (c *MockArtifactsClient) RemoveContainerVersion(ctx context.Context, request artifacts.RemoveContainerVersionRequest) (response artifacts.RemoveContainerVersionResponse, err error) {
+	c.removeVersionReqs = append(c.removeVersionReqs, request)
+
+	if *request.ImageId == "id-existing-image:tag" && *request.Version == "tag" {
+		return artifacts.RemoveContainerVersionResponse{}, nil
+	}
+	return artifacts.RemoveContainerVersionResponse{}, MockServiceError{code: "NotAuthorizedOrNotFound"}
+}
+
+func (c *MockArtifactsClient) DeleteContainerImage(ctx context.Context, request artifacts.DeleteContainerImageRequest) (response artifacts.DeleteContainerImageResponse, err error) {
+	c.deleteImageReqs = append(c.deleteImageReqs, request)
+
+	if *request.ImageId == "id-existing-image@sha256:9abc" {
+		return artifacts.DeleteContainerImageResponse{}, nil
+	}
+	return artifacts.DeleteContainerImageResponse{}, MockServiceError{code: "NotAuthorizedOrNotFound"}
+}
+
 func (e *MockArtifactsClient) assertCounts(t *testing.T, expected map[string]int) {
 	countRequests := map[string]int{
-		"listRepos":   len(e.listRequests),
-		"createRepos": len(e.createRequests),
-		"deleteRepos": len(e.deleteRequests),
-		"listImages":  len(e.listImagesRequests),
+		"listRepos":      len(e.listRequests),
+		"createRepos":    len(e.createRequests),
+		"deleteRepos":    len(e.deleteRequests),
+		"listImages":     len(e.listImagesRequests),
+		"getImages":      len(e.getImageRequests),
+		"removeVersions": len(e.removeVersionReqs),
+		"deleteImages":   len(e.deleteImageReqs),
 	}
 	for k, v := range countRequests {
 		e := 0
@@ -201,12 +310,111 @@ func (e *MockArtifactsClient) assertCounts(t *testing.T, expected map[string]int
 	}
 }
 
+type MockIdentityClient struct {
+	tokens []identity.AuthToken
+
+	listRequests   []identity.ListAuthTokensRequest
+	createRequests []identity.CreateAuthTokenRequest
+	deleteRequests []identity.DeleteAuthTokenRequest
+}
+
+func timestamp() time.Time {
+	return time.Date(2023, 1, 1, 12, 34, 56, 0, time.UTC)
+}
+
+func newMockIdentityClient() *MockIdentityClient {
+	return &MockIdentityClient{
+		tokens: []identity.AuthToken{
+			{
+				Id:             ocicommon.String("token-old"),
+				Description:    ocicommon.String(authTokenDescription),
+				TimeCreated:    &ocicommon.SDKTime{Time: time.Now().Add(-48 * time.Hour)},
+				LifecycleState: identity.AuthTokenLifecycleStateActive,
+			},
+			{
+				Id:             ocicommon.String("token-other"),
+				Description:    ocicommon.String("other"),
+				TimeCreated:    &ocicommon.SDKTime{Time: time.Now().Add(-72 * time.Hour)},
+				LifecycleState: identity.AuthTokenLifecycleStateActive,
+			},
+		},
+	}
+}
+
+func (c *MockIdentityClient) ListAuthTokens(ctx context.Context, request identity.ListAuthTokensRequest) (response identity.ListAuthTokensResponse, err error) {
+	c.listRequests = append(c.listRequests, request)
+	return identity.ListAuthTokensResponse{
+		Items: append([]identity.AuthToken{}, c.tokens...),
+	}, nil
+}
+
+func (c *MockIdentityClient) CreateAuthToken(ctx context.Context, request identity.CreateAuthTokenRequest) (response identity.CreateAuthTokenResponse, err error) {
+	c.createRequests = append(c.createRequests, request)
+	if len(c.tokens) >= maxAuthTokens {
+		return identity.CreateAuthTokenResponse{}, MockServiceError{code: "LimitExceeded"}
+	}
+	token := identity.AuthToken{
+		Id:             ocicommon.String(fmt.Sprintf("token-%d", len(c.createRequests))),
+		Token:          ocicommon.String(fmt.Sprintf("secret-token-%d", len(c.createRequests))),
+		UserId:         request.UserId,
+		Description:    request.Description,
+		TimeCreated:    &ocicommon.SDKTime{Time: time.Now()},
+		LifecycleState: identity.AuthTokenLifecycleStateActive,
+	}
+	c.tokens = append(c.tokens, token)
+	return identity.CreateAuthTokenResponse{
+		AuthToken: token,
+	}, nil
+}
+
+// age makes a token older, as if time has passed
+func (c *MockIdentityClient) age(id string, d time.Duration) {
+	for i := range c.tokens {
+		if *c.tokens[i].Id == id {
+			c.tokens[i].TimeCreated = &ocicommon.SDKTime{Time: c.tokens[i].TimeCreated.Add(-d)}
+		}
+	}
+}
+
+func (c *MockIdentityClient) DeleteAuthToken(ctx context.Context, request identity.DeleteAuthTokenRequest) (response identity.DeleteAuthTokenResponse, err error) {
+	c.deleteRequests = append(c.deleteRequests, request)
+	for i, token := range c.tokens {
+		if *token.Id == *request.AuthTokenId {
+			c.tokens = append(c.tokens[:i], c.tokens[i+1:]...)
+			return identity.DeleteAuthTokenResponse{}, nil
+		}
+	}
+	return identity.DeleteAuthTokenResponse{}, MockServiceError{code: "NotAuthorizedOrNotFound"}
+}
+
+func (c *MockIdentityClient) assertCounts(t *testing.T, expected map[string]int) {
+	countRequests := map[string]int{
+		"listTokens":   len(c.listRequests),
+		"createTokens": len(c.createRequests),
+		"deleteTokens": len(c.deleteRequests),
+	}
+	for k, v := range countRequests {
+		e := 0
+		if val, ok := expected[k]; ok {
+			e = val
+			delete(expected, k)
+		}
+		if v != e {
+			t.Errorf("Expected %d %s requests: %d", e, k, v)
+		}
+	}
+	if len(expected) > 0 {
+		t.Errorf("Invalid expected counts: %v", expected)
+	}
+}
+
 func request(t *testing.T, method string, path string) (MockArtifactsClient, *http.Response, []byte, error) {
 	art := MockArtifactsClient{}
 	a := &artifactsHandler{
 		compartmentId: "compartmentId",
 		client:        &art,
 		namespace:     "namespace",
+		registryHost:  "ocir.uk-london-1.oci.oraclecloud.com",
 	}
 	s := &common.RegistryServer{
 		Client: a,
@@ -298,19 +506,79 @@ func TestGetImage(t *testing.T) {
 
 	art.assertCounts(t, map[string]int{
 		"listImages": 1,
+		"getImages":  1,
 	})
 
 	fmt.Println(string(data))
 
-	var result map[string]interface{}
+	var result common.Image
 	err2 := json.Unmarshal([]byte(data), &result)
 	if err2 != nil {
 		t.Errorf("Unexpected error: %v", err2)
 	}
 
-	if result["displayName"] != "existing-image:tag" || result["id"] != "id-existing-image:tag" {
+	if result.Repository != "namespace/existing-image" || result.Tag != "tag" || result.Digest != "sha256:1234" || result.SizeBytes != 123456 || !result.PushedAt.Equal(timestamp()) {
 		t.Errorf("Expected 'existing-image': %v", result)
 	}
+	if result.Provider.(map[string]interface{})["id"] != "id-existing-image:tag" {
+		t.Errorf("Expected provider response: %v", result.Provider)
+	}
+}
+
+func TestListImages(t *testing.T) {
+	{
+		art, res, data, err := request(t, "GET", "/images/namespace/existing-image")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 200 {
+			t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+		}
+
+		art.assertCounts(t, map[string]int{
+			"listRepos":  1,
+			"listImages": 2,
+			"getImages":  2,
+		})
+
+		var result []common.Image
+		err2 := json.Unmarshal([]byte(data), &result)
+		if err2 != nil {
+			t.Errorf("Unexpected error: %v", err2)
+		}
+
+		if len(result) != 3 {
+			t.Fatalf("Expected 3 items: %v", result)
+		}
+		for i, tag := range []string{"tag", "latest"} {
+			if result[i].Repository != "namespace/existing-image" || result[i].Tag != tag || result[i].Digest != "sha256:1234" || result[i].SizeBytes != 123456 || !result[i].PushedAt.Equal(timestamp()) {
+				t.Errorf("Unexpected image: %v", result[i])
+			}
+		}
+		if result[2].Tag != "" || result[2].Digest != "sha256:5678" {
+			t.Errorf("Expected untagged image: %v", result[2])
+		}
+	}
+
+	{
+		art, res, data, err := request(t, "GET", "/images/namespace/new-image")
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != 404 {
+			t.Errorf("Expected StatusCode 404: %v", res.StatusCode)
+		}
+
+		art.assertCounts(t, map[string]int{
+			"listRepos": 1,
+		})
+
+		if string(data) != "null\n" {
+			t.Errorf("Expected 'null': %v", string(data))
+		}
+	}
 }
 
 func TestListRepos(t *testing.T) {
@@ -324,28 +592,91 @@ func TestListRepos(t *testing.T) {
 	}
 
 	art.assertCounts(t, map[string]int{
-		"listRepos": 1,
+		"listRepos": 2,
 	})
 
+	if res.Header.Get(common.NextPageTokenHeader) != "" {
+		t.Errorf("Unexpected next page token: %v", res.Header.Get(common.NextPageTokenHeader))
+	}
+
 	fmt.Println(string(data))
 
-	var result []map[string]interface{}
+	var result []common.Repository
 	err2 := json.Unmarshal([]byte(data), &result)
 	if err2 != nil {
 		t.Errorf("Unexpected error: %v", err2)
 	}
 
-	if len(result) != 2 {
-		t.Errorf("Expected 2 items: %v", result)
+	if len(result) != 3 {
+		t.Fatalf("Expected 3 items: %v", result)
 	}
-	if result[0]["displayName"] != "existing-image" || result[0]["id"] != "id-existing-image" {
+	if result[0].Name != "namespace/existing-image" || result[0].URI != "ocir.uk-london-1.oci.oraclecloud.com/namespace/existing-image" ||
+		*result[0].ImageCount != 2 || *result[0].SizeBytes != 123456 || !result[0].Created.Equal(timestamp()) {
 		t.Errorf("Expected 'existing-image': %v", result[0])
 	}
-	if result[1]["displayName"] != "another-image" || result[1]["id"] != "id-another-image" {
+	if result[1].Name != "namespace/another-image" || result[1].Provider.(map[string]interface{})["id"] != "id-another-image" {
 		t.Errorf("Expected 'another-image': %v", result[1])
 	}
 }
 
+func TestListReposPaged(t *testing.T) {
+	testCases := []struct {
+		query             string
+		expectedStatus    int
+		expectedNames     []string
+		expectedNextToken string
+	}{
+		{"?limit=1", 200, []string{"existing-image"}, "1"},
+		{"?limit=1&page_token=1", 200, []string{"another-image"}, "2"},
+		{"?page_token=1", 200, []string{"another-image", "third-image"}, ""},
+		{"?limit=5", 200, []string{"existing-image", "another-image", "third-image"}, ""},
+		{"?limit=x", 400, nil, ""},
+		{"?page_token=invalid", 500, nil, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			art, res, data, err := request(t, "GET", "/repos/"+tc.query)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != tc.expectedStatus {
+				t.Errorf("Expected StatusCode %v: %v", tc.expectedStatus, res.StatusCode)
+			}
+			if tc.expectedStatus == 400 {
+				art.assertCounts(t, map[string]int{})
+				return
+			}
+
+			art.assertCounts(t, map[string]int{
+				"listRepos": 1,
+			})
+			if tc.expectedStatus != 200 {
+				return
+			}
+
+			if res.Header.Get(common.NextPageTokenHeader) != tc.expectedNextToken {
+				t.Errorf("Expected next page token '%v': %v", tc.expectedNextToken, res.Header.Get(common.NextPageTokenHeader))
+			}
+
+			var result []common.Repository
+			err2 := json.Unmarshal([]byte(data), &result)
+			if err2 != nil {
+				t.Errorf("Unexpected error: %v", err2)
+			}
+
+			names := []string{}
+			for _, repo := range result {
+				names = append(names, strings.TrimPrefix(repo.Name, "namespace/"))
+			}
+			if !reflect.DeepEqual(names, tc.expectedNames) {
+				t.Errorf("Expected %v: %v", tc.expectedNames, names)
+			}
+		})
+	}
+}
+
 func TestCreate(t *testing.T) {
 	testCases := []struct {
 		imageName string
@@ -379,13 +710,13 @@ func TestCreate(t *testing.T) {
 				})
 			}
 
-			var result map[string]interface{}
+			var result common.Repository
 			err2 := json.Unmarshal([]byte(data), &result)
 			if err2 != nil {
 				t.Errorf("Unexpected error: %v", err2)
 			}
 
-			if result["displayName"] != tc.imageName {
+			if result.Name != "namespace/"+tc.imageName {
 				t.Errorf("Expected '%v': %v", tc.imageName, result)
 			}
 		})
@@ -425,6 +756,35 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestDeleteImage(t *testing.T) {
+	testCases := []struct {
+		imageName      string
+		expectedCounts map[string]int
+	}{
+		// Image has other tags so only the version is removed
+		{"existing-image:tag", map[string]int{"listImages": 1, "getImages": 1, "removeVersions": 1}},
+		// Last tag so the image is deleted
+		{"existing-image:only-tag", map[string]int{"listImages": 1, "getImages": 1, "deleteImages": 1}},
+		{"existing-image:new-tag", map[string]int{"listImages": 1}},
+		{"new-image:tag", map[string]int{"listImages": 1}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.imageName, func(t *testing.T) {
+			art, res, _, err := request(t, "DELETE", "/image/namespace/"+tc.imageName)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			if res.StatusCode != 200 {
+				t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+			}
+
+			art.assertCounts(t, tc.expectedCounts)
+		})
+	}
+}
+
 func TestToken(t *testing.T) {
 	_, res, _, err := request(t, "GET", "/token")
 	if err != nil {
@@ -434,4 +794,167 @@ func TestToken(t *testing.T) {
 	if res.StatusCode != 404 {
 		t.Errorf("Expected StatusCode 404: %v", res.StatusCode)
 	}
+
+	// No user configured
+	_, res, _, err = request(t, "POST", "/token/namespace/existing-image:tag")
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if res.StatusCode != 404 {
+		t.Errorf("Expected StatusCode 404: %v", res.StatusCode)
+	}
+}
+
+func newTokenHandler(ident *MockIdentityClient, lifetime time.Duration) *artifactsHandler {
+	return &artifactsHandler{
+		compartmentId:     "compartmentId",
+		client:            &MockArtifactsClient{},
+		namespace:         "namespace",
+		identityClient:    ident,
+		userId:            "ocid1.user.oc1..user",
+		registryUsername:  "namespace/user@example.org",
+		registryHost:      "ocir.uk-london-1.oci.oraclecloud.com",
+		authTokenLifetime: lifetime,
+	}
+}
+
+func requestToken(t *testing.T, a *artifactsHandler) (int, common.RegistryToken) {
+	s := &common.RegistryServer{
+		Client: a,
+	}
+	req := httptest.NewRequest("POST", "/token/namespace/existing-image:tag", http.NoBody)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+	var result common.RegistryToken
+	if res.StatusCode == http.StatusOK {
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.Unmarshal(data, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.StatusCode, result
+}
+
+func TestAuthToken(t *testing.T) {
+	testCases := []struct {
+		lifetime time.Duration
+		// token-old is only deleted if it's older than the lifetime
+		expectedStatus int
+		expectedDelete int
+	}{
+		{24 * time.Hour, 200, 1},
+		{72 * time.Hour, 500, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%v", tc.lifetime), func(t *testing.T) {
+			ident := newMockIdentityClient()
+			a := newTokenHandler(ident, tc.lifetime)
+
+			for i := 0; i < 2; i++ {
+				before := time.Now()
+				status, result := requestToken(t, a)
+				if status != tc.expectedStatus {
+					t.Fatalf("Expected StatusCode %d: %d", tc.expectedStatus, status)
+				}
+				if status != 200 {
+					continue
+				}
+				if result.Username != "namespace/user@example.org" || result.Password != "secret-token-1" || result.Registry != "https://ocir.uk-london-1.oci.oraclecloud.com" {
+					t.Errorf("Unexpected result: %v", result)
+				}
+				// The token is cached so Expires doesn't change
+				if i == 0 && (result.Expires.Before(before.Add(tc.lifetime)) || result.Expires.After(time.Now().Add(tc.lifetime))) {
+					t.Errorf("Unexpected expiry: %v", result.Expires)
+				}
+			}
+
+			// The token limit is checked before creating a token
+			ident.assertCounts(t, map[string]int{
+				"listTokens":   2 - tc.expectedDelete,
+				"createTokens": tc.expectedDelete,
+				"deleteTokens": tc.expectedDelete,
+			})
+			if tc.expectedDelete > 0 {
+				if *ident.deleteRequests[0].AuthTokenId != "token-old" || *ident.deleteRequests[0].UserId != "ocid1.user.oc1..user" {
+					t.Errorf("Unexpected delete request: %v", ident.deleteRequests[0])
+				}
+				if *ident.createRequests[0].Description != authTokenDescription {
+					t.Errorf("Unexpected create request: %v", ident.createRequests[0])
+				}
+			}
+		})
+	}
+}
+
+// Replicas, or a restarted replica, share the user's auth tokens
+func TestAuthTokenMultipleInstances(t *testing.T) {
+	ident := &MockIdentityClient{}
+	lifetime := time.Hour
+	replica1 := newTokenHandler(ident, lifetime)
+	replica2 := newTokenHandler(ident, lifetime)
+	restarted := newTokenHandler(ident, lifetime)
+
+	status, token1 := requestToken(t, replica1)
+	if status != 200 || token1.Password != "secret-token-1" {
+		t.Fatalf("Unexpected token: %d %v", status, token1)
+	}
+	status, token2 := requestToken(t, replica2)
+	if status != 200 || token2.Password != "secret-token-2" {
+		t.Fatalf("Unexpected token: %d %v", status, token2)
+	}
+
+	// Both tokens may be in use so neither can be deleted
+	status, _ = requestToken(t, restarted)
+	if status != 500 {
+		t.Errorf("Expected StatusCode 500: %d", status)
+	}
+	ident.assertCounts(t, map[string]int{
+		"listTokens":   3,
+		"createTokens": 2,
+		"deleteTokens": 0,
+	})
+
+	// Once token-1 is older than the lifetime no replica can still be using it
+	ident.age("token-1", lifetime)
+	status, token3 := requestToken(t, restarted)
+	if status != 200 || token3.Password != "secret-token-3" {
+		t.Fatalf("Unexpected token: %d %v", status, token3)
+	}
+	if len(ident.deleteRequests) != 1 || *ident.deleteRequests[0].AuthTokenId != "token-1" {
+		t.Errorf("Unexpected delete requests: %v", ident.deleteRequests)
+	}
+
+	// replica2's token is close to expiry but can't be renewed yet, so the
+	// cached token is returned until it expires
+	replica2.authToken.Expires = time.Now().Add(authTokenRenewBefore / 2)
+	status, renewed := requestToken(t, replica2)
+	if status != 200 || renewed.Password != token2.Password || !renewed.Expires.Equal(replica2.authToken.Expires) {
+		t.Errorf("Expected cached token: %d %v", status, renewed)
+	}
+	if len(ident.tokens) != maxAuthTokens {
+		t.Errorf("Expected %d tokens: %v", maxAuthTokens, ident.tokens)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	art := MockArtifactsClient{}
+	a := &artifactsHandler{
+		compartmentId: "compartmentId",
+		client:        &art,
+	}
+	err := a.HealthCheck(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(art.listRequests) != 1 || *art.listRequests[0].Limit != 1 || *art.listRequests[0].CompartmentId != "compartmentId" {
+		t.Errorf("Unexpected requests: %v", art.listRequests)
+	}
 }
@@ -0,0 +1,238 @@
+package oracle
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/artifacts"
+	ocicommon "github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+const (
+	OCI_KEEP_LAST_N_IMAGES_ENV_VAR       = "OCI_KEEP_LAST_N_IMAGES"
+	OCI_EXPIRES_AFTER_PUSH_DAYS_ENV_VAR  = "OCI_EXPIRES_AFTER_PUSH_DAYS"
+	OCI_RETENTION_INTERVAL_HOURS_ENV_VAR = "OCI_RETENTION_INTERVAL_HOURS"
+)
+
+const defaultRetentionIntervalHours = 24
+
+// Maximum number of repositories waiting for the retention policy to be
+// enforced after CreateRepository, further repositories are skipped until the
+// next periodic check
+const retentionQueueSize = 100
+
+var imagesExpiredCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "binderhub_container_registry_helper",
+	Name:      "images_expired_total",
+	Help:      "Total number of images deleted by the retention policy",
+})
+
+// retentionRequest is a repository waiting for the retention policy to be
+// enforced
+type retentionRequest struct {
+	repositoryId *string
+	name         string
+	requestID    string
+}
+
+// retentionPolicy deletes old images, OCIR doesn't have lifecycle policies
+// like AWS ECR
+type retentionPolicy struct {
+	// Keep this many of the most recently created images, 0 means unlimited
+	keepLastN int
+	// Delete images created more than this long ago, 0 means never
+	expiresAfterPush time.Duration
+	// Time between checking all repositories, 0 disables periodic checks
+	interval time.Duration
+}
+
+func (p retentionPolicy) enabled() bool {
+	return p.keepLastN > 0 || p.expiresAfterPush > 0
+}
+
+func envvarNonNegativeInt(envvar string, defaultValue int) (int, error) {
+	s := os.Getenv(envvar)
+	if s == "" {
+		return defaultValue, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("%s must be an integer >= 0: %s", envvar, s)
+	}
+	return i, nil
+}
+
+// retentionPolicyFromEnv reads the retention policy from environment variables
+func retentionPolicyFromEnv() (retentionPolicy, error) {
+	policy := retentionPolicy{}
+	var err error
+	policy.keepLastN, err = envvarNonNegativeInt(OCI_KEEP_LAST_N_IMAGES_ENV_VAR, 0)
+	if err != nil {
+		return policy, err
+	}
+	days, err := envvarNonNegativeInt(OCI_EXPIRES_AFTER_PUSH_DAYS_ENV_VAR, 0)
+	if err != nil {
+		return policy, err
+	}
+	policy.expiresAfterPush = time.Duration(days) * 24 * time.Hour
+	hours, err := envvarNonNegativeInt(OCI_RETENTION_INTERVAL_HOURS_ENV_VAR, defaultRetentionIntervalHours)
+	if err != nil {
+		return policy, err
+	}
+	policy.interval = time.Duration(hours) * time.Hour
+	return policy, nil
+}
+
+// enforceRetention deletes images in a repository that are older than the
+// newest keepLastN images, or were created more than expiresAfterPush ago.
+// Returns the number of images deleted.
+func (c *artifactsHandler) enforceRetention(ctx context.Context, repositoryId *string, repoName string) (int, error) {
+	if !c.retention.enabled() {
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-c.retention.expiresAfterPush)
+	request := artifacts.ListContainerImagesRequest{
+		CompartmentId: &c.compartmentId,
+		RepositoryId:  repositoryId,
+		SortBy:        artifacts.ListContainerImagesSortByTimecreated,
+		SortOrder:     artifacts.ListContainerImagesSortOrderDesc,
+		// Images that are already being deleted mustn't count towards
+		// keepLastN or be deleted again
+		LifecycleState: ocicommon.String(string(artifacts.ContainerImageLifecycleStateAvailable)),
+	}
+	expired := []artifacts.ContainerImageSummary{}
+	n := 0
+	for {
+		response, err := c.client.ListContainerImages(ctx, request)
+		if err != nil {
+			return 0, err
+		}
+		for _, image := range response.Items {
+			n++
+			tooMany := c.retention.keepLastN > 0 && n > c.retention.keepLastN
+			tooOld := c.retention.expiresAfterPush > 0 && image.TimeCreated != nil && image.TimeCreated.Before(cutoff)
+			if tooMany || tooOld {
+				expired = append(expired, image)
+			}
+		}
+		if response.OpcNextPage == nil {
+			break
+		}
+		request.Page = response.OpcNextPage
+	}
+
+	// Delete after listing so deletions don't change the pages
+	deleted := 0
+	for _, image := range expired {
+		slog.InfoContext(ctx, "Deleting expired image", "repo", repoName, "image_id", *image.Id, "time_created", image.TimeCreated)
+		_, err := c.client.DeleteContainerImage(ctx, artifacts.DeleteContainerImageRequest{
+			ImageId: image.Id,
+		})
+		if err != nil {
+			// Continue so one image doesn't block the rest of the repository
+			slog.WarnContext(ctx, "Failed to delete expired image", "repo", repoName, "image_id", *image.Id, "error", err)
+			continue
+		}
+		deleted++
+		imagesExpiredCounter.Inc()
+	}
+	if deleted > 0 && c.repositoryChanged != nil {
+		c.repositoryChanged(ctx, fmt.Sprintf("%s/%s", c.namespace, repoName))
+	}
+	return deleted, nil
+}
+
+// enforceRetentionAll enforces the retention policy for all repositories in
+// the compartment. Errors for individual repositories are logged.
+func (c *artifactsHandler) enforceRetentionAll(ctx context.Context) error {
+	request := artifacts.ListContainerRepositoriesRequest{
+		CompartmentId: &c.compartmentId,
+		Limit:         ocicommon.Int(maxLimit),
+	}
+	deleted := 0
+	for {
+		repos, err := c.client.ListContainerRepositories(ctx, request)
+		if err != nil {
+			return err
+		}
+		for _, repo := range repos.Items {
+			n, err := c.enforceRetention(ctx, repo.Id, *repo.DisplayName)
+			deleted += n
+			if err != nil {
+				slog.WarnContext(ctx, "Failed to enforce retention policy", "repo", *repo.DisplayName, "error", err)
+			}
+		}
+		if repos.OpcNextPage == nil {
+			break
+		}
+		request.Page = repos.OpcNextPage
+	}
+	slog.InfoContext(ctx, "Enforced retention policy", "deleted", deleted)
+	return nil
+}
+
+// OnRepositoryChanged implements common.IRepositoryChangeNotifier, f is called
+// after the retention policy deletes images
+func (c *artifactsHandler) OnRepositoryChanged(f func(ctx context.Context, repository string)) {
+	c.repositoryChanged = f
+}
+
+// queueRetention enforces the retention policy for a repository in the
+// background
+func (c *artifactsHandler) queueRetention(ctx context.Context, repositoryId *string, name string) {
+	if c.retentionQueue == nil {
+		return
+	}
+	select {
+	case c.retentionQueue <- retentionRequest{repositoryId: repositoryId, name: name, requestID: common.RequestID(ctx)}:
+	default:
+		slog.WarnContext(ctx, "Retention queue is full, skipping repository", "repo", name)
+	}
+}
+
+// RunBackgroundTasks enforces the retention policy for repositories queued by
+// CreateRepository. If scheduled is true it's also enforced for all
+// repositories immediately and then every interval. Runs until ctx is
+// cancelled.
+func (c *artifactsHandler) RunBackgroundTasks(ctx context.Context, scheduled bool) {
+	if !c.retention.enabled() {
+		return
+	}
+	var tick <-chan time.Time
+	if scheduled && c.retention.interval > 0 {
+		ticker := time.NewTicker(c.retention.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+		c.runRetentionAll(ctx)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case request := <-c.retentionQueue:
+			requestCtx := common.WithRequestID(ctx, request.requestID)
+			deleted, err := c.enforceRetention(requestCtx, request.repositoryId, request.name)
+			if err != nil {
+				slog.WarnContext(requestCtx, "Failed to enforce retention policy", "repo", request.name, "error", err)
+			} else if deleted > 0 {
+				slog.InfoContext(requestCtx, "Deleted expired images", "repo", request.name, "deleted", deleted)
+			}
+		case <-tick:
+			c.runRetentionAll(ctx)
+		}
+	}
+}
+
+func (c *artifactsHandler) runRetentionAll(ctx context.Context) {
+	err := c.enforceRetentionAll(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to enforce retention policy", "error", err)
+	}
+}
@@ -0,0 +1,248 @@
+package oracle
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/artifacts"
+	ocicommon "github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// retentionMockClient returns images created 1, 2, 3... days ago, two per
+// page, for repositories with an image count
+type retentionMockClient struct {
+	MockArtifactsClient
+	// Repository ID: number of images
+	imageCounts map[string]int
+	deleted     []string
+	// Image IDs that fail to delete
+	deleteErrors map[string]bool
+}
+
+func (c *retentionMockClient) ListContainerImages(ctx context.Context, request artifacts.ListContainerImagesRequest) (artifacts.ListContainerImagesResponse, error) {
+	c.listImagesRequests = append(c.listImagesRequests, request)
+	if request.SortBy != artifacts.ListContainerImagesSortByTimecreated || request.SortOrder != artifacts.ListContainerImagesSortOrderDesc ||
+		request.LifecycleState == nil || *request.LifecycleState != "AVAILABLE" {
+		return artifacts.ListContainerImagesResponse{}, MockServiceError{code: "InvalidParameter"}
+	}
+	count := c.imageCounts[*request.RepositoryId]
+	start := 0
+	if request.Page != nil {
+		_, _ = fmt.Sscanf(*request.Page, "%d", &start)
+	}
+	response := artifacts.ListContainerImagesResponse{}
+	for i := start; i < start+2 && i < count; i++ {
+		response.Items = append(response.Items, artifacts.ContainerImageSummary{
+			Id:          ocicommon.String(fmt.Sprintf("%s-image-%d", *request.RepositoryId, i+1)),
+			TimeCreated: &ocicommon.SDKTime{Time: time.Now().Add(-time.Duration(i+1)*24*time.Hour + time.Minute)},
+		})
+	}
+	if start+2 < count {
+		response.OpcNextPage = ocicommon.String(fmt.Sprintf("%d", start+2))
+	}
+	return response, nil
+}
+
+func (c *retentionMockClient) DeleteContainerImage(ctx context.Context, request artifacts.DeleteContainerImageRequest) (artifacts.DeleteContainerImageResponse, error) {
+	if c.deleteErrors[*request.ImageId] {
+		return artifacts.DeleteContainerImageResponse{}, MockServiceError{code: "InternalServerError"}
+	}
+	c.deleted = append(c.deleted, *request.ImageId)
+	return artifacts.DeleteContainerImageResponse{}, nil
+}
+
+func TestRetentionPolicyFromEnv(t *testing.T) {
+	policy, err := retentionPolicyFromEnv()
+	if err != nil || policy.enabled() || policy.interval != 24*time.Hour {
+		t.Errorf("Unexpected default policy: %+v %v", policy, err)
+	}
+
+	t.Setenv(OCI_KEEP_LAST_N_IMAGES_ENV_VAR, "5")
+	t.Setenv(OCI_EXPIRES_AFTER_PUSH_DAYS_ENV_VAR, "30")
+	t.Setenv(OCI_RETENTION_INTERVAL_HOURS_ENV_VAR, "0")
+	policy, err = retentionPolicyFromEnv()
+	if err != nil || !policy.enabled() || policy.keepLastN != 5 || policy.expiresAfterPush != 30*24*time.Hour || policy.interval != 0 {
+		t.Errorf("Unexpected policy: %+v %v", policy, err)
+	}
+
+	t.Setenv(OCI_KEEP_LAST_N_IMAGES_ENV_VAR, "-1")
+	_, err = retentionPolicyFromEnv()
+	if err == nil {
+		t.Errorf("Expected error for negative %s", OCI_KEEP_LAST_N_IMAGES_ENV_VAR)
+	}
+}
+
+func TestEnforceRetention(t *testing.T) {
+	testCases := []struct {
+		policy   retentionPolicy
+		expected []string
+	}{
+		{retentionPolicy{}, nil},
+		{retentionPolicy{keepLastN: 3}, []string{"repo-image-4", "repo-image-5"}},
+		{retentionPolicy{expiresAfterPush: 2 * 24 * time.Hour}, []string{"repo-image-3", "repo-image-4", "repo-image-5"}},
+		{retentionPolicy{keepLastN: 4, expiresAfterPush: 3 * 24 * time.Hour}, []string{"repo-image-4", "repo-image-5"}},
+		{retentionPolicy{keepLastN: 10}, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%+v", tc.policy), func(t *testing.T) {
+			client := &retentionMockClient{imageCounts: map[string]int{"repo": 5}}
+			a := &artifactsHandler{
+				compartmentId: "compartmentId",
+				client:        client,
+				namespace:     "namespace",
+				retention:     tc.policy,
+			}
+			expired := testutil.ToFloat64(imagesExpiredCounter)
+
+			deleted, err := a.enforceRetention(context.Background(), ocicommon.String("repo"), "repo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted != len(tc.expected) || len(client.deleted) != len(tc.expected) {
+				t.Fatalf("Expected %v deleted: %d %v", tc.expected, deleted, client.deleted)
+			}
+			for i, id := range tc.expected {
+				if client.deleted[i] != id {
+					t.Errorf("Expected %s deleted: %v", id, client.deleted)
+				}
+			}
+			if d := testutil.ToFloat64(imagesExpiredCounter) - expired; d != float64(len(tc.expected)) {
+				t.Errorf("Expected images_expired_total to increase by %d: %f", len(tc.expected), d)
+			}
+		})
+	}
+}
+
+func TestEnforceRetentionDeleteError(t *testing.T) {
+	client := &retentionMockClient{
+		imageCounts:  map[string]int{"repo": 5},
+		deleteErrors: map[string]bool{"repo-image-4": true},
+	}
+	changed := []string{}
+	a := &artifactsHandler{
+		compartmentId: "compartmentId",
+		client:        client,
+		namespace:     "namespace",
+		retention:     retentionPolicy{keepLastN: 2},
+	}
+	a.OnRepositoryChanged(func(ctx context.Context, repository string) {
+		changed = append(changed, repository)
+	})
+
+	// The remaining images are deleted if one fails
+	deleted, err := a.enforceRetention(context.Background(), ocicommon.String("repo"), "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 || len(client.deleted) != 2 || client.deleted[0] != "repo-image-3" || client.deleted[1] != "repo-image-5" {
+		t.Errorf("Unexpected deletions: %d %v", deleted, client.deleted)
+	}
+	if len(changed) != 1 || changed[0] != "namespace/repo" {
+		t.Errorf("Expected repository changed notification: %v", changed)
+	}
+}
+
+func TestEnforceRetentionAll(t *testing.T) {
+	client := &retentionMockClient{imageCounts: map[string]int{
+		"id-existing-image": 3,
+		"id-another-image":  1,
+		"id-third-image":    2,
+	}}
+	a := &artifactsHandler{
+		compartmentId: "compartmentId",
+		client:        client,
+		namespace:     "namespace",
+		retention:     retentionPolicy{keepLastN: 1},
+	}
+
+	err := a.enforceRetentionAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"id-existing-image-image-2", "id-existing-image-image-3", "id-third-image-image-2"}
+	if len(client.deleted) != len(expected) {
+		t.Fatalf("Expected %v deleted: %v", expected, client.deleted)
+	}
+	for i, id := range expected {
+		if client.deleted[i] != id {
+			t.Errorf("Expected %s deleted: %v", id, client.deleted)
+		}
+	}
+}
+
+func TestCreateEnforcesRetention(t *testing.T) {
+	client := &retentionMockClient{imageCounts: map[string]int{"id-existing-image": 3}}
+	a := &artifactsHandler{
+		compartmentId:  "compartmentId",
+		client:         client,
+		namespace:      "namespace",
+		registryHost:   "ocir.uk-london-1.oci.oraclecloud.com",
+		retention:      retentionPolicy{keepLastN: 2},
+		retentionQueue: make(chan retentionRequest, retentionQueueSize),
+	}
+	s := &common.RegistryServer{
+		Client: a,
+	}
+
+	for _, name := range []string{"existing-image", "new-image"} {
+		req := httptest.NewRequest("POST", "/repo/namespace/"+name, http.NoBody)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		res := w.Result()
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Expected StatusCode 200: %v", res.StatusCode)
+		}
+	}
+	// The policy is enforced in the background, new repositories are empty
+	// so they aren't queued
+	if len(client.listImagesRequests) != 0 || len(a.retentionQueue) != 1 {
+		t.Fatalf("Expected existing-image to be queued: %v %d", client.listImagesRequests, len(a.retentionQueue))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.RunBackgroundTasks(ctx, false)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(a.retentionQueue) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if len(client.deleted) != 1 || client.deleted[0] != "id-existing-image-image-3" {
+		t.Errorf("Unexpected deletions: %v", client.deleted)
+	}
+}
+
+func TestRunBackgroundTasksScheduled(t *testing.T) {
+	for _, scheduled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("%t", scheduled), func(t *testing.T) {
+			client := &retentionMockClient{imageCounts: map[string]int{"id-existing-image": 3}}
+			a := &artifactsHandler{
+				compartmentId: "compartmentId",
+				client:        client,
+				namespace:     "namespace",
+				retention:     retentionPolicy{keepLastN: 1, interval: time.Hour},
+			}
+			// The scheduled check runs at startup before waiting for ctx
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			a.RunBackgroundTasks(ctx, scheduled)
+			if scheduled != (len(client.listRequests) > 0) {
+				t.Errorf("Unexpected ListContainerRepositories requests: %v", client.listRequests)
+			}
+		})
+	}
+}
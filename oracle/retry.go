@@ -0,0 +1,74 @@
+package oracle
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/oracle/oci-go-sdk/v65/artifacts"
+	ocicommon "github.com/oracle/oci-go-sdk/v65/common"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// retryable returns true if err is caused by throttling or a server error
+func retryable(err error) bool {
+	var serviceErr ocicommon.ServiceError
+	if errors.As(err, &serviceErr) {
+		if serviceErr.GetCode() == "TooManyRequests" {
+			return true
+		}
+		status := serviceErr.GetHTTPStatusCode()
+		return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	}
+	return false
+}
+
+// retryingArtifactsClient wraps an IArtifactsClient to retry calls that fail
+// with a retryable error
+type retryingArtifactsClient struct {
+	client  IArtifactsClient
+	retrier *common.Retrier
+}
+
+func (c *retryingArtifactsClient) ListContainerRepositories(ctx context.Context, request artifacts.ListContainerRepositoriesRequest) (artifacts.ListContainerRepositoriesResponse, error) {
+	return common.Retry(ctx, c.retrier, "oci.ListContainerRepositories", func(ctx context.Context) (artifacts.ListContainerRepositoriesResponse, error) {
+		return c.client.ListContainerRepositories(ctx, request)
+	})
+}
+
+func (c *retryingArtifactsClient) ListContainerImages(ctx context.Context, request artifacts.ListContainerImagesRequest) (artifacts.ListContainerImagesResponse, error) {
+	return common.Retry(ctx, c.retrier, "oci.ListContainerImages", func(ctx context.Context) (artifacts.ListContainerImagesResponse, error) {
+		return c.client.ListContainerImages(ctx, request)
+	})
+}
+
+func (c *retryingArtifactsClient) GetContainerImage(ctx context.Context, request artifacts.GetContainerImageRequest) (artifacts.GetContainerImageResponse, error) {
+	return common.Retry(ctx, c.retrier, "oci.GetContainerImage", func(ctx context.Context) (artifacts.GetContainerImageResponse, error) {
+		return c.client.GetContainerImage(ctx, request)
+	})
+}
+
+func (c *retryingArtifactsClient) RemoveContainerVersion(ctx context.Context, request artifacts.RemoveContainerVersionRequest) (artifacts.RemoveContainerVersionResponse, error) {
+	return common.Retry(ctx, c.retrier, "oci.RemoveContainerVersion", func(ctx context.Context) (artifacts.RemoveContainerVersionResponse, error) {
+		return c.client.RemoveContainerVersion(ctx, request)
+	})
+}
+
+func (c *retryingArtifactsClient) DeleteContainerImage(ctx context.Context, request artifacts.DeleteContainerImageRequest) (artifacts.DeleteContainerImageResponse, error) {
+	return common.Retry(ctx, c.retrier, "oci.DeleteContainerImage", func(ctx context.Context) (artifacts.DeleteContainerImageResponse, error) {
+		return c.client.DeleteContainerImage(ctx, request)
+	})
+}
+
+func (c *retryingArtifactsClient) CreateContainerRepository(ctx context.Context, request artifacts.CreateContainerRepositoryRequest) (artifacts.CreateContainerRepositoryResponse, error) {
+	return common.Retry(ctx, c.retrier, "oci.CreateContainerRepository", func(ctx context.Context) (artifacts.CreateContainerRepositoryResponse, error) {
+		return c.client.CreateContainerRepository(ctx, request)
+	})
+}
+
+func (c *retryingArtifactsClient) DeleteContainerRepository(ctx context.Context, request artifacts.DeleteContainerRepositoryRequest) (artifacts.DeleteContainerRepositoryResponse, error) {
+	return common.Retry(ctx, c.retrier, "oci.DeleteContainerRepository", func(ctx context.Context) (artifacts.DeleteContainerRepositoryResponse, error) {
+		return c.client.DeleteContainerRepository(ctx, request)
+	})
+}
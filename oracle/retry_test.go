@@ -0,0 +1,48 @@
+package oracle
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/oracle/oci-go-sdk/v65/artifacts"
+	ocicommon "github.com/oracle/oci-go-sdk/v65/common"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+func TestRetryable(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"throttling", MockServiceError{code: "TooManyRequests", status: 429}, true},
+		{"server-error", MockServiceError{code: "InternalServerError", status: 500}, true},
+		{"not-found", MockServiceError{code: "NotAuthorizedOrNotFound", status: 404}, false},
+		{"other", errors.New("failed"), false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if r := retryable(tc.err); r != tc.expected {
+				t.Errorf("Expected %v: %v", tc.expected, r)
+			}
+		})
+	}
+}
+
+func TestRetryingClient(t *testing.T) {
+	art := &MockArtifactsClient{}
+	client := &retryingArtifactsClient{
+		client:  art,
+		retrier: common.NewRetrier("oracle", common.RetryConfig{MaxAttempts: 3}, retryable),
+	}
+	_, err := client.GetContainerImage(context.Background(), artifacts.GetContainerImageRequest{ImageId: ocicommon.String("missing")})
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	// Not found isn't retried
+	if len(art.getImageRequests) != 1 {
+		t.Errorf("Expected 1 request: %v", art.getImageRequests)
+	}
+}
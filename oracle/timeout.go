@@ -0,0 +1,83 @@
+package oracle
+
+import (
+	"context"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/artifacts"
+	"github.com/oracle/oci-go-sdk/v65/identity"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// timeoutArtifactsClient wraps an IArtifactsClient to apply a timeout to every call
+type timeoutArtifactsClient struct {
+	client  IArtifactsClient
+	timeout time.Duration
+}
+
+func (c *timeoutArtifactsClient) ListContainerRepositories(ctx context.Context, request artifacts.ListContainerRepositoriesRequest) (artifacts.ListContainerRepositoriesResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.ListContainerRepositories(ctx, request)
+}
+
+func (c *timeoutArtifactsClient) ListContainerImages(ctx context.Context, request artifacts.ListContainerImagesRequest) (artifacts.ListContainerImagesResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.ListContainerImages(ctx, request)
+}
+
+func (c *timeoutArtifactsClient) GetContainerImage(ctx context.Context, request artifacts.GetContainerImageRequest) (artifacts.GetContainerImageResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.GetContainerImage(ctx, request)
+}
+
+func (c *timeoutArtifactsClient) RemoveContainerVersion(ctx context.Context, request artifacts.RemoveContainerVersionRequest) (artifacts.RemoveContainerVersionResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.RemoveContainerVersion(ctx, request)
+}
+
+func (c *timeoutArtifactsClient) DeleteContainerImage(ctx context.Context, request artifacts.DeleteContainerImageRequest) (artifacts.DeleteContainerImageResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.DeleteContainerImage(ctx, request)
+}
+
+func (c *timeoutArtifactsClient) CreateContainerRepository(ctx context.Context, request artifacts.CreateContainerRepositoryRequest) (artifacts.CreateContainerRepositoryResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.CreateContainerRepository(ctx, request)
+}
+
+func (c *timeoutArtifactsClient) DeleteContainerRepository(ctx context.Context, request artifacts.DeleteContainerRepositoryRequest) (artifacts.DeleteContainerRepositoryResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.DeleteContainerRepository(ctx, request)
+}
+
+// timeoutIdentityClient wraps an IIdentityClient to apply a timeout to every call
+type timeoutIdentityClient struct {
+	client  IIdentityClient
+	timeout time.Duration
+}
+
+func (c *timeoutIdentityClient) ListAuthTokens(ctx context.Context, request identity.ListAuthTokensRequest) (identity.ListAuthTokensResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.ListAuthTokens(ctx, request)
+}
+
+func (c *timeoutIdentityClient) CreateAuthToken(ctx context.Context, request identity.CreateAuthTokenRequest) (identity.CreateAuthTokenResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.CreateAuthToken(ctx, request)
+}
+
+func (c *timeoutIdentityClient) DeleteAuthToken(ctx context.Context, request identity.DeleteAuthTokenRequest) (identity.DeleteAuthTokenResponse, error) {
+	ctx, cancel := common.UpstreamContext(ctx, c.timeout)
+	defer cancel()
+	return c.client.DeleteAuthToken(ctx, request)
+}
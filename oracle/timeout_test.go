@@ -0,0 +1,64 @@
+package oracle
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/artifacts"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+// slowArtifactsClient blocks ListContainerRepositories until the context is done
+type slowArtifactsClient struct {
+	MockArtifactsClient
+}
+
+func (c *slowArtifactsClient) ListContainerRepositories(ctx context.Context, request artifacts.ListContainerRepositoriesRequest) (artifacts.ListContainerRepositoriesResponse, error) {
+	<-ctx.Done()
+	return artifacts.ListContainerRepositoriesResponse{}, ctx.Err()
+}
+
+func TestTimeout(t *testing.T) {
+	testCases := []struct {
+		client             IArtifactsClient
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{&slowArtifactsClient{}, 504, `{"error": "upstream timeout"}` + "\n"},
+		{&MockArtifactsClient{}, 200, ""},
+	}
+
+	for _, tc := range testCases {
+		a := &artifactsHandler{
+			compartmentId: "compartmentId",
+			client:        &timeoutArtifactsClient{client: tc.client, timeout: 10 * time.Millisecond},
+			namespace:     "namespace",
+			registryHost:  "ocir.uk-london-1.oci.oraclecloud.com",
+		}
+		s := &common.RegistryServer{
+			Client: a,
+		}
+
+		req := httptest.NewRequest("GET", "/repo/namespace/existing-image", http.NoBody)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if res.StatusCode != tc.expectedStatusCode {
+			t.Errorf("Expected StatusCode %d: %d", tc.expectedStatusCode, res.StatusCode)
+		}
+		if tc.expectedBody != "" && string(data) != tc.expectedBody {
+			t.Errorf("Unexpected body: %s", data)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package oracle
+
+import (
+	"context"
+
+	"github.com/oracle/oci-go-sdk/v65/artifacts"
+	"github.com/oracle/oci-go-sdk/v65/identity"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+func startSpan(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return common.StartUpstreamSpan(ctx, "oracle", operation)
+}
+
+// endSpan ends a span with the OCI error code if the call failed
+func endSpan(span trace.Span, err error) {
+	common.EndUpstreamSpan(span, errorCode(err), err)
+}
+
+// tracingArtifactsClient wraps an IArtifactsClient to create a span for every
+// call
+type tracingArtifactsClient struct {
+	client IArtifactsClient
+}
+
+func (c *tracingArtifactsClient) ListContainerRepositories(ctx context.Context, request artifacts.ListContainerRepositoriesRequest) (artifacts.ListContainerRepositoriesResponse, error) {
+	ctx, span := startSpan(ctx, "oci.ListContainerRepositories")
+	response, err := c.client.ListContainerRepositories(ctx, request)
+	endSpan(span, err)
+	return response, err
+}
+
+func (c *tracingArtifactsClient) ListContainerImages(ctx context.Context, request artifacts.ListContainerImagesRequest) (artifacts.ListContainerImagesResponse, error) {
+	ctx, span := startSpan(ctx, "oci.ListContainerImages")
+	response, err := c.client.ListContainerImages(ctx, request)
+	endSpan(span, err)
+	return response, err
+}
+
+func (c *tracingArtifactsClient) GetContainerImage(ctx context.Context, request artifacts.GetContainerImageRequest) (artifacts.GetContainerImageResponse, error) {
+	ctx, span := startSpan(ctx, "oci.GetContainerImage")
+	response, err := c.client.GetContainerImage(ctx, request)
+	endSpan(span, err)
+	return response, err
+}
+
+func (c *tracingArtifactsClient) RemoveContainerVersion(ctx context.Context, request artifacts.RemoveContainerVersionRequest) (artifacts.RemoveContainerVersionResponse, error) {
+	ctx, span := startSpan(ctx, "oci.RemoveContainerVersion")
+	response, err := c.client.RemoveContainerVersion(ctx, request)
+	endSpan(span, err)
+	return response, err
+}
+
+func (c *tracingArtifactsClient) DeleteContainerImage(ctx context.Context, request artifacts.DeleteContainerImageRequest) (artifacts.DeleteContainerImageResponse, error) {
+	ctx, span := startSpan(ctx, "oci.DeleteContainerImage")
+	response, err := c.client.DeleteContainerImage(ctx, request)
+	endSpan(span, err)
+	return response, err
+}
+
+func (c *tracingArtifactsClient) CreateContainerRepository(ctx context.Context, request artifacts.CreateContainerRepositoryRequest) (artifacts.CreateContainerRepositoryResponse, error) {
+	ctx, span := startSpan(ctx, "oci.CreateContainerRepository")
+	response, err := c.client.CreateContainerRepository(ctx, request)
+	endSpan(span, err)
+	return response, err
+}
+
+func (c *tracingArtifactsClient) DeleteContainerRepository(ctx context.Context, request artifacts.DeleteContainerRepositoryRequest) (artifacts.DeleteContainerRepositoryResponse, error) {
+	ctx, span := startSpan(ctx, "oci.DeleteContainerRepository")
+	response, err := c.client.DeleteContainerRepository(ctx, request)
+	endSpan(span, err)
+	return response, err
+}
+
+// tracingIdentityClient wraps an IIdentityClient to create a span for every
+// call
+type tracingIdentityClient struct {
+	client IIdentityClient
+}
+
+func (c *tracingIdentityClient) ListAuthTokens(ctx context.Context, request identity.ListAuthTokensRequest) (identity.ListAuthTokensResponse, error) {
+	ctx, span := startSpan(ctx, "oci.ListAuthTokens")
+	response, err := c.client.ListAuthTokens(ctx, request)
+	endSpan(span, err)
+	return response, err
+}
+
+func (c *tracingIdentityClient) CreateAuthToken(ctx context.Context, request identity.CreateAuthTokenRequest) (identity.CreateAuthTokenResponse, error) {
+	ctx, span := startSpan(ctx, "oci.CreateAuthToken")
+	response, err := c.client.CreateAuthToken(ctx, request)
+	endSpan(span, err)
+	return response, err
+}
+
+func (c *tracingIdentityClient) DeleteAuthToken(ctx context.Context, request identity.DeleteAuthTokenRequest) (identity.DeleteAuthTokenResponse, error) {
+	ctx, span := startSpan(ctx, "oci.DeleteAuthToken")
+	response, err := c.client.DeleteAuthToken(ctx, request)
+	endSpan(span, err)
+	return response, err
+}
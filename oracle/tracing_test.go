@@ -0,0 +1,45 @@
+package oracle
+
+import (
+	"context"
+	"testing"
+
+	"github.com/oracle/oci-go-sdk/v65/artifacts"
+	ocicommon "github.com/oracle/oci-go-sdk/v65/common"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/manics/binderhub-container-registry-helper/common"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	client := &tracingArtifactsClient{client: &MockArtifactsClient{}}
+	_, err := client.GetContainerImage(context.Background(), artifacts.GetContainerImageRequest{ImageId: ocicommon.String("id-existing-image:tag")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.GetContainerImage(context.Background(), artifacts.GetContainerImageRequest{ImageId: ocicommon.String("missing")})
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans: %v", spans)
+	}
+	for i, expectedCode := range []string{"", "NotAuthorizedOrNotFound"} {
+		attrs := map[string]string{}
+		for _, kv := range spans[i].Attributes() {
+			attrs[string(kv.Key)] = kv.Value.Emit()
+		}
+		if spans[i].Name() != "oci.GetContainerImage" || attrs[string(common.ProviderAttribute)] != "oracle" || attrs[string(common.ErrorCodeAttribute)] != expectedCode {
+			t.Errorf("Unexpected span %s: %v", spans[i].Name(), attrs)
+		}
+	}
+}